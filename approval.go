@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Points of the roll where it can pause for approval
+const (
+	gatePreflight  = "preflight"
+	gateFirstBatch = "first-batch"
+	gateComponent  = "component"
+	gateBatches    = "batches"
+
+	approvalTimeoutAbort    = "abort"
+	approvalTimeoutContinue = "continue"
+
+	// Slack requests older than this are rejected to prevent replays
+	slackRequestMaxAge = 5 * time.Minute
+)
+
+type approvalDecision struct {
+	approved bool
+	by       string
+}
+
+type approvalGate struct {
+	ID          string    `json:"id"`
+	Description string    `json:"description"`
+	Requested   time.Time `json:"requested"`
+	decision    chan approvalDecision
+}
+
+// Pauses the roll at the configured gates until someone approves it, from the
+// terminal, the http api or a slack button.
+type approvals struct {
+	mu            sync.Mutex
+	gates         map[string]bool
+	batchInterval int
+	timeout       time.Duration
+	timeoutAction string
+	tty           bool
+	httpAddr      string
+	signingSecret string
+	// Gates waiting for a decision, oldest first
+	pending []*approvalGate
+}
+
+type slackInteraction struct {
+	User struct {
+		Username string `json:"username"`
+	} `json:"user"`
+	Actions []struct {
+		ActionID string `json:"action_id"`
+		Value    string `json:"value"`
+	} `json:"actions"`
+	ResponseURL string `json:"response_url"`
+}
+
+func newApprovals() *approvals {
+	return &approvals{
+		gates:         make(map[string]bool),
+		timeoutAction: approvalTimeoutAbort,
+	}
+}
+
+func (a *approvals) enabled(gate string) bool {
+	if a == nil {
+		return false
+	}
+	if gate == gateBatches {
+		return a.batchInterval > 0
+	}
+	return a.gates[gate]
+}
+
+func (a *approvals) request(id, description string) *approvalGate {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	gate := &approvalGate{
+		ID:          id,
+		Description: description,
+		Requested:   time.Now(),
+		decision:    make(chan approvalDecision, 1),
+	}
+	a.pending = append(a.pending, gate)
+	return gate
+}
+
+// Decides on the pending gate with the given id, or on the oldest one when id is empty
+func (a *approvals) resolve(id string, d approvalDecision) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for i, gate := range a.pending {
+		if id == "" || gate.ID == id {
+			a.pending = append(a.pending[:i], a.pending[i+1:]...)
+			gate.decision <- d
+			return nil
+		}
+	}
+	if id == "" {
+		return fmt.Errorf("nothing is waiting for approval")
+	}
+	return fmt.Errorf("%s is not waiting for approval", id)
+}
+
+func (a *approvals) cancel(id string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for i, gate := range a.pending {
+		if gate.ID == id {
+			a.pending = append(a.pending[:i], a.pending[i+1:]...)
+			return
+		}
+	}
+}
+
+func (a *approvals) list() []approvalGate {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	gates := []approvalGate{}
+	for _, gate := range a.pending {
+		gates = append(gates, *gate)
+	}
+	return gates
+}
+
+// Tells the approvers how they can answer
+func (a *approvals) instructions(id string) string {
+	var ways []string
+	if a.tty {
+		ways = append(ways, "answer yes or no on the roller terminal")
+	}
+	if a.httpAddr != "" {
+		ways = append(ways, fmt.Sprintf("POST to /approvals/approve?id=%s or /approvals/reject?id=%s on %s", url.QueryEscape(id), url.QueryEscape(id), a.httpAddr))
+	}
+	if len(ways) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("\nTo decide, %s.", strings.Join(ways, ", or "))
+}
+
+// Reads the answers typed on the terminal. An answer applies to the oldest pending
+// gate unless followed by the id of another one.
+func (a *approvals) readTTY(in io.Reader, operator string) {
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		var approved bool
+		switch strings.ToLower(fields[0]) {
+		case "y", "yes", "approve":
+			approved = true
+		case "n", "no", "reject":
+			approved = false
+		default:
+			fmt.Println("Answer yes or no, optionally followed by the id of the gate")
+			continue
+		}
+		id := ""
+		if len(fields) > 1 {
+			id = fields[1]
+		}
+		err := a.resolve(id, approvalDecision{approved: approved, by: operator})
+		if err != nil {
+			fmt.Println(err)
+		}
+	}
+}
+
+func (a *approvals) register(server *rollerServer) {
+	server.handle("/approvals", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, a.list())
+	})
+	server.handleControl("/approvals/approve", a.decisionHandler(true))
+	server.handleControl("/approvals/reject", a.decisionHandler(false))
+	if a.signingSecret != "" {
+		server.handleUnauthenticated("/slack/interactions", a.slackInteractionHandler)
+	}
+}
+
+func (a *approvals) decisionHandler(approved bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		err := a.resolve(r.URL.Query().Get("id"), approvalDecision{approved: approved, by: httpCaller(r)})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]bool{"approved": approved})
+	}
+}
+
+// Checks the signature slack adds to every request it makes to the app
+func verifySlackSignature(secret string, header http.Header, body []byte, now time.Time) error {
+	timestamp := header.Get("X-Slack-Request-Timestamp")
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid slack request timestamp %q", timestamp)
+	}
+	if now.Sub(time.Unix(ts, 0)) > slackRequestMaxAge {
+		return fmt.Errorf("slack request is too old")
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(fmt.Sprintf("v0:%s:%s", timestamp, body)))
+	expected := "v0=" + hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(expected), []byte(header.Get("X-Slack-Signature"))) {
+		return fmt.Errorf("invalid slack request signature")
+	}
+	return nil
+}
+
+// Receives the clicks on the approve and reject buttons of the slack approval messages
+func (a *approvals) slackInteractionHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = verifySlackSignature(a.signingSecret, r.Header, body, time.Now())
+	if err != nil {
+		glog.Errorf("rejected a slack interaction: %s", err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	values, err := url.ParseQuery(string(body))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	interaction := slackInteraction{}
+	err = json.Unmarshal([]byte(values.Get("payload")), &interaction)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	for _, action := range interaction.Actions {
+		if action.ActionID != slackApproveAction && action.ActionID != slackRejectAction {
+			continue
+		}
+		approved := action.ActionID == slackApproveAction
+		decision := "rejected"
+		if approved {
+			decision = "approved"
+		}
+		text := fmt.Sprintf("%s %s by %s", action.Value, decision, interaction.User.Username)
+		err := a.resolve(action.Value, approvalDecision{approved: approved, by: interaction.User.Username})
+		if err != nil {
+			text = err.Error()
+		}
+		if interaction.ResponseURL != "" {
+			_, err = postJSON(interaction.ResponseURL, map[string]interface{}{"replace_original": true, "text": text}, nil)
+			if err != nil {
+				glog.Errorf("an error occurred answering the slack interaction.\nError %s", err)
+			}
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// Pauses the roll at the given gate until it is approved. A rejection, or a timeout
+// when APPROVAL_TIMEOUT_ACTION is abort, aborts the whole roll.
+func (s *rollerState) awaitApproval(gate, component, id, description string) error {
+	a := s.approvals
+	if !a.enabled(gate) {
+		return nil
+	}
+
+	pending := a.request(id, description)
+	glog.Infof("Waiting for approval of %s: %s", id, description)
+	if a.tty {
+		fmt.Printf("%s\nContinue the roll? [yes/no] ", description)
+	}
+	s.notifications.send(notification{
+		kind:      notifyApproval,
+		title:     fmt.Sprintf("Rolling update of %s waiting for approval", kubernetesCluster),
+		text:      fmt.Sprintf("%s\nThe roll of %s is waiting for approval of %s.%s", description, kubernetesCluster, id, a.instructions(id)),
+		component: component,
+		approval:  id,
+		progress:  s.progressSnapshot(),
+	})
+
+	var timeout <-chan time.Time
+	if a.timeout > 0 {
+		timer := time.NewTimer(a.timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	var err error
+	select {
+	case d := <-pending.decision:
+		if d.approved {
+			s.notify(notifyApproval, fmt.Sprintf("Rolling update of %s approved", kubernetesCluster),
+				fmt.Sprintf("%s approved by %s, continuing the roll of %s", id, d.by, kubernetesCluster), component)
+			return nil
+		}
+		err = fmt.Errorf("%s was rejected by %s", id, d.by)
+	case <-timeout:
+		a.cancel(id)
+		if a.timeoutAction == approvalTimeoutContinue {
+			s.notify(notifyApproval, fmt.Sprintf("Rolling update of %s continuing without approval", kubernetesCluster),
+				fmt.Sprintf("No decision on %s within %v, continuing the roll of %s", id, a.timeout, kubernetesCluster), component)
+			return nil
+		}
+		err = fmt.Errorf("no decision on %s within %v", id, a.timeout)
+	case <-s.abortChannel():
+		a.cancel(id)
+		return s.abortError()
+	}
+
+	s.abort(err)
+	return err
+}
+
+// Pauses after a batch of replacements when the first batch or every N batches gates are set
+func (s *rollerState) approveBatch(c *componentType, batch int) error {
+	if batch == 1 && s.approvals.enabled(gateFirstBatch) {
+		return s.awaitApproval(gateFirstBatch, c.name, fmt.Sprintf("%s-first-batch", c.name),
+			fmt.Sprintf("The first batch of %s has been replaced.", c.name))
+	}
+	if s.approvals.enabled(gateBatches) && batch%s.approvals.batchInterval == 0 {
+		return s.awaitApproval(gateBatches, c.name, fmt.Sprintf("%s-batch-%d", c.name, batch),
+			fmt.Sprintf("%d batches of %s have been replaced.", batch, c.name))
+	}
+	return nil
+}
+
+// Builds the approval gates from the environment, nil when no gate is configured
+func configureApprovals(httpAddr string) (*approvals, error) {
+	a := newApprovals()
+
+	if v := os.Getenv("APPROVAL_GATES"); v != "" {
+		for _, g := range strings.Split(v, ",") {
+			gate := strings.TrimSpace(g)
+			switch gate {
+			case gatePreflight, gateFirstBatch, gateComponent:
+				a.gates[gate] = true
+			default:
+				return nil, fmt.Errorf("unknown approval gate %q, expected one of %s, %s or %s", gate, gatePreflight, gateFirstBatch, gateComponent)
+			}
+		}
+	}
+	if v := os.Getenv("APPROVAL_BATCH_INTERVAL"); v != "" {
+		interval, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse APPROVAL_BATCH_INTERVAL: %s", err)
+		}
+		a.batchInterval = interval
+	}
+	if len(a.gates) == 0 && a.batchInterval == 0 {
+		return nil, nil
+	}
+
+	timeout, err := parseSeconds("APPROVAL_TIMEOUT_SECONDS", 0)
+	if err != nil {
+		return nil, err
+	}
+	a.timeout = timeout
+	if v := os.Getenv("APPROVAL_TIMEOUT_ACTION"); v != "" {
+		if v != approvalTimeoutAbort && v != approvalTimeoutContinue {
+			return nil, fmt.Errorf("unknown APPROVAL_TIMEOUT_ACTION %q, expected %s or %s", v, approvalTimeoutAbort, approvalTimeoutContinue)
+		}
+		a.timeoutAction = v
+	}
+
+	a.tty = os.Getenv("APPROVAL_TTY") == "true"
+	a.httpAddr = httpAddr
+	a.signingSecret = os.Getenv("SLACK_SIGNING_SECRET")
+	if a.signingSecret != "" && httpAddr == "" {
+		return nil, fmt.Errorf("set the ROLLER_HTTP_ADDR variable for slack to reach the approval buttons")
+	}
+	if !a.tty && httpAddr == "" {
+		return nil, fmt.Errorf("set APPROVAL_TTY=true or ROLLER_HTTP_ADDR for the approval gates to be answered")
+	}
+	return a, nil
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func fakeApprovalState(a *approvals) *rollerState {
+	s := fakeRollerState()
+	s.notifications = newNotificationDispatcher()
+	s.approvals = a
+	return s
+}
+
+// Answers the gate as soon as it is pending
+func answerApproval(a *approvals, id string, approved bool) {
+	go func() {
+		for {
+			if a.resolve(id, approvalDecision{approved: approved, by: "tester"}) == nil {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+}
+
+func TestAwaitApproval(t *testing.T) {
+	a := newApprovals()
+	a.gates[gateFirstBatch] = true
+	s := fakeApprovalState(a)
+	component := s.components[0]
+
+	if err := s.awaitApproval(gateComponent, "etcd", "etcd-done", "fake"); err != nil {
+		t.Errorf("expected a disabled gate not to wait, got %s", err)
+	}
+
+	answerApproval(a, "etcd-first-batch", true)
+	if err := s.approveBatch(component, 1); err != nil {
+		t.Errorf("expected the gate to be approved, got %s", err)
+	}
+	if err := s.approveBatch(component, 2); err != nil {
+		t.Errorf("expected no gate after the second batch, got %s", err)
+	}
+
+	answerApproval(a, "etcd-first-batch", false)
+	err := s.approveBatch(component, 1)
+	if err == nil || !strings.Contains(err.Error(), "rejected by tester") {
+		t.Errorf("expected the gate to be rejected, got %v", err)
+	}
+	if s.abortError() == nil {
+		t.Errorf("expected a rejection to abort the roll")
+	}
+}
+
+func TestAwaitApprovalBatchInterval(t *testing.T) {
+	a := newApprovals()
+	a.batchInterval = 3
+	s := fakeApprovalState(a)
+	component := s.components[0]
+
+	for batch := 1; batch < 6; batch++ {
+		if batch == 3 {
+			answerApproval(a, "etcd-batch-3", true)
+		}
+		if err := s.approveBatch(component, batch); err != nil {
+			t.Errorf("unexpected error after batch %d: %s", batch, err)
+		}
+	}
+}
+
+func TestAwaitApprovalTimeout(t *testing.T) {
+	a := newApprovals()
+	a.gates[gatePreflight] = true
+	a.timeout = 10 * time.Millisecond
+	a.timeoutAction = approvalTimeoutContinue
+	s := fakeApprovalState(a)
+
+	if err := s.awaitApproval(gatePreflight, "", "preflight", "fake"); err != nil {
+		t.Errorf("expected the roll to continue on timeout, got %s", err)
+	}
+	if len(a.list()) != 0 {
+		t.Errorf("expected the gate to be cancelled on timeout")
+	}
+
+	a.timeoutAction = approvalTimeoutAbort
+	err := s.awaitApproval(gatePreflight, "", "preflight", "fake")
+	if err == nil || s.abortError() == nil {
+		t.Errorf("expected the roll to be aborted on timeout, got %v", err)
+	}
+}
+
+func TestApprovalReadTTY(t *testing.T) {
+	a := newApprovals()
+	first := a.request("first", "")
+	second := a.request("second", "")
+
+	a.readTTY(strings.NewReader("maybe\nno second\ny\n"), "operator")
+
+	d := <-second.decision
+	if d.approved || d.by != "operator" {
+		t.Errorf("expected second to be rejected by operator, got %+v", d)
+	}
+	d = <-first.decision
+	if !d.approved {
+		t.Errorf("expected first to be approved, got %+v", d)
+	}
+}
+
+func TestApprovalHTTP(t *testing.T) {
+	a := newApprovals()
+	server := newRollerServer("", "fake-token")
+	a.register(server)
+	ts := httptest.NewServer(server.mux)
+	defer ts.Close()
+
+	gate := a.request("k8s-node-first-batch", "fake")
+
+	resp, err := http.Post(ts.URL+"/approvals/approve?id=k8s-node-first-batch", "", nil)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected the request without token to be unauthorized, got %v (%v)", resp.StatusCode, err)
+	}
+
+	req, _ := http.NewRequest("POST", ts.URL+"/approvals/approve?id=k8s-node-first-batch&by=alice", nil)
+	req.Header.Set("Authorization", "Bearer fake-token")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the gate to be approved, got %v (%v)", resp.StatusCode, err)
+	}
+	d := <-gate.decision
+	if !d.approved || !strings.HasPrefix(d.by, "the http api from ") {
+		t.Errorf("expected an approval by the http api whatever the caller claims, got %+v", d)
+	}
+
+	resp, _ = http.DefaultClient.Do(req)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected a 404 once nothing is pending, got %d", resp.StatusCode)
+	}
+}
+
+func signSlackRequest(secret string, timestamp int64, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(fmt.Sprintf("v0:%d:%s", timestamp, body)))
+	return "v0=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestSlackInteraction(t *testing.T) {
+	var responses []string
+	responseServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b := make([]byte, r.ContentLength)
+		r.Body.Read(b)
+		responses = append(responses, string(b))
+	}))
+	defer responseServer.Close()
+
+	a := newApprovals()
+	a.signingSecret = "fake-secret"
+	server := newRollerServer("", "fake-token")
+	a.register(server)
+	ts := httptest.NewServer(server.mux)
+	defer ts.Close()
+
+	gate := a.request("preflight", "fake")
+	payload := fmt.Sprintf(`{"user":{"username":"bob"},"actions":[{"action_id":"reject","value":"preflight"}],"response_url":%q}`, responseServer.URL)
+	body := url.Values{"payload": {payload}}.Encode()
+
+	post := func(signature string) int {
+		req, _ := http.NewRequest("POST", ts.URL+"/slack/interactions", strings.NewReader(body))
+		now := time.Now().Unix()
+		req.Header.Set("X-Slack-Request-Timestamp", strconv.FormatInt(now, 10))
+		if signature == "" {
+			signature = signSlackRequest("fake-secret", now, body)
+		}
+		req.Header.Set("X-Slack-Signature", signature)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode
+	}
+
+	if status := post("v0=bad"); status != http.StatusUnauthorized {
+		t.Errorf("expected a bad signature to be rejected, got %d", status)
+	}
+	if status := post(""); status != http.StatusOK {
+		t.Fatalf("expected the interaction to be accepted, got %d", status)
+	}
+
+	d := <-gate.decision
+	if d.approved || d.by != "bob" {
+		t.Errorf("expected a rejection by bob, got %+v", d)
+	}
+	if len(responses) != 1 || !strings.Contains(responses[0], "preflight rejected by bob") {
+		t.Errorf("expected the slack message to be replaced, got %v", responses)
+	}
+}
+
+func TestSlackAPINotifierApprovalButtons(t *testing.T) {
+	server, calls := newFakeSlackAPI()
+	defer server.Close()
+	slackAPIURL = server.URL
+
+	n := newSlackAPINotifier("fake-token", "#fake", slackModeUpdate, "")
+	n.notify(notification{kind: notifyStart, text: "starting"})
+	n.notify(notification{kind: notifyApproval, text: "waiting", approval: "preflight"})
+
+	if len(*calls) != 2 {
+		t.Fatalf("expected 2 slack calls, got %d", len(*calls))
+	}
+	msg := (*calls)[1].message
+	if msg.ThreadTs != "1234.5678" || len(msg.Blocks) != 2 || msg.Blocks[1].Type != "actions" || len(msg.Blocks[1].Elements) != 2 {
+		t.Errorf("expected a threaded approval request with two buttons, got %+v", msg)
+	}
+}
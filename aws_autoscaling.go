@@ -2,17 +2,34 @@ package main
 
 import (
 	"fmt"
+	"regexp"
+	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/autoscaling"
 )
 
+// Start of the description of the scaling activities launching instances
+const launchActivityDescription = "Launching a new EC2 instance"
+
+var instanceIDPattern = regexp.MustCompile(`i-[0-9a-f]{8,}`)
+
 type awsAutoscaling interface {
 	suspendProcesses(*autoscaling.ScalingProcessQuery) (string, error)
 	resumeProcesses(*autoscaling.ScalingProcessQuery) (string, error)
 	setDesiredCount(*autoscaling.SetDesiredCapacityInput) (string, error)
 	describeAutoscalingGroups(*autoscaling.DescribeAutoScalingGroupsInput) (*autoscaling.DescribeAutoScalingGroupsOutput, error)
+	describeScalingActivities(*autoscaling.DescribeScalingActivitiesInput) (*autoscaling.DescribeScalingActivitiesOutput, error)
+	describeInstanceRefreshes(*autoscaling.DescribeInstanceRefreshesInput) (*autoscaling.DescribeInstanceRefreshesOutput, error)
+	describeLaunchConfigurations(*autoscaling.DescribeLaunchConfigurationsInput) (*autoscaling.DescribeLaunchConfigurationsOutput, error)
+	terminateInstanceInAutoScalingGroup(*autoscaling.TerminateInstanceInAutoScalingGroupInput) (string, error)
+	updateAutoScalingGroup(*autoscaling.UpdateAutoScalingGroupInput) (string, error)
+	createOrUpdateTags(*autoscaling.CreateOrUpdateTagsInput) (string, error)
+	deleteTags(*autoscaling.DeleteTagsInput) (string, error)
+	setInstanceProtection(*autoscaling.SetInstanceProtectionInput) (string, error)
+	createAutoScalingGroup(*autoscaling.CreateAutoScalingGroupInput) (string, error)
+	deleteAutoScalingGroup(*autoscaling.DeleteAutoScalingGroupInput) (string, error)
+	describeLifecycleHooks(*autoscaling.DescribeLifecycleHooksInput) (*autoscaling.DescribeLifecycleHooksOutput, error)
 }
 
 type awsAutoscalingClient struct {
@@ -25,7 +42,7 @@ type awsAutoscalingController struct {
 
 func newAWSAutoscalingClient() awsAutoscaling {
 	return &awsAutoscalingClient{
-		session: autoscaling.New(session.New()),
+		session: autoscaling.New(newAWSSession()),
 	}
 }
 
@@ -57,6 +74,64 @@ func (autoScalingClient *awsAutoscalingClient) describeAutoscalingGroups(autosca
 	return autoScalingClient.session.DescribeAutoScalingGroups(autoscalingGroupInput)
 }
 
+func (autoScalingClient *awsAutoscalingClient) describeScalingActivities(input *autoscaling.DescribeScalingActivitiesInput) (*autoscaling.DescribeScalingActivitiesOutput, error) {
+	return autoScalingClient.session.DescribeScalingActivities(input)
+}
+
+func (autoScalingClient *awsAutoscalingClient) describeInstanceRefreshes(input *autoscaling.DescribeInstanceRefreshesInput) (*autoscaling.DescribeInstanceRefreshesOutput, error) {
+	return autoScalingClient.session.DescribeInstanceRefreshes(input)
+}
+
+func (autoScalingClient *awsAutoscalingClient) describeLaunchConfigurations(input *autoscaling.DescribeLaunchConfigurationsInput) (*autoscaling.DescribeLaunchConfigurationsOutput, error) {
+	return autoScalingClient.session.DescribeLaunchConfigurations(input)
+}
+
+func (autoScalingClient *awsAutoscalingClient) terminateInstanceInAutoScalingGroup(input *autoscaling.TerminateInstanceInAutoScalingGroupInput) (string, error) {
+	var response *autoscaling.TerminateInstanceInAutoScalingGroupOutput
+	response, err := autoScalingClient.session.TerminateInstanceInAutoScalingGroup(input)
+	return response.String(), err
+}
+
+func (autoScalingClient *awsAutoscalingClient) updateAutoScalingGroup(input *autoscaling.UpdateAutoScalingGroupInput) (string, error) {
+	var response *autoscaling.UpdateAutoScalingGroupOutput
+	response, err := autoScalingClient.session.UpdateAutoScalingGroup(input)
+	return response.String(), err
+}
+
+func (autoScalingClient *awsAutoscalingClient) createOrUpdateTags(input *autoscaling.CreateOrUpdateTagsInput) (string, error) {
+	var response *autoscaling.CreateOrUpdateTagsOutput
+	response, err := autoScalingClient.session.CreateOrUpdateTags(input)
+	return response.String(), err
+}
+
+func (autoScalingClient *awsAutoscalingClient) deleteTags(input *autoscaling.DeleteTagsInput) (string, error) {
+	var response *autoscaling.DeleteTagsOutput
+	response, err := autoScalingClient.session.DeleteTags(input)
+	return response.String(), err
+}
+
+func (autoScalingClient *awsAutoscalingClient) setInstanceProtection(input *autoscaling.SetInstanceProtectionInput) (string, error) {
+	var response *autoscaling.SetInstanceProtectionOutput
+	response, err := autoScalingClient.session.SetInstanceProtection(input)
+	return response.String(), err
+}
+
+func (autoScalingClient *awsAutoscalingClient) createAutoScalingGroup(input *autoscaling.CreateAutoScalingGroupInput) (string, error) {
+	var response *autoscaling.CreateAutoScalingGroupOutput
+	response, err := autoScalingClient.session.CreateAutoScalingGroup(input)
+	return response.String(), err
+}
+
+func (autoScalingClient *awsAutoscalingClient) deleteAutoScalingGroup(input *autoscaling.DeleteAutoScalingGroupInput) (string, error) {
+	var response *autoscaling.DeleteAutoScalingGroupOutput
+	response, err := autoScalingClient.session.DeleteAutoScalingGroup(input)
+	return response.String(), err
+}
+
+func (autoScalingClient *awsAutoscalingClient) describeLifecycleHooks(input *autoscaling.DescribeLifecycleHooksInput) (*autoscaling.DescribeLifecycleHooksOutput, error) {
+	return autoScalingClient.session.DescribeLifecycleHooks(input)
+}
+
 func (c *awsAutoscalingController) manageASGProcesses(asg string, scalingProcesses []*string, action string) (string, error) {
 	var err error
 	var response string
@@ -82,6 +157,14 @@ func (c *awsAutoscalingController) setDesiredCount(asg string, desiredCapacity i
 	return c.client.setDesiredCount(scalingProcessQuery)
 }
 
+// Terminates an instance and lowers the desired count of its ASG so that it does not get replaced
+func (c *awsAutoscalingController) terminateAndDecrement(instanceID string) (string, error) {
+	return c.client.terminateInstanceInAutoScalingGroup(&autoscaling.TerminateInstanceInAutoScalingGroupInput{
+		InstanceId:                     aws.String(instanceID),
+		ShouldDecrementDesiredCapacity: aws.Bool(true),
+	})
+}
+
 func (c *awsAutoscalingController) getDesiredCount(asg string) (int64, error) {
 	autoscalingGroupInput := &autoscaling.DescribeAutoScalingGroupsInput{
 		AutoScalingGroupNames: []*string{
@@ -121,3 +204,387 @@ func (c *awsAutoscalingController) getInstanceCount(asg string) (int, error) {
 	}
 	return len(instances), nil
 }
+
+func (c *awsAutoscalingController) getAutoscalingGroup(asg string) (*autoscaling.Group, error) {
+	autoscalingGroupOutput, err := c.client.describeAutoscalingGroups(&autoscaling.DescribeAutoScalingGroupsInput{
+		AutoScalingGroupNames: []*string{
+			&asg,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, autoscalingGroup := range autoscalingGroupOutput.AutoScalingGroups {
+		if *autoscalingGroup.AutoScalingGroupName == asg {
+			return autoscalingGroup, nil
+		}
+	}
+	return nil, fmt.Errorf("Could not find ASG %s", asg)
+}
+
+// Returns the names of the ASGs which have the tag key, among the ones tagged with
+// every one of tags
+func (c *awsAutoscalingController) getASGsWithTag(key string, tags map[string]string) ([]string, error) {
+	input := &autoscaling.DescribeAutoScalingGroupsInput{
+		Filters: []*autoscaling.Filter{{Name: aws.String("tag-key"), Values: aws.StringSlice([]string{key})}},
+	}
+	for _, k := range sortedKeys(tags) {
+		input.Filters = append(input.Filters, &autoscaling.Filter{Name: aws.String("tag:" + k), Values: aws.StringSlice([]string{tags[k]})})
+	}
+	var asgs []string
+	for {
+		output, err := c.client.describeAutoscalingGroups(input)
+		if err != nil {
+			return nil, err
+		}
+		for _, group := range output.AutoScalingGroups {
+			if _, ok := asgTag(group, key); ok {
+				asgs = append(asgs, aws.StringValue(group.AutoScalingGroupName))
+			}
+		}
+		if output.NextToken == nil {
+			return asgs, nil
+		}
+		input.NextToken = output.NextToken
+	}
+}
+
+// Returns the number of instances of the ASG which are in service
+func (c *awsAutoscalingController) getInServiceCount(asg string) (int, error) {
+	group, err := c.getAutoscalingGroup(asg)
+	if err != nil {
+		return -1, err
+	}
+	var count int
+	for _, instance := range group.Instances {
+		if aws.StringValue(instance.LifecycleState) == autoscaling.LifecycleStateInService {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// Returns the descriptions of the scaling activities of the ASG which have not completed yet
+func (c *awsAutoscalingController) getInProgressActivities(asg string) ([]string, error) {
+	var activities []string
+	resp, err := c.client.describeScalingActivities(&autoscaling.DescribeScalingActivitiesInput{
+		AutoScalingGroupName: aws.String(asg),
+		MaxRecords:           aws.Int64(20),
+	})
+	if err != nil {
+		return activities, err
+	}
+	for _, activity := range resp.Activities {
+		switch aws.StringValue(activity.StatusCode) {
+		case autoscaling.ScalingActivityStatusCodeSuccessful,
+			autoscaling.ScalingActivityStatusCodeFailed,
+			autoscaling.ScalingActivityStatusCodeCancelled:
+			continue
+		}
+		activities = append(activities, aws.StringValue(activity.Description))
+	}
+	return activities, nil
+}
+
+// Returns the IDs of the instance refreshes of the ASG which have not completed yet
+func (c *awsAutoscalingController) getInProgressInstanceRefreshes(asg string) ([]string, error) {
+	var refreshes []string
+	resp, err := c.client.describeInstanceRefreshes(&autoscaling.DescribeInstanceRefreshesInput{
+		AutoScalingGroupName: aws.String(asg),
+	})
+	if err != nil {
+		return refreshes, err
+	}
+	for _, refresh := range resp.InstanceRefreshes {
+		switch aws.StringValue(refresh.Status) {
+		case autoscaling.InstanceRefreshStatusPending,
+			autoscaling.InstanceRefreshStatusInProgress,
+			autoscaling.InstanceRefreshStatusCancelling:
+			refreshes = append(refreshes, aws.StringValue(refresh.InstanceRefreshId))
+		}
+	}
+	return refreshes, nil
+}
+
+// Returns the AMI the ASG launches when it uses a launch configuration
+func (c *awsAutoscalingController) getLaunchConfigurationImage(name string) (string, error) {
+	resp, err := c.client.describeLaunchConfigurations(&autoscaling.DescribeLaunchConfigurationsInput{
+		LaunchConfigurationNames: []*string{aws.String(name)},
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(resp.LaunchConfigurations) == 0 {
+		return "", fmt.Errorf("launch configuration %s does not exist", name)
+	}
+	return aws.StringValue(resp.LaunchConfigurations[0].ImageId), nil
+}
+
+// Returns the latest activities of the ASG launching instances, most recent first
+func (c *awsAutoscalingController) getLaunchActivities(asg string) ([]launchEvent, error) {
+	var launches []launchEvent
+	resp, err := c.client.describeScalingActivities(&autoscaling.DescribeScalingActivitiesInput{
+		AutoScalingGroupName: aws.String(asg),
+		MaxRecords:           aws.Int64(100),
+	})
+	if err != nil {
+		return launches, err
+	}
+	for _, activity := range resp.Activities {
+		description := aws.StringValue(activity.Description)
+		if !strings.HasPrefix(description, launchActivityDescription) {
+			continue
+		}
+		launches = append(launches, launchEvent{
+			ASG:        asg,
+			ActivityID: aws.StringValue(activity.ActivityId),
+			Instance:   instanceIDPattern.FindString(description),
+			Status:     aws.StringValue(activity.StatusCode),
+			Message:    aws.StringValue(activity.StatusMessage),
+			Time:       aws.TimeValue(activity.StartTime),
+			// Capacity rebalancing launches ahead of the interruption, and says so
+			Interruption: isSpotInterruption(aws.StringValue(activity.Cause)),
+		})
+	}
+	return launches, nil
+}
+
+// Launches the instances of the ASG with the given instance types, through its mixed
+// instances policy, and in the given subnets. Either may be empty to keep them as they are.
+func (c *awsAutoscalingController) switchLaunchTargets(group *autoscaling.Group, instanceTypes, subnets []string) error {
+	input := &autoscaling.UpdateAutoScalingGroupInput{
+		AutoScalingGroupName: group.AutoScalingGroupName,
+	}
+	if len(instanceTypes) > 0 {
+		var overrides []*autoscaling.LaunchTemplateOverrides
+		for _, t := range instanceTypes {
+			overrides = append(overrides, &autoscaling.LaunchTemplateOverrides{InstanceType: aws.String(t)})
+		}
+		switch {
+		case group.MixedInstancesPolicy != nil && group.MixedInstancesPolicy.LaunchTemplate != nil:
+			input.MixedInstancesPolicy = &autoscaling.MixedInstancesPolicy{
+				InstancesDistribution: group.MixedInstancesPolicy.InstancesDistribution,
+				LaunchTemplate: &autoscaling.LaunchTemplate{
+					LaunchTemplateSpecification: group.MixedInstancesPolicy.LaunchTemplate.LaunchTemplateSpecification,
+					Overrides:                   overrides,
+				},
+			}
+		case group.LaunchTemplate != nil:
+			input.MixedInstancesPolicy = &autoscaling.MixedInstancesPolicy{
+				LaunchTemplate: &autoscaling.LaunchTemplate{
+					LaunchTemplateSpecification: group.LaunchTemplate,
+					Overrides:                   overrides,
+				},
+			}
+		default:
+			return fmt.Errorf("ASG %s uses a launch configuration, its instance types can not be switched", aws.StringValue(group.AutoScalingGroupName))
+		}
+	}
+	if len(subnets) > 0 {
+		input.VPCZoneIdentifier = aws.String(strings.Join(subnets, ","))
+	}
+	_, err := c.client.updateAutoScalingGroup(input)
+	return err
+}
+
+// Puts an ASG switched to instance type overrides by switchLaunchTargets back on its
+// launch template alone
+func (c *awsAutoscalingController) useLaunchTemplate(group *autoscaling.Group) error {
+	if group.MixedInstancesPolicy == nil || group.MixedInstancesPolicy.LaunchTemplate == nil {
+		return nil
+	}
+	_, err := c.client.updateAutoScalingGroup(&autoscaling.UpdateAutoScalingGroupInput{
+		AutoScalingGroupName: group.AutoScalingGroupName,
+		LaunchTemplate:       group.MixedInstancesPolicy.LaunchTemplate.LaunchTemplateSpecification,
+	})
+	return err
+}
+
+// Sets the tags on the ASG, without propagating them to the instances it launches
+func (c *awsAutoscalingController) tagASG(asg string, tags map[string]string) error {
+	input := &autoscaling.CreateOrUpdateTagsInput{}
+	for _, key := range sortedKeys(tags) {
+		input.Tags = append(input.Tags, &autoscaling.Tag{
+			ResourceId:        aws.String(asg),
+			ResourceType:      aws.String("auto-scaling-group"),
+			Key:               aws.String(key),
+			Value:             aws.String(tags[key]),
+			PropagateAtLaunch: aws.Bool(false),
+		})
+	}
+	_, err := c.client.createOrUpdateTags(input)
+	return err
+}
+
+func (c *awsAutoscalingController) untagASG(asg string, keys []string) error {
+	input := &autoscaling.DeleteTagsInput{}
+	for _, key := range keys {
+		input.Tags = append(input.Tags, &autoscaling.Tag{
+			ResourceId:   aws.String(asg),
+			ResourceType: aws.String("auto-scaling-group"),
+			Key:          aws.String(key),
+		})
+	}
+	_, err := c.client.deleteTags(input)
+	return err
+}
+
+// Sets the scale-in protection of instances of the ASG, 50 at a time as the API allows
+func (c *awsAutoscalingController) setScaleInProtection(asg string, instances []string, protected bool) error {
+	for start := 0; start < len(instances); start += 50 {
+		end := start + 50
+		if end > len(instances) {
+			end = len(instances)
+		}
+		_, err := c.client.setInstanceProtection(&autoscaling.SetInstanceProtectionInput{
+			AutoScalingGroupName: aws.String(asg),
+			InstanceIds:          aws.StringSlice(instances[start:end]),
+			ProtectedFromScaleIn: aws.Bool(protected),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Creates an empty copy of the ASG named name, with its subnets, target groups, tags and
+// the given lifecycle hooks. The copy launches the given version of the launch template
+// of the ASG when set, and gets the extra tags without propagating them.
+func (c *awsAutoscalingController) cloneAutoScalingGroup(group *autoscaling.Group, name, version string, hooks []*autoscaling.LifecycleHook, extraTags map[string]string) error {
+	input := &autoscaling.CreateAutoScalingGroupInput{
+		AutoScalingGroupName:             aws.String(name),
+		MinSize:                          aws.Int64(0),
+		MaxSize:                          group.MaxSize,
+		DesiredCapacity:                  aws.Int64(0),
+		DefaultCooldown:                  group.DefaultCooldown,
+		DefaultInstanceWarmup:            group.DefaultInstanceWarmup,
+		CapacityRebalance:                group.CapacityRebalance,
+		Context:                          group.Context,
+		DesiredCapacityType:              group.DesiredCapacityType,
+		HealthCheckType:                  group.HealthCheckType,
+		HealthCheckGracePeriod:           group.HealthCheckGracePeriod,
+		LaunchConfigurationName:          group.LaunchConfigurationName,
+		LaunchTemplate:                   group.LaunchTemplate,
+		MixedInstancesPolicy:             group.MixedInstancesPolicy,
+		LoadBalancerNames:                group.LoadBalancerNames,
+		TargetGroupARNs:                  group.TargetGroupARNs,
+		MaxInstanceLifetime:              group.MaxInstanceLifetime,
+		NewInstancesProtectedFromScaleIn: group.NewInstancesProtectedFromScaleIn,
+		PlacementGroup:                   group.PlacementGroup,
+		ServiceLinkedRoleARN:             group.ServiceLinkedRoleARN,
+		TerminationPolicies:              group.TerminationPolicies,
+		VPCZoneIdentifier:                group.VPCZoneIdentifier,
+	}
+	if group.VPCZoneIdentifier == nil {
+		input.AvailabilityZones = group.AvailabilityZones
+	}
+
+	if version != "" {
+		switch {
+		case group.MixedInstancesPolicy != nil && group.MixedInstancesPolicy.LaunchTemplate != nil:
+			template := *group.MixedInstancesPolicy.LaunchTemplate.LaunchTemplateSpecification
+			template.Version = aws.String(version)
+			input.MixedInstancesPolicy = &autoscaling.MixedInstancesPolicy{
+				InstancesDistribution: group.MixedInstancesPolicy.InstancesDistribution,
+				LaunchTemplate: &autoscaling.LaunchTemplate{
+					LaunchTemplateSpecification: &template,
+					Overrides:                   group.MixedInstancesPolicy.LaunchTemplate.Overrides,
+				},
+			}
+		case group.LaunchTemplate != nil:
+			template := *group.LaunchTemplate
+			template.Version = aws.String(version)
+			input.LaunchTemplate = &template
+		default:
+			return fmt.Errorf("ASG %s uses a launch configuration, it has no launch template version to switch to", aws.StringValue(group.AutoScalingGroupName))
+		}
+	}
+
+	for _, hook := range hooks {
+		input.LifecycleHookSpecificationList = append(input.LifecycleHookSpecificationList, &autoscaling.LifecycleHookSpecification{
+			LifecycleHookName:     hook.LifecycleHookName,
+			LifecycleTransition:   hook.LifecycleTransition,
+			DefaultResult:         hook.DefaultResult,
+			HeartbeatTimeout:      hook.HeartbeatTimeout,
+			NotificationMetadata:  hook.NotificationMetadata,
+			NotificationTargetARN: hook.NotificationTargetARN,
+			RoleARN:               hook.RoleARN,
+		})
+	}
+
+	// The reserved aws: tags can not be set, and the roll tags of the original are its own
+	for _, tag := range group.Tags {
+		key := aws.StringValue(tag.Key)
+		if strings.HasPrefix(key, "aws:") || strings.HasPrefix(key, "roller:") {
+			continue
+		}
+		input.Tags = append(input.Tags, &autoscaling.Tag{
+			ResourceId:        aws.String(name),
+			ResourceType:      aws.String("auto-scaling-group"),
+			Key:               tag.Key,
+			Value:             tag.Value,
+			PropagateAtLaunch: tag.PropagateAtLaunch,
+		})
+	}
+	for _, key := range sortedKeys(extraTags) {
+		input.Tags = append(input.Tags, &autoscaling.Tag{
+			ResourceId:        aws.String(name),
+			ResourceType:      aws.String("auto-scaling-group"),
+			Key:               aws.String(key),
+			Value:             aws.String(extraTags[key]),
+			PropagateAtLaunch: aws.Bool(false),
+		})
+	}
+
+	_, err := c.client.createAutoScalingGroup(input)
+	return err
+}
+
+func (c *awsAutoscalingController) getLifecycleHooks(asg string) ([]*autoscaling.LifecycleHook, error) {
+	resp, err := c.client.describeLifecycleHooks(&autoscaling.DescribeLifecycleHooksInput{
+		AutoScalingGroupName: aws.String(asg),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.LifecycleHooks, nil
+}
+
+// Sets the minimum size and the desired capacity of the ASG together, so that it can be
+// scaled all the way in
+func (c *awsAutoscalingController) resizeAutoScalingGroup(asg string, minSize, desiredCapacity int64) error {
+	_, err := c.client.updateAutoScalingGroup(&autoscaling.UpdateAutoScalingGroupInput{
+		AutoScalingGroupName: aws.String(asg),
+		MinSize:              aws.Int64(minSize),
+		DesiredCapacity:      aws.Int64(desiredCapacity),
+	})
+	return err
+}
+
+// Deletes the ASG, along with the instances it still has when forced
+func (c *awsAutoscalingController) deleteAutoScalingGroup(asg string, force bool) error {
+	_, err := c.client.deleteAutoScalingGroup(&autoscaling.DeleteAutoScalingGroupInput{
+		AutoScalingGroupName: aws.String(asg),
+		ForceDelete:          aws.Bool(force),
+	})
+	return err
+}
+
+// Sets the On-Demand base capacity of the mixed instances policy of the ASG, keeping the
+// rest of the policy as it is
+func (c *awsAutoscalingController) setOnDemandBaseCapacity(group *autoscaling.Group, base int64) error {
+	if group.MixedInstancesPolicy == nil || group.MixedInstancesPolicy.InstancesDistribution == nil {
+		return fmt.Errorf("ASG %s has no mixed instances policy", aws.StringValue(group.AutoScalingGroupName))
+	}
+	distribution := *group.MixedInstancesPolicy.InstancesDistribution
+	distribution.OnDemandBaseCapacity = aws.Int64(base)
+	_, err := c.client.updateAutoScalingGroup(&autoscaling.UpdateAutoScalingGroupInput{
+		AutoScalingGroupName: group.AutoScalingGroupName,
+		MixedInstancesPolicy: &autoscaling.MixedInstancesPolicy{
+			InstancesDistribution: &distribution,
+			LaunchTemplate:        group.MixedInstancesPolicy.LaunchTemplate,
+		},
+	})
+	return err
+}
@@ -8,6 +8,17 @@ import (
 )
 
 var fakeDescribeAutoScalingGroupsOutput = &autoscaling.DescribeAutoScalingGroupsOutput{}
+var fakeDescribeScalingActivitiesOutput = &autoscaling.DescribeScalingActivitiesOutput{}
+var fakeDescribeInstanceRefreshesOutput = &autoscaling.DescribeInstanceRefreshesOutput{}
+var fakeDescribeLaunchConfigurationsOutput = &autoscaling.DescribeLaunchConfigurationsOutput{}
+var fakeUpdateAutoScalingGroupInput *autoscaling.UpdateAutoScalingGroupInput
+var fakeSetDesiredCapacityInputs []*autoscaling.SetDesiredCapacityInput
+var fakeSetInstanceProtectionInputs []*autoscaling.SetInstanceProtectionInput
+var fakeCreateOrUpdateTagsInputs []*autoscaling.CreateOrUpdateTagsInput
+var fakeDeleteASGTagsInputs []*autoscaling.DeleteTagsInput
+var fakeCreateAutoScalingGroupInputs []*autoscaling.CreateAutoScalingGroupInput
+var fakeDeleteAutoScalingGroupInputs []*autoscaling.DeleteAutoScalingGroupInput
+var fakeDescribeLifecycleHooksOutput = &autoscaling.DescribeLifecycleHooksOutput{}
 
 type FakeAwsAutoscalingClient struct{}
 
@@ -24,6 +35,7 @@ func (autoScalingClient *FakeAwsAutoscalingClient) resumeProcesses(params *autos
 }
 
 func (autoScalingClient *FakeAwsAutoscalingClient) setDesiredCount(input *autoscaling.SetDesiredCapacityInput) (string, error) {
+	fakeSetDesiredCapacityInputs = append(fakeSetDesiredCapacityInputs, input)
 	return "{}", nil
 }
 
@@ -31,6 +43,56 @@ func (autoScalingClient *FakeAwsAutoscalingClient) describeAutoscalingGroups(aut
 	return fakeDescribeAutoScalingGroupsOutput, nil
 }
 
+func (autoScalingClient *FakeAwsAutoscalingClient) terminateInstanceInAutoScalingGroup(input *autoscaling.TerminateInstanceInAutoScalingGroupInput) (string, error) {
+	return "{}", nil
+}
+
+func (autoScalingClient *FakeAwsAutoscalingClient) describeScalingActivities(input *autoscaling.DescribeScalingActivitiesInput) (*autoscaling.DescribeScalingActivitiesOutput, error) {
+	return fakeDescribeScalingActivitiesOutput, nil
+}
+
+func (autoScalingClient *FakeAwsAutoscalingClient) describeInstanceRefreshes(input *autoscaling.DescribeInstanceRefreshesInput) (*autoscaling.DescribeInstanceRefreshesOutput, error) {
+	return fakeDescribeInstanceRefreshesOutput, nil
+}
+
+func (autoScalingClient *FakeAwsAutoscalingClient) describeLaunchConfigurations(input *autoscaling.DescribeLaunchConfigurationsInput) (*autoscaling.DescribeLaunchConfigurationsOutput, error) {
+	return fakeDescribeLaunchConfigurationsOutput, nil
+}
+
+func (autoScalingClient *FakeAwsAutoscalingClient) updateAutoScalingGroup(input *autoscaling.UpdateAutoScalingGroupInput) (string, error) {
+	fakeUpdateAutoScalingGroupInput = input
+	return "{}", nil
+}
+
+func (autoScalingClient *FakeAwsAutoscalingClient) createOrUpdateTags(input *autoscaling.CreateOrUpdateTagsInput) (string, error) {
+	fakeCreateOrUpdateTagsInputs = append(fakeCreateOrUpdateTagsInputs, input)
+	return "{}", nil
+}
+
+func (autoScalingClient *FakeAwsAutoscalingClient) deleteTags(input *autoscaling.DeleteTagsInput) (string, error) {
+	fakeDeleteASGTagsInputs = append(fakeDeleteASGTagsInputs, input)
+	return "{}", nil
+}
+
+func (autoScalingClient *FakeAwsAutoscalingClient) setInstanceProtection(input *autoscaling.SetInstanceProtectionInput) (string, error) {
+	fakeSetInstanceProtectionInputs = append(fakeSetInstanceProtectionInputs, input)
+	return "{}", nil
+}
+
+func (autoScalingClient *FakeAwsAutoscalingClient) createAutoScalingGroup(input *autoscaling.CreateAutoScalingGroupInput) (string, error) {
+	fakeCreateAutoScalingGroupInputs = append(fakeCreateAutoScalingGroupInputs, input)
+	return "{}", nil
+}
+
+func (autoScalingClient *FakeAwsAutoscalingClient) deleteAutoScalingGroup(input *autoscaling.DeleteAutoScalingGroupInput) (string, error) {
+	fakeDeleteAutoScalingGroupInputs = append(fakeDeleteAutoScalingGroupInputs, input)
+	return "{}", nil
+}
+
+func (autoScalingClient *FakeAwsAutoscalingClient) describeLifecycleHooks(input *autoscaling.DescribeLifecycleHooksInput) (*autoscaling.DescribeLifecycleHooksOutput, error) {
+	return fakeDescribeLifecycleHooksOutput, nil
+}
+
 func TestAwsManageASGProcessesSuspend(t *testing.T) {
 	awsAutoscalingController := newAWSAutoscalingController(newFakeAWSAutoscalingClient())
 	scalingProcesses := []*string{
@@ -3,12 +3,20 @@ package main
 type awsClient struct {
 	ec2         *awsEc2Controller
 	autoscaling *awsAutoscalingController
+	quotas      *awsServiceQuotasController
+	ssm         *awsSSMController
+	sqs         *awsSQSController
+	sts         *awsSTSController
 }
 
 func newAwsClient() *awsClient {
 	awsClient := &awsClient{
 		ec2:         newAWSEc2Controller(newAWSEc2Client()),
 		autoscaling: newAWSAutoscalingController(newAWSAutoscalingClient()),
+		quotas:      newAWSServiceQuotasController(newAWSServiceQuotasClient()),
+		ssm:         newAWSSSMController(newAWSSSMClient()),
+		sqs:         newAWSSQSController(newAWSSQSClient()),
+		sts:         newAWSSTSController(newAWSSTSClient()),
 	}
 	return awsClient
 }
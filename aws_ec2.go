@@ -1,11 +1,12 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/golang/glog"
 )
@@ -14,6 +15,11 @@ type awsEc2 interface {
 	describeInstances(*ec2.DescribeInstancesInput) (*ec2.DescribeInstancesOutput, error)
 	describeTags(*ec2.DescribeTagsInput) (*ec2.DescribeTagsOutput, error)
 	terminateInstances(*ec2.TerminateInstancesInput) (*ec2.TerminateInstancesOutput, error)
+	describeInstanceTypes(*ec2.DescribeInstanceTypesInput) (*ec2.DescribeInstanceTypesOutput, error)
+	describeLaunchTemplateVersions(*ec2.DescribeLaunchTemplateVersionsInput) (*ec2.DescribeLaunchTemplateVersionsOutput, error)
+	describeImages(*ec2.DescribeImagesInput) (*ec2.DescribeImagesOutput, error)
+	createTags(*ec2.CreateTagsInput) (*ec2.CreateTagsOutput, error)
+	deleteTags(*ec2.DeleteTagsInput) (*ec2.DeleteTagsOutput, error)
 }
 
 type awsEc2Client struct {
@@ -27,7 +33,7 @@ type awsEc2Controller struct {
 
 func newAWSEc2Client() awsEc2 {
 	return &awsEc2Client{
-		session: ec2.New(session.New()),
+		session: ec2.New(newAWSSession()),
 	}
 }
 
@@ -49,6 +55,26 @@ func (e awsEc2Client) terminateInstances(input *ec2.TerminateInstancesInput) (*e
 	return e.session.TerminateInstances(input)
 }
 
+func (e awsEc2Client) describeInstanceTypes(input *ec2.DescribeInstanceTypesInput) (*ec2.DescribeInstanceTypesOutput, error) {
+	return e.session.DescribeInstanceTypes(input)
+}
+
+func (e awsEc2Client) describeLaunchTemplateVersions(input *ec2.DescribeLaunchTemplateVersionsInput) (*ec2.DescribeLaunchTemplateVersionsOutput, error) {
+	return e.session.DescribeLaunchTemplateVersions(input)
+}
+
+func (e awsEc2Client) describeImages(input *ec2.DescribeImagesInput) (*ec2.DescribeImagesOutput, error) {
+	return e.session.DescribeImages(input)
+}
+
+func (e awsEc2Client) createTags(input *ec2.CreateTagsInput) (*ec2.CreateTagsOutput, error) {
+	return e.session.CreateTags(input)
+}
+
+func (e awsEc2Client) deleteTags(input *ec2.DeleteTagsInput) (*ec2.DeleteTagsOutput, error) {
+	return e.session.DeleteTags(input)
+}
+
 func (c *awsEc2Controller) describeInstances(request *ec2.DescribeInstancesInput) ([]*ec2.Instance, error) {
 	// Instances are paged
 	results := []*ec2.Instance{}
@@ -58,7 +84,7 @@ func (c *awsEc2Controller) describeInstances(request *ec2.DescribeInstancesInput
 	// Set the request filters
 	request.Filters, err = c.mergeFilters(request.Filters)
 	if err != nil {
-		glog.Fatalf("An error occurred describing the ec2 instances: %s", err)
+		return nil, err
 	}
 
 	for {
@@ -223,27 +249,22 @@ func (c *awsEc2Controller) terminateInstance(instance string) (*ec2.TerminateIns
 	return resp, err
 }
 
-func (c *awsEc2Controller) findReplacementInstances(myComponent *componentType, ansibleVersion string, count int, t time.Time) ([]string, error) {
+// Waits for count instances of the component launched after t not at the ansible version yet
+func (c *awsEc2Controller) findReplacementInstances(ctx context.Context, w waiter, myComponent *componentType, ansibleVersion string, count int, t time.Time) ([]string, error) {
 	newInstances := make(map[string]struct{})
-	var err error
 
-	// Loop until we have new healthy replacements or time has expired
-	for loop := 0; loop < 30; loop++ {
+	// Poll until we have new replacements or time has expired
+	loop := 0
+	err := w.wait(ctx, func() (bool, error) {
 		glog.Infof("Checking for %d replacement %s instances - %s - loop %d\n", count, myComponent.name, timeStamp(), loop)
-
-		var inv []*ec2.Instance
+		loop++
 
 		params := &ec2.DescribeInstancesInput{}
-		params.Filters = []*ec2.Filter{c.newEC2Filter("tag:ServiceComponent", myComponent.name)}
+		params.Filters = myComponent.spec.filters()
 
-		inv, err = c.describeInstancesNotMatchingAnsibleVersion(params, ansibleVersion)
+		inv, err := c.describeInstancesNotMatchingAnsibleVersion(params, ansibleVersion)
 		if err != nil {
-			glog.Fatalf("An error occurred getting the EC2 inventory: %s.\n", err)
-		}
-
-		var instanceList []string
-		for _, e := range inv {
-			instanceList = append(instanceList, *e.InstanceId)
+			return false, fmt.Errorf("an error occurred looking for replacement %s instances: %s", myComponent.name, err)
 		}
 
 		for _, e := range inv {
@@ -252,12 +273,10 @@ func (c *awsEc2Controller) findReplacementInstances(myComponent *componentType,
 				newInstances[*e.InstanceId] = struct{}{}
 			}
 		}
-
-		if len(newInstances) == count {
-			break
-		}
-
-		time.Sleep(time.Second * 30)
+		return len(newInstances) == count, nil
+	})
+	if err != nil && !errors.Is(err, errWaitTimeout) {
+		return nil, err
 	}
 
 	// We want to return a slice here rather than a map with empty values
@@ -273,42 +292,137 @@ func (c *awsEc2Controller) findReplacementInstances(myComponent *componentType,
 	}
 
 	glog.V(4).Infof("Exiting find without an error for component %s.\n", myComponent.name)
-	return replacementInstances, err
+	return replacementInstances, nil
 }
 
-func (c *awsEc2Controller) verifyReplacementInstances(myComponent *componentType, instances []string) ([]string, error) {
-	var err error
-	var status string
-
-	for loop := 0; loop < 30; loop++ {
-		for i := len(instances) - 1; i >= 0; i-- {
-			instance := instances[i]
-			status, err = c.getInstanceHealth(instance)
+func (c *awsEc2Controller) verifyReplacementInstances(ctx context.Context, w waiter, myComponent *componentType, instances []string) ([]string, error) {
+	pending := instances
+	err := w.wait(ctx, func() (bool, error) {
+		// Only the instances not yet healthy get checked again
+		var unhealthy []string
+		for _, instance := range pending {
+			status, err := c.getInstanceHealth(instance)
 			if err != nil {
-				return instances, err
+				return false, err
 			}
 			glog.Infof("Component %s instance %s current status is %s - %s \n", myComponent.name, instance, status, timeStamp())
 			if status == "True" {
 				glog.Infof("Verification complete component %s instance %s is healthy\n", myComponent.name, instance)
-				// Remove instance from the slice so we don't check it again
-				instances = append(instances[:i], instances[i+1:]...)
 				continue
 			}
+			unhealthy = append(unhealthy, instance)
 		}
+		pending = unhealthy
 
 		// If any instances are not yet healthy, keep checking
-		if len(instances) > 0 {
-			glog.Infof("Still waiting for the following %s instances to become healthy %s\n", myComponent.name, instances)
-			time.Sleep(time.Second * 30)
-			continue
+		if len(pending) > 0 {
+			glog.Infof("Still waiting for the following %s instances to become healthy %s\n", myComponent.name, pending)
+			return false, nil
 		}
-		break
+		return true, nil
+	})
+	if errors.Is(err, errWaitTimeout) {
+		return pending, fmt.Errorf("Failed to verify %s instances %s", myComponent.name, pending)
 	}
-
-	if len(instances) > 0 {
-		return instances, fmt.Errorf("Failed to verify %s instances %s", myComponent.name, instances)
+	if err != nil {
+		return pending, err
 	}
 
 	glog.Infof("Verification complete component %s all instances are healthy\n", myComponent.name)
-	return instances, nil
+	return pending, nil
+}
+
+// Returns the number of vCPUs of each of the given instance types
+func (c *awsEc2Controller) getInstanceTypeVCPUs(instanceTypes []string) (map[string]int64, error) {
+	vcpus := make(map[string]int64)
+	if len(instanceTypes) == 0 {
+		return vcpus, nil
+	}
+
+	params := &ec2.DescribeInstanceTypesInput{
+		InstanceTypes: aws.StringSlice(instanceTypes),
+	}
+	for {
+		resp, err := c.client.describeInstanceTypes(params)
+		if err != nil {
+			return vcpus, err
+		}
+		for _, t := range resp.InstanceTypes {
+			if t.VCpuInfo != nil {
+				vcpus[aws.StringValue(t.InstanceType)] = aws.Int64Value(t.VCpuInfo.DefaultVCpus)
+			}
+		}
+		if aws.StringValue(resp.NextToken) == "" {
+			break
+		}
+		params.NextToken = resp.NextToken
+	}
+	return vcpus, nil
+}
+
+// Returns the AMI a launch template version launches. An empty version resolves
+// to the default version of the template.
+func (c *awsEc2Controller) getLaunchTemplateImage(id, name, version string) (string, error) {
+	if version == "" {
+		version = "$Default"
+	}
+	params := &ec2.DescribeLaunchTemplateVersionsInput{
+		Versions: []*string{aws.String(version)},
+	}
+	if id != "" {
+		params.LaunchTemplateId = aws.String(id)
+	} else {
+		params.LaunchTemplateName = aws.String(name)
+	}
+
+	resp, err := c.client.describeLaunchTemplateVersions(params)
+	if err != nil {
+		return "", err
+	}
+	if len(resp.LaunchTemplateVersions) == 0 || resp.LaunchTemplateVersions[0].LaunchTemplateData == nil {
+		return "", fmt.Errorf("launch template %s%s has no version %s", id, name, version)
+	}
+
+	imageID := aws.StringValue(resp.LaunchTemplateVersions[0].LaunchTemplateData.ImageId)
+	if imageID == "" {
+		return "", fmt.Errorf("launch template %s%s version %s does not set an AMI", id, name, version)
+	}
+	return imageID, nil
+}
+
+// Ensures the AMI exists and can be launched
+func (c *awsEc2Controller) validateImage(imageID string) error {
+	resp, err := c.client.describeImages(&ec2.DescribeImagesInput{
+		ImageIds: []*string{aws.String(imageID)},
+	})
+	if err != nil {
+		return err
+	}
+	if len(resp.Images) == 0 {
+		return fmt.Errorf("AMI %s does not exist", imageID)
+	}
+	if state := aws.StringValue(resp.Images[0].State); state != ec2.ImageStateAvailable {
+		return fmt.Errorf("AMI %s is %s", imageID, state)
+	}
+	return nil
+}
+
+// Sets the tags on the instances
+func (c *awsEc2Controller) tagInstances(instances []string, tags map[string]string) error {
+	input := &ec2.CreateTagsInput{Resources: aws.StringSlice(instances)}
+	for _, key := range sortedKeys(tags) {
+		input.Tags = append(input.Tags, &ec2.Tag{Key: aws.String(key), Value: aws.String(tags[key])})
+	}
+	_, err := c.client.createTags(input)
+	return err
+}
+
+// Removes the tags from the instances, whatever their values
+func (c *awsEc2Controller) untagInstances(instances []string, keys []string) error {
+	input := &ec2.DeleteTagsInput{Resources: aws.StringSlice(instances)}
+	for _, key := range keys {
+		input.Tags = append(input.Tags, &ec2.Tag{Key: aws.String(key)})
+	}
+	_, err := c.client.deleteTags(input)
+	return err
 }
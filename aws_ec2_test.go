@@ -1,13 +1,29 @@
 package main
 
 import (
+	"context"
+	"reflect"
 	"testing"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/ec2"
 )
 
 type FakeAwsEc2Client struct{}
 
+var fakeDescribeInstanceTypesOutput = &ec2.DescribeInstanceTypesOutput{}
+var fakeDescribeLaunchTemplateVersionsOutput = &ec2.DescribeLaunchTemplateVersionsOutput{}
+var fakeDescribeImagesOutput = &ec2.DescribeImagesOutput{}
+
+// Returned by describeInstances instead of the fake instance when set
+var fakeDescribeInstancesOutput *ec2.DescribeInstancesOutput
+var fakeCreateTagsInputs []*ec2.CreateTagsInput
+var fakeDeleteTagsInputs []*ec2.DeleteTagsInput
+
+// Value of the healthy tag of the instance described by describeTags, when set
+var fakeInstanceHealth func(instanceID string) string
+
 func newFakeAWSEc2Client() awsEc2 {
 	return &FakeAwsEc2Client{}
 }
@@ -27,6 +43,9 @@ func fakeEc2Instance() *ec2.Instance {
 }
 
 func (e FakeAwsEc2Client) describeInstances(input *ec2.DescribeInstancesInput) (*ec2.DescribeInstancesOutput, error) {
+	if fakeDescribeInstancesOutput != nil {
+		return fakeDescribeInstancesOutput, nil
+	}
 	reservation := &ec2.Reservation{
 		Instances: []*ec2.Instance{
 			fakeEc2Instance(),
@@ -41,13 +60,47 @@ func (e FakeAwsEc2Client) describeInstances(input *ec2.DescribeInstancesInput) (
 }
 
 func (e FakeAwsEc2Client) describeTags(input *ec2.DescribeTagsInput) (*ec2.DescribeTagsOutput, error) {
-	return &ec2.DescribeTagsOutput{}, nil
+	if fakeInstanceHealth == nil {
+		return &ec2.DescribeTagsOutput{}, nil
+	}
+	var tags []*ec2.TagDescription
+	for _, filter := range input.Filters {
+		if aws.StringValue(filter.Name) != "resource-id" {
+			continue
+		}
+		for _, id := range filter.Values {
+			tags = append(tags, &ec2.TagDescription{Key: aws.String("healthy"), Value: aws.String(fakeInstanceHealth(*id)), ResourceId: id})
+		}
+	}
+	return &ec2.DescribeTagsOutput{Tags: tags}, nil
 }
 
 func (e FakeAwsEc2Client) terminateInstances(input *ec2.TerminateInstancesInput) (*ec2.TerminateInstancesOutput, error) {
 	return &ec2.TerminateInstancesOutput{}, nil
 }
 
+func (e FakeAwsEc2Client) describeInstanceTypes(input *ec2.DescribeInstanceTypesInput) (*ec2.DescribeInstanceTypesOutput, error) {
+	return fakeDescribeInstanceTypesOutput, nil
+}
+
+func (e FakeAwsEc2Client) describeLaunchTemplateVersions(input *ec2.DescribeLaunchTemplateVersionsInput) (*ec2.DescribeLaunchTemplateVersionsOutput, error) {
+	return fakeDescribeLaunchTemplateVersionsOutput, nil
+}
+
+func (e FakeAwsEc2Client) describeImages(input *ec2.DescribeImagesInput) (*ec2.DescribeImagesOutput, error) {
+	return fakeDescribeImagesOutput, nil
+}
+
+func (e FakeAwsEc2Client) createTags(input *ec2.CreateTagsInput) (*ec2.CreateTagsOutput, error) {
+	fakeCreateTagsInputs = append(fakeCreateTagsInputs, input)
+	return &ec2.CreateTagsOutput{}, nil
+}
+
+func (e FakeAwsEc2Client) deleteTags(input *ec2.DeleteTagsInput) (*ec2.DeleteTagsOutput, error) {
+	fakeDeleteTagsInputs = append(fakeDeleteTagsInputs, input)
+	return &ec2.DeleteTagsOutput{}, nil
+}
+
 func TestAwsEc2Client_DescribeInstances(t *testing.T) {
 	ec2Controller := newAWSEc2Controller(newFakeAWSEc2Client())
 	params := &ec2.DescribeInstancesInput{}
@@ -60,3 +113,51 @@ func TestAwsEc2Client_DescribeInstances(t *testing.T) {
 		t.Error("Could not describe instances")
 	}
 }
+
+func TestDescribeInstancesWithoutFilters(t *testing.T) {
+	awsEc2Controller := newAWSEc2Controller(newFakeAWSEc2Client())
+	_, err := awsEc2Controller.describeInstances(&ec2.DescribeInstancesInput{})
+	if err == nil {
+		t.Error("expected describing the instances without any filter to fail")
+	}
+}
+
+// Becomes healthy on the checkAt-th health check of each instance
+func fakeHealthAfter(checkAt map[string]int) func(string) string {
+	checks := make(map[string]int)
+	return func(instanceID string) string {
+		checks[instanceID]++
+		if checks[instanceID] >= checkAt[instanceID] {
+			return "True"
+		}
+		return "False"
+	}
+}
+
+func TestVerifyReplacementInstancesKeepsInstances(t *testing.T) {
+	defer func() { fakeInstanceHealth = nil }()
+	c := newAWSEc2Controller(newFakeAWSEc2Client())
+	w := waiter{what: "test", timeout: time.Second, interval: time.Millisecond}
+	component := &componentType{name: "k8s-node"}
+
+	// i-b turns healthy a poll before the others
+	fakeInstanceHealth = fakeHealthAfter(map[string]int{"i-a": 2, "i-b": 1, "i-c": 2})
+	instances := []string{"i-a", "i-b", "i-c"}
+	failed, err := c.verifyReplacementInstances(context.Background(), w, component, instances)
+	if err != nil || len(failed) != 0 {
+		t.Errorf("expected all the instances healthy, got %v and %v", failed, err)
+	}
+	if !reflect.DeepEqual(instances, []string{"i-a", "i-b", "i-c"}) {
+		t.Errorf("expected the instances left as they were, got %v", instances)
+	}
+
+	w.timeout = 10 * time.Millisecond
+	fakeInstanceHealth = fakeHealthAfter(map[string]int{"i-a": 1000, "i-b": 1, "i-c": 1000})
+	failed, err = c.verifyReplacementInstances(context.Background(), w, component, instances)
+	if err == nil || !reflect.DeepEqual(failed, []string{"i-a", "i-c"}) {
+		t.Errorf("expected i-a and i-c to fail the verification, got %v and %v", failed, err)
+	}
+	if !reflect.DeepEqual(instances, []string{"i-a", "i-b", "i-c"}) {
+		t.Errorf("expected the instances left as they were, got %v", instances)
+	}
+}
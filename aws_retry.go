@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/golang/glog"
+)
+
+const (
+	// Retries of the AWS operations without a budget of their own
+	defaultAWSRetryBudget = 5
+	// First delay before retrying a transient error, doubled on each retry
+	awsRetryBaseDelay = 500 * time.Millisecond
+	// First delay before retrying a throttled call, doubled on each retry
+	awsThrottleBaseDelay = 2 * time.Second
+	awsRetryMaxDelay     = 30 * time.Second
+)
+
+// Retries of the AWS operations, by operation name. Reads are cheap to retry and
+// the roll can not go on without them, so they get more room than the default.
+var defaultAWSRetryBudgets = map[string]int{
+	"DescribeInstances":         10,
+	"DescribeTags":              10,
+	"DescribeAutoScalingGroups": 10,
+	"DescribeScalingActivities": 10,
+	"GetCommandInvocation":      10,
+}
+
+// How many times the AWS calls of an operation got retried during the roll
+type awsOperationStats struct {
+	Retries   int
+	Throttles int
+	// Calls which still failed once the retry budget was spent
+	Exhausted int
+}
+
+// Retries the throttled and transient errors of the AWS calls with an exponential
+// backoff and jitter, up to the retry budget of each operation, and counts the retries
+type awsRetryer struct {
+	budgets       map[string]int
+	defaultBudget int
+	mu            sync.Mutex
+	stats         map[string]*awsOperationStats
+}
+
+// Retryer of the AWS clients of the roller, its budgets set from AWS_RETRY_BUDGETS
+var rollerRetryer = newAWSRetryer(nil)
+
+func newAWSRetryer(budgets map[string]int) *awsRetryer {
+	r := &awsRetryer{
+		budgets:       make(map[string]int),
+		defaultBudget: defaultAWSRetryBudget,
+		stats:         make(map[string]*awsOperationStats),
+	}
+	for op, budget := range defaultAWSRetryBudgets {
+		r.budgets[op] = budget
+	}
+	for op, budget := range budgets {
+		if op == "default" {
+			r.defaultBudget = budget
+			continue
+		}
+		r.budgets[op] = budget
+	}
+	return r
+}
+
+// Parses a comma separated list of operation=retries, such as
+// DescribeInstances=20,TerminateInstances=2. The default key sets the budget of the
+// operations not listed.
+func parseAWSRetryBudgets(s string) (map[string]int, error) {
+	budgets := make(map[string]int)
+	for op, v := range parseKeyValues(s) {
+		budget, err := strconv.Atoi(v)
+		if err != nil || budget < 0 {
+			return nil, fmt.Errorf("invalid retry budget %q for %s", v, op)
+		}
+		budgets[op] = budget
+	}
+	return budgets, nil
+}
+
+func (r *awsRetryer) budget(op string) int {
+	if budget, ok := r.budgets[op]; ok {
+		return budget
+	}
+	return r.defaultBudget
+}
+
+// The largest budget, the SDK stops retrying past it whatever ShouldRetry says
+func (r *awsRetryer) MaxRetries() int {
+	max := r.defaultBudget
+	for _, budget := range r.budgets {
+		if budget > max {
+			max = budget
+		}
+	}
+	return max
+}
+
+func (r *awsRetryer) ShouldRetry(req *request.Request) bool {
+	retryable := req.IsErrorThrottle() || req.IsErrorRetryable()
+	if req.Retryable != nil {
+		retryable = *req.Retryable
+	}
+	if !retryable {
+		return false
+	}
+
+	op := req.Operation.Name
+	if req.RetryCount >= r.budget(op) {
+		r.mu.Lock()
+		r.operationStats(op).Exhausted++
+		r.mu.Unlock()
+		glog.Errorf("Giving up on AWS %s after %d retries: %s", op, req.RetryCount, req.Error)
+		return false
+	}
+	return true
+}
+
+func (r *awsRetryer) RetryRules(req *request.Request) time.Duration {
+	throttled := req.IsErrorThrottle()
+	delay := awsBackoff(req.RetryCount, throttled)
+
+	op := req.Operation.Name
+	r.mu.Lock()
+	stats := r.operationStats(op)
+	stats.Retries++
+	if throttled {
+		stats.Throttles++
+	}
+	r.mu.Unlock()
+
+	glog.V(2).Infof("Retrying AWS %s in %v, retry %d/%d: %s", op, delay.Round(time.Millisecond), req.RetryCount+1, r.budget(op), req.Error)
+	return delay
+}
+
+// Must be called with the lock held
+func (r *awsRetryer) operationStats(op string) *awsOperationStats {
+	stats, ok := r.stats[op]
+	if !ok {
+		stats = &awsOperationStats{}
+		r.stats[op] = stats
+	}
+	return stats
+}
+
+func (r *awsRetryer) operations() map[string]awsOperationStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stats := make(map[string]awsOperationStats)
+	for op, s := range r.stats {
+		stats[op] = *s
+	}
+	return stats
+}
+
+// Metrics of the retries of each operation, for datadog
+func (r *awsRetryer) ddMetrics() []ddMetric {
+	stats := r.operations()
+	var ops []string
+	for op := range stats {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+
+	var metrics []ddMetric
+	for _, op := range ops {
+		tags := append(ddTags(""), fmt.Sprintf("operation:%s", op))
+		metrics = append(metrics,
+			ddMetric{name: "roller.aws.retries", value: float64(stats[op].Retries), tags: tags},
+			ddMetric{name: "roller.aws.throttles", value: float64(stats[op].Throttles), tags: tags},
+			ddMetric{name: "roller.aws.exhausted", value: float64(stats[op].Exhausted), tags: tags},
+		)
+	}
+	return metrics
+}
+
+// Exponential backoff with jitter, between half and all of base doubled retryCount
+// times, capped at awsRetryMaxDelay
+func awsBackoff(retryCount int, throttled bool) time.Duration {
+	delay := awsRetryBaseDelay
+	if throttled {
+		delay = awsThrottleBaseDelay
+	}
+	for i := 0; i < retryCount && delay < awsRetryMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > awsRetryMaxDelay {
+		delay = awsRetryMaxDelay
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
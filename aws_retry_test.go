@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestParseAWSRetryBudgets(t *testing.T) {
+	budgets, err := parseAWSRetryBudgets("DescribeInstances=20, default=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := newAWSRetryer(budgets)
+	if r.budget("DescribeInstances") != 20 || r.budget("TerminateInstances") != 2 || r.budget("DescribeTags") != 10 {
+		t.Errorf("expected the budgets to override the defaults, got %v and %d", r.budgets, r.defaultBudget)
+	}
+	if r.MaxRetries() != 20 {
+		t.Errorf("expected the largest budget as the max retries, got %d", r.MaxRetries())
+	}
+
+	_, err = parseAWSRetryBudgets("DescribeInstances=lots")
+	if err == nil {
+		t.Errorf("expected an invalid budget to fail")
+	}
+}
+
+func TestAWSRetryerShouldRetry(t *testing.T) {
+	r := newAWSRetryer(map[string]int{"TerminateInstances": 2})
+	req := &request.Request{
+		Operation: &request.Operation{Name: "TerminateInstances"},
+		Error:     awserr.New("RequestLimitExceeded", "Request limit exceeded.", nil),
+	}
+	if !r.ShouldRetry(req) {
+		t.Errorf("expected a throttled call to be retried")
+	}
+	req.RetryCount = 2
+	if r.ShouldRetry(req) {
+		t.Errorf("expected the retries to stop once the budget is spent")
+	}
+	if r.operations()["TerminateInstances"].Exhausted != 1 {
+		t.Errorf("expected the spent budget to be counted, got %+v", r.operations())
+	}
+
+	req.RetryCount = 0
+	req.Error = awserr.New("InvalidInstanceID.NotFound", "The instance does not exist", nil)
+	if r.ShouldRetry(req) {
+		t.Errorf("expected a client error not to be retried")
+	}
+}
+
+func TestAWSBackoff(t *testing.T) {
+	for retry := 0; retry < 10; retry++ {
+		delay := awsBackoff(retry, false)
+		if delay < awsRetryBaseDelay/2 || delay > awsRetryMaxDelay {
+			t.Errorf("expected retry %d to wait between %v and %v, got %v", retry, awsRetryBaseDelay/2, awsRetryMaxDelay, delay)
+		}
+	}
+	if awsBackoff(0, true) < awsThrottleBaseDelay/2 {
+		t.Errorf("expected throttled calls to back off longer")
+	}
+	if awsBackoff(20, true) < awsRetryMaxDelay/2 {
+		t.Errorf("expected the delay to reach the cap")
+	}
+}
+
+// A throttled DescribeInstances no longer fails the roll, it gets retried
+func TestAWSRetryerThrottledCall(t *testing.T) {
+	calls := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(`<Response><Errors><Error><Code>RequestLimitExceeded</Code><Message>Request limit exceeded.</Message></Error></Errors><RequestID>1</RequestID></Response>`))
+			return
+		}
+		w.Write([]byte(`<DescribeInstancesResponse><reservationSet><item><instancesSet><item><instanceId>i-1</instanceId></item></instancesSet></item></reservationSet></DescribeInstancesResponse>`))
+	}))
+	defer ts.Close()
+
+	r := newAWSRetryer(nil)
+	config := aws.NewConfig().
+		WithEndpoint(ts.URL).
+		WithRegion("us-east-1").
+		WithCredentials(credentials.NewStaticCredentials("id", "secret", "")).
+		WithSleepDelay(func(time.Duration) {})
+	config.EnforceShouldRetryCheck = aws.Bool(true)
+	controller := newAWSEc2Controller(&awsEc2Client{session: ec2.New(session.New(request.WithRetryer(config, r)))})
+
+	instances, err := controller.describeInstances(&ec2.DescribeInstancesInput{Filters: []*ec2.Filter{controller.newEC2Filter("tag:ServiceComponent", "k8s-node")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(instances) != 1 || calls != 3 {
+		t.Errorf("expected the instance after 3 calls, got %d instances after %d calls", len(instances), calls)
+	}
+	stats := r.operations()["DescribeInstances"]
+	if stats.Retries != 2 || stats.Throttles != 2 {
+		t.Errorf("expected 2 throttled retries to be counted, got %+v", stats)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/servicequotas"
+)
+
+// Service quota codes of the running On-Demand vCPU limits, by instance family
+const (
+	standardVCPUQuotaCode = "L-1216C47A"
+	fVCPUQuotaCode        = "L-74FC7D96"
+	gVCPUQuotaCode        = "L-DB2E81BA"
+	infVCPUQuotaCode      = "L-1945791B"
+	pVCPUQuotaCode        = "L-417A185B"
+	xVCPUQuotaCode        = "L-7295265B"
+)
+
+type awsServiceQuotas interface {
+	getServiceQuota(*servicequotas.GetServiceQuotaInput) (*servicequotas.GetServiceQuotaOutput, error)
+}
+
+type awsServiceQuotasClient struct {
+	session *servicequotas.ServiceQuotas
+}
+
+type awsServiceQuotasController struct {
+	client awsServiceQuotas
+}
+
+func newAWSServiceQuotasClient() awsServiceQuotas {
+	return &awsServiceQuotasClient{
+		session: servicequotas.New(newAWSSession()),
+	}
+}
+
+func newAWSServiceQuotasController(awsServiceQuotasClient awsServiceQuotas) *awsServiceQuotasController {
+	return &awsServiceQuotasController{
+		client: awsServiceQuotasClient,
+	}
+}
+
+func (q awsServiceQuotasClient) getServiceQuota(input *servicequotas.GetServiceQuotaInput) (*servicequotas.GetServiceQuotaOutput, error) {
+	return q.session.GetServiceQuota(input)
+}
+
+// Returns the running On-Demand vCPU quota code covering the instance type
+func vcpuQuotaCode(instanceType string) string {
+	switch {
+	case strings.HasPrefix(instanceType, "inf"):
+		return infVCPUQuotaCode
+	case strings.HasPrefix(instanceType, "f"):
+		return fVCPUQuotaCode
+	case strings.HasPrefix(instanceType, "g"), strings.HasPrefix(instanceType, "vt"):
+		return gVCPUQuotaCode
+	case strings.HasPrefix(instanceType, "p"):
+		return pVCPUQuotaCode
+	case strings.HasPrefix(instanceType, "x"):
+		return xVCPUQuotaCode
+	}
+	return standardVCPUQuotaCode
+}
+
+func (c *awsServiceQuotasController) getEC2Quota(quotaCode string) (float64, error) {
+	resp, err := c.client.getServiceQuota(&servicequotas.GetServiceQuotaInput{
+		ServiceCode: aws.String("ec2"),
+		QuotaCode:   aws.String(quotaCode),
+	})
+	if err != nil {
+		return 0, err
+	}
+	return aws.Float64Value(resp.Quota.Value), nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/golang/glog"
+)
+
+const (
+	// Session tag holding who started the roll, on the assumed role sessions
+	awsOperatorSessionTag = "RollerOperator"
+	// Longest role session name STS accepts
+	awsSessionNameLimit = 64
+)
+
+// Characters STS does not accept in role session names and session tag values
+var awsSessionNameInvalid = regexp.MustCompile(`[^\w+=,.@-]`)
+
+var awsAccountIDPattern = regexp.MustCompile(`^[0-9]{12}$`)
+
+// How the roller gets to the AWS account of the cluster
+type awsSessionSettings struct {
+	region  string
+	profile string
+	// Role assumed on top of the credentials of the profile, or with the web identity token
+	roleARN     string
+	externalID  string
+	sessionName string
+	// Who started the roll, in the role session name and tagged on the sessions when
+	// tagSession is set, which the trust policy of the role has to allow
+	operator   string
+	tagSession bool
+	duration   time.Duration
+	// MFA device required by the role. Without a token, the code is prompted on stdin.
+	mfaSerial string
+	mfaToken  string
+	// OIDC token exchanged for the role, like the service account tokens of EKS
+	webIdentityTokenFile string
+}
+
+var (
+	sharedAWSSession     *session.Session
+	sharedAWSSessionErr  error
+	sharedAWSSessionOnce sync.Once
+)
+
+// Session shared by the AWS clients of the roller, so that the role gets assumed and
+// the MFA code prompted once
+func newAWSSession() *session.Session {
+	sharedAWSSessionOnce.Do(func() {
+		sharedAWSSession, sharedAWSSessionErr = buildAWSSession(currentAWSSessionSettings())
+	})
+	if sharedAWSSessionErr != nil {
+		glog.Fatalf("Unable to create the AWS session: %s", sharedAWSSessionErr)
+	}
+	return sharedAWSSession
+}
+
+func currentAWSSessionSettings() awsSessionSettings {
+	return awsSessionSettings{
+		region:               awsRegion,
+		profile:              awsProfile,
+		roleARN:              awsAssumeRoleARN,
+		externalID:           awsAssumeRoleExternalID,
+		sessionName:          awsAssumeRoleSessionName,
+		operator:             operatorIdentity(),
+		tagSession:           awsAssumeRoleTagSession,
+		duration:             awsAssumeRoleDuration,
+		mfaSerial:            awsMFASerial,
+		mfaToken:             awsMFAToken,
+		webIdentityTokenFile: awsWebIdentityTokenFile,
+	}
+}
+
+func buildAWSSession(settings awsSessionSettings) (*session.Session, error) {
+	config := aws.NewConfig()
+	config.EnforceShouldRetryCheck = aws.Bool(true)
+	if settings.region != "" {
+		config.Region = aws.String(settings.region)
+	}
+	base, err := session.NewSessionWithOptions(session.Options{
+		Config:            *request.WithRetryer(config, rollerRetryer),
+		Profile:           settings.profile,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if settings.roleARN == "" {
+		return base, nil
+	}
+
+	sessionName := settings.roleSessionName()
+	if settings.webIdentityTokenFile != "" {
+		glog.V(2).Infof("Assuming role %s with the web identity token %s", settings.roleARN, settings.webIdentityTokenFile)
+		provider := stscreds.NewWebIdentityRoleProvider(sts.New(base), settings.roleARN, sessionName, settings.webIdentityTokenFile)
+		if settings.duration > 0 {
+			provider.Duration = settings.duration
+		}
+		return base.Copy(&aws.Config{Credentials: credentials.NewCredentials(provider)}), nil
+	}
+	glog.V(2).Infof("Assuming role %s as %s", settings.roleARN, sessionName)
+	return base.Copy(&aws.Config{
+		Credentials: stscreds.NewCredentials(base, settings.roleARN, settings.assumeRoleOptions),
+	}), nil
+}
+
+// Role session name, the configured one or one naming the operator
+func (settings awsSessionSettings) roleSessionName() string {
+	name := settings.sessionName
+	if name == "" {
+		name = "kubernetes-updater"
+		if settings.operator != "" {
+			name = fmt.Sprintf("%s-%s", name, settings.operator)
+		}
+	}
+	name = awsSessionNameInvalid.ReplaceAllString(name, "_")
+	if len(name) > awsSessionNameLimit {
+		name = name[:awsSessionNameLimit]
+	}
+	return name
+}
+
+func (settings awsSessionSettings) assumeRoleOptions(p *stscreds.AssumeRoleProvider) {
+	p.RoleSessionName = settings.roleSessionName()
+	if settings.externalID != "" {
+		p.ExternalID = aws.String(settings.externalID)
+	}
+	if settings.tagSession && settings.operator != "" {
+		p.Tags = []*sts.Tag{{
+			Key:   aws.String(awsOperatorSessionTag),
+			Value: aws.String(awsSessionNameInvalid.ReplaceAllString(settings.operator, "_")),
+		}}
+	}
+	if settings.duration > 0 {
+		p.Duration = settings.duration
+	}
+	if settings.mfaSerial != "" {
+		p.SerialNumber = aws.String(settings.mfaSerial)
+		if settings.mfaToken != "" {
+			p.TokenCode = aws.String(settings.mfaToken)
+		} else {
+			p.TokenProvider = stscreds.StdinTokenProvider
+		}
+	}
+}
+
+// Fails the roll when the credentials lead to another account than AWS_ACCOUNT, when
+// it holds an account ID rather than an alias
+func checkAWSAccount(awsClient *awsClient, account string) error {
+	arn, callerAccount, err := awsClient.sts.callerIdentity()
+	if err != nil {
+		return fmt.Errorf("unable to tell who the AWS credentials belong to: %s", err)
+	}
+	glog.V(2).Infof("Running as %s", arn)
+	if awsAccountIDPattern.MatchString(account) && account != callerAccount {
+		return fmt.Errorf("the AWS credentials of %s belong to account %s rather than %s", arn, callerAccount, account)
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+type FakeAwsSTSClient struct {
+	account string
+	err     error
+}
+
+func (s *FakeAwsSTSClient) getCallerIdentity(input *sts.GetCallerIdentityInput) (*sts.GetCallerIdentityOutput, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	return &sts.GetCallerIdentityOutput{
+		Account: aws.String(s.account),
+		Arn:     aws.String(fmt.Sprintf("arn:aws:sts::%s:assumed-role/roller/kubernetes-updater", s.account)),
+	}, nil
+}
+
+func TestAssumeRoleOptions(t *testing.T) {
+	settings := awsSessionSettings{
+		roleARN:    "arn:aws:iam::123456789012:role/roller",
+		externalID: "fleet",
+		operator:   "jane doe",
+		tagSession: true,
+		duration:   time.Hour,
+		mfaSerial:  "arn:aws:iam::210987654321:mfa/jane",
+		mfaToken:   "123456",
+	}
+	p := &stscreds.AssumeRoleProvider{}
+	settings.assumeRoleOptions(p)
+	if p.RoleSessionName != "kubernetes-updater-jane_doe" || aws.StringValue(p.ExternalID) != "fleet" || p.Duration != time.Hour {
+		t.Errorf("expected the session name, external ID and duration, got %+v", p)
+	}
+	if len(p.Tags) != 1 || aws.StringValue(p.Tags[0].Key) != awsOperatorSessionTag || aws.StringValue(p.Tags[0].Value) != "jane_doe" {
+		t.Errorf("expected the operator session tag, got %v", p.Tags)
+	}
+	if aws.StringValue(p.SerialNumber) != settings.mfaSerial || aws.StringValue(p.TokenCode) != "123456" || p.TokenProvider != nil {
+		t.Errorf("expected the MFA token, got %+v", p)
+	}
+
+	settings = awsSessionSettings{sessionName: strings.Repeat("a", 70), operator: "jane", mfaSerial: "arn:aws:iam::210987654321:mfa/jane"}
+	p = &stscreds.AssumeRoleProvider{}
+	settings.assumeRoleOptions(p)
+	if len(p.RoleSessionName) != awsSessionNameLimit || p.Tags != nil || p.TokenProvider == nil {
+		t.Errorf("expected a truncated session name, no session tag and the MFA code prompted, got %+v", p)
+	}
+}
+
+func TestBuildAWSSession(t *testing.T) {
+	dir, err := ioutil.TempDir("", "aws-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := filepath.Join(dir, "config")
+	err = ioutil.WriteFile(config, []byte("[profile prod]\nregion = eu-west-1\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(v string) { os.Setenv("AWS_CONFIG_FILE", v) }(os.Getenv("AWS_CONFIG_FILE"))
+	os.Setenv("AWS_CONFIG_FILE", config)
+
+	sess, err := buildAWSSession(awsSessionSettings{profile: "prod"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aws.StringValue(sess.Config.Region) != "eu-west-1" {
+		t.Errorf("expected the region of the profile, got %s", aws.StringValue(sess.Config.Region))
+	}
+
+	sess, err = buildAWSSession(awsSessionSettings{profile: "prod", region: "us-east-1", roleARN: "arn:aws:iam::123456789012:role/roller"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aws.StringValue(sess.Config.Region) != "us-east-1" {
+		t.Errorf("expected the explicit region, got %s", aws.StringValue(sess.Config.Region))
+	}
+}
+
+func TestCheckAWSAccount(t *testing.T) {
+	awsClient := &awsClient{sts: newAWSSTSController(&FakeAwsSTSClient{account: "123456789012"})}
+	if err := checkAWSAccount(awsClient, "123456789012"); err != nil {
+		t.Errorf("expected the account to match, got %s", err)
+	}
+	if err := checkAWSAccount(awsClient, "vevo"); err != nil {
+		t.Errorf("expected account aliases to be let through, got %s", err)
+	}
+	err := checkAWSAccount(awsClient, "210987654321")
+	if err == nil || !strings.Contains(err.Error(), "rather than 210987654321") {
+		t.Errorf("expected the account mismatch, got %v", err)
+	}
+
+	awsClient.sts = newAWSSTSController(&FakeAwsSTSClient{err: fmt.Errorf("ExpiredToken")})
+	if err := checkAWSAccount(awsClient, "123456789012"); err == nil {
+		t.Errorf("expected the error of the credentials")
+	}
+}
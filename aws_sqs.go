@@ -0,0 +1,60 @@
+package main
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+type awsSQS interface {
+	receiveMessage(*sqs.ReceiveMessageInput) (*sqs.ReceiveMessageOutput, error)
+	deleteMessage(*sqs.DeleteMessageInput) (*sqs.DeleteMessageOutput, error)
+}
+
+type awsSQSClient struct {
+	session *sqs.SQS
+}
+
+type awsSQSController struct {
+	client awsSQS
+}
+
+func newAWSSQSClient() awsSQS {
+	return &awsSQSClient{
+		session: sqs.New(newAWSSession()),
+	}
+}
+
+func newAWSSQSController(awsSQSClient awsSQS) *awsSQSController {
+	return &awsSQSController{
+		client: awsSQSClient,
+	}
+}
+
+func (s awsSQSClient) receiveMessage(input *sqs.ReceiveMessageInput) (*sqs.ReceiveMessageOutput, error) {
+	return s.session.ReceiveMessage(input)
+}
+
+func (s awsSQSClient) deleteMessage(input *sqs.DeleteMessageInput) (*sqs.DeleteMessageOutput, error) {
+	return s.session.DeleteMessage(input)
+}
+
+// Returns the messages waiting in the queue, without waiting for new ones
+func (c *awsSQSController) receiveMessages(queueURL string) ([]*sqs.Message, error) {
+	resp, err := c.client.receiveMessage(&sqs.ReceiveMessageInput{
+		QueueUrl:            aws.String(queueURL),
+		MaxNumberOfMessages: aws.Int64(10),
+		WaitTimeSeconds:     aws.Int64(0),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Messages, nil
+}
+
+func (c *awsSQSController) deleteMessage(queueURL string, message *sqs.Message) error {
+	_, err := c.client.deleteMessage(&sqs.DeleteMessageInput{
+		QueueUrl:      aws.String(queueURL),
+		ReceiptHandle: message.ReceiptHandle,
+	})
+	return err
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ssm"
+)
+
+// Number of characters of the output of a command kept in the run report, the last ones
+const ssmOutputLimit = 4096
+
+type awsSSM interface {
+	sendCommand(*ssm.SendCommandInput) (*ssm.SendCommandOutput, error)
+	getCommandInvocation(*ssm.GetCommandInvocationInput) (*ssm.GetCommandInvocationOutput, error)
+}
+
+type awsSSMClient struct {
+	session *ssm.SSM
+}
+
+type awsSSMController struct {
+	client awsSSM
+}
+
+// Outcome of a Systems Manager command run on an instance
+type ssmCommandResult struct {
+	Instance  string
+	Document  string
+	CommandID string
+	Status    string
+	Output    string
+	Duration  time.Duration
+}
+
+func newAWSSSMClient() awsSSM {
+	return &awsSSMClient{
+		session: ssm.New(newAWSSession()),
+	}
+}
+
+func newAWSSSMController(awsSSMClient awsSSM) *awsSSMController {
+	return &awsSSMController{
+		client: awsSSMClient,
+	}
+}
+
+func (s awsSSMClient) sendCommand(input *ssm.SendCommandInput) (*ssm.SendCommandOutput, error) {
+	return s.session.SendCommand(input)
+}
+
+func (s awsSSMClient) getCommandInvocation(input *ssm.GetCommandInvocationInput) (*ssm.GetCommandInvocationOutput, error) {
+	return s.session.GetCommandInvocation(input)
+}
+
+// Sends the document to the instance and waits for its invocation to finish. The result
+// is returned along with an error when the command did not succeed.
+func (c *awsSSMController) runCommand(ctx context.Context, w waiter, instanceID, document string, parameters map[string][]string) (result ssmCommandResult, err error) {
+	result = ssmCommandResult{Instance: instanceID, Document: document}
+	start := time.Now()
+	defer func() {
+		result.Duration = time.Since(start)
+	}()
+
+	input := &ssm.SendCommandInput{
+		DocumentName: aws.String(document),
+		InstanceIds:  []*string{aws.String(instanceID)},
+		Comment:      aws.String(fmt.Sprintf("kubernetes-updater pre-termination of %s", instanceID)),
+	}
+	if len(parameters) > 0 {
+		input.Parameters = make(map[string][]*string)
+		for k, v := range parameters {
+			input.Parameters[k] = aws.StringSlice(v)
+		}
+	}
+	sent, err := c.client.sendCommand(input)
+	if err != nil {
+		return result, fmt.Errorf("unable to send %s to %s: %s", document, instanceID, err)
+	}
+	result.CommandID = aws.StringValue(sent.Command.CommandId)
+
+	err = w.wait(ctx, func() (bool, error) {
+		resp, err := c.client.getCommandInvocation(&ssm.GetCommandInvocationInput{
+			CommandId:  aws.String(result.CommandID),
+			InstanceId: aws.String(instanceID),
+		})
+		// The invocation takes a moment to show up once the command is sent
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == ssm.ErrCodeInvocationDoesNotExist {
+			return false, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("unable to get the invocation of command %s on %s: %s", result.CommandID, instanceID, err)
+		}
+
+		result.Status = aws.StringValue(resp.Status)
+		result.Output = ssmOutput(resp)
+		switch result.Status {
+		case ssm.CommandInvocationStatusSuccess:
+			return true, nil
+		case ssm.CommandInvocationStatusFailed, ssm.CommandInvocationStatusCancelled, ssm.CommandInvocationStatusTimedOut:
+			return false, fmt.Errorf("command %s of %s on %s finished with status %s", result.CommandID, document, instanceID, result.Status)
+		}
+		return false, nil
+	})
+	if errors.Is(err, errWaitTimeout) {
+		result.Status = ssm.CommandInvocationStatusTimedOut
+		return result, fmt.Errorf("command %s of %s on %s did not finish within %v", result.CommandID, document, instanceID, w.timeout)
+	}
+	return result, err
+}
+
+// Standard output and error of the invocation, trimmed to the last ssmOutputLimit characters
+func ssmOutput(resp *ssm.GetCommandInvocationOutput) string {
+	output := strings.TrimSpace(aws.StringValue(resp.StandardOutputContent))
+	if stderr := strings.TrimSpace(aws.StringValue(resp.StandardErrorContent)); stderr != "" {
+		output = strings.TrimSpace(output + "\n" + stderr)
+	}
+	if len(output) > ssmOutputLimit {
+		output = output[len(output)-ssmOutputLimit:]
+	}
+	return output
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ssm"
+)
+
+// Statuses returned by the successive invocation polls, the last one repeating
+type FakeAwsSSMClient struct {
+	statuses []string
+	sent     *ssm.SendCommandInput
+	polls    int
+}
+
+func (s *FakeAwsSSMClient) sendCommand(input *ssm.SendCommandInput) (*ssm.SendCommandOutput, error) {
+	s.sent = input
+	return &ssm.SendCommandOutput{Command: &ssm.Command{CommandId: aws.String("cmd-1")}}, nil
+}
+
+func (s *FakeAwsSSMClient) getCommandInvocation(input *ssm.GetCommandInvocationInput) (*ssm.GetCommandInvocationOutput, error) {
+	status := s.statuses[len(s.statuses)-1]
+	if s.polls < len(s.statuses) {
+		status = s.statuses[s.polls]
+	}
+	s.polls++
+	if status == "" {
+		return nil, awserr.New(ssm.ErrCodeInvocationDoesNotExist, "not yet", nil)
+	}
+	return &ssm.GetCommandInvocationOutput{
+		Status:                aws.String(status),
+		StandardOutputContent: aws.String("flushed\n"),
+		StandardErrorContent:  aws.String(""),
+	}, nil
+}
+
+func TestRunCommand(t *testing.T) {
+	client := &FakeAwsSSMClient{statuses: []string{"", ssm.CommandInvocationStatusInProgress, ssm.CommandInvocationStatusSuccess}}
+	controller := newAWSSSMController(client)
+	result, err := controller.runCommand(context.Background(), waiter{timeout: time.Minute, interval: time.Millisecond}, "i-old", "AWS-RunShellScript", map[string][]string{"commands": {"sync"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Status != ssm.CommandInvocationStatusSuccess || result.Output != "flushed" || result.CommandID != "cmd-1" || client.polls != 3 || result.Duration <= 0 {
+		t.Errorf("expected the command to succeed after 3 polls, got %+v after %d", result, client.polls)
+	}
+	if aws.StringValue(client.sent.InstanceIds[0]) != "i-old" || aws.StringValue(client.sent.Parameters["commands"][0]) != "sync" {
+		t.Errorf("expected the document to be sent to the instance with its parameters, got %s", client.sent)
+	}
+
+	client = &FakeAwsSSMClient{statuses: []string{ssm.CommandInvocationStatusFailed}}
+	result, err = newAWSSSMController(client).runCommand(context.Background(), waiter{timeout: time.Minute, interval: time.Millisecond}, "i-old", "AWS-RunShellScript", nil)
+	if err == nil || result.Status != ssm.CommandInvocationStatusFailed {
+		t.Errorf("expected the failed command to return an error, got %v", err)
+	}
+
+	client = &FakeAwsSSMClient{statuses: []string{ssm.CommandInvocationStatusInProgress}}
+	result, err = newAWSSSMController(client).runCommand(context.Background(), waiter{timeout: 10 * time.Millisecond, interval: time.Millisecond}, "i-old", "AWS-RunShellScript", nil)
+	if err == nil || !strings.Contains(err.Error(), "did not finish") || result.Status != ssm.CommandInvocationStatusTimedOut {
+		t.Errorf("expected the command to time out, got %v", err)
+	}
+}
+
+func TestRunPreTerminateCommand(t *testing.T) {
+	s := fakeApprovalState(nil)
+	defer func(st *rollerState) { state = st }(state)
+	state = s
+
+	client := &FakeAwsSSMClient{statuses: []string{ssm.CommandInvocationStatusFailed}}
+	awsClient := &awsClient{ssm: newAWSSSMController(client)}
+	c := s.components[1]
+
+	// Components without a command terminate right away
+	err := runPreTerminateCommand(awsClient, c, "i-old", time.Millisecond)
+	if err != nil || client.sent != nil {
+		t.Errorf("expected no command to be sent, got %v", err)
+	}
+
+	c.spec.PreTerminateCommand = &ssmCommandSpec{Document: "AWS-RunShellScript", OnFailure: hookFailureIgnore}
+	err = runPreTerminateCommand(awsClient, c, "i-old", time.Millisecond)
+	if err != nil || s.abortError() != nil {
+		t.Errorf("expected the failure to be ignored, got %v", err)
+	}
+
+	c.spec.PreTerminateCommand.OnFailure = ""
+	err = runPreTerminateCommand(awsClient, c, "i-old", time.Millisecond)
+	if err == nil || s.abortError() == nil {
+		t.Errorf("expected the failure to abort the roll")
+	}
+
+	commands := c.model().Commands
+	if len(commands) != 2 || commands[0].Instance != "i-old" || commands[0].Status != ssm.CommandInvocationStatusFailed {
+		t.Errorf("expected both commands in the report, got %+v", commands)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+type awsSTS interface {
+	getCallerIdentity(*sts.GetCallerIdentityInput) (*sts.GetCallerIdentityOutput, error)
+}
+
+type awsSTSClient struct {
+	session *sts.STS
+}
+
+type awsSTSController struct {
+	client awsSTS
+}
+
+func newAWSSTSClient() awsSTS {
+	return &awsSTSClient{
+		session: sts.New(newAWSSession()),
+	}
+}
+
+func newAWSSTSController(awsSTSClient awsSTS) *awsSTSController {
+	return &awsSTSController{
+		client: awsSTSClient,
+	}
+}
+
+func (s awsSTSClient) getCallerIdentity(input *sts.GetCallerIdentityInput) (*sts.GetCallerIdentityOutput, error) {
+	return s.session.GetCallerIdentity(input)
+}
+
+// Returns the ARN and account of the credentials the roller runs with
+func (c *awsSTSController) callerIdentity() (string, string, error) {
+	resp, err := c.client.getCallerIdentity(&sts.GetCallerIdentityInput{})
+	if err != nil {
+		return "", "", err
+	}
+	return *resp.Arn, *resp.Account, nil
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/golang/glog"
+)
+
+// Tag of the ASGs created by the blue-green strategy, naming the ASG they replaced
+const rollerTagReplacesASG = "roller:replaces-asg"
+
+// Suffix a blue-green roll gives the ASGs it creates
+var blueGreenSuffix = regexp.MustCompile(`-[0-9]{8}T[0-9]{6}Z$`)
+
+// Name of the ASG replacing asg, its name with the run ID in place of the one of the
+// roll which created it, if any
+func blueGreenName(asg, runID string) string {
+	return fmt.Sprintf("%s-%s", blueGreenSuffix.ReplaceAllString(asg, ""), runID)
+}
+
+// Replaces each ASG of the component with a copy launching the new instances. The copy
+// is scaled up to the size of the original and verified before the nodes of the
+// original get drained and the original gets scaled in and deleted. Until then, a
+// failure or an abort deletes the copy and puts the original back in service.
+func replaceInstancesBlueGreen(awsClient *awsClient, component string, ansibleVersion string) error {
+	glog.V(4).Infof("Starting process to replace the ASGs of %s", component)
+
+	scalingProcesses := []*string{
+		aws.String("AZRebalance"),
+	}
+	myComponent, _, err := replaceInstancesPrepare(awsClient, component, scalingProcesses)
+	if err != nil {
+		err = fmt.Errorf("an error occurred while preparing for instance replacement for %s\n Error: %s", myComponent.name, err)
+		glog.V(4).Infof("%s", err)
+		return err
+	}
+
+	// The deleted ASGs leave the component, the ones left are the originals after a rollback
+	defer resumeASGProcesses(awsClient, scalingProcesses, myComponent)
+
+	blues := append([]string(nil), myComponent.asgs...)
+	for i, blue := range blues {
+		err = state.checkAbort(myComponent)
+		if err != nil {
+			return err
+		}
+		err = switchASGBlueGreen(awsClient, myComponent, blue, ansibleVersion)
+		if err != nil {
+			return err
+		}
+		if i < len(blues)-1 {
+			err = state.approveBatch(myComponent, i+1)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	untagRoll(awsClient, myComponent)
+
+	glog.V(4).Infof("Completed the replacement of the ASGs of component %s", myComponent.name)
+	return nil
+}
+
+// Moves the instances of the component in ASG blue to a new copy of it
+func switchASGBlueGreen(awsClient *awsClient, c *componentType, blue, ansibleVersion string) (err error) {
+	group, err := awsClient.autoscaling.getAutoscalingGroup(blue)
+	if err != nil {
+		return err
+	}
+	hooks, err := awsClient.autoscaling.getLifecycleHooks(blue)
+	if err != nil {
+		return fmt.Errorf("unable to list the lifecycle hooks of ASG %s: %s", blue, err)
+	}
+	var originals []string
+	for _, i := range c.instances {
+		if asg, _ := instanceTag(i, asgTagName); asg == blue {
+			originals = append(originals, *i.InstanceId)
+		}
+	}
+
+	runID := state.runID
+	if runID == "" {
+		runID = newRunID(time.Now())
+	}
+	green := blueGreenName(blue, runID)
+	tags := map[string]string{rollerTagReplacesASG: blue}
+	if state.runID != "" {
+		tags[rollerTagRunID] = state.runID
+	}
+	glog.Infof("Creating ASG %s to replace ASG %s of %s", green, blue, c.name)
+	err = awsClient.autoscaling.cloneAutoScalingGroup(group, green, c.spec.LaunchTemplateVersion, hooks, tags)
+	if err != nil {
+		return fmt.Errorf("unable to create ASG %s to replace %s: %s", green, blue, err)
+	}
+	c.replaceASG(blue, green)
+
+	switched := false
+	defer func() {
+		if err != nil && !switched {
+			rollbackBlueGreen(awsClient, c, blue, green, originals, err)
+		}
+	}()
+
+	desired := aws.Int64Value(group.DesiredCapacity)
+	state.setPhase(c, phaseSurge)
+	replacements := state.startReplacementBatch(c)
+	err = awsClient.autoscaling.resizeAutoScalingGroup(green, aws.Int64Value(group.MinSize), desired)
+	if err != nil {
+		return fmt.Errorf("unable to scale ASG %s up to %d: %s", green, desired, err)
+	}
+	state.mu.Lock()
+	if c.desired == nil {
+		c.desired = make(map[string]int)
+	}
+	c.desired[green] = int(desired)
+	state.mu.Unlock()
+
+	state.setPhase(c, phaseVerify)
+	newInstances, err := findAndVerifyReplacementInstances(awsClient, c, ansibleVersion, int(desired), replacements)
+	if err != nil {
+		return err
+	}
+	state.addProgress(c, 0, len(newInstances))
+	tagReplacedInstances(awsClient, originals, newInstances)
+
+	err = state.checkAbort(c)
+	if err != nil {
+		return err
+	}
+	if c.spec.Kubernetes == kubernetesRoleDrain {
+		tagInstanceState(awsClient, originals, instanceStateDraining)
+		err = cordonAndDrain(c, originals)
+		if err != nil {
+			return err
+		}
+	}
+	for _, instanceID := range originals {
+		err = runHooks(newHookPayload(hookPreTerminate, c, findInstance(c.instances, instanceID)))
+		if err != nil {
+			return err
+		}
+		err = runPreTerminateCommand(awsClient, c, instanceID, preTerminatePollInterval)
+		if err != nil {
+			return err
+		}
+		if ddDowntimeScope == "host" {
+			startHostDownTime(c, instanceID)
+		}
+	}
+
+	// There is no going back once the original instances start terminating
+	switched = true
+	state.setPhase(c, phaseTerminate)
+	tagInstanceState(awsClient, originals, instanceStatePendingTermination)
+	err = awsClient.autoscaling.resizeAutoScalingGroup(blue, 0, 0)
+	if err != nil {
+		return fmt.Errorf("unable to scale ASG %s in: %s", blue, err)
+	}
+
+	ctx, cancel := state.waitContext()
+	defer cancel()
+	w := componentWaiter(c, fmt.Sprintf("the old instances to leave ASG %s", blue))
+	err = w.wait(ctx, func() (bool, error) {
+		count, err := awsClient.autoscaling.getInstanceCount(blue)
+		if err != nil {
+			return false, fmt.Errorf("an error occurred counting the instances of ASG %s\n Error: %s", blue, err)
+		}
+		return count == 0, nil
+	})
+	if errors.Is(err, errWaitTimeout) {
+		err = fmt.Errorf("timed out waiting for the instances to leave ASG %s", blue)
+	}
+	if err != nil {
+		return err
+	}
+	for _, instanceID := range originals {
+		state.recordInstanceEvent(c, instanceID, eventTerminated)
+	}
+	state.addProgress(c, len(originals), 0)
+
+	err = awsClient.autoscaling.deleteAutoScalingGroup(blue, false)
+	if err != nil {
+		return fmt.Errorf("unable to delete ASG %s once empty: %s", blue, err)
+	}
+	glog.Infof("Replaced ASG %s of %s with %s", blue, c.name, green)
+	state.notify(notifyProgress, fmt.Sprintf("ASG %s replaced on %s", blue, kubernetesCluster),
+		fmt.Sprintf("ASG %s of %s has been replaced with ASG %s and deleted.", blue, c.name, green), c.name)
+	return nil
+}
+
+// Puts the original ASG back in service and deletes the copy which was to replace it,
+// along with its instances
+func rollbackBlueGreen(awsClient *awsClient, c *componentType, blue, green string, originals []string, cause error) {
+	glog.Errorf("Rolling back the replacement of ASG %s with %s: %s", blue, green, cause)
+	c.replaceASG(green, blue)
+
+	if c.spec.Kubernetes == kubernetesRoleDrain && len(originals) > 0 {
+		err := uncordonKubernetesNodes(newClient(kubernetesServer, kubernetesToken), originals)
+		if err != nil {
+			glog.Errorf("an error occurred uncordoning the nodes of ASG %s.\nError %s", blue, err)
+		}
+	}
+	if state.runID != "" && len(originals) > 0 {
+		err := awsClient.ec2.untagInstances(originals, []string{rollerTagState, rollerTagReplacedBy})
+		if err != nil {
+			glog.Errorf("an error occurred removing the roll tags of instances %v.\nError %s", originals, err)
+		}
+	}
+
+	err := awsClient.autoscaling.deleteAutoScalingGroup(green, true)
+	if err != nil {
+		glog.Errorf("an error occurred deleting ASG %s.\nError %s", green, err)
+	}
+	state.notify(notifyFailure, fmt.Sprintf("ASG %s rolled back on %s", blue, kubernetesCluster),
+		fmt.Sprintf("The replacement of ASG %s of %s failed: %s. ASG %s is back in service and ASG %s %s.",
+			blue, c.name, cause, blue, green, deletionOutcome(err)), c.name)
+}
+
+func deletionOutcome(err error) string {
+	if err != nil {
+		return fmt.Sprintf("could not be deleted: %s", err)
+	}
+	return "has been deleted"
+}
+
+// Swaps an ASG of the component for another, which the component is now made of
+func (c *componentType) replaceASG(from, to string) {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	for i, asg := range c.asgs {
+		if asg == from {
+			c.asgs[i] = to
+		}
+	}
+	if desired, ok := c.desired[from]; ok {
+		delete(c.desired, from)
+		c.desired[to] = desired
+	}
+}
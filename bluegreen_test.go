@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+)
+
+func TestBlueGreenName(t *testing.T) {
+	tests := map[string]string{
+		"prod-nodes":                  "prod-nodes-20210304T050607Z",
+		"prod-nodes-20200102T030405Z": "prod-nodes-20210304T050607Z",
+		"prod-nodes-v2":               "prod-nodes-v2-20210304T050607Z",
+	}
+	for asg, expected := range tests {
+		if name := blueGreenName(asg, "20210304T050607Z"); name != expected {
+			t.Errorf("expected %s to be replaced by %s, got %s", asg, expected, name)
+		}
+	}
+}
+
+func TestCloneAutoScalingGroup(t *testing.T) {
+	defer func() { fakeCreateAutoScalingGroupInputs = nil }()
+	c := newAWSAutoscalingController(newFakeAWSAutoscalingClient())
+	group := &autoscaling.Group{
+		AutoScalingGroupName: aws.String("nodes"),
+		MinSize:              aws.Int64(2),
+		MaxSize:              aws.Int64(10),
+		DesiredCapacity:      aws.Int64(3),
+		LaunchTemplate:       &autoscaling.LaunchTemplateSpecification{LaunchTemplateId: aws.String("lt-1"), Version: aws.String("3")},
+		VPCZoneIdentifier:    aws.String("subnet-1,subnet-2"),
+		TargetGroupARNs:      aws.StringSlice([]string{"arn:tg"}),
+		Tags: []*autoscaling.TagDescription{
+			{Key: aws.String("aws:cloudformation:stack-name"), Value: aws.String("prod")},
+			{Key: aws.String(rollerTagRunID), Value: aws.String("20200102T030405Z")},
+			{Key: aws.String("KubernetesCluster"), Value: aws.String("prod"), PropagateAtLaunch: aws.Bool(true)},
+		},
+	}
+	hooks := []*autoscaling.LifecycleHook{{
+		LifecycleHookName:   aws.String("launching"),
+		LifecycleTransition: aws.String("autoscaling:EC2_INSTANCE_LAUNCHING"),
+		HeartbeatTimeout:    aws.Int64(300),
+	}}
+
+	err := c.cloneAutoScalingGroup(group, "nodes-20210304T050607Z", "$Latest", hooks, map[string]string{rollerTagReplacesASG: "nodes"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := fakeCreateAutoScalingGroupInputs[0]
+	if aws.Int64Value(input.DesiredCapacity) != 0 || aws.Int64Value(input.MinSize) != 0 || aws.Int64Value(input.MaxSize) != 10 {
+		t.Errorf("expected an empty copy with the same maximum size, got %v", input)
+	}
+	if aws.StringValue(input.LaunchTemplate.Version) != "$Latest" || aws.StringValue(group.LaunchTemplate.Version) != "3" {
+		t.Errorf("expected the copy alone to launch the latest version, got %v and %v", input.LaunchTemplate, group.LaunchTemplate)
+	}
+	if aws.StringValue(input.VPCZoneIdentifier) != "subnet-1,subnet-2" || len(input.TargetGroupARNs) != 1 {
+		t.Errorf("expected the subnets and target groups copied, got %v", input)
+	}
+	if len(input.LifecycleHookSpecificationList) != 1 || aws.Int64Value(input.LifecycleHookSpecificationList[0].HeartbeatTimeout) != 300 {
+		t.Errorf("expected the lifecycle hook copied, got %v", input.LifecycleHookSpecificationList)
+	}
+	tags := make(map[string]string)
+	for _, tag := range input.Tags {
+		if aws.StringValue(tag.ResourceId) != "nodes-20210304T050607Z" {
+			t.Errorf("expected the tags set on the copy, got %v", tag)
+		}
+		tags[aws.StringValue(tag.Key)] = fmt.Sprintf("%s/%t", aws.StringValue(tag.Value), aws.BoolValue(tag.PropagateAtLaunch))
+	}
+	if len(tags) != 2 || tags["KubernetesCluster"] != "prod/true" || tags[rollerTagReplacesASG] != "nodes/false" {
+		t.Errorf("expected the tags copied but the reserved and roll ones, got %v", tags)
+	}
+
+	group.LaunchTemplate = nil
+	group.LaunchConfigurationName = aws.String("nodes-lc")
+	err = c.cloneAutoScalingGroup(group, "nodes-20210304T050607Z", "$Latest", nil, nil)
+	if err == nil {
+		t.Errorf("expected no launch template version to switch to with a launch configuration")
+	}
+}
+
+func TestRollbackBlueGreen(t *testing.T) {
+	defer func(st *rollerState) { state = st }(state)
+	defer func() { fakeDeleteAutoScalingGroupInputs = nil }()
+	state = fakeRollerState()
+	state.notifications = newNotificationDispatcher()
+	awsClient := &awsClient{
+		ec2:         newAWSEc2Controller(newFakeAWSEc2Client()),
+		autoscaling: newAWSAutoscalingController(newFakeAWSAutoscalingClient()),
+	}
+	c := &componentType{name: "k8s-node", asgs: []string{"masters", "nodes-20210304T050607Z"}, desired: map[string]int{"nodes-20210304T050607Z": 3}}
+
+	rollbackBlueGreen(awsClient, c, "nodes", "nodes-20210304T050607Z", []string{"i-1"}, fmt.Errorf("unhealthy"))
+	if c.asgs[1] != "nodes" || c.desired["nodes"] != 3 {
+		t.Errorf("expected the original ASG back in the component, got %v and %v", c.asgs, c.desired)
+	}
+	if len(fakeDeleteAutoScalingGroupInputs) != 1 || aws.StringValue(fakeDeleteAutoScalingGroupInputs[0].AutoScalingGroupName) != "nodes-20210304T050607Z" ||
+		!aws.BoolValue(fakeDeleteAutoScalingGroupInputs[0].ForceDelete) {
+		t.Errorf("expected the copy deleted along with its instances, got %v", fakeDeleteAutoScalingGroupInputs)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// How often the health of a soaking canary is checked
+const canaryCheckInterval = 30 * time.Second
+
+func canaryEnabled(component string) bool {
+	if lookupComponentSpec(component).Canary {
+		return true
+	}
+	for _, c := range canaryComponents {
+		if c == component {
+			return true
+		}
+	}
+	return false
+}
+
+// A canary is healthy when its node is ready and none of the pods scheduled on it
+// failed or are crash looping. Instances which do not run a kubernetes node, like
+// etcd, are only checked when requireNode is false.
+func checkCanaryHealth(client kubernetesClient, instanceID string, requireNode bool) error {
+	nodes, err := kubernetesNodes{}.getNodesByLabel(client, map[string]string{"instance-id": instanceID})
+	if err != nil {
+		return err
+	}
+	if len(nodes.Items) == 0 {
+		if requireNode {
+			return fmt.Errorf("no kubernetes node found for canary %s", instanceID)
+		}
+		return nil
+	}
+
+	node := nodes.Items[0]
+	if !nodeReady(node) {
+		return fmt.Errorf("canary node %s is not ready", node.Name)
+	}
+
+	pods, err := client.getPods(metav1.NamespaceAll, metav1.ListOptions{
+		FieldSelector: fmt.Sprintf("spec.nodeName=%s", node.Name),
+	})
+	if err != nil {
+		return err
+	}
+	var unhealthy []string
+	for _, pod := range pods.Items {
+		if pod.Status.Phase == corev1.PodFailed {
+			unhealthy = append(unhealthy, fmt.Sprintf("%s/%s", pod.Namespace, pod.Name))
+			continue
+		}
+		for _, status := range pod.Status.ContainerStatuses {
+			if status.State.Waiting != nil && status.State.Waiting.Reason == "CrashLoopBackOff" {
+				unhealthy = append(unhealthy, fmt.Sprintf("%s/%s", pod.Namespace, pod.Name))
+				break
+			}
+		}
+	}
+	if len(unhealthy) > 0 {
+		return fmt.Errorf("%d pods are failing on canary node %s: %s", len(unhealthy), node.Name, limitList(unhealthy))
+	}
+	return nil
+}
+
+// Keeps checking the health of the canary until it soaked for the given duration,
+// giving up as soon as it is unhealthy or the roll gets aborted
+func soakCanary(client kubernetesClient, c *componentType, instanceID string, requireNode bool, soak, interval time.Duration) error {
+	state.setPhase(c, phaseSoak)
+	glog.Infof("Soaking canary %s of %s for %v", instanceID, c.name, soak)
+
+	deadline := time.NewTimer(soak)
+	defer deadline.Stop()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		err := checkCanaryHealth(client, instanceID, requireNode)
+		if err != nil {
+			return fmt.Errorf("canary %s of %s failed: %s", instanceID, c.name, err)
+		}
+
+		select {
+		case <-state.abortChannel():
+			return state.checkAbort(c)
+		case <-deadline.C:
+			glog.Infof("Canary %s of %s soaked for %v", instanceID, c.name, soak)
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Launches a single replacement instance in asg for a component rolled with
+// replaceInstancesVerifyAndTerminate, cordons a few of the old nodes to push workloads
+// onto it and soaks it. A failing canary gets terminated, the old nodes uncordoned
+// and the whole roll aborted.
+func runCanary(awsClient *awsClient, kubernetesClient kubernetesClient, c *componentType, asg string, desiredCount int, instanceList []string) (string, error) {
+	state.setPhase(c, phaseCanary)
+	glog.Infof("Launching a canary for %s in ASG %s", c.name, asg)
+
+	replacements := state.startReplacementBatch(c)
+	err := setDesiredCount(awsClient, c, asg, desiredCount+1)
+	if err != nil {
+		return "", fmt.Errorf("got error when trying to set the desired count for ASG %s: %s", asg, err)
+	}
+
+	canaries, err := findAndVerifyReplacementInstances(awsClient, c, ansibleVersion, 1, replacements)
+	if err == nil && len(canaries) != 1 {
+		err = fmt.Errorf("expected a single canary instance, found %v", canaries)
+	}
+	if err != nil {
+		err = fmt.Errorf("canary of %s failed: %s", c.name, err)
+		revertCanary(awsClient, kubernetesClient, c, asg, desiredCount, canaries, nil)
+		state.abort(err)
+		return "", err
+	}
+	canary := canaries[0]
+
+	var cordoned []string
+	if canaryCordonNodes > 0 {
+		cordoned = instanceList
+		if len(cordoned) > canaryCordonNodes {
+			cordoned = cordoned[:canaryCordonNodes]
+		}
+		glog.V(4).Infof("Cordoning %v to schedule workloads onto canary %s", cordoned, canary)
+		err = cordonKubernetesNodes(kubernetesClient, cordoned)
+		if err != nil {
+			glog.Errorf("an error occurred cordoning nodes for canary %s.\nError %s", canary, err)
+		}
+	}
+
+	err = soakCanary(kubernetesClient, c, canary, c.spec.Kubernetes != kubernetesRoleNone, canarySoak, canaryCheckInterval)
+	if err != nil {
+		revertCanary(awsClient, kubernetesClient, c, asg, desiredCount, canaries, cordoned)
+		state.abort(err)
+		return "", err
+	}
+
+	state.addProgress(c, 0, 1)
+	return canary, nil
+}
+
+// Terminates the canary instances and puts the ASG and the cordoned nodes back the
+// way they were before the canary
+func revertCanary(awsClient *awsClient, kubernetesClient kubernetesClient, c *componentType, asg string, desiredCount int, canaries, cordoned []string) {
+	glog.Infof("Reverting canary %v in ASG %s", canaries, asg)
+	for _, instanceID := range canaries {
+		_, err := awsClient.autoscaling.terminateAndDecrement(instanceID)
+		if err != nil {
+			glog.Errorf("an error occurred terminating canary %s.\nError %s", instanceID, err)
+		}
+	}
+	err := setDesiredCount(awsClient, c, asg, desiredCount)
+	if err != nil {
+		glog.Errorf("an error occurred resetting the desired count of ASG %s.\nError %s", asg, err)
+	}
+	if len(cordoned) > 0 {
+		err = uncordonKubernetesNodes(kubernetesClient, cordoned)
+		if err != nil {
+			glog.Errorf("an error occurred uncordoning %v.\nError %s", cordoned, err)
+		}
+	}
+}
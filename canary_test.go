@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func readyFakeNode() func() {
+	fakeNode.Status.Conditions = []corev1.NodeCondition{
+		{Type: corev1.NodeReady, Status: corev1.ConditionTrue},
+	}
+	return func() { fakeNode.Status.Conditions = nil }
+}
+
+func TestCanaryEnabled(t *testing.T) {
+	canaryComponents = []string{"k8s-node"}
+	defer func() { canaryComponents = nil }()
+
+	if !canaryEnabled("k8s-node") || canaryEnabled("etcd") {
+		t.Errorf("expected only k8s-node to have a canary")
+	}
+}
+
+func TestCheckCanaryHealth(t *testing.T) {
+	client := newFakeClient()
+
+	err := checkCanaryHealth(client, "i-unknown", false)
+	if err != nil {
+		t.Errorf("expected an instance without node to pass when no node is required, got %s", err)
+	}
+	err = checkCanaryHealth(client, "i-unknown", true)
+	if err == nil {
+		t.Errorf("expected an instance without node to fail when a node is required")
+	}
+
+	err = checkCanaryHealth(client, "i-fake-instanceid", true)
+	if err == nil || !strings.Contains(err.Error(), "not ready") {
+		t.Errorf("expected a node which is not ready to fail, got %v", err)
+	}
+
+	defer readyFakeNode()()
+	err = checkCanaryHealth(client, "i-fake-instanceid", true)
+	if err != nil {
+		t.Errorf("expected a ready node to pass, got %s", err)
+	}
+
+	defer func() { fakePodList = &corev1.PodList{} }()
+	fakePodList = &corev1.PodList{
+		Items: []corev1.Pod{
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "default"},
+				Status: corev1.PodStatus{
+					Phase: corev1.PodRunning,
+					ContainerStatuses: []corev1.ContainerStatus{
+						{State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "CrashLoopBackOff"}}},
+					},
+				},
+			},
+		},
+	}
+	err = checkCanaryHealth(client, "i-fake-instanceid", true)
+	if err == nil || !strings.Contains(err.Error(), "default/api") {
+		t.Errorf("expected the crash looping pod to be reported, got %v", err)
+	}
+}
+
+func TestSoakCanary(t *testing.T) {
+	state = fakeRollerState()
+	state.notifications = newNotificationDispatcher()
+	state.templates, _ = loadMessageTemplates()
+	defer func() { state = nil }()
+	client := newFakeClient()
+	component := state.components[1]
+
+	defer readyFakeNode()()
+	err := soakCanary(client, component, "i-fake-instanceid", true, 20*time.Millisecond, time.Millisecond)
+	if err != nil {
+		t.Errorf("expected the canary to soak, got %s", err)
+	}
+	if component.phase != phaseSoak {
+		t.Errorf("expected the component to be soaking, got %s", component.phase)
+	}
+
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		state.abort(fmt.Errorf("fake abort"))
+	}()
+	err = soakCanary(client, component, "i-fake-instanceid", true, time.Minute, time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "aborted") {
+		t.Errorf("expected the soak to stop when the roll is aborted, got %v", err)
+	}
+}
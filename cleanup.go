@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/golang/glog"
+)
+
+// Scaling processes a roll may have left suspended
+var rollScalingProcesses = []*string{
+	aws.String("AZRebalance"),
+	aws.String("Terminate"),
+	aws.String("Launch"),
+}
+
+// Puts back the instances and ASGs of the cluster left tagged by an interrupted roll,
+// finding out what it did from the tags alone: the nodes it was draining or about to
+// terminate get uncordoned, the ASGs get their scaling processes resumed and their
+// desired capacity set back along with the instance types and subnets a launch
+// fallback switched, and the roll tags are removed.
+func cleanupRoll(awsClient *awsClient, kubernetesClient kubernetesClient) error {
+	lock := newRollLock(kubernetesClient, operatorIdentity())
+	err := lock.acquire()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		lockErr := lock.release()
+		if lockErr != nil {
+			glog.Errorf("An error occurred releasing the roll lock.\nError %s", lockErr)
+		}
+	}()
+
+	instances, err := awsClient.ec2.describeInstances(&ec2.DescribeInstancesInput{
+		Filters: []*ec2.Filter{
+			awsClient.ec2.newEC2Filter("tag:KubernetesCluster", kubernetesCluster),
+			awsClient.ec2.newEC2Filter("instance-state-name", "running"),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("unable to list the instances of the cluster: %s", err)
+	}
+
+	var failures []string
+	var tagged, inService []string
+	scaleIn := make(map[string]map[string][]string)
+	for _, i := range instances {
+		if change, ok := instanceTag(i, rollerTagScaleIn); ok {
+			asg, _ := instanceTag(i, asgTagName)
+			if asg == "" {
+				glog.Warningf("Instance %s was left with its scale-in protection %s but is in no ASG", *i.InstanceId, change)
+				continue
+			}
+			if scaleIn[asg] == nil {
+				scaleIn[asg] = make(map[string][]string)
+			}
+			scaleIn[asg][change] = append(scaleIn[asg][change], *i.InstanceId)
+		}
+		instanceState, ok := instanceTag(i, rollerTagState)
+		if !ok {
+			continue
+		}
+		runID, _ := instanceTag(i, rollerTagRunID)
+		glog.Infof("Instance %s was left %s by run %s", *i.InstanceId, instanceState, runID)
+		tagged = append(tagged, *i.InstanceId)
+		if instanceState == instanceStateDraining || instanceState == instanceStatePendingTermination {
+			inService = append(inService, *i.InstanceId)
+		}
+	}
+	if len(inService) > 0 {
+		err = uncordonKubernetesNodes(kubernetesClient, inService)
+		if err != nil {
+			failures = append(failures, err.Error())
+		}
+	}
+	if len(tagged) > 0 {
+		err = awsClient.ec2.untagInstances(tagged, []string{rollerTagState, rollerTagReplacedBy, rollerTagReplaces})
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("unable to remove the roll tags of instances %v: %s", tagged, err))
+		}
+	}
+
+	// Put the scale-in protection back before the ASGs scale in
+	for asg, changes := range scaleIn {
+		for change, ids := range changes {
+			err = awsClient.autoscaling.setScaleInProtection(asg, ids, change == scaleInProtectionRemoved)
+			if err == nil {
+				err = awsClient.ec2.untagInstances(ids, []string{rollerTagScaleIn})
+			}
+			if err != nil {
+				failures = append(failures, fmt.Sprintf("unable to restore the scale-in protection of %v in ASG %s: %s", ids, asg, err))
+			}
+		}
+	}
+
+	asgs, err := awsClient.ec2.getUniqueTagValues(asgTagName, instances)
+	if err != nil {
+		return err
+	}
+	// The ASGs left without instances, like the copy of a blue-green roll scaled to zero,
+	// and the ASGs a launch fallback switched, even when their roll completed
+	for _, key := range []string{rollerTagRunID, rollerTagOriginalInstanceTypes, rollerTagOriginalSubnets} {
+		taggedASGs, err := awsClient.autoscaling.getASGsWithTag(key, map[string]string{"KubernetesCluster": kubernetesCluster})
+		if err != nil {
+			return fmt.Errorf("unable to list the ASGs of the cluster left tagged by a roll: %s", err)
+		}
+		asgs = append(asgs, withoutStrings(taggedASGs, asgs)...)
+	}
+	for _, asg := range asgs {
+		if asg == "" {
+			continue
+		}
+		err = cleanupRollASG(awsClient, asg)
+		if err != nil {
+			failures = append(failures, err.Error())
+		}
+	}
+
+	if len(failures) > 0 {
+		return fmt.Errorf("%s", strings.Join(failures, "; "))
+	}
+	glog.Infof("Cleaned up %d instances of %s", len(tagged), kubernetesCluster)
+	return nil
+}
+
+func cleanupRollASG(awsClient *awsClient, asg string) error {
+	group, err := awsClient.autoscaling.getAutoscalingGroup(asg)
+	if err != nil {
+		return err
+	}
+	runID, ok := asgTag(group, rollerTagRunID)
+	if !ok {
+		return restoreLaunchTargets(awsClient, group)
+	}
+	glog.Infof("ASG %s was left by run %s", asg, runID)
+	// Which of the two ASGs of an interrupted blue-green roll should stay is not for the tags to tell
+	if original, ok := asgTag(group, rollerTagReplacesASG); ok {
+		glog.Warningf("ASG %s was created by run %s to replace ASG %s, delete whichever of the two should not stay", asg, runID, original)
+	}
+
+	_, err = awsClient.autoscaling.manageASGProcesses(asg, rollScalingProcesses, "resume")
+	if err != nil {
+		return fmt.Errorf("unable to resume the scaling processes of ASG %s: %s", asg, err)
+	}
+	if value, ok := asgTag(group, rollerTagDesiredCapacity); ok {
+		desired, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("ASG %s has an invalid %s tag %q", asg, rollerTagDesiredCapacity, value)
+		}
+		if aws.Int64Value(group.DesiredCapacity) > desired {
+			glog.Infof("Setting the desired count of ASG %s back to %d from %d", asg, desired, aws.Int64Value(group.DesiredCapacity))
+			_, err = awsClient.autoscaling.setDesiredCount(asg, desired)
+			if err != nil {
+				return fmt.Errorf("unable to set the desired count of ASG %s back to %d: %s", asg, desired, err)
+			}
+		}
+	}
+	if value, ok := asgTag(group, rollerTagOnDemandBase); ok {
+		base, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("ASG %s has an invalid %s tag %q", asg, rollerTagOnDemandBase, value)
+		}
+		glog.Infof("Setting the On-Demand base capacity of ASG %s back to %d", asg, base)
+		err = restoreASGOnDemandBase(awsClient, asg, base)
+		if err != nil {
+			return err
+		}
+	}
+	err = restoreLaunchTargets(awsClient, group)
+	if err != nil {
+		return err
+	}
+	err = awsClient.autoscaling.untagASG(asg, []string{rollerTagRunID, rollerTagDesiredCapacity})
+	if err != nil {
+		return fmt.Errorf("unable to remove the roll tags of ASG %s: %s", asg, err)
+	}
+	return nil
+}
@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"github.com/golang/glog"
 	appsv1 "k8s.io/api/apps/v1"
+	coordinationv1 "k8s.io/api/coordination/v1"
 	corev1 "k8s.io/api/core/v1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
@@ -21,6 +23,12 @@ type kubernetesClient interface {
 	getNodes(metav1.ListOptions) (*corev1.NodeList, error)
 	updateNode(*corev1.Node) (*corev1.Node, error)
 	drainNode(*corev1.Node) error
+	getPods(namespace string, listOptions metav1.ListOptions) (*corev1.PodList, error)
+	getPodDisruptionBudgets(namespace string) (*policyv1beta1.PodDisruptionBudgetList, error)
+	getLease(name string, namespace string) (*coordinationv1.Lease, error)
+	createLease(*coordinationv1.Lease) (*coordinationv1.Lease, error)
+	updateLease(*coordinationv1.Lease) (*coordinationv1.Lease, error)
+	deleteLease(name string, namespace string) error
 }
 
 type kubernetesClientConfig struct {
@@ -62,6 +70,30 @@ func (c kubernetesClientConfig) updateNode(newNode *corev1.Node) (*corev1.Node,
 	return node, err
 }
 
+func (c kubernetesClientConfig) getPods(namespace string, listOptions metav1.ListOptions) (*corev1.PodList, error) {
+	return c.clientset.CoreV1().Pods(namespace).List(context.TODO(), listOptions)
+}
+
+func (c kubernetesClientConfig) getPodDisruptionBudgets(namespace string) (*policyv1beta1.PodDisruptionBudgetList, error) {
+	return c.clientset.PolicyV1beta1().PodDisruptionBudgets(namespace).List(context.TODO(), metav1.ListOptions{})
+}
+
+func (c kubernetesClientConfig) getLease(name string, namespace string) (*coordinationv1.Lease, error) {
+	return c.clientset.CoordinationV1().Leases(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+}
+
+func (c kubernetesClientConfig) createLease(lease *coordinationv1.Lease) (*coordinationv1.Lease, error) {
+	return c.clientset.CoordinationV1().Leases(lease.Namespace).Create(context.TODO(), lease, metav1.CreateOptions{})
+}
+
+func (c kubernetesClientConfig) updateLease(lease *coordinationv1.Lease) (*coordinationv1.Lease, error) {
+	return c.clientset.CoordinationV1().Leases(lease.Namespace).Update(context.TODO(), lease, metav1.UpdateOptions{})
+}
+
+func (c kubernetesClientConfig) deleteLease(name string, namespace string) error {
+	return c.clientset.CoordinationV1().Leases(namespace).Delete(context.TODO(), name, metav1.DeleteOptions{})
+}
+
 func (c kubernetesClientConfig) drainNode(node *corev1.Node) error {
 	if c.clientset == nil {
 		return fmt.Errorf("K8sClient not set")
@@ -4,8 +4,12 @@ import (
 	"fmt"
 
 	appsv1 "k8s.io/api/apps/v1"
+	coordinationv1 "k8s.io/api/coordination/v1"
 	corev1 "k8s.io/api/core/v1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 )
 
 type FakeKubernetesClientConfig struct{}
@@ -55,6 +59,15 @@ func fakeNodeList(listOptions metav1.ListOptions) *corev1.NodeList {
 	return nodeList
 }
 
+var fakePodList = &corev1.PodList{}
+
+var fakePodDisruptionBudgetList = &policyv1beta1.PodDisruptionBudgetList{}
+
+var fakeLeases = make(map[string]*coordinationv1.Lease)
+
+// Returned by getNodes when set
+var fakeGetNodesError error
+
 func newFakeClient() kubernetesClient {
 	return &FakeKubernetesClientConfig{}
 }
@@ -73,6 +86,9 @@ func (c FakeKubernetesClientConfig) updateDeployment(newDeployment *appsv1.Deplo
 }
 
 func (c FakeKubernetesClientConfig) getNodes(listOptions metav1.ListOptions) (*corev1.NodeList, error) {
+	if fakeGetNodesError != nil {
+		return nil, fakeGetNodesError
+	}
 	return fakeNodeList(listOptions), nil
 }
 
@@ -82,3 +98,34 @@ func (c FakeKubernetesClientConfig) updateNode(newNode *corev1.Node) (*corev1.No
 func (c FakeKubernetesClientConfig) drainNode(newNode *corev1.Node) error {
 	return nil
 }
+
+func (c FakeKubernetesClientConfig) getPods(namespace string, listOptions metav1.ListOptions) (*corev1.PodList, error) {
+	return fakePodList, nil
+}
+
+func (c FakeKubernetesClientConfig) getPodDisruptionBudgets(namespace string) (*policyv1beta1.PodDisruptionBudgetList, error) {
+	return fakePodDisruptionBudgetList, nil
+}
+
+func (c FakeKubernetesClientConfig) getLease(name string, namespace string) (*coordinationv1.Lease, error) {
+	lease, ok := fakeLeases[namespace+"/"+name]
+	if !ok {
+		return nil, apierrors.NewNotFound(schema.GroupResource{Group: "coordination.k8s.io", Resource: "leases"}, name)
+	}
+	return lease.DeepCopy(), nil
+}
+
+func (c FakeKubernetesClientConfig) createLease(lease *coordinationv1.Lease) (*coordinationv1.Lease, error) {
+	fakeLeases[lease.Namespace+"/"+lease.Name] = lease.DeepCopy()
+	return lease, nil
+}
+
+func (c FakeKubernetesClientConfig) updateLease(lease *coordinationv1.Lease) (*coordinationv1.Lease, error) {
+	fakeLeases[lease.Namespace+"/"+lease.Name] = lease.DeepCopy()
+	return lease, nil
+}
+
+func (c FakeKubernetesClientConfig) deleteLease(name string, namespace string) error {
+	delete(fakeLeases, namespace+"/"+name)
+	return nil
+}
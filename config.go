@@ -0,0 +1,332 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// How the replacement instances of a component are deemed healthy
+const (
+	// The instance tags itself healthy=True once provisioned
+	healthCheckTag = "tag"
+	// The instance joined the cluster as a Ready kubernetes node
+	healthCheckNode = "node"
+	// The instance launched, nothing more is checked
+	healthCheckNone = "none"
+)
+
+// How the instances of a component take part in kubernetes
+const (
+	// Kubernetes nodes cordoned and drained before being terminated
+	kubernetesRoleDrain = "drain"
+	// Kubernetes nodes terminated without being drained
+	kubernetesRoleNode = "node"
+	// Not kubernetes nodes
+	kubernetesRoleNone = "none"
+)
+
+const asgTagName = "aws:autoscaling:groupName"
+
+// A group of instances rolled together. Instances belong to a component when they
+// carry all of its tags and, if it lists any, are in one of its ASGs.
+type componentSpec struct {
+	Name        string            `json:"name"`
+	Tags        map[string]string `json:"tags"`
+	ASGs        []string          `json:"asgs"`
+	Strategy    string            `json:"strategy"`
+	HealthCheck string            `json:"healthCheck"`
+	Kubernetes  string            `json:"kubernetes"`
+	DependsOn   []string          `json:"dependsOn"`
+	Canary      bool              `json:"canary"`
+	// Systems Manager command run on each original instance before it gets terminated
+	PreTerminateCommand *ssmCommandSpec `json:"preTerminateCommand"`
+	// How long to wait for the instances to launch, get healthy or leave the ASGs, and
+	// how often to check on them
+	WaitTimeoutSeconds  int `json:"waitTimeoutSeconds"`
+	PollIntervalSeconds int `json:"pollIntervalSeconds"`
+	// Instance types and subnets to switch the ASGs to, in order, when they fail to
+	// launch replacements for lack of capacity or quota
+	LaunchFallbacks []launchFallback `json:"launchFallbacks"`
+	// Launch template version the blue-green strategy launches the new ASGs with,
+	// the version of the original ASGs when empty
+	LaunchTemplateVersion string `json:"launchTemplateVersion"`
+}
+
+// Content of the ROLLER_CONFIG file
+type rollerConfig struct {
+	Components []componentSpec `json:"components"`
+	Hooks      []hookSpec      `json:"hooks"`
+}
+
+// The components known without any configuration
+var builtinComponentSpecs = []componentSpec{
+	{
+		Name:        "k8s-node",
+		Tags:        map[string]string{"ServiceComponent": "k8s-node"},
+		Strategy:    strategyVerifyAndTerminate,
+		HealthCheck: healthCheckTag,
+		Kubernetes:  kubernetesRoleDrain,
+	},
+	{
+		Name:        "k8s-master",
+		Tags:        map[string]string{"ServiceComponent": "k8s-master"},
+		Strategy:    strategyTerminateAndVerify,
+		HealthCheck: healthCheckTag,
+		Kubernetes:  kubernetesRoleNode,
+	},
+	{
+		Name:        "etcd",
+		Tags:        map[string]string{"ServiceComponent": "etcd"},
+		Strategy:    strategyTerminateAndVerify,
+		HealthCheck: healthCheckTag,
+		Kubernetes:  kubernetesRoleNone,
+	},
+}
+
+// Spec of every known component, by name, once loaded
+var componentSpecs = make(map[string]componentSpec)
+
+// Components which are not configured are selected by their ServiceComponent tag
+func defaultComponentSpec(name string) componentSpec {
+	return componentSpec{
+		Name:        name,
+		Tags:        map[string]string{"ServiceComponent": name},
+		Strategy:    strategyTerminateAndVerify,
+		HealthCheck: healthCheckTag,
+		Kubernetes:  kubernetesRoleNone,
+	}
+}
+
+func lookupComponentSpec(name string) componentSpec {
+	if spec, ok := componentSpecs[name]; ok {
+		return spec
+	}
+	for _, spec := range builtinComponentSpecs {
+		if spec.Name == name {
+			return spec
+		}
+	}
+	return defaultComponentSpec(name)
+}
+
+func (spec componentSpec) validate() error {
+	if spec.Name == "" {
+		return fmt.Errorf("component without a name")
+	}
+	if len(spec.Tags) == 0 && len(spec.ASGs) == 0 {
+		return fmt.Errorf("component %s has neither tags nor asgs to select its instances", spec.Name)
+	}
+	switch spec.Strategy {
+	case strategyTerminateAndVerify, strategyVerifyAndTerminate:
+	case strategyBlueGreen:
+		// The new ASGs get new names, only the tags keep selecting their instances
+		if len(spec.ASGs) > 0 {
+			return fmt.Errorf("component %s selects its instances by ASG, which the %s strategy replaces", spec.Name, strategyBlueGreen)
+		}
+	default:
+		return fmt.Errorf("component %s has an unknown strategy %q", spec.Name, spec.Strategy)
+	}
+	switch spec.Kubernetes {
+	case kubernetesRoleDrain, kubernetesRoleNode, kubernetesRoleNone:
+	default:
+		return fmt.Errorf("component %s has an unknown kubernetes handling %q", spec.Name, spec.Kubernetes)
+	}
+	switch spec.HealthCheck {
+	case healthCheckTag, healthCheckNone:
+	case healthCheckNode:
+		if spec.Kubernetes == kubernetesRoleNone {
+			return fmt.Errorf("component %s can not check the health of kubernetes nodes it does not have", spec.Name)
+		}
+	default:
+		return fmt.Errorf("component %s has an unknown health check %q", spec.Name, spec.HealthCheck)
+	}
+	if spec.WaitTimeoutSeconds < 0 || spec.PollIntervalSeconds < 0 {
+		return fmt.Errorf("component %s has a negative waitTimeoutSeconds or pollIntervalSeconds", spec.Name)
+	}
+	for _, f := range spec.LaunchFallbacks {
+		if err := f.validate(spec.Name); err != nil {
+			return err
+		}
+	}
+	if spec.PreTerminateCommand != nil {
+		return spec.PreTerminateCommand.validate(spec.Name)
+	}
+	return nil
+}
+
+// Whether the strategy of the component launches all its replacements before
+// terminating anything
+func (spec componentSpec) surges() bool {
+	return spec.Strategy == strategyVerifyAndTerminate || spec.Strategy == strategyBlueGreen
+}
+
+// Loads the component specs, the built-in ones overridden or complemented by the
+// ones of the config file at path when set. Returns the names of all the known
+// components, the built-in ones first.
+func loadComponentSpecs(path string) ([]string, error) {
+	var names []string
+	specs := make(map[string]componentSpec)
+	for _, spec := range builtinComponentSpecs {
+		specs[spec.Name] = spec
+		names = append(names, spec.Name)
+	}
+
+	if path != "" {
+		config, err := readRollerConfig(path)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, spec := range config.Components {
+			base, builtin := specs[spec.Name]
+			if !builtin {
+				base = defaultComponentSpec(spec.Name)
+				base.Tags = nil
+				names = append(names, spec.Name)
+			}
+			specs[spec.Name] = mergeComponentSpec(base, spec)
+		}
+	}
+
+	for _, spec := range specs {
+		err := spec.validate()
+		if err != nil {
+			return nil, err
+		}
+	}
+	componentSpecs = specs
+	return names, nil
+}
+
+func readRollerConfig(path string) (rollerConfig, error) {
+	config := rollerConfig{}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return config, fmt.Errorf("unable to read the config file: %s", err)
+	}
+	err = json.Unmarshal(b, &config)
+	if err != nil {
+		return config, fmt.Errorf("unable to parse the config file: %s", err)
+	}
+	return config, nil
+}
+
+// Overrides the fields of base which are set in spec
+func mergeComponentSpec(base, spec componentSpec) componentSpec {
+	if spec.Tags != nil {
+		base.Tags = spec.Tags
+	}
+	if spec.ASGs != nil {
+		base.ASGs = spec.ASGs
+	}
+	if spec.Strategy != "" {
+		base.Strategy = spec.Strategy
+	}
+	if spec.HealthCheck != "" {
+		base.HealthCheck = spec.HealthCheck
+	}
+	if spec.Kubernetes != "" {
+		base.Kubernetes = spec.Kubernetes
+	}
+	if spec.DependsOn != nil {
+		base.DependsOn = spec.DependsOn
+	}
+	if spec.Canary {
+		base.Canary = true
+	}
+	if spec.PreTerminateCommand != nil {
+		base.PreTerminateCommand = spec.PreTerminateCommand
+	}
+	if spec.WaitTimeoutSeconds != 0 {
+		base.WaitTimeoutSeconds = spec.WaitTimeoutSeconds
+	}
+	if spec.PollIntervalSeconds != 0 {
+		base.PollIntervalSeconds = spec.PollIntervalSeconds
+	}
+	if spec.LaunchFallbacks != nil {
+		base.LaunchFallbacks = spec.LaunchFallbacks
+	}
+	if spec.LaunchTemplateVersion != "" {
+		base.LaunchTemplateVersion = spec.LaunchTemplateVersion
+	}
+	return base
+}
+
+// Adds the dependsOn of the component specs to dependencies
+func specDependencies(dependencies map[string][]string) map[string][]string {
+	var names []string
+	for name := range componentSpecs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		dependencies[name] = append(dependencies[name], componentSpecs[name].DependsOn...)
+	}
+	return dependencies
+}
+
+func instanceTag(instance *ec2.Instance, key string) (string, bool) {
+	for _, tag := range instance.Tags {
+		if aws.StringValue(tag.Key) == key {
+			return aws.StringValue(tag.Value), true
+		}
+	}
+	return "", false
+}
+
+func (spec componentSpec) matches(instance *ec2.Instance) bool {
+	for key, value := range spec.Tags {
+		if v, ok := instanceTag(instance, key); !ok || v != value {
+			return false
+		}
+	}
+	if len(spec.ASGs) == 0 {
+		return true
+	}
+	asg, _ := instanceTag(instance, asgTagName)
+	for _, a := range spec.ASGs {
+		if a == asg {
+			return true
+		}
+	}
+	return false
+}
+
+func (spec componentSpec) selectInstances(instances []*ec2.Instance) []*ec2.Instance {
+	results := []*ec2.Instance{}
+	for _, instance := range instances {
+		if spec.matches(instance) {
+			results = append(results, instance)
+		}
+	}
+	return results
+}
+
+// EC2 filters matching the instances of the component
+func (spec componentSpec) filters() []*ec2.Filter {
+	var keys []string
+	for key := range spec.Tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var filters []*ec2.Filter
+	for _, key := range keys {
+		filters = append(filters, &ec2.Filter{
+			Name:   aws.String(fmt.Sprintf("tag:%s", key)),
+			Values: aws.StringSlice([]string{spec.Tags[key]}),
+		})
+	}
+	if len(spec.ASGs) > 0 {
+		filters = append(filters, &ec2.Filter{
+			Name:   aws.String(fmt.Sprintf("tag:%s", asgTagName)),
+			Values: aws.StringSlice(spec.ASGs),
+		})
+	}
+	return filters
+}
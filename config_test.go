@@ -0,0 +1,154 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func writeRollerConfig(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "roller-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "config.json")
+	err = ioutil.WriteFile(path, []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadComponentSpecs(t *testing.T) {
+	defer func() { componentSpecs = make(map[string]componentSpec) }()
+
+	names, err := loadComponentSpecs("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(names, []string{"k8s-node", "k8s-master", "etcd"}) {
+		t.Errorf("expected the built-in components, got %v", names)
+	}
+
+	path := writeRollerConfig(t, `{
+  "components": [
+    {"name": "k8s-master", "canary": true},
+    {
+      "name": "ingress-node",
+      "tags": {"Role": "ingress", "Cluster": "prod"},
+      "strategy": "verify-and-terminate",
+      "healthCheck": "node",
+      "kubernetes": "drain",
+      "dependsOn": ["k8s-node"]
+    },
+    {"name": "bastion", "asgs": ["prod-bastion"], "healthCheck": "none"}
+  ]
+}`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	names, err = loadComponentSpecs(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(names, []string{"k8s-node", "k8s-master", "etcd", "ingress-node", "bastion"}) {
+		t.Errorf("expected the built-in then the configured components, got %v", names)
+	}
+
+	master := lookupComponentSpec("k8s-master")
+	if !master.Canary || master.Strategy != strategyTerminateAndVerify || master.Tags["ServiceComponent"] != "k8s-master" {
+		t.Errorf("expected the k8s-master overrides to be merged over the built-in spec, got %+v", master)
+	}
+	if componentStrategy("ingress-node") != strategyVerifyAndTerminate {
+		t.Errorf("expected ingress-node to use its configured strategy")
+	}
+	bastion := lookupComponentSpec("bastion")
+	if len(bastion.Tags) != 0 || bastion.Strategy != strategyTerminateAndVerify || bastion.Kubernetes != kubernetesRoleNone {
+		t.Errorf("expected bastion to default to the terminate-and-verify strategy without tags, got %+v", bastion)
+	}
+
+	dependencies := specDependencies(map[string][]string{"k8s-node": {"k8s-master"}})
+	if !reflect.DeepEqual(dependencies["ingress-node"], []string{"k8s-node"}) {
+		t.Errorf("expected ingress-node to depend on k8s-node, got %v", dependencies)
+	}
+}
+
+func TestLoadComponentSpecsInvalid(t *testing.T) {
+	defer func() { componentSpecs = make(map[string]componentSpec) }()
+
+	tests := map[string]string{
+		`{"components": [{"name": "foo"}]}`:                                           "neither tags nor asgs",
+		`{"components": [{"name": "foo", "asgs": ["a"], "strategy": "yolo"}]}`:        "unknown strategy",
+		`{"components": [{"name": "foo", "asgs": ["a"], "healthCheck": "node"}]}`:     "kubernetes nodes it does not have",
+		`{"components": [{"name": "foo", "asgs": ["a"], "kubernetes": "evict"}]}`:     "unknown kubernetes handling",
+		`{"components": [{"name": "foo", "asgs": ["a"], "preTerminateCommand": {}}]}`: "needs a document",
+		`{"components": [{"name": "foo", "asgs": ["a"], "waitTimeoutSeconds": -1}]}`:  "negative waitTimeoutSeconds",
+		`{"components": [{"name": "foo", "asgs": ["a"], "launchFallbacks": [{}]}]}`:   "neither instanceTypes nor subnets",
+		`{"components": [{"name": "foo", "asgs": ["a"], "strategy": "blue-green"}]}`:  "selects its instances by ASG",
+		`{"components": [{"asgs": ["a"]}]}`:                                           "without a name",
+		`{"components": `:                                                             "unable to parse",
+	}
+	for content, expected := range tests {
+		path := writeRollerConfig(t, content)
+		_, err := loadComponentSpecs(path)
+		os.RemoveAll(filepath.Dir(path))
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected an error containing %q for %s, got %v", expected, content, err)
+		}
+	}
+}
+
+func TestComponentSpecSelectInstances(t *testing.T) {
+	newInstance := func(id string, tags map[string]string) *ec2.Instance {
+		instance := &ec2.Instance{InstanceId: aws.String(id)}
+		for key, value := range tags {
+			instance.Tags = append(instance.Tags, &ec2.Tag{Key: aws.String(key), Value: aws.String(value)})
+		}
+		return instance
+	}
+	inventory := []*ec2.Instance{
+		newInstance("i-1", map[string]string{"Role": "ingress", asgTagName: "ingress-a"}),
+		newInstance("i-2", map[string]string{"Role": "ingress", asgTagName: "ingress-b"}),
+		newInstance("i-3", map[string]string{"Role": "worker", asgTagName: "ingress-a"}),
+		newInstance("i-4", map[string]string{asgTagName: "bastion"}),
+	}
+
+	ids := func(instances []*ec2.Instance) []string {
+		var results []string
+		for _, i := range instances {
+			results = append(results, *i.InstanceId)
+		}
+		return results
+	}
+
+	spec := componentSpec{Name: "ingress", Tags: map[string]string{"Role": "ingress"}}
+	if got := ids(spec.selectInstances(inventory)); !reflect.DeepEqual(got, []string{"i-1", "i-2"}) {
+		t.Errorf("expected the instances tagged Role=ingress, got %v", got)
+	}
+	spec.ASGs = []string{"ingress-a"}
+	if got := ids(spec.selectInstances(inventory)); !reflect.DeepEqual(got, []string{"i-1"}) {
+		t.Errorf("expected the instances tagged Role=ingress in ingress-a, got %v", got)
+	}
+	spec = componentSpec{Name: "bastion", ASGs: []string{"bastion"}}
+	if got := ids(spec.selectInstances(inventory)); !reflect.DeepEqual(got, []string{"i-4"}) {
+		t.Errorf("expected the instances of the bastion ASG, got %v", got)
+	}
+
+	spec = componentSpec{Name: "ingress", Tags: map[string]string{"Role": "ingress", "Cluster": "prod"}, ASGs: []string{"ingress-a", "ingress-b"}}
+	filters := spec.filters()
+	var names []string
+	for _, f := range filters {
+		names = append(names, *f.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"tag:Cluster", "tag:Role", "tag:" + asgTagName}) {
+		t.Errorf("expected a filter per tag then the ASG filter, got %v", names)
+	}
+	if len(filters[2].Values) != 2 {
+		t.Errorf("expected the ASG filter to match both ASGs, got %v", filters[2].Values)
+	}
+}
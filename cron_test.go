@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCronSchedule(t *testing.T) {
+	for _, spec := range []string{"* * * * *", "0 2 * * 1-5", "*/15 0-6,22-23 1,15 * 0", "30 3 * 1-3 7"} {
+		_, err := parseCronSchedule(spec)
+		if err != nil {
+			t.Errorf("expected %q to parse, got %s", spec, err)
+		}
+	}
+	for _, spec := range []string{"* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "*/0 * * * *", "a * * * *", "5-1 * * * *"} {
+		_, err := parseCronSchedule(spec)
+		if err == nil {
+			t.Errorf("expected %q not to parse", spec)
+		}
+	}
+}
+
+func TestCronScheduleNext(t *testing.T) {
+	paris, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		t.Skip("no time zone database")
+	}
+	// Wednesday
+	after := time.Date(2026, 10, 14, 10, 17, 30, 0, paris)
+
+	tests := map[string]time.Time{
+		"* * * * *":     time.Date(2026, 10, 14, 10, 18, 0, 0, paris),
+		"*/15 * * * *":  time.Date(2026, 10, 14, 10, 30, 0, 0, paris),
+		"0 2 * * 1-5":   time.Date(2026, 10, 15, 2, 0, 0, 0, paris),
+		"0 2 * * 6":     time.Date(2026, 10, 17, 2, 0, 0, 0, paris),
+		"0 2 * * 7":     time.Date(2026, 10, 18, 2, 0, 0, 0, paris),
+		"0 0 1 * *":     time.Date(2026, 11, 1, 0, 0, 0, 0, paris),
+		"0 0 1 1 *":     time.Date(2027, 1, 1, 0, 0, 0, 0, paris),
+		"0 0 20 * 4":    time.Date(2026, 10, 15, 0, 0, 0, 0, paris),
+		"30 22 29 2 *":  time.Date(2028, 2, 29, 22, 30, 0, 0, paris),
+		"17 10 14 10 *": time.Date(2027, 10, 14, 10, 17, 0, 0, paris),
+	}
+	for spec, expected := range tests {
+		s, err := parseCronSchedule(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		next := s.next(after)
+		if !next.Equal(expected) {
+			t.Errorf("expected %q to next fire at %v, got %v", spec, expected, next)
+		}
+		if !s.matches(next) {
+			t.Errorf("expected %q to match %v", spec, next)
+		}
+	}
+
+	s, _ := parseCronSchedule("0 0 31 2 *")
+	if next := s.next(after); !next.IsZero() {
+		t.Errorf("expected a schedule which never fires to return the zero time, got %v", next)
+	}
+}
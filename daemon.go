@@ -0,0 +1,306 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Layout of the blackout dates
+const blackoutDateLayout = "2006-01-02"
+
+// Clusters may only be rolled by the daemon for duration once schedule fires
+type maintenanceWindow struct {
+	Schedule        string `json:"schedule"`
+	DurationMinutes int    `json:"durationMinutes"`
+	schedule        *cronSchedule
+}
+
+// Content of the -daemon file
+type daemonConfig struct {
+	CheckIntervalSeconds int `json:"checkIntervalSeconds"`
+	MaxConcurrentRolls   int `json:"maxConcurrentRolls"`
+	// Time zone the windows and blackout dates are in, UTC by default
+	Timezone      string              `json:"timezone"`
+	Windows       []maintenanceWindow `json:"windows"`
+	BlackoutDates []string            `json:"blackoutDates"`
+	Clusters      []fleetCluster      `json:"clusters"`
+	location      *time.Location
+	blackouts     map[string]bool
+}
+
+type daemonClusterStatus struct {
+	Name       string    `json:"name"`
+	LastCheck  time.Time `json:"lastCheck"`
+	CheckError string    `json:"checkError,omitempty"`
+	// Number of instances not running the desired version at the last check
+	Drift    int                 `json:"drift"`
+	Rolling  bool                `json:"rolling"`
+	LastRoll *fleetClusterReport `json:"lastRoll,omitempty"`
+}
+
+type daemonStatus struct {
+	WindowOpen         bool                  `json:"windowOpen"`
+	NextWindow         time.Time             `json:"nextWindow"`
+	Rolling            int                   `json:"rolling"`
+	MaxConcurrentRolls int                   `json:"maxConcurrentRolls"`
+	Clusters           []daemonClusterStatus `json:"clusters"`
+}
+
+// Keeps checking the clusters for drift and rolls them during the maintenance windows
+type daemon struct {
+	mu      sync.Mutex
+	config  *daemonConfig
+	planner fleetRunner
+	roller  fleetRunner
+	status  map[string]*daemonClusterStatus
+	rolling int
+	wg      sync.WaitGroup
+}
+
+func loadDaemonConfig(path string) (*daemonConfig, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the daemon file: %s", err)
+	}
+	config := &daemonConfig{}
+	err = json.Unmarshal(b, config)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse the daemon file: %s", err)
+	}
+
+	if config.CheckIntervalSeconds <= 0 {
+		config.CheckIntervalSeconds = 900
+	}
+	if config.MaxConcurrentRolls <= 0 {
+		config.MaxConcurrentRolls = 1
+	}
+	config.location, err = time.LoadLocation(config.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("unknown timezone %q: %s", config.Timezone, err)
+	}
+	if len(config.Windows) == 0 {
+		return nil, fmt.Errorf("the daemon has no maintenance windows")
+	}
+	for i, w := range config.Windows {
+		config.Windows[i].schedule, err = parseCronSchedule(w.Schedule)
+		if err != nil {
+			return nil, err
+		}
+		if w.DurationMinutes <= 0 {
+			return nil, fmt.Errorf("maintenance window %q needs a durationMinutes", w.Schedule)
+		}
+	}
+	config.blackouts = make(map[string]bool)
+	for _, date := range config.BlackoutDates {
+		_, err = time.Parse(blackoutDateLayout, date)
+		if err != nil {
+			return nil, fmt.Errorf("invalid blackout date %q, expected YYYY-MM-DD", date)
+		}
+		config.blackouts[date] = true
+	}
+	if len(config.Clusters) == 0 {
+		return nil, fmt.Errorf("the daemon has no clusters")
+	}
+	err = checkFleetClusters(config.Clusters, make(map[string]bool))
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func (c *daemonConfig) blackedOut(t time.Time) bool {
+	return c.blackouts[t.In(c.location).Format(blackoutDateLayout)]
+}
+
+// Whether a maintenance window is open at now, outside of the blackout dates
+func (c *daemonConfig) windowOpen(now time.Time) bool {
+	now = now.In(c.location)
+	if c.blackedOut(now) {
+		return false
+	}
+	for _, w := range c.Windows {
+		duration := time.Duration(w.DurationMinutes) * time.Minute
+		start := w.schedule.next(now.Add(-duration))
+		if !start.IsZero() && !start.After(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns now when a window is open, the start of the next window not on a blackout
+// date otherwise, or the zero time if there is none
+func (c *daemonConfig) nextWindow(now time.Time) time.Time {
+	if c.windowOpen(now) {
+		return now
+	}
+	var next time.Time
+	for _, w := range c.Windows {
+		start := w.schedule.next(now.In(c.location))
+		for i := 0; i < 1000 && !start.IsZero() && c.blackedOut(start); i++ {
+			start = w.schedule.next(start)
+		}
+		if !start.IsZero() && !c.blackedOut(start) && (next.IsZero() || start.Before(next)) {
+			next = start
+		}
+	}
+	return next
+}
+
+func newDaemon(config *daemonConfig, planner, roller fleetRunner) *daemon {
+	d := &daemon{
+		config:  config,
+		planner: planner,
+		roller:  roller,
+		status:  make(map[string]*daemonClusterStatus),
+	}
+	for _, c := range config.Clusters {
+		d.status[c.Name] = &daemonClusterStatus{Name: c.Name}
+	}
+	return d
+}
+
+// Checks every cluster which is not rolling for drift, and starts rolling the drifted
+// ones if a window is open and fewer than MaxConcurrentRolls clusters are rolling
+func (d *daemon) tick(now time.Time) {
+	open := d.config.windowOpen(now)
+	for _, c := range d.config.Clusters {
+		d.mu.Lock()
+		status := d.status[c.Name]
+		rolling := status.Rolling
+		d.mu.Unlock()
+		if rolling {
+			continue
+		}
+
+		run, err := d.planner.rollCluster(c)
+		drift := 0
+		if run != nil {
+			for _, component := range run.Components {
+				drift += component.Total
+			}
+		}
+
+		d.mu.Lock()
+		status.LastCheck = now
+		status.CheckError = errorString(err)
+		status.Drift = drift
+		start := err == nil && drift > 0 && open && d.rolling < d.config.MaxConcurrentRolls
+		if start {
+			status.Rolling = true
+			d.rolling++
+		}
+		d.mu.Unlock()
+
+		switch {
+		case err != nil:
+			glog.Errorf("An error occurred checking cluster %s for drift.\nError %s", c.Name, err)
+		case drift == 0:
+			glog.V(2).Infof("Cluster %s is up to date", c.Name)
+		case !open:
+			glog.Infof("Cluster %s has %d instances to replace, waiting for a maintenance window", c.Name, drift)
+		case !start:
+			glog.Infof("Cluster %s has %d instances to replace, waiting for one of the %d rolls in progress to finish",
+				c.Name, drift, d.config.MaxConcurrentRolls)
+		default:
+			glog.Infof("Cluster %s has %d instances to replace, rolling it", c.Name, drift)
+			d.wg.Add(1)
+			go d.roll(c)
+		}
+	}
+}
+
+func (d *daemon) roll(c fleetCluster) {
+	defer d.wg.Done()
+
+	start := time.Now()
+	run, err := d.roller.rollCluster(c)
+	result := newFleetClusterReport("", c, start, run, err)
+	if result.Status == fleetFailure {
+		glog.Errorf("The roll of cluster %s failed: %s", c.Name, result.Error)
+	} else {
+		glog.Infof("The roll of cluster %s succeeded", c.Name)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	status := d.status[c.Name]
+	status.Rolling = false
+	status.LastRoll = &result
+	d.rolling--
+}
+
+func (d *daemon) currentStatus(now time.Time) daemonStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	s := daemonStatus{
+		WindowOpen:         d.config.windowOpen(now),
+		NextWindow:         d.config.nextWindow(now),
+		Rolling:            d.rolling,
+		MaxConcurrentRolls: d.config.MaxConcurrentRolls,
+	}
+	for _, c := range d.config.Clusters {
+		s.Clusters = append(s.Clusters, *d.status[c.Name])
+	}
+	return s
+}
+
+func (d *daemon) register(server *rollerServer) {
+	server.handle("/daemon", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, d.currentStatus(time.Now()))
+	})
+}
+
+// Checks the clusters every CheckIntervalSeconds until stop is closed, then waits for
+// the rolls in progress
+func (d *daemon) run(stop <-chan struct{}) {
+	ticker := time.NewTicker(time.Duration(d.config.CheckIntervalSeconds) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		d.tick(time.Now())
+		select {
+		case <-stop:
+			glog.Info("Stopping the daemon, waiting for the rolls in progress")
+			d.wg.Wait()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Runs the roller as a daemon with the config file at path, until stop is closed
+func runDaemon(path string, stop <-chan struct{}) {
+	config, err := loadDaemonConfig(path)
+	if err != nil {
+		glog.Fatalf("Unable to load the daemon config: %s", err)
+	}
+	binary, err := os.Executable()
+	if err != nil {
+		glog.Fatalf("Unable to find the roller binary: %s", err)
+	}
+	d := newDaemon(config,
+		execFleetRunner{binary: binary, args: []string{"-plan"}, out: os.Stderr},
+		execFleetRunner{binary: binary, out: os.Stderr})
+
+	if httpAddr != "" {
+		server := newRollerServer(httpAddr, httpToken)
+		d.register(server)
+		err = server.start()
+		if err != nil {
+			glog.Fatalf("Unable to start the http server: %s", err)
+		}
+		defer server.stop()
+	}
+
+	glog.Infof("Watching %d clusters, next maintenance window at %v", len(config.Clusters), config.nextWindow(time.Now()))
+	d.run(stop)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeDaemonRunner struct {
+	mu      sync.Mutex
+	drift   map[string]int
+	rolled  []string
+	release chan struct{}
+}
+
+func (r *fakeDaemonRunner) rollCluster(c fleetCluster) (*runModel, error) {
+	r.mu.Lock()
+	drift, ok := r.drift[c.Name]
+	r.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("exit status 255")
+	}
+	return &runModel{Status: planStatus, Components: []componentModel{{Name: "k8s-node", Total: drift}}}, nil
+}
+
+func (r *fakeDaemonRunner) rollClusterBlocking(c fleetCluster) (*runModel, error) {
+	r.mu.Lock()
+	r.rolled = append(r.rolled, c.Name)
+	r.mu.Unlock()
+	<-r.release
+	return &runModel{Status: fleetSuccess}, nil
+}
+
+type fakeDaemonRoller struct{ *fakeDaemonRunner }
+
+func (r fakeDaemonRoller) rollCluster(c fleetCluster) (*runModel, error) {
+	return r.rollClusterBlocking(c)
+}
+
+func fakeDaemonConfig(t *testing.T) *daemonConfig {
+	path := writeRollerConfig(t, `{
+  "maxConcurrentRolls": 1,
+  "windows": [{"schedule": "0 2 * * *", "durationMinutes": 240}],
+  "blackoutDates": ["2026-12-24"],
+  "clusters": [
+    {"name": "a", "profile": "dev", "region": "us-east-1", "cluster": "a", "kubernetesServer": "https://a"},
+    {"name": "b", "profile": "dev", "region": "us-east-1", "cluster": "b", "kubernetesServer": "https://b"},
+    {"name": "c", "profile": "dev", "region": "us-east-1", "cluster": "c", "kubernetesServer": "https://c"},
+    {"name": "d", "profile": "dev", "region": "us-east-1", "cluster": "d", "kubernetesServer": "https://d"}
+  ]
+}`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	config, err := loadDaemonConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+func TestDaemonWindows(t *testing.T) {
+	config := fakeDaemonConfig(t)
+
+	tests := map[time.Time]bool{
+		time.Date(2026, 12, 22, 2, 0, 0, 0, time.UTC):  true,
+		time.Date(2026, 12, 22, 5, 59, 0, 0, time.UTC): true,
+		time.Date(2026, 12, 22, 6, 0, 0, 0, time.UTC):  false,
+		time.Date(2026, 12, 22, 1, 59, 0, 0, time.UTC): false,
+		time.Date(2026, 12, 24, 3, 0, 0, 0, time.UTC):  false,
+	}
+	for now, expected := range tests {
+		if config.windowOpen(now) != expected {
+			t.Errorf("expected the window open at %v to be %t", now, expected)
+		}
+	}
+
+	now := time.Date(2026, 12, 23, 7, 0, 0, 0, time.UTC)
+	expected := time.Date(2026, 12, 25, 2, 0, 0, 0, time.UTC)
+	if next := config.nextWindow(now); !next.Equal(expected) {
+		t.Errorf("expected the next window to skip the blackout date and open at %v, got %v", expected, next)
+	}
+	now = time.Date(2026, 12, 23, 3, 0, 0, 0, time.UTC)
+	if next := config.nextWindow(now); !next.Equal(now) {
+		t.Errorf("expected the current window to be returned, got %v", next)
+	}
+}
+
+func TestDaemonTick(t *testing.T) {
+	config := fakeDaemonConfig(t)
+	planner := &fakeDaemonRunner{drift: map[string]int{"a": 0, "b": 3, "c": 2}, release: make(chan struct{})}
+	d := newDaemon(config, planner, fakeDaemonRoller{planner})
+
+	// Outside of the windows the drift is recorded but nothing rolls
+	d.tick(time.Date(2026, 12, 22, 12, 0, 0, 0, time.UTC))
+	status := d.currentStatus(time.Date(2026, 12, 22, 12, 0, 0, 0, time.UTC))
+	if status.WindowOpen || status.Rolling != 0 || status.Clusters[1].Drift != 3 {
+		t.Errorf("expected the drift of b to be recorded without rolling it, got %+v", status)
+	}
+	if !strings.Contains(status.Clusters[3].CheckError, "exit status 255") {
+		t.Errorf("expected the check of d to fail, got %+v", status.Clusters[3])
+	}
+
+	// In a window only one of the drifted clusters rolls at a time
+	now := time.Date(2026, 12, 23, 2, 30, 0, 0, time.UTC)
+	d.tick(now)
+	d.tick(now)
+	status = d.currentStatus(now)
+	if status.Rolling != 1 || !status.Clusters[1].Rolling || status.Clusters[2].Rolling {
+		t.Errorf("expected only b to be rolling, got %+v", status)
+	}
+
+	planner.release <- struct{}{}
+	d.mu.Lock()
+	for d.rolling > 0 {
+		d.mu.Unlock()
+		time.Sleep(time.Millisecond)
+		d.mu.Lock()
+	}
+	d.mu.Unlock()
+
+	status = d.currentStatus(now)
+	if status.Clusters[1].LastRoll == nil || status.Clusters[1].LastRoll.Status != fleetSuccess {
+		t.Errorf("expected the roll of b to be recorded, got %+v", status.Clusters[1])
+	}
+
+	planner.mu.Lock()
+	planner.drift["b"] = 0
+	planner.mu.Unlock()
+	d.tick(now)
+	status = d.currentStatus(now)
+	if !status.Clusters[2].Rolling {
+		t.Errorf("expected c to be rolling once b is done, got %+v", status)
+	}
+	close(planner.release)
+	d.wg.Wait()
+
+	if strings.Join(planner.rolled, ",") != "b,c" {
+		t.Errorf("expected b then c to be rolled, got %v", planner.rolled)
+	}
+}
+
+func TestLoadDaemonConfigInvalid(t *testing.T) {
+	cluster := `{"profile": "dev", "region": "us-east-1", "cluster": "a", "kubernetesServer": "https://a"}`
+	tests := map[string]string{
+		`{"clusters": [` + cluster + `]}`: "no maintenance windows",
+		`{"windows": [{"schedule": "0 2 * *", "durationMinutes": 60}], "clusters": [` + cluster + `]}`:                               "expected 5 fields",
+		`{"windows": [{"schedule": "0 2 * * *"}], "clusters": [` + cluster + `]}`:                                                    "needs a durationMinutes",
+		`{"windows": [{"schedule": "0 2 * * *", "durationMinutes": 60}], "blackoutDates": ["24/12"], "clusters": [` + cluster + `]}`: "invalid blackout date",
+		`{"windows": [{"schedule": "0 2 * * *", "durationMinutes": 60}], "timezone": "Mars/Olympus", "clusters": [` + cluster + `]}`: "unknown timezone",
+		`{"windows": [{"schedule": "0 2 * * *", "durationMinutes": 60}]}`:                                                            "no clusters",
+	}
+	for content, expected := range tests {
+		path := writeRollerConfig(t, content)
+		_, err := loadDaemonConfig(path)
+		os.RemoveAll(filepath.Dir(path))
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected an error containing %q, got %v", expected, err)
+		}
+	}
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/golang/glog"
+)
+
+// What happened to an instance during the roll, in the order it usually happens
+const (
+	eventLaunched   = "launched"
+	eventHealthy    = "healthy"
+	eventCordoned   = "cordoned"
+	eventDrained    = "drained"
+	eventTerminated = "terminated"
+	// The spot instance was reclaimed by EC2 rather than terminated by the roll
+	eventReclaimed = "reclaimed"
+)
+
+const (
+	// Number of log lines shown on the dashboard
+	dashboardLogLines = 200
+	// How much of the end of the log file the lines are read from
+	dashboardLogBytes = 256 * 1024
+	// How long the ASG capacities shown on the dashboard are cached, to spare the AWS api
+	dashboardCapacityTTL = 15 * time.Second
+)
+
+type instanceEvent struct {
+	Time      time.Time
+	Component string
+	Instance  string
+	Event     string
+}
+
+func (s *rollerState) recordInstanceEvent(c *componentType, instanceID, event string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, instanceEvent{Time: time.Now(), Component: c.name, Instance: instanceID, Event: event})
+}
+
+func (s *rollerState) instanceEvents() []instanceEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]instanceEvent(nil), s.events...)
+}
+
+// Last lines of the log file glog writes to at path
+type logTail struct {
+	path string
+	max  int
+}
+
+func (l *logTail) recent() []string {
+	glog.Flush()
+	f, err := os.Open(l.path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	// The last lines are in the end of the file, which can grow large over a long roll
+	offset := int64(0)
+	if info, err := f.Stat(); err == nil && info.Size() > dashboardLogBytes {
+		offset = info.Size() - dashboardLogBytes
+		f.Seek(offset, io.SeekStart)
+	}
+	reader := bufio.NewReader(f)
+	if offset > 0 {
+		// Starting in the middle of a line
+		reader.ReadString('\n')
+	}
+	var lines []string
+	for {
+		line, err := reader.ReadString('\n')
+		if line != "" {
+			lines = append(lines, line)
+		}
+		if err != nil {
+			break
+		}
+	}
+	if len(lines) > l.max {
+		lines = lines[len(lines)-l.max:]
+	}
+	return lines
+}
+
+// Has glog write to a log file in a temporary directory on top of stderr, for the
+// dashboard to show its last lines. Must be called before anything gets logged
+// concurrently.
+func captureLogs() (*logTail, error) {
+	dir, err := ioutil.TempDir("", "kubernetes-updater-logs")
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range [][2]string{{"log_dir", dir}, {"alsologtostderr", "true"}, {"logtostderr", "false"}} {
+		err = flag.Set(f[0], f[1])
+		if err != nil {
+			return nil, err
+		}
+	}
+	// glog links <program>.INFO to the current log file
+	return &logTail{path: filepath.Join(dir, filepath.Base(os.Args[0])+".INFO"), max: dashboardLogLines}, nil
+}
+
+type asgCapacity struct {
+	Component string
+	ASG       string
+	Min       int64
+	Max       int64
+	Desired   int64
+	InService int
+	Instances int
+}
+
+type dashboardData struct {
+	Events     []instanceEvent
+	Capacities []asgCapacity
+	Logs       []string
+}
+
+// Web page supervising the roll, served on / next to the status api
+type dashboard struct {
+	mu           sync.Mutex
+	state        *rollerState
+	awsClient    *awsClient
+	logs         *logTail
+	capacities   []asgCapacity
+	capacitiesAt time.Time
+}
+
+func newDashboard(state *rollerState, awsClient *awsClient, logs *logTail) *dashboard {
+	return &dashboard{state: state, awsClient: awsClient, logs: logs}
+}
+
+// Current capacities of the ASGs of the components, cached for dashboardCapacityTTL
+func (d *dashboard) asgCapacities(now time.Time) []asgCapacity {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if now.Sub(d.capacitiesAt) < dashboardCapacityTTL {
+		return d.capacities
+	}
+
+	var capacities []asgCapacity
+	for _, c := range d.state.runModel("").Components {
+		for _, asg := range c.ASGs {
+			group, err := d.awsClient.autoscaling.getAutoscalingGroup(asg)
+			if err != nil {
+				glog.Errorf("an error occurred describing ASG %s for the dashboard.\nError %s", asg, err)
+				continue
+			}
+			capacity := asgCapacity{
+				Component: c.Name,
+				ASG:       asg,
+				Min:       aws.Int64Value(group.MinSize),
+				Max:       aws.Int64Value(group.MaxSize),
+				Desired:   aws.Int64Value(group.DesiredCapacity),
+				Instances: len(group.Instances),
+			}
+			for _, i := range group.Instances {
+				if aws.StringValue(i.LifecycleState) == "InService" {
+					capacity.InService++
+				}
+			}
+			capacities = append(capacities, capacity)
+		}
+	}
+	d.capacities = capacities
+	d.capacitiesAt = now
+	return capacities
+}
+
+func (d *dashboard) register(server *rollerServer) {
+	server.handleUnauthenticated("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, dashboardHTML)
+	})
+	server.handle("/dashboard/data", func(w http.ResponseWriter, r *http.Request) {
+		data := dashboardData{
+			Events:     d.state.instanceEvents(),
+			Capacities: d.asgCapacities(time.Now()),
+		}
+		if d.logs != nil {
+			data.Logs = d.logs.recent()
+		}
+		writeJSON(w, http.StatusOK, data)
+	})
+}
+
+// The page only holds the layout, everything shown comes from /status and /dashboard/data.
+// The ROLLER_HTTP_TOKEN is asked for when the api requires it.
+const dashboardHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>kubernetes-updater</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+h1 { font-size: 1.4em; }
+h2 { font-size: 1.1em; margin-top: 1.5em; }
+table { border-collapse: collapse; }
+td, th { padding: 0.2em 0.8em; text-align: left; border-bottom: 1px solid #ddd; }
+.bar { width: 300px; height: 14px; background: #eee; display: inline-block; vertical-align: middle; }
+.bar div { height: 100%; background: #2e8b57; }
+.failure .bar div { background: #c0392b; }
+.event-terminated { color: #c0392b; }
+.event-healthy { color: #2e8b57; }
+pre { background: #f6f6f6; padding: 1em; max-height: 25em; overflow: auto; font-size: 0.85em; }
+button { margin-right: 0.5em; }
+#error { color: #c0392b; }
+</style>
+</head>
+<body>
+<h1 id="title">kubernetes-updater</h1>
+<div id="summary"></div>
+<div id="error"></div>
+<p>
+<button onclick="control('pause')">Pause</button>
+<button onclick="control('resume')">Resume</button>
+<button onclick="abortRoll()">Abort</button>
+</p>
+<h2>Components</h2>
+<table id="components"></table>
+<h2>ASG capacities</h2>
+<table id="capacities"></table>
+<h2>Instances</h2>
+<table id="instances"></table>
+<h2>Logs</h2>
+<pre id="logs"></pre>
+<script>
+var token = sessionStorage.getItem("roller-token") || "";
+
+function text(s) {
+  var div = document.createElement("div");
+  div.textContent = s == null ? "" : String(s);
+  return div.innerHTML;
+}
+
+function api(method, path) {
+  return fetch(path, {method: method, headers: token ? {"Authorization": "Bearer " + token} : {}}).then(function(resp) {
+    if (resp.status == 401) {
+      token = prompt("ROLLER_HTTP_TOKEN") || "";
+      sessionStorage.setItem("roller-token", token);
+      throw new Error("unauthorized");
+    }
+    if (!resp.ok) {
+      return resp.text().then(function(t) { throw new Error(t); });
+    }
+    return resp.json();
+  });
+}
+
+function control(action, reason) {
+  var query = reason ? "?reason=" + encodeURIComponent(reason) : "";
+  api("POST", "/" + action + query).then(refresh, showError);
+}
+
+function abortRoll() {
+  var reason = prompt("Abort the roll? Reason:");
+  if (reason !== null) {
+    control("abort", reason);
+  }
+}
+
+function showError(err) {
+  document.getElementById("error").textContent = err.message;
+}
+
+function renderStatus(s) {
+  document.getElementById("title").textContent = "Rolling " + s.Cluster + " to " + s.AnsibleVersion;
+  var summary = "Started by " + s.Operator + ", " + Math.round(s.Duration / 6e10) + " minutes ago: " + s.Status;
+  if (s.Paused) summary += ", paused by " + s.PausedBy;
+  if (s.AbortReason) summary += ", aborted: " + s.AbortReason;
+  document.getElementById("summary").textContent = summary;
+
+  var rows = "<tr><th>Component</th><th>Phase</th><th>Progress</th><th>Replaced</th><th>Failures</th><th>Error</th></tr>";
+  (s.Components || []).forEach(function(c) {
+    var pct = c.Total ? Math.round(100 * c.Replaced / c.Total) : 100;
+    rows += "<tr class='" + text(c.Status) + "'><td>" + text(c.Name) + "</td><td>" + text(c.Phase) +
+      "</td><td><span class='bar'><div style='width:" + pct + "%'></div></span> " + pct + "%</td><td>" +
+      c.Replaced + "/" + c.Total + "</td><td>" + c.Failures + "</td><td>" + text(c.Error) + "</td></tr>";
+  });
+  document.getElementById("components").innerHTML = rows;
+}
+
+function renderData(d) {
+  var rows = "<tr><th>Component</th><th>ASG</th><th>Desired</th><th>In service</th><th>Instances</th><th>Min</th><th>Max</th></tr>";
+  (d.Capacities || []).forEach(function(c) {
+    rows += "<tr><td>" + text(c.Component) + "</td><td>" + text(c.ASG) + "</td><td>" + c.Desired + "</td><td>" +
+      c.InService + "</td><td>" + c.Instances + "</td><td>" + c.Min + "</td><td>" + c.Max + "</td></tr>";
+  });
+  document.getElementById("capacities").innerHTML = rows;
+
+  var instances = {}, order = [];
+  (d.Events || []).forEach(function(e) {
+    if (!instances[e.Instance]) {
+      instances[e.Instance] = {component: e.Component, events: []};
+      order.push(e.Instance);
+    }
+    instances[e.Instance].events.push(e);
+  });
+  rows = "<tr><th>Instance</th><th>Component</th><th>Timeline</th></tr>";
+  order.reverse().forEach(function(id) {
+    var timeline = instances[id].events.map(function(e) {
+      return "<span class='event-" + text(e.Event) + "'>" + text(e.Event) + " " + new Date(e.Time).toLocaleTimeString() + "</span>";
+    }).join(" &rarr; ");
+    rows += "<tr><td>" + text(id) + "</td><td>" + text(instances[id].component) + "</td><td>" + timeline + "</td></tr>";
+  });
+  document.getElementById("instances").innerHTML = rows;
+
+  var logs = document.getElementById("logs");
+  var atBottom = logs.scrollTop + logs.clientHeight >= logs.scrollHeight - 5;
+  logs.textContent = (d.Logs || []).join("");
+  if (atBottom) logs.scrollTop = logs.scrollHeight;
+}
+
+function refresh() {
+  Promise.all([api("GET", "/status"), api("GET", "/dashboard/data")]).then(function(results) {
+    document.getElementById("error").textContent = "";
+    renderStatus(results[0]);
+    renderData(results[1]);
+  }, showError);
+}
+
+refresh();
+setInterval(refresh, 5000);
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+)
+
+func writeLogFile(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "roller-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.WriteString(content)
+	return f.Name()
+}
+
+func TestLogTail(t *testing.T) {
+	var content bytes.Buffer
+	for i := 1; i <= 5; i++ {
+		fmt.Fprintf(&content, "line %d\n", i)
+	}
+	content.WriteString("partial")
+	path := writeLogFile(t, content.String())
+	defer os.Remove(path)
+
+	l := &logTail{path: path, max: 3}
+	expected := []string{"line 4\n", "line 5\n", "partial"}
+	if fmt.Sprint(l.recent()) != fmt.Sprint(expected) {
+		t.Errorf("expected the last 3 lines, got %q", l.recent())
+	}
+
+	// Only the end of a large file is read, from the start of a line
+	content.Reset()
+	for i := 1; i <= 50000; i++ {
+		fmt.Fprintf(&content, "line %d\n", i)
+	}
+	large := writeLogFile(t, content.String())
+	defer os.Remove(large)
+	l = &logTail{path: large, max: 100000}
+	lines := l.recent()
+	if len(lines) == 0 || len(lines) >= 50000 || !strings.HasPrefix(lines[0], "line ") || lines[len(lines)-1] != "line 50000\n" {
+		t.Errorf("expected whole lines from the end of the file, got %d lines from %q", len(lines), lines[0])
+	}
+
+	l = &logTail{path: path + "-missing", max: 3}
+	if len(l.recent()) != 0 {
+		t.Errorf("expected no lines before glog creates the file")
+	}
+}
+
+func TestDashboard(t *testing.T) {
+	defer func() { fakeDescribeAutoScalingGroupsOutput = &autoscaling.DescribeAutoScalingGroupsOutput{} }()
+	fakeDescribeAutoScalingGroupsOutput = &autoscaling.DescribeAutoScalingGroupsOutput{
+		AutoScalingGroups: []*autoscaling.Group{
+			{
+				AutoScalingGroupName: aws.String("k8s-node-asg"),
+				MinSize:              aws.Int64(100),
+				MaxSize:              aws.Int64(200),
+				DesiredCapacity:      aws.Int64(125),
+				Instances: []*autoscaling.Instance{
+					{InstanceId: aws.String("i-1"), LifecycleState: aws.String("InService")},
+					{InstanceId: aws.String("i-2"), LifecycleState: aws.String("Pending")},
+				},
+			},
+		},
+	}
+
+	s := fakeApprovalState(nil)
+	s.components[1].asgs = []string{"k8s-node-asg"}
+	s.recordInstanceEvent(s.components[1], "i-old", eventCordoned)
+	s.recordInstanceEvent(s.components[1], "i-old", eventTerminated)
+	awsClient := &awsClient{autoscaling: newAWSAutoscalingController(newFakeAWSAutoscalingClient())}
+	path := writeLogFile(t, "I1019 roller started\n")
+	defer os.Remove(path)
+	logs := &logTail{path: path, max: 10}
+
+	server := newRollerServer("", "")
+	newDashboard(s, awsClient, logs).register(server)
+	ts := httptest.NewServer(server.mux)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(page), "/dashboard/data") {
+		t.Errorf("expected the dashboard page to be served")
+	}
+	resp, _ = http.Get(ts.URL + "/missing")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected unknown paths not to serve the dashboard, got %d", resp.StatusCode)
+	}
+
+	resp, err = http.Get(ts.URL + "/dashboard/data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data := dashboardData{}
+	err = json.NewDecoder(resp.Body).Decode(&data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data.Events) != 2 || data.Events[1].Event != eventTerminated || data.Events[1].Component != "k8s-node" {
+		t.Errorf("expected the instance events, got %+v", data.Events)
+	}
+	if len(data.Capacities) != 1 || data.Capacities[0].Desired != 125 || data.Capacities[0].InService != 1 || data.Capacities[0].Instances != 2 {
+		t.Errorf("expected the capacity of k8s-node-asg, got %+v", data.Capacities)
+	}
+	if len(data.Logs) != 1 {
+		t.Errorf("expected the logs, got %v", data.Logs)
+	}
+}
+
+func TestDashboardCapacityCache(t *testing.T) {
+	s := fakeApprovalState(nil)
+	s.components[1].asgs = []string{"k8s-node-asg"}
+	d := newDashboard(s, &awsClient{autoscaling: newAWSAutoscalingController(newFakeAWSAutoscalingClient())}, nil)
+
+	now := time.Now()
+	d.capacities = []asgCapacity{{ASG: "cached"}}
+	d.capacitiesAt = now.Add(-time.Second)
+	if c := d.asgCapacities(now); len(c) != 1 || c[0].ASG != "cached" {
+		t.Errorf("expected the cached capacities, got %+v", c)
+	}
+	if c := d.asgCapacities(now.Add(dashboardCapacityTTL)); len(c) == 1 && c[0].ASG == "cached" {
+		t.Errorf("expected the capacities to be refreshed once expired")
+	}
+}
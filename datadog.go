@@ -1,35 +1,264 @@
 package main
 
 import (
+	"fmt"
+	"math"
 	"time"
 
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/golang/glog"
 	"gopkg.in/zorkian/go-datadog-api.v2"
 )
 
+const (
+	// Rough time it takes for a replacement instance to launch, provision and report healthy
+	instanceReplacementEstimate = 10 * time.Minute
+	// Rough time it takes to drain a single kubernetes node
+	nodeDrainEstimate = time.Minute
+	// Extra time added on top of every downtime estimate
+	downtimePadding = 30 * time.Minute
+	// Extend the cluster downtime once less than this is left on it
+	downtimeExtensionMargin = 15 * time.Minute
+	// Length of the per host downtimes created when instances are terminated
+	hostDowntimeDuration = time.Hour
+)
+
 type ddClientConfig struct {
 	client *datadog.Client
 }
 
+type ddMetric struct {
+	name  string
+	value float64
+	tags  []string
+}
+
 func newDataDogClient(apiKey string, appKey string) *ddClientConfig {
 	c := datadog.NewClient(apiKey, appKey)
 	return &ddClientConfig{client: c}
 }
 
-func (c ddClientConfig) startDownTime(scope []string) (int, error) {
-	start := time.Now().Unix()
-	// Use default of 3 hours for downtime
-	end := start + 10800
+func (c ddClientConfig) startDownTime(scope []string, duration time.Duration) (int, error) {
+	start := time.Now()
+	end := start.Add(duration)
 
 	downtime, err := c.client.CreateDowntime(&datadog.Downtime{
-		Message: datadog.String("Downtime for kubernetes cluster roll"),
+		Message: datadog.String(fmt.Sprintf("Downtime for kubernetes cluster roll of %s to ansible version %s", kubernetesCluster, ansibleVersion)),
 		Scope:   scope,
-		End:     datadog.Int(int(end)),
+		Start:   datadog.Int(int(start.Unix())),
+		End:     datadog.Int(int(end.Unix())),
 	})
 
 	return downtime.GetId(), err
 }
 
+func (c ddClientConfig) startHostDownTime(host string, duration time.Duration) (int, error) {
+	return c.startDownTime([]string{fmt.Sprintf("host:%s", host)}, duration)
+}
+
+func (c ddClientConfig) extendDownTime(id int, end time.Time) error {
+	downtime, err := c.client.GetDowntime(id)
+	if err != nil {
+		return err
+	}
+	downtime.End = datadog.Int(int(end.Unix()))
+	return c.client.UpdateDowntime(downtime)
+}
+
 func (c ddClientConfig) endDownTime(id int) error {
 	err := c.client.DeleteDowntime(id)
 	return err
 }
+
+// Posts an event to the datadog event stream. The alertType is one of
+// info, success, warning or error.
+func (c ddClientConfig) postEvent(title, text, alertType string, tags []string) error {
+	_, err := c.client.PostEvent(&datadog.Event{
+		Title:       datadog.String(title),
+		Text:        datadog.String(text),
+		AlertType:   datadog.String(alertType),
+		Aggregation: datadog.String(fmt.Sprintf("roller-%s", kubernetesCluster)),
+		SourceType:  datadog.String("kubernetes-updater"),
+		Tags:        tags,
+	})
+	return err
+}
+
+func (c ddClientConfig) submitMetrics(metrics []ddMetric) error {
+	now := float64(time.Now().Unix())
+	series := []datadog.Metric{}
+	for _, m := range metrics {
+		series = append(series, datadog.Metric{
+			Metric: datadog.String(m.name),
+			Points: []datadog.DataPoint{{datadog.Float64(now), datadog.Float64(m.value)}},
+			Type:   datadog.String("gauge"),
+			Tags:   m.tags,
+		})
+	}
+	return c.client.PostMetrics(series)
+}
+
+// Returns the most recent value of a metric query over the last window, and false
+// when the query returned no data point
+func (c ddClientConfig) queryMetric(query string, window time.Duration) (float64, bool, error) {
+	to := time.Now()
+	series, err := c.client.QueryMetrics(to.Add(-window).Unix(), to.Unix(), query)
+	if err != nil {
+		return 0, false, err
+	}
+	for _, serie := range series {
+		for i := len(serie.Points) - 1; i >= 0; i-- {
+			if serie.Points[i][1] != nil {
+				return *serie.Points[i][1], true, nil
+			}
+		}
+	}
+	return 0, false, nil
+}
+
+// Tags attached to every event and metric sent for a roll, optionally scoped to a component
+func ddTags(component string) []string {
+	tags := []string{
+		fmt.Sprintf("kubernetescluster:%s", kubernetesCluster),
+		fmt.Sprintf("ansible_version:%s", ansibleVersion),
+	}
+	if component != "" {
+		tags = append(tags, fmt.Sprintf("component:%s", component))
+	}
+	return tags
+}
+
+// Datadog reports EC2 hosts by their private DNS name, fall back to the instance ID
+// when it is not known
+func ddHostName(instanceID string, instances []*ec2.Instance) string {
+	for _, i := range instances {
+		if *i.InstanceId == instanceID && i.PrivateDnsName != nil && *i.PrivateDnsName != "" {
+			return *i.PrivateDnsName
+		}
+	}
+	return instanceID
+}
+
+// Estimates how long rolling the components of the graph will take based on the number
+// of instances in the inventory for each of them. Components wait on their prerequisites
+// and otherwise roll in parallel.
+func estimateRollDuration(inventory []*ec2.Instance, graph *componentGraph) time.Duration {
+	estimates := make(map[string]time.Duration)
+
+	for _, component := range graph.components {
+		spec := lookupComponentSpec(component)
+		count := len(spec.selectInstances(inventory))
+
+		switch spec.Strategy {
+		case strategyBlueGreen:
+			// The new ASGs launch everything at once and the old ones scale in together
+			estimates[component] = instanceReplacementEstimate + time.Duration(count)*nodeDrainEstimate
+		case strategyVerifyAndTerminate:
+			batches := 1
+			if count > remainingThreshold {
+				batches += int(math.Ceil(float64(count-remainingThreshold) / float64(desiredCountStep)))
+			}
+			estimates[component] = time.Duration(batches)*instanceReplacementEstimate +
+				time.Duration(count)*(nodeDrainEstimate+terminationWaitPeriod)
+		default:
+			estimates[component] = time.Duration(count) * instanceReplacementEstimate
+		}
+	}
+
+	// The graph was validated when built, so it has no cycle
+	stages, _ := graph.stages()
+	finish := make(map[string]time.Duration)
+	var duration time.Duration
+	for _, stage := range stages {
+		for _, component := range stage {
+			var start time.Duration
+			for _, d := range graph.dependencies[component] {
+				if finish[d] > start {
+					start = finish[d]
+				}
+			}
+			finish[component] = start + estimates[component]
+			if finish[component] > duration {
+				duration = finish[component]
+			}
+		}
+	}
+	return duration + downtimePadding
+}
+
+// Keeps the cluster downtime from expiring while the roll is still running, pushing
+// its end out by downtimePadding whenever it gets within downtimeExtensionMargin.
+func (s *rollerState) watchDownTime(stop <-chan struct{}) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if time.Until(s.downtimeEnd) > downtimeExtensionMargin {
+				continue
+			}
+			end := time.Now().Add(downtimeExtensionMargin + downtimePadding)
+			glog.V(4).Infof("Roll is overrunning the datadog downtime, extending it until %s", end.Format(time.RFC822))
+			err := s.dd.extendDownTime(s.downtimeID, end)
+			if err != nil {
+				glog.Errorf("an error occurred extending the datadog downtime.\nError %s", err)
+				continue
+			}
+			s.downtimeEnd = end
+		}
+	}
+}
+
+// Posts the outcome of a component from a snapshot of it taken under the state lock
+func (s *rollerState) ddComponentEvent(c componentModel) {
+	title := fmt.Sprintf("Roll of %s completed on %s", c.Name, kubernetesCluster)
+	text := fmt.Sprintf("Component %s replaced %d instances in %v", c.Name, c.Replaced, c.Duration.Round(time.Second))
+	alertType := "success"
+	if c.Status != statusSuccess {
+		title = fmt.Sprintf("Roll of %s failed on %s", c.Name, kubernetesCluster)
+		text = fmt.Sprintf("%s\nError: %s", text, c.Error)
+		alertType = "error"
+	}
+
+	err := s.dd.postEvent(title, text, alertType, ddTags(c.Name))
+	if err != nil {
+		glog.Errorf("an error occurred posting the datadog event for %s.\nError %s", c.Name, err)
+	}
+}
+
+// Submits duration, replaced instance and failure metrics for the roll and each component,
+// and the retries of the AWS calls
+func (s *rollerState) ddSubmitMetrics() error {
+	var metrics []ddMetric
+	var replaced, failures, failedComponents int
+
+	s.mu.Lock()
+	for _, c := range s.components {
+		failed := 0
+		if !c.status {
+			failed = 1
+		}
+		metrics = append(metrics,
+			ddMetric{name: "roller.component.duration", value: c.finish.Sub(c.start).Seconds(), tags: ddTags(c.name)},
+			ddMetric{name: "roller.component.replaced", value: float64(c.replaced), tags: ddTags(c.name)},
+			ddMetric{name: "roller.component.failures", value: float64(c.failures), tags: ddTags(c.name)},
+			ddMetric{name: "roller.component.failed", value: float64(failed), tags: ddTags(c.name)},
+		)
+		replaced += c.replaced
+		failures += c.failures
+		failedComponents += failed
+	}
+	s.mu.Unlock()
+
+	metrics = append(metrics,
+		ddMetric{name: "roller.duration", value: time.Since(s.startTime).Seconds(), tags: ddTags("")},
+		ddMetric{name: "roller.replaced", value: float64(replaced), tags: ddTags("")},
+		ddMetric{name: "roller.failures", value: float64(failures), tags: ddTags("")},
+		ddMetric{name: "roller.failed_components", value: float64(failedComponents), tags: ddTags("")},
+	)
+	metrics = append(metrics, rollerRetryer.ddMetrics()...)
+	return s.dd.submitMetrics(metrics)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func fakeComponentInventory(component string, count int) []*ec2.Instance {
+	var instances []*ec2.Instance
+	for i := 0; i < count; i++ {
+		instances = append(instances, &ec2.Instance{
+			InstanceId: aws.String("i-fake-instanceid"),
+			Tags: []*ec2.Tag{
+				{
+					Key:   aws.String("ServiceComponent"),
+					Value: aws.String(component),
+				},
+			},
+		})
+	}
+	return instances
+}
+
+func TestEstimateRollDuration(t *testing.T) {
+	var inventory []*ec2.Instance
+	inventory = append(inventory, fakeComponentInventory("etcd", 3)...)
+	inventory = append(inventory, fakeComponentInventory("k8s-master", 2)...)
+
+	dependencies, err := parseComponentOrder(defaultComponentOrder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	graph, err := newComponentGraph([]string{"etcd", "k8s-master"}, dependencies)
+	if err != nil {
+		t.Fatal(err)
+	}
+	estimate := estimateRollDuration(inventory, graph)
+	expected := 3*instanceReplacementEstimate + downtimePadding
+	if estimate != expected {
+		t.Errorf("expected %v, got %v", expected, estimate)
+	}
+
+	inventory = append(inventory, fakeComponentInventory("k8s-node", 20)...)
+	graph, err = newComponentGraph([]string{"etcd", "k8s-master", "k8s-node"}, dependencies)
+	if err != nil {
+		t.Fatal(err)
+	}
+	estimate = estimateRollDuration(inventory, graph)
+	// 2 masters, then 1 batch for the last 10 nodes plus 2 batches of 5
+	expected = 2*instanceReplacementEstimate + 3*instanceReplacementEstimate +
+		20*(nodeDrainEstimate+terminationWaitPeriod) + downtimePadding
+	if estimate != expected {
+		t.Errorf("expected %v, got %v", expected, estimate)
+	}
+}
+
+func TestDdHostName(t *testing.T) {
+	instances := []*ec2.Instance{
+		{
+			InstanceId:     aws.String("i-fake-instanceid"),
+			PrivateDnsName: aws.String("ip-10-0-0-1.ec2.internal"),
+		},
+	}
+	if host := ddHostName("i-fake-instanceid", instances); host != "ip-10-0-0-1.ec2.internal" {
+		t.Errorf("expected ip-10-0-0-1.ec2.internal, got %s", host)
+	}
+	if host := ddHostName("i-missing-instanceid", instances); host != "i-missing-instanceid" {
+		t.Errorf("expected i-missing-instanceid, got %s", host)
+	}
+}
+
+func TestDdTags(t *testing.T) {
+	kubernetesCluster = "fake-cluster"
+	ansibleVersion = "fake-version"
+	tags := ddTags("etcd")
+	if len(tags) != 3 || tags[2] != "component:etcd" {
+		t.Errorf("unexpected tags %v", tags)
+	}
+	if len(ddTags("")) != 2 {
+		t.Errorf("expected no component tag, got %v", ddTags(""))
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/golang/glog"
+)
+
+// Tags of the ASGs switched by a launch fallback, with the instance types and subnets
+// they had before. The instance types are empty for an ASG launching its launch
+// template alone.
+const (
+	rollerTagOriginalInstanceTypes = "roller:original-instance-types"
+	rollerTagOriginalSubnets       = "roller:original-subnets"
+)
+
+// Causes of the failed launches
+const (
+	// No capacity left for the instance type in the AZ
+	launchCauseCapacity = "capacity"
+	// An account limit such as the running vCPUs was reached
+	launchCauseQuota = "quota"
+	// The launch template, AMI or other launch parameters are invalid
+	launchCauseConfiguration = "configuration"
+	launchCauseUnknown       = "unknown"
+)
+
+// Instance types and subnets the ASGs of a component switch to when they fail to
+// launch replacements for lack of capacity or quota
+type launchFallback struct {
+	InstanceTypes []string `json:"instanceTypes"`
+	Subnets       []string `json:"subnets"`
+}
+
+// A fallback applied to an ASG during the roll
+type appliedFallback struct {
+	ASG           string
+	InstanceTypes []string
+	Subnets       []string
+	// The failed launch which triggered it
+	Cause   string
+	Message string
+	Time    time.Time
+	Error   string
+}
+
+// Returned when an ASG failed to launch a replacement instance
+type launchFailureError struct {
+	component string
+	launch    launchEvent
+}
+
+func (e *launchFailureError) Error() string {
+	return fmt.Sprintf("launching a replacement %s instance in ASG %s failed (%s): %s",
+		e.component, e.launch.ASG, launchFailureCause(e.launch.Message), e.launch.Message)
+}
+
+// Sorts the status message of a failed launch activity into one of the launch causes
+func launchFailureCause(message string) string {
+	m := strings.ToLower(message)
+	switch {
+	case strings.Contains(m, "insufficientinstancecapacity"), strings.Contains(m, "unsupported"),
+		strings.Contains(m, "sufficient") && strings.Contains(m, "capacity"):
+		return launchCauseCapacity
+	case strings.Contains(m, "limitexceeded"), strings.Contains(m, "limit exceeded"),
+		strings.Contains(m, "quota"), strings.Contains(m, "vcpu limit"):
+		return launchCauseQuota
+	case strings.Contains(m, "launch template"), strings.Contains(m, "invalid"),
+		strings.Contains(m, "does not exist"), strings.Contains(m, "not authorized"):
+		return launchCauseConfiguration
+	}
+	return launchCauseUnknown
+}
+
+func (f launchFallback) validate(component string) error {
+	if len(f.InstanceTypes) == 0 && len(f.Subnets) == 0 {
+		return fmt.Errorf("a launchFallback of component %s has neither instanceTypes nor subnets", component)
+	}
+	return nil
+}
+
+// Applies the next launch fallback of the component to the ASG which failed to launch,
+// when the cause of the failure is one a fallback can help with. Returns whether the
+// ASG is worth waiting on again.
+func applyLaunchFallback(awsClient *awsClient, c *componentType, launch launchEvent) bool {
+	cause := launchFailureCause(launch.Message)
+	if cause != launchCauseCapacity && cause != launchCauseQuota {
+		return false
+	}
+
+	state.mu.Lock()
+	next := 0
+	for _, f := range c.fallbacks {
+		if f.ASG == launch.ASG {
+			next++
+		}
+	}
+	state.mu.Unlock()
+	if next >= len(c.spec.LaunchFallbacks) {
+		return false
+	}
+
+	fallback := c.spec.LaunchFallbacks[next]
+	applied := appliedFallback{
+		ASG:           launch.ASG,
+		InstanceTypes: fallback.InstanceTypes,
+		Subnets:       fallback.Subnets,
+		Cause:         cause,
+		Message:       launch.Message,
+		Time:          time.Now(),
+	}
+	group, err := awsClient.autoscaling.getAutoscalingGroup(launch.ASG)
+	if err == nil {
+		err = tagOriginalLaunchTargets(awsClient, group, fallback)
+	}
+	if err == nil {
+		err = awsClient.autoscaling.switchLaunchTargets(group, fallback.InstanceTypes, fallback.Subnets)
+	}
+	applied.Error = errorString(err)
+
+	state.mu.Lock()
+	c.fallbacks = append(c.fallbacks, applied)
+	state.mu.Unlock()
+
+	if err != nil {
+		glog.Errorf("an error occurred applying launch fallback %d to ASG %s.\nError %s", next+1, launch.ASG, err)
+		return false
+	}
+	glog.Infof("ASG %s failed to launch a %s instance for lack of %s, switched it to the instance types %v and subnets %v",
+		launch.ASG, c.name, cause, fallback.InstanceTypes, fallback.Subnets)
+	state.notify(notifyProgress, fmt.Sprintf("Launch fallback applied to %s on %s", launch.ASG, kubernetesCluster),
+		fmt.Sprintf("ASG %s of %s failed to launch an instance: %s. Switched it to the instance types %v and subnets %v, it is left that way after the roll until -cleanup puts back what it had.",
+			launch.ASG, c.name, launch.Message, fallback.InstanceTypes, fallback.Subnets), c.name)
+	return true
+}
+
+// Instance types the ASG launches on top of its launch template
+func launchInstanceTypes(group *autoscaling.Group) []string {
+	var types []string
+	if group.MixedInstancesPolicy == nil || group.MixedInstancesPolicy.LaunchTemplate == nil {
+		return types
+	}
+	for _, o := range group.MixedInstancesPolicy.LaunchTemplate.Overrides {
+		if o.InstanceType != nil {
+			types = append(types, *o.InstanceType)
+		}
+	}
+	return types
+}
+
+// Tags the ASG with the instance types and subnets the fallback is about to replace,
+// unless an earlier fallback already did
+func tagOriginalLaunchTargets(awsClient *awsClient, group *autoscaling.Group, fallback launchFallback) error {
+	tags := make(map[string]string)
+	if _, ok := asgTag(group, rollerTagOriginalInstanceTypes); !ok && len(fallback.InstanceTypes) > 0 {
+		tags[rollerTagOriginalInstanceTypes] = strings.Join(launchInstanceTypes(group), ",")
+	}
+	if _, ok := asgTag(group, rollerTagOriginalSubnets); !ok && len(fallback.Subnets) > 0 {
+		tags[rollerTagOriginalSubnets] = aws.StringValue(group.VPCZoneIdentifier)
+	}
+	if len(tags) == 0 {
+		return nil
+	}
+	err := awsClient.autoscaling.tagASG(aws.StringValue(group.AutoScalingGroupName), tags)
+	if err != nil {
+		return fmt.Errorf("unable to tag ASG %s with its original instance types and subnets: %s", aws.StringValue(group.AutoScalingGroupName), err)
+	}
+	return nil
+}
+
+// Puts back the instance types and subnets the ASG had before its launch fallbacks
+func restoreLaunchTargets(awsClient *awsClient, group *autoscaling.Group) error {
+	asg := aws.StringValue(group.AutoScalingGroupName)
+	types, restoreTypes := asgTag(group, rollerTagOriginalInstanceTypes)
+	subnets, restoreSubnets := asgTag(group, rollerTagOriginalSubnets)
+	if !restoreTypes && !restoreSubnets {
+		return nil
+	}
+
+	var instanceTypes, subnetIDs []string
+	var keys []string
+	if restoreTypes {
+		keys = append(keys, rollerTagOriginalInstanceTypes)
+		if types != "" {
+			instanceTypes = strings.Split(types, ",")
+		}
+	}
+	if restoreSubnets {
+		keys = append(keys, rollerTagOriginalSubnets)
+		subnetIDs = strings.Split(subnets, ",")
+	}
+
+	glog.Infof("Setting the instance types of ASG %s back to %v and its subnets to %v", asg, instanceTypes, subnetIDs)
+	var err error
+	if len(instanceTypes) > 0 || len(subnetIDs) > 0 {
+		err = awsClient.autoscaling.switchLaunchTargets(group, instanceTypes, subnetIDs)
+	}
+	if err == nil && restoreTypes && len(instanceTypes) == 0 {
+		err = awsClient.autoscaling.useLaunchTemplate(group)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to set the instance types and subnets of ASG %s back: %s", asg, err)
+	}
+	err = awsClient.autoscaling.untagASG(asg, keys)
+	if err != nil {
+		return fmt.Errorf("unable to remove the launch fallback tags of ASG %s: %s", asg, err)
+	}
+	return nil
+}
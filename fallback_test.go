@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+)
+
+func TestLaunchFailureCause(t *testing.T) {
+	tests := map[string]string{
+		"We currently do not have sufficient m5.large capacity in the Availability Zone you requested (us-east-1a).": launchCauseCapacity,
+		"InsufficientInstanceCapacity": launchCauseCapacity,
+		"You have requested more vCPU capacity than your current vCPU limit of 64 allows. VcpuLimitExceeded": launchCauseQuota,
+		"The image id '[ami-123]' does not exist. Launching EC2 instance failed.":                            launchCauseConfiguration,
+		"Something else happened": launchCauseUnknown,
+	}
+	for message, expected := range tests {
+		if cause := launchFailureCause(message); cause != expected {
+			t.Errorf("expected %s for %q, got %s", expected, message, cause)
+		}
+	}
+}
+
+func TestSwitchLaunchTargets(t *testing.T) {
+	defer func() { fakeUpdateAutoScalingGroupInput = nil }()
+	client := newAWSAutoscalingController(newFakeAWSAutoscalingClient())
+	template := &autoscaling.LaunchTemplateSpecification{LaunchTemplateName: aws.String("nodes"), Version: aws.String("$Latest")}
+
+	err := client.switchLaunchTargets(&autoscaling.Group{AutoScalingGroupName: aws.String("nodes"), LaunchTemplate: template}, []string{"m5a.large", "m4.large"}, []string{"subnet-1", "subnet-2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := fakeUpdateAutoScalingGroupInput
+	if input.MixedInstancesPolicy == nil || input.MixedInstancesPolicy.LaunchTemplate.LaunchTemplateSpecification != template ||
+		len(input.MixedInstancesPolicy.LaunchTemplate.Overrides) != 2 || aws.StringValue(input.VPCZoneIdentifier) != "subnet-1,subnet-2" {
+		t.Errorf("expected the launch template with the instance types in the subnets, got %+v", input)
+	}
+
+	// Only the subnets change
+	fakeUpdateAutoScalingGroupInput = nil
+	err = client.switchLaunchTargets(&autoscaling.Group{AutoScalingGroupName: aws.String("nodes")}, nil, []string{"subnet-3"})
+	if err != nil || fakeUpdateAutoScalingGroupInput.MixedInstancesPolicy != nil {
+		t.Errorf("expected only the subnets to change, got %+v, %v", fakeUpdateAutoScalingGroupInput, err)
+	}
+
+	err = client.switchLaunchTargets(&autoscaling.Group{AutoScalingGroupName: aws.String("nodes"), LaunchConfigurationName: aws.String("nodes")}, []string{"m5a.large"}, nil)
+	if err == nil {
+		t.Errorf("expected an error for a launch configuration")
+	}
+}
+
+func TestApplyLaunchFallback(t *testing.T) {
+	s := fakeApprovalState(nil)
+	defer func(st *rollerState) { state = st }(state)
+	state = s
+	defer func() {
+		fakeUpdateAutoScalingGroupInput = nil
+		fakeCreateOrUpdateTagsInputs = nil
+		fakeDescribeAutoScalingGroupsOutput = &autoscaling.DescribeAutoScalingGroupsOutput{}
+	}()
+	fakeDescribeAutoScalingGroupsOutput = &autoscaling.DescribeAutoScalingGroupsOutput{
+		AutoScalingGroups: []*autoscaling.Group{{
+			AutoScalingGroupName: aws.String("nodes"),
+			LaunchTemplate:       &autoscaling.LaunchTemplateSpecification{LaunchTemplateName: aws.String("nodes")},
+			VPCZoneIdentifier:    aws.String("subnet-1"),
+		}},
+	}
+
+	awsClient := &awsClient{autoscaling: newAWSAutoscalingController(newFakeAWSAutoscalingClient())}
+	source := &localLaunchSource{events: map[string][]launchEvent{}}
+	s.launchSource = source
+	c := &componentType{name: "k8s-node", asgs: []string{"nodes"}}
+	c.spec.LaunchFallbacks = []launchFallback{{InstanceTypes: []string{"m5a.large"}}}
+	w := waiter{what: "test", timeout: time.Second, interval: time.Millisecond}
+
+	batch := s.startReplacementBatch(c)
+	source.launch(launchEvent{ASG: "nodes", ActivityID: "a1", Status: "Failed", Message: "InsufficientInstanceCapacity"})
+	_, err := findBatchReplacements(context.Background(), w, batch, 1)
+	var failure *launchFailureError
+	if !errors.As(err, &failure) || !strings.Contains(err.Error(), "(capacity)") {
+		t.Fatalf("expected the launch failure with its cause, got %v", err)
+	}
+
+	// Launch template problems are not worth a fallback
+	if applyLaunchFallback(awsClient, c, launchEvent{ASG: "nodes", Message: "The image id does not exist"}) {
+		t.Errorf("expected no fallback for a launch template problem")
+	}
+
+	if !applyLaunchFallback(awsClient, c, failure.launch) {
+		t.Fatalf("expected the fallback to be applied")
+	}
+	if fakeUpdateAutoScalingGroupInput == nil || len(c.fallbacks) != 1 || c.fallbacks[0].Cause != launchCauseCapacity {
+		t.Errorf("expected the fallback in the report, got %+v", c.fallbacks)
+	}
+	// Only the instance types were switched, from the launch template alone
+	if len(fakeCreateOrUpdateTagsInputs) != 1 || len(fakeCreateOrUpdateTagsInputs[0].Tags) != 1 ||
+		aws.StringValue(fakeCreateOrUpdateTagsInputs[0].Tags[0].Key) != rollerTagOriginalInstanceTypes ||
+		aws.StringValue(fakeCreateOrUpdateTagsInputs[0].Tags[0].Value) != "" {
+		t.Errorf("expected the ASG tagged with its original instance types, got %v", fakeCreateOrUpdateTagsInputs)
+	}
+	if err := batch.skipFailures("nodes"); err != nil {
+		t.Fatal(err)
+	}
+	source.launch(launchEvent{ASG: "nodes", ActivityID: "a2", Instance: "i-2", Status: "Successful"})
+	instances, err := findBatchReplacements(context.Background(), w, batch, 1)
+	if err != nil || len(instances) != 1 {
+		t.Errorf("expected the instance launched after the fallback, got %v, %v", instances, err)
+	}
+
+	// Every fallback was used up
+	if applyLaunchFallback(awsClient, c, failure.launch) {
+		t.Errorf("expected no fallback left")
+	}
+}
+
+func TestRestoreLaunchTargets(t *testing.T) {
+	defer func() {
+		fakeUpdateAutoScalingGroupInput = nil
+		fakeDeleteASGTagsInputs = nil
+	}()
+	awsClient := &awsClient{autoscaling: newAWSAutoscalingController(newFakeAWSAutoscalingClient())}
+	template := &autoscaling.LaunchTemplateSpecification{LaunchTemplateName: aws.String("nodes")}
+	group := &autoscaling.Group{
+		AutoScalingGroupName: aws.String("nodes"),
+		MixedInstancesPolicy: &autoscaling.MixedInstancesPolicy{LaunchTemplate: &autoscaling.LaunchTemplate{
+			LaunchTemplateSpecification: template,
+			Overrides:                   []*autoscaling.LaunchTemplateOverrides{{InstanceType: aws.String("m5a.large")}},
+		}},
+		Tags: []*autoscaling.TagDescription{
+			{Key: aws.String(rollerTagOriginalInstanceTypes), Value: aws.String("m5.large,m4.large")},
+			{Key: aws.String(rollerTagOriginalSubnets), Value: aws.String("subnet-1,subnet-2")},
+		},
+	}
+
+	err := restoreLaunchTargets(awsClient, group)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := fakeUpdateAutoScalingGroupInput
+	if input == nil || strings.Join(launchInstanceTypes(&autoscaling.Group{MixedInstancesPolicy: input.MixedInstancesPolicy}), ",") != "m5.large,m4.large" ||
+		aws.StringValue(input.VPCZoneIdentifier) != "subnet-1,subnet-2" {
+		t.Errorf("expected the original instance types and subnets back, got %+v", input)
+	}
+	if len(fakeDeleteASGTagsInputs) != 1 || len(fakeDeleteASGTagsInputs[0].Tags) != 2 {
+		t.Errorf("expected the launch fallback tags removed, got %v", fakeDeleteASGTagsInputs)
+	}
+
+	// An ASG which launched its launch template alone gets it back
+	group.Tags = []*autoscaling.TagDescription{{Key: aws.String(rollerTagOriginalInstanceTypes), Value: aws.String("")}}
+	fakeUpdateAutoScalingGroupInput = nil
+	err = restoreLaunchTargets(awsClient, group)
+	if err != nil || fakeUpdateAutoScalingGroupInput.LaunchTemplate != template || fakeUpdateAutoScalingGroupInput.MixedInstancesPolicy != nil {
+		t.Errorf("expected the ASG back on its launch template, got %+v, %v", fakeUpdateAutoScalingGroupInput, err)
+	}
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Outcome of the roll of a cluster of the fleet
+const (
+	fleetSuccess = "success"
+	fleetFailure = "failure"
+	// Not rolled because the fleet rollout stopped before reaching it
+	fleetSkipped = "skipped"
+)
+
+// A cluster of the fleet, rolled by running the roller with its settings
+type fleetCluster struct {
+	Name    string `json:"name"`
+	Account string `json:"account"`
+	Profile string `json:"profile"`
+	Region  string `json:"region"`
+	// Role the roller of the cluster assumes, to reach clusters in other accounts
+	RoleARN          string `json:"roleArn"`
+	ExternalID       string `json:"externalId"`
+	Cluster          string `json:"cluster"`
+	KubernetesServer string `json:"kubernetesServer"`
+	// Name of the variable holding the kubernetes token of the cluster, KUBERNETES_TOKEN by default
+	KubernetesTokenEnv string `json:"kubernetesTokenEnv"`
+	// Any other roller variables, like ROLLER_COMPONENTS
+	Env map[string]string `json:"env"`
+}
+
+// Clusters rolled together, at most parallelism of them at a time
+type fleetWave struct {
+	Name        string         `json:"name"`
+	Parallelism int            `json:"parallelism"`
+	Clusters    []fleetCluster `json:"clusters"`
+}
+
+// Content of the -fleet file
+type fleetConfig struct {
+	Waves []fleetWave `json:"waves"`
+}
+
+type fleetClusterReport struct {
+	Wave     string        `json:"wave"`
+	Name     string        `json:"name"`
+	Status   string        `json:"status"`
+	Duration time.Duration `json:"duration"`
+	Error    string        `json:"error,omitempty"`
+	// Report of the roller run on the cluster, when it got far enough to write one
+	Run *runModel `json:"run,omitempty"`
+}
+
+type fleetReport struct {
+	Status   string               `json:"status"`
+	Clusters []fleetClusterReport `json:"clusters"`
+}
+
+// Rolls a single cluster of the fleet
+type fleetRunner interface {
+	rollCluster(cluster fleetCluster) (*runModel, error)
+}
+
+// Rolls clusters by running the roller binary once per cluster
+type execFleetRunner struct {
+	binary string
+	args   []string
+	out    io.Writer
+}
+
+func loadFleetConfig(path string) (*fleetConfig, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the fleet file: %s", err)
+	}
+	config := &fleetConfig{}
+	err = json.Unmarshal(b, config)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse the fleet file: %s", err)
+	}
+
+	if len(config.Waves) == 0 {
+		return nil, fmt.Errorf("the fleet has no waves")
+	}
+	names := make(map[string]bool)
+	for i, wave := range config.Waves {
+		if wave.Name == "" {
+			config.Waves[i].Name = fmt.Sprintf("wave-%d", i+1)
+		}
+		if wave.Parallelism <= 0 {
+			config.Waves[i].Parallelism = 1
+		}
+		err = checkFleetClusters(config.Waves[i].Clusters, names)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return config, nil
+}
+
+// Validates the clusters and names the ones without a name after their account, region
+// and cluster. Fails on clusters already in names.
+func checkFleetClusters(clusters []fleetCluster, names map[string]bool) error {
+	for i, c := range clusters {
+		if c.Cluster == "" || c.Region == "" || c.KubernetesServer == "" {
+			return fmt.Errorf("cluster %q needs a cluster, region and kubernetesServer", c.Name)
+		}
+		if c.Account == "" && c.Profile == "" {
+			return fmt.Errorf("cluster %s needs one of account or profile", c.Cluster)
+		}
+		if c.Name == "" {
+			clusters[i].Name = fmt.Sprintf("%s-%s-%s", c.Account, c.Region, c.Cluster)
+		}
+		if names[clusters[i].Name] {
+			return fmt.Errorf("cluster %s is listed more than once", clusters[i].Name)
+		}
+		names[clusters[i].Name] = true
+	}
+	return nil
+}
+
+// Builds the report of a cluster rolled by a runner. The cluster failed when the runner
+// did, or when the roll reported a failure.
+func newFleetClusterReport(wave string, c fleetCluster, start time.Time, run *runModel, err error) fleetClusterReport {
+	result := fleetClusterReport{
+		Wave:     wave,
+		Name:     c.Name,
+		Status:   fleetSuccess,
+		Duration: time.Since(start),
+		Error:    errorString(err),
+		Run:      run,
+	}
+	if err == nil && run != nil && run.Status == fleetFailure {
+		result.Error = fmt.Sprintf("the roll of %s ended with status %s", c.Name, run.Status)
+		if run.AbortReason != "" {
+			result.Error = fmt.Sprintf("%s: %s", result.Error, run.AbortReason)
+		}
+	}
+	if result.Error != "" {
+		result.Status = fleetFailure
+	}
+	return result
+}
+
+// Rolls the waves in order, the clusters of each wave in parallel. Once a cluster
+// failed no other cluster gets started and the remaining ones are reported skipped.
+func runFleet(config *fleetConfig, runner fleetRunner) fleetReport {
+	report := fleetReport{Status: fleetSuccess}
+	var mu sync.Mutex
+	failed := false
+
+	for _, wave := range config.Waves {
+		results := make([]fleetClusterReport, len(wave.Clusters))
+		slots := make(chan struct{}, wave.Parallelism)
+		var wg sync.WaitGroup
+
+		glog.Infof("Starting wave %s of %d clusters", wave.Name, len(wave.Clusters))
+		for i, c := range wave.Clusters {
+			slots <- struct{}{}
+			mu.Lock()
+			stop := failed
+			mu.Unlock()
+			if stop {
+				<-slots
+				results[i] = fleetClusterReport{Wave: wave.Name, Name: c.Name, Status: fleetSkipped}
+				continue
+			}
+
+			wg.Add(1)
+			go func(i int, c fleetCluster) {
+				defer wg.Done()
+				defer func() { <-slots }()
+
+				start := time.Now()
+				glog.Infof("Rolling cluster %s of wave %s", c.Name, wave.Name)
+				run, err := runner.rollCluster(c)
+				result := newFleetClusterReport(wave.Name, c, start, run, err)
+				if result.Status == fleetFailure {
+					glog.Errorf("Cluster %s of wave %s failed, stopping the fleet rollout: %s", c.Name, wave.Name, result.Error)
+					mu.Lock()
+					failed = true
+					mu.Unlock()
+				}
+				results[i] = result
+			}(i, c)
+		}
+		wg.Wait()
+		report.Clusters = append(report.Clusters, results...)
+	}
+
+	for _, c := range report.Clusters {
+		if c.Status != fleetSuccess {
+			report.Status = fleetFailure
+		}
+	}
+	return report
+}
+
+func (r fleetReport) render() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Fleet rollout status: %s\n", r.Status)
+	wave := ""
+	for _, c := range r.Clusters {
+		if c.Wave != wave {
+			wave = c.Wave
+			fmt.Fprintf(&b, "Wave %s:\n", wave)
+		}
+		fmt.Fprintf(&b, "  %s: %s", c.Name, c.Status)
+		if c.Status != fleetSkipped {
+			fmt.Fprintf(&b, " in %v", c.Duration.Round(time.Second))
+		}
+		if c.Run != nil {
+			var replaced, total int
+			for _, component := range c.Run.Components {
+				replaced += component.Replaced
+				total += component.Total
+			}
+			if c.Run.Status == planStatus {
+				fmt.Fprintf(&b, ", %d instances to replace", total)
+			} else {
+				fmt.Fprintf(&b, ", %d/%d instances replaced", replaced, total)
+			}
+		}
+		if c.Error != "" {
+			fmt.Fprintf(&b, " (%s)", c.Error)
+		}
+		fmt.Fprintln(&b)
+	}
+	return b.String()
+}
+
+// Variables the roller of the cluster runs with, on top of the ones of the fleet rollout
+func (c fleetCluster) environ(reportFile string) []string {
+	env := map[string]string{
+		"AWS_ACCOUNT":                 c.Account,
+		"AWS_PROFILE":                 c.Profile,
+		"AWS_REGION":                  c.Region,
+		"AWS_ASSUME_ROLE_ARN":         c.RoleARN,
+		"AWS_ASSUME_ROLE_EXTERNAL_ID": c.ExternalID,
+		"CLUSTER":                     c.Cluster,
+		"KUBERNETES_SERVER":           c.KubernetesServer,
+		"ROLLER_REPORT_FILE":          reportFile,
+		// Clusters rolling at the same time can not all listen on the same address
+		"ROLLER_HTTP_ADDR": "",
+	}
+	if c.KubernetesTokenEnv != "" {
+		env["KUBERNETES_TOKEN"] = os.Getenv(c.KubernetesTokenEnv)
+	}
+	for k, v := range c.Env {
+		env[k] = v
+	}
+
+	var environ []string
+	for _, kv := range os.Environ() {
+		if _, ok := env[strings.SplitN(kv, "=", 2)[0]]; !ok {
+			environ = append(environ, kv)
+		}
+	}
+	for k, v := range env {
+		environ = append(environ, fmt.Sprintf("%s=%s", k, v))
+	}
+	return environ
+}
+
+func (r execFleetRunner) rollCluster(c fleetCluster) (*runModel, error) {
+	dir, err := ioutil.TempDir("", "roller-fleet")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	reportFile := filepath.Join(dir, "report.json")
+
+	out := &prefixWriter{out: r.out, prefix: fmt.Sprintf("[%s] ", c.Name)}
+	cmd := exec.Command(r.binary, r.args...)
+	cmd.Env = c.environ(reportFile)
+	cmd.Stdout = out
+	cmd.Stderr = out
+	err = cmd.Run()
+	out.flush()
+
+	var run *runModel
+	b, readErr := ioutil.ReadFile(reportFile)
+	if readErr == nil {
+		run = &runModel{}
+		readErr = json.Unmarshal(b, run)
+		if readErr != nil {
+			return nil, fmt.Errorf("unable to parse the report of %s: %s", c.Name, readErr)
+		}
+	}
+	if err != nil {
+		return run, fmt.Errorf("%s, last output: %s", err, out.lastLine())
+	}
+	return run, nil
+}
+
+// Writes the report of a roll or plan to ROLLER_REPORT_FILE, for the fleet rollouts and the daemon
+func writeReport(path string, model runModel) error {
+	b, err := json.MarshalIndent(model, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, 0600)
+}
+
+// Prefixes every line written to out, so that the output of clusters rolling in
+// parallel can be told apart. Remembers the last line written.
+type prefixWriter struct {
+	mu     sync.Mutex
+	out    io.Writer
+	prefix string
+	buf    bytes.Buffer
+	last   string
+}
+
+func (w *prefixWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buf.Write(p)
+	for {
+		line, err := w.buf.ReadString('\n')
+		if err != nil {
+			// Keep the incomplete line until the rest of it comes in
+			w.buf.Reset()
+			w.buf.WriteString(line)
+			return len(p), nil
+		}
+		w.writeLine(line)
+	}
+}
+
+func (w *prefixWriter) writeLine(line string) {
+	if strings.TrimSpace(line) != "" {
+		w.last = strings.TrimSpace(line)
+	}
+	fmt.Fprintf(w.out, "%s%s", w.prefix, line)
+}
+
+func (w *prefixWriter) flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.buf.Len() > 0 {
+		w.writeLine(w.buf.String() + "\n")
+		w.buf.Reset()
+	}
+}
+
+func (w *prefixWriter) lastLine() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.last
+}
+
+// Rolls every cluster of the fleet file at path, returning whether all of them succeeded
+func rollFleet(path string, planOnly bool) bool {
+	config, err := loadFleetConfig(path)
+	if err != nil {
+		glog.Fatalf("Unable to load the fleet: %s", err)
+	}
+	binary, err := os.Executable()
+	if err != nil {
+		glog.Fatalf("Unable to find the roller binary: %s", err)
+	}
+	runner := execFleetRunner{binary: binary, out: os.Stderr}
+	if planOnly {
+		runner.args = []string{"-plan"}
+	}
+
+	report := runFleet(config, runner)
+	fmt.Print(report.render())
+	if fleetReportFile != "" {
+		b, err := json.MarshalIndent(report, "", "  ")
+		if err == nil {
+			err = ioutil.WriteFile(fleetReportFile, b, 0600)
+		}
+		if err != nil {
+			glog.Errorf("An error occurred writing the fleet report.\nError %s", err)
+		}
+	}
+	return report.Status == fleetSuccess
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeFleetRunner struct {
+	mu       sync.Mutex
+	rolled   []string
+	running  int
+	maxRun   int
+	failures map[string]error
+	statuses map[string]string
+}
+
+func (r *fakeFleetRunner) rollCluster(c fleetCluster) (*runModel, error) {
+	r.mu.Lock()
+	r.rolled = append(r.rolled, c.Name)
+	r.running++
+	if r.running > r.maxRun {
+		r.maxRun = r.running
+	}
+	r.mu.Unlock()
+
+	time.Sleep(10 * time.Millisecond)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.running--
+	if err := r.failures[c.Name]; err != nil {
+		return nil, err
+	}
+	status := fleetSuccess
+	if s, ok := r.statuses[c.Name]; ok {
+		status = s
+	}
+	return &runModel{Cluster: c.Name, Status: status, Components: []componentModel{{Name: "k8s-node", Replaced: 3, Total: 3}}}, nil
+}
+
+func fakeFleet() *fleetConfig {
+	return &fleetConfig{
+		Waves: []fleetWave{
+			{Name: "dev", Parallelism: 2, Clusters: []fleetCluster{{Name: "dev-1"}, {Name: "dev-2"}, {Name: "dev-3"}}},
+			{Name: "canary-prod", Parallelism: 1, Clusters: []fleetCluster{{Name: "prod-1"}}},
+			{Name: "prod", Parallelism: 3, Clusters: []fleetCluster{{Name: "prod-2"}, {Name: "prod-3"}}},
+		},
+	}
+}
+
+func TestRunFleet(t *testing.T) {
+	runner := &fakeFleetRunner{}
+	report := runFleet(fakeFleet(), runner)
+	if report.Status != fleetSuccess {
+		t.Errorf("expected the fleet rollout to succeed, got %s", report.Status)
+	}
+	if len(runner.rolled) != 6 {
+		t.Fatalf("expected all the clusters to be rolled, got %v", runner.rolled)
+	}
+	if runner.rolled[3] != "prod-1" {
+		t.Errorf("expected prod-1 to be rolled after the dev wave, got %v", runner.rolled)
+	}
+	if runner.maxRun > 3 {
+		t.Errorf("expected at most 3 clusters rolling at a time, got %d", runner.maxRun)
+	}
+
+	rendered := report.render()
+	for _, expected := range []string{"Wave dev:", "  dev-2: success in ", "3/3 instances replaced", "Wave prod:"} {
+		if !strings.Contains(rendered, expected) {
+			t.Errorf("expected %q in the report:\n%s", expected, rendered)
+		}
+	}
+}
+
+func TestRunFleetStopsOnFailure(t *testing.T) {
+	runner := &fakeFleetRunner{failures: map[string]error{"prod-1": fmt.Errorf("exit status 255")}}
+	report := runFleet(fakeFleet(), runner)
+	if report.Status != fleetFailure {
+		t.Errorf("expected the fleet rollout to fail, got %s", report.Status)
+	}
+	if !reflect.DeepEqual(runner.rolled[3:], []string{"prod-1"}) {
+		t.Errorf("expected no cluster to be rolled after prod-1 failed, got %v", runner.rolled)
+	}
+
+	statuses := make(map[string]string)
+	for _, c := range report.Clusters {
+		statuses[c.Name] = c.Status
+	}
+	expected := map[string]string{
+		"dev-1": fleetSuccess, "dev-2": fleetSuccess, "dev-3": fleetSuccess,
+		"prod-1": fleetFailure, "prod-2": fleetSkipped, "prod-3": fleetSkipped,
+	}
+	if !reflect.DeepEqual(statuses, expected) {
+		t.Errorf("expected %v, got %v", expected, statuses)
+	}
+
+	// A roll reporting a failure fails the cluster even when the roller exited cleanly
+	runner = &fakeFleetRunner{statuses: map[string]string{"dev-1": fleetFailure}}
+	report = runFleet(&fleetConfig{Waves: fakeFleet().Waves[:1]}, runner)
+	if report.Clusters[0].Status != fleetFailure || !strings.Contains(report.Clusters[0].Error, "ended with status failure") {
+		t.Errorf("expected dev-1 to fail, got %+v", report.Clusters[0])
+	}
+}
+
+func TestLoadFleetConfig(t *testing.T) {
+	path := writeRollerConfig(t, `{"waves": [
+  {"clusters": [{"account": "dev", "region": "us-east-1", "cluster": "a", "kubernetesServer": "https://a"}]},
+  {"name": "prod", "parallelism": 2, "clusters": [{"name": "prod-b", "profile": "prod", "region": "us-east-1", "cluster": "b", "kubernetesServer": "https://b"}]}
+]}`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	config, err := loadFleetConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Waves[0].Name != "wave-1" || config.Waves[0].Parallelism != 1 || config.Waves[0].Clusters[0].Name != "dev-us-east-1-a" {
+		t.Errorf("expected the defaults to be filled in, got %+v", config.Waves[0])
+	}
+
+	invalid := map[string]string{
+		`{"waves": []}`: "no waves",
+		`{"waves": [{"clusters": [{"account": "dev", "region": "us-east-1", "cluster": "a"}]}]}`:                "needs a cluster, region and kubernetesServer",
+		`{"waves": [{"clusters": [{"region": "us-east-1", "cluster": "a", "kubernetesServer": "https://a"}]}]}`: "one of account or profile",
+		`{"waves": [{"clusters": [{"name": "a", "profile": "p", "region": "r", "cluster": "a", "kubernetesServer": "https://a"}]},
+		  {"clusters": [{"name": "a", "profile": "p", "region": "r", "cluster": "b", "kubernetesServer": "https://b"}]}]}`: "more than once",
+	}
+	for content, expected := range invalid {
+		path := writeRollerConfig(t, content)
+		_, err := loadFleetConfig(path)
+		os.RemoveAll(filepath.Dir(path))
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected an error containing %q, got %v", expected, err)
+		}
+	}
+}
+
+func TestFleetClusterEnviron(t *testing.T) {
+	os.Setenv("FLEET_TEST_TOKEN", "secret")
+	defer os.Unsetenv("FLEET_TEST_TOKEN")
+
+	c := fleetCluster{
+		Profile:            "prod",
+		Region:             "eu-west-1",
+		RoleARN:            "arn:aws:iam::123456789012:role/roller",
+		Cluster:            "b",
+		KubernetesServer:   "https://b",
+		KubernetesTokenEnv: "FLEET_TEST_TOKEN",
+		Env:                map[string]string{"ROLLER_COMPONENTS": "k8s-node"},
+	}
+	env := make(map[string]string)
+	for _, kv := range c.environ("/tmp/report.json") {
+		parts := strings.SplitN(kv, "=", 2)
+		env[parts[0]] = parts[1]
+	}
+	expected := map[string]string{
+		"AWS_PROFILE":         "prod",
+		"AWS_REGION":          "eu-west-1",
+		"AWS_ASSUME_ROLE_ARN": "arn:aws:iam::123456789012:role/roller",
+		"CLUSTER":             "b",
+		"KUBERNETES_SERVER":   "https://b",
+		"KUBERNETES_TOKEN":    "secret",
+		"ROLLER_COMPONENTS":   "k8s-node",
+		"ROLLER_REPORT_FILE":  "/tmp/report.json",
+		"FLEET_TEST_TOKEN":    "secret",
+	}
+	for k, v := range expected {
+		if env[k] != v {
+			t.Errorf("expected %s=%s, got %q", k, v, env[k])
+		}
+	}
+}
+
+func TestPrefixWriter(t *testing.T) {
+	var out bytes.Buffer
+	w := &prefixWriter{out: &out, prefix: "[dev-1] "}
+	fmt.Fprint(w, "first line\nsecond ")
+	fmt.Fprint(w, "line\nunterminated")
+	w.flush()
+
+	expected := "[dev-1] first line\n[dev-1] second line\n[dev-1] unterminated\n"
+	if out.String() != expected {
+		t.Errorf("expected %q, got %q", expected, out.String())
+	}
+	if w.lastLine() != "unterminated" {
+		t.Errorf("expected the last line to be remembered, got %q", w.lastLine())
+	}
+}
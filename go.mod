@@ -3,7 +3,7 @@ module github.com/VEVO/kubernetes-updater
 require (
 	github.com/aktau/github-release v0.10.0 // indirect
 	github.com/armon/consul-api v0.0.0-20180202201655-eb2c6b5be1b6 // indirect
-	github.com/aws/aws-sdk-go v1.25.41
+	github.com/aws/aws-sdk-go v1.44.100
 	github.com/cenkalti/backoff v2.2.1+incompatible // indirect
 	github.com/dustin/go-humanize v1.0.0 // indirect
 	github.com/github-release/github-release v0.10.0 // indirect
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/golang/glog"
+)
+
+// Points of the roll hooks run at
+const (
+	// Once the roll is about to start replacing instances
+	hookPreRoll = "pre-roll"
+	// Before each instance gets terminated
+	hookPreTerminate = "pre-terminate"
+	// Once each replacement instance is healthy
+	hookPostHealthy = "post-healthy"
+	// Once each component is done, successfully or not
+	hookPostComponent = "post-component"
+	// Once every component is done
+	hookPostRoll = "post-roll"
+)
+
+// What happens when a hook fails
+const (
+	hookFailureAbort  = "abort"
+	hookFailureIgnore = "ignore"
+)
+
+// How long a hook gets to run unless its timeoutSeconds says otherwise
+const defaultHookTimeout = 5 * time.Minute
+
+// A local executable or http webhook run at a point of the roll. The payload
+// describing the roll, component and instance is written to the standard input of
+// the executable, or posted to the webhook.
+type hookSpec struct {
+	Name    string   `json:"name"`
+	Point   string   `json:"point"`
+	Command []string `json:"command"`
+	URL     string   `json:"url"`
+	// Only run for these components, all of them when empty
+	Components     []string `json:"components"`
+	TimeoutSeconds int      `json:"timeoutSeconds"`
+	// abort (the default) stops the roll when the hook fails, ignore only logs the failure
+	OnFailure string `json:"onFailure"`
+}
+
+type hookPayload struct {
+	Point          string `json:"point"`
+	Cluster        string `json:"cluster"`
+	AnsibleVersion string `json:"ansibleVersion"`
+	Component      string `json:"component,omitempty"`
+	Instance       string `json:"instance,omitempty"`
+	PrivateIP      string `json:"privateIp,omitempty"`
+	PrivateDNS     string `json:"privateDns,omitempty"`
+	// Outcome of the component or of the roll, for the post-component and post-roll hooks
+	Status string `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Hooks from the ROLLER_CONFIG file
+var rollerHooks []hookSpec
+
+func (h hookSpec) validate() error {
+	switch h.Point {
+	case hookPreRoll, hookPreTerminate, hookPostHealthy, hookPostComponent, hookPostRoll:
+	default:
+		return fmt.Errorf("hook %s has an unknown point %q", h.Name, h.Point)
+	}
+	if (len(h.Command) == 0) == (h.URL == "") {
+		return fmt.Errorf("hook %s needs either a command or a url", h.Name)
+	}
+	switch h.OnFailure {
+	case "", hookFailureAbort, hookFailureIgnore:
+	default:
+		return fmt.Errorf("hook %s has an unknown onFailure %q", h.Name, h.OnFailure)
+	}
+	return nil
+}
+
+// Loads the hooks of the config file at path, if set
+func loadHooks(path string) ([]hookSpec, error) {
+	if path == "" {
+		return nil, nil
+	}
+	config, err := readRollerConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	for i, h := range config.Hooks {
+		if h.Name == "" {
+			config.Hooks[i].Name = fmt.Sprintf("%s-%d", h.Point, i+1)
+		}
+		err = config.Hooks[i].validate()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return config.Hooks, nil
+}
+
+func (h hookSpec) appliesTo(point, component string) bool {
+	if h.Point != point {
+		return false
+	}
+	if len(h.Components) == 0 || component == "" {
+		return true
+	}
+	for _, c := range h.Components {
+		if c == component {
+			return true
+		}
+	}
+	return false
+}
+
+func (h hookSpec) timeout() time.Duration {
+	if h.TimeoutSeconds > 0 {
+		return time.Duration(h.TimeoutSeconds) * time.Second
+	}
+	return defaultHookTimeout
+}
+
+func (h hookSpec) run(payload hookPayload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout())
+	defer cancel()
+
+	if h.URL != "" {
+		req, err := http.NewRequest(http.MethodPost, h.URL, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			b, _ := ioutil.ReadAll(resp.Body)
+			return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(b)))
+		}
+		return nil
+	}
+
+	cmd := exec.CommandContext(ctx, h.Command[0], h.Command[1:]...)
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("ROLLER_HOOK_POINT=%s", payload.Point),
+		fmt.Sprintf("ROLLER_HOOK_COMPONENT=%s", payload.Component),
+		fmt.Sprintf("ROLLER_HOOK_INSTANCE=%s", payload.Instance),
+	)
+	out, err := cmd.CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("timed out after %v", h.timeout())
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(string(out)))
+	}
+	glog.V(4).Infof("Hook %s output: %s", h.Name, out)
+	return nil
+}
+
+// Describes the component and instance the hooks of point run for, either may be nil
+func newHookPayload(point string, c *componentType, instance *ec2.Instance) hookPayload {
+	payload := hookPayload{
+		Point:          point,
+		Cluster:        kubernetesCluster,
+		AnsibleVersion: ansibleVersion,
+	}
+	if c != nil {
+		payload.Component = c.name
+	}
+	if instance != nil {
+		payload.Instance = aws.StringValue(instance.InstanceId)
+		payload.PrivateIP = aws.StringValue(instance.PrivateIpAddress)
+		payload.PrivateDNS = aws.StringValue(instance.PrivateDnsName)
+	}
+	return payload
+}
+
+// Returns the instance with the given id, or one only knowing its id when it is not in instances
+func findInstance(instances []*ec2.Instance, instanceID string) *ec2.Instance {
+	for _, i := range instances {
+		if aws.StringValue(i.InstanceId) == instanceID {
+			return i
+		}
+	}
+	return &ec2.Instance{InstanceId: aws.String(instanceID)}
+}
+
+func hasHooks(point string) bool {
+	for _, h := range rollerHooks {
+		if h.Point == point {
+			return true
+		}
+	}
+	return false
+}
+
+// Runs the hooks of the point of the payload in order. A failing hook aborts the roll
+// and its error is returned, unless it is set to be ignored.
+func runHooks(payload hookPayload) error {
+	for _, h := range rollerHooks {
+		if !h.appliesTo(payload.Point, payload.Component) {
+			continue
+		}
+		glog.V(2).Infof("Running %s hook %s for %s %s", payload.Point, h.Name, payload.Component, payload.Instance)
+		err := h.run(payload)
+		if err == nil {
+			continue
+		}
+		err = fmt.Errorf("%s hook %s failed for %s %s: %s", payload.Point, h.Name, payload.Component, payload.Instance, err)
+		if h.OnFailure == hookFailureIgnore {
+			glog.Errorf("%s", err)
+			continue
+		}
+		state.abort(err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestLoadHooks(t *testing.T) {
+	path := writeRollerConfig(t, `{"hooks": [
+  {"point": "pre-terminate", "command": ["/usr/local/bin/consul-deregister"], "components": ["k8s-master"], "timeoutSeconds": 30},
+  {"name": "dns", "point": "post-healthy", "url": "https://hooks.example.com/dns", "onFailure": "ignore"}
+]}`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	hooks, err := loadHooks(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hooks) != 2 || hooks[0].Name != "pre-terminate-1" || hooks[1].Name != "dns" {
+		t.Errorf("expected the hooks to be named, got %+v", hooks)
+	}
+	if !hooks[0].appliesTo(hookPreTerminate, "k8s-master") || hooks[0].appliesTo(hookPreTerminate, "k8s-node") || hooks[0].appliesTo(hookPostHealthy, "k8s-master") {
+		t.Errorf("expected the first hook to only apply to the k8s-master terminations")
+	}
+
+	invalid := map[string]string{
+		`{"hooks": [{"point": "mid-roll", "url": "https://a"}]}`:                       "unknown point",
+		`{"hooks": [{"point": "pre-roll"}]}`:                                           "either a command or a url",
+		`{"hooks": [{"point": "pre-roll", "url": "https://a", "command": ["true"]}]}`:  "either a command or a url",
+		`{"hooks": [{"point": "pre-roll", "url": "https://a", "onFailure": "retry"}]}`: "unknown onFailure",
+	}
+	for content, expected := range invalid {
+		path := writeRollerConfig(t, content)
+		_, err := loadHooks(path)
+		os.RemoveAll(filepath.Dir(path))
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected an error containing %q, got %v", expected, err)
+		}
+	}
+}
+
+func TestRunHooks(t *testing.T) {
+	s := fakeApprovalState(nil)
+	defer func(st *rollerState) { state = st }(state)
+	state = s
+	defer func() { rollerHooks = nil }()
+
+	var received hookPayload
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&received)
+		if received.Instance == "i-broken" {
+			http.Error(w, "no such record", http.StatusBadRequest)
+		}
+	}))
+	defer ts.Close()
+
+	dir, _ := ioutil.TempDir("", "roller-hooks")
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "payload.json")
+
+	rollerHooks = []hookSpec{
+		{Name: "dns", Point: hookPostHealthy, URL: ts.URL},
+		{Name: "script", Point: hookPostHealthy, Command: []string{"sh", "-c", "cat > " + out + " && test $ROLLER_HOOK_INSTANCE = i-new"}, OnFailure: hookFailureIgnore},
+	}
+	instance := &ec2.Instance{InstanceId: aws.String("i-new"), PrivateIpAddress: aws.String("10.0.0.1")}
+	err := runHooks(newHookPayload(hookPostHealthy, s.components[1], instance))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received.Component != "k8s-node" || received.PrivateIP != "10.0.0.1" || received.Point != hookPostHealthy {
+		t.Errorf("expected the webhook to get the instance, got %+v", received)
+	}
+	b, _ := ioutil.ReadFile(out)
+	if !strings.Contains(string(b), `"instance":"i-new"`) {
+		t.Errorf("expected the command to get the payload on its standard input, got %s", b)
+	}
+
+	// A failing ignored hook does not stop the roll
+	err = runHooks(newHookPayload(hookPostHealthy, s.components[1], findInstance(nil, "i-other")))
+	if err != nil {
+		t.Errorf("expected the failure of the script to be ignored, got %s", err)
+	}
+	if s.abortError() != nil {
+		t.Errorf("expected the roll not to be aborted")
+	}
+
+	// A failing hook aborts the roll by default
+	err = runHooks(newHookPayload(hookPostHealthy, s.components[1], findInstance(nil, "i-broken")))
+	if err == nil || !strings.Contains(err.Error(), "no such record") {
+		t.Errorf("expected the webhook failure, got %v", err)
+	}
+	if s.abortError() == nil {
+		t.Errorf("expected the roll to be aborted")
+	}
+}
+
+// Finds and verifies the replacements i-a, i-b and i-c of the component, i-b turning
+// healthy a poll before the others
+func findAndVerifyOutOfOrder(t *testing.T, c *componentType) []string {
+	defer func() { fakeInstanceHealth = nil }()
+	source := &localLaunchSource{events: make(map[string][]launchEvent)}
+	state.launchSource = source
+	batch := state.startReplacementBatch(c)
+	for _, id := range []string{"i-a", "i-b", "i-c"} {
+		source.launch(launchEvent{ASG: c.asgs[0], ActivityID: id, Instance: id, Status: "Successful"})
+	}
+	fakeInstanceHealth = fakeHealthAfter(map[string]int{"i-a": 2, "i-b": 1, "i-c": 2})
+	awsClient := &awsClient{ec2: newAWSEc2Controller(newFakeAWSEc2Client())}
+
+	instances, err := findAndVerifyReplacementInstances(awsClient, c, "", 3, batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return instances
+}
+
+func TestPostHealthyHooksOutOfOrder(t *testing.T) {
+	defer func(st *rollerState) { state = st }(state)
+	state = fakeApprovalState(nil)
+	defer func() { rollerHooks = nil }()
+
+	var mu sync.Mutex
+	var received []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload hookPayload
+		json.NewDecoder(r.Body).Decode(&payload)
+		mu.Lock()
+		received = append(received, payload.Instance+"/"+payload.PrivateIP)
+		mu.Unlock()
+	}))
+	defer ts.Close()
+	rollerHooks = []hookSpec{{Name: "dns", Point: hookPostHealthy, URL: ts.URL}}
+	defer func() { fakeDescribeInstancesOutput = nil }()
+	var described []*ec2.Instance
+	for i, id := range []string{"i-a", "i-b", "i-c"} {
+		described = append(described, &ec2.Instance{InstanceId: aws.String(id), PrivateIpAddress: aws.String(fmt.Sprintf("10.0.0.%d", i+1))})
+	}
+	fakeDescribeInstancesOutput = &ec2.DescribeInstancesOutput{Reservations: []*ec2.Reservation{{Instances: described}}}
+
+	c := &componentType{name: "k8s-node", asgs: []string{"nodes"}, spec: componentSpec{PollIntervalSeconds: 1}}
+	findAndVerifyOutOfOrder(t, c)
+	sort.Strings(received)
+	if strings.Join(received, ",") != "i-a/10.0.0.1,i-b/10.0.0.2,i-c/10.0.0.3" {
+		t.Errorf("expected the hook to run once for each replacement with its address, got %v", received)
+	}
+}
+
+func TestHookTimeout(t *testing.T) {
+	h := hookSpec{Name: "slow", Point: hookPreRoll, Command: []string{"sleep", "5"}, TimeoutSeconds: 1}
+	err := h.run(newHookPayload(hookPreRoll, nil, nil))
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("expected the hook to time out, got %v", err)
+	}
+}
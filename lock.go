@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/golang/glog"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	rollLockName      = "kubernetes-updater"
+	rollLockNamespace = "kube-system"
+	// The lock is considered abandoned if not renewed within this period
+	rollLockDuration = 10 * time.Minute
+	rollLockRenewal  = 2 * time.Minute
+)
+
+// Cluster wide lock preventing two rolls from running at the same time, stored as a
+// kubernetes lease so that it lives with the cluster rather than with the roller.
+type rollLock struct {
+	client kubernetesClient
+	holder string
+	stop   chan struct{}
+}
+
+func newRollLock(client kubernetesClient, operator string) *rollLock {
+	hostname, _ := os.Hostname()
+	return &rollLock{
+		client: client,
+		holder: fmt.Sprintf("%s@%s-%d", operator, hostname, os.Getpid()),
+	}
+}
+
+func leaseExpired(lease *coordinationv1.Lease) bool {
+	if lease.Spec.RenewTime == nil || lease.Spec.LeaseDurationSeconds == nil {
+		return true
+	}
+	expiry := lease.Spec.RenewTime.Add(time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second)
+	return time.Now().After(expiry)
+}
+
+// Returns who holds the lock when someone other than us does
+func (l *rollLock) heldBy() (string, error) {
+	lease, err := l.client.getLease(rollLockName, rollLockNamespace)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	holder := ""
+	if lease.Spec.HolderIdentity != nil {
+		holder = *lease.Spec.HolderIdentity
+	}
+	if holder == "" || holder == l.holder || leaseExpired(lease) {
+		return "", nil
+	}
+	return holder, nil
+}
+
+func (l *rollLock) leaseSpec(lease *coordinationv1.Lease) {
+	now := metav1.NewMicroTime(time.Now())
+	duration := int32(rollLockDuration.Seconds())
+	if lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity != l.holder {
+		lease.Spec.AcquireTime = &now
+	}
+	lease.Spec.HolderIdentity = &l.holder
+	lease.Spec.LeaseDurationSeconds = &duration
+	lease.Spec.RenewTime = &now
+}
+
+// Takes the lock, taking over an expired one, and keeps it renewed until released
+func (l *rollLock) acquire() error {
+	lease, err := l.client.getLease(rollLockName, rollLockNamespace)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+
+	if apierrors.IsNotFound(err) {
+		lease = &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      rollLockName,
+				Namespace: rollLockNamespace,
+			},
+		}
+		l.leaseSpec(lease)
+		_, err = l.client.createLease(lease)
+	} else {
+		var holder string
+		holder, err = l.heldBy()
+		if err != nil {
+			return err
+		}
+		if holder != "" {
+			return fmt.Errorf("roll lock is held by %s", holder)
+		}
+		l.leaseSpec(lease)
+		_, err = l.client.updateLease(lease)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to acquire the roll lock: %s", err)
+	}
+
+	glog.V(4).Infof("Acquired the roll lock as %s", l.holder)
+	l.stop = make(chan struct{})
+	go l.keepRenewed(l.stop)
+	return nil
+}
+
+func (l *rollLock) renew() error {
+	lease, err := l.client.getLease(rollLockName, rollLockNamespace)
+	if err != nil {
+		return err
+	}
+	if lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity != l.holder {
+		return fmt.Errorf("roll lock was taken over by %v", lease.Spec.HolderIdentity)
+	}
+	l.leaseSpec(lease)
+	_, err = l.client.updateLease(lease)
+	return err
+}
+
+func (l *rollLock) keepRenewed(stop <-chan struct{}) {
+	ticker := time.NewTicker(rollLockRenewal)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			err := l.renew()
+			if err != nil {
+				glog.Errorf("an error occurred renewing the roll lock.\nError %s", err)
+			}
+		}
+	}
+}
+
+func (l *rollLock) release() error {
+	if l.stop != nil {
+		close(l.stop)
+		l.stop = nil
+	}
+	lease, err := l.client.getLease(rollLockName, rollLockNamespace)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// Even expired, the lease of another holder is theirs to release or take over
+	if lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity != l.holder {
+		holder := ""
+		if lease.Spec.HolderIdentity != nil {
+			holder = *lease.Spec.HolderIdentity
+		}
+		return fmt.Errorf("roll lock is held by %q, not releasing it", holder)
+	}
+	err = l.client.deleteLease(rollLockName, rollLockNamespace)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestRollLock(t *testing.T) {
+	defer func() { fakeLeases = make(map[string]*coordinationv1.Lease) }()
+	client := newFakeClient()
+
+	first := &rollLock{client: client, holder: "first"}
+	second := &rollLock{client: client, holder: "second"}
+
+	err := first.acquire()
+	if err != nil {
+		t.Fatalf("expected the lock to be acquired, got %s", err)
+	}
+	defer first.release()
+
+	holder, err := second.heldBy()
+	if err != nil || holder != "first" {
+		t.Errorf("expected the lock to be held by first, got %q (%v)", holder, err)
+	}
+	if err := checkRollLock(second); err == nil || !strings.Contains(err.Error(), "first") {
+		t.Errorf("expected the roll-lock check to fail, got %v", err)
+	}
+	if err := second.acquire(); err == nil {
+		t.Errorf("expected the lock not to be acquired while held")
+	}
+	if err := second.release(); err == nil {
+		t.Errorf("expected the lock not to be released by another holder")
+	}
+
+	holder, err = first.heldBy()
+	if err != nil || holder != "" {
+		t.Errorf("expected the lock not to be reported as held by someone else, got %q (%v)", holder, err)
+	}
+
+	err = first.release()
+	if err != nil {
+		t.Fatalf("expected the lock to be released, got %s", err)
+	}
+	if len(fakeLeases) != 0 {
+		t.Errorf("expected the lease to be deleted")
+	}
+}
+
+func TestRollLockExpired(t *testing.T) {
+	defer func() { fakeLeases = make(map[string]*coordinationv1.Lease) }()
+	client := newFakeClient()
+
+	stale := metav1.NewMicroTime(time.Now().Add(-2 * rollLockDuration))
+	duration := int32(rollLockDuration.Seconds())
+	holder := "crashed"
+	fakeLeases[rollLockNamespace+"/"+rollLockName] = &coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{Name: rollLockName, Namespace: rollLockNamespace},
+		Spec: coordinationv1.LeaseSpec{
+			HolderIdentity:       &holder,
+			LeaseDurationSeconds: &duration,
+			RenewTime:            &stale,
+		},
+	}
+
+	lock := &rollLock{client: client, holder: "new"}
+	if err := lock.release(); err == nil || len(fakeLeases) != 1 {
+		t.Errorf("expected the expired lock of another holder not to be released, got %v", err)
+	}
+	err := lock.acquire()
+	if err != nil {
+		t.Fatalf("expected the expired lock to be taken over, got %s", err)
+	}
+	defer lock.release()
+
+	lease := fakeLeases[rollLockNamespace+"/"+rollLockName]
+	if *lease.Spec.HolderIdentity != "new" || leaseExpired(lease) {
+		t.Errorf("expected the lease to be renewed for new, got %v", lease.Spec)
+	}
+}
@@ -1,6 +1,11 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/golang/glog"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
@@ -30,3 +35,33 @@ func (k kubernetesNodes) drainNode(client kubernetesClient, node *corev1.Node) e
 	err := client.drainNode(node)
 	return err
 }
+
+// Waits for the instances to join the cluster as Ready nodes and returns the ones which did not
+func verifyReplacementNodes(ctx context.Context, w waiter, client kubernetesClient, myComponent *componentType, instances []string) ([]string, error) {
+	pending := instances
+	err := w.wait(ctx, func() (bool, error) {
+		var notReady []string
+		for _, instance := range pending {
+			nodes, err := kubernetesNodes{}.getNodesByLabel(client, map[string]string{"instance-id": instance})
+			if err != nil {
+				return false, err
+			}
+			if len(nodes.Items) > 0 && nodeReady(nodes.Items[0]) {
+				glog.Infof("Verification complete component %s instance %s is a ready node\n", myComponent.name, instance)
+				continue
+			}
+			notReady = append(notReady, instance)
+		}
+		pending = notReady
+
+		if len(pending) > 0 {
+			glog.Infof("Still waiting for the following %s instances to become ready nodes %s\n", myComponent.name, pending)
+			return false, nil
+		}
+		return true, nil
+	})
+	if errors.Is(err, errWaitTimeout) {
+		return pending, fmt.Errorf("Failed to verify %s nodes %s", myComponent.name, pending)
+	}
+	return pending, err
+}
@@ -1,6 +1,11 @@
 package main
 
-import "testing"
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
 
 func TestKubernetesNodes_GetNodesByLabel(t *testing.T) {
 	client := newFakeClient()
@@ -63,3 +68,16 @@ func TestKubernetesNodes_UpdateNodesByLabel(t *testing.T) {
 		}
 	}
 }
+
+func TestVerifyReplacementNodesKeepsInstances(t *testing.T) {
+	defer readyFakeNode()()
+	w := waiter{what: "test", timeout: 10 * time.Millisecond, interval: time.Millisecond}
+	instances := []string{"i-fake-instanceid", "i-missing-instanceid"}
+	failed, err := verifyReplacementNodes(context.Background(), w, newFakeClient(), &componentType{name: "k8s-node"}, instances)
+	if err == nil || !reflect.DeepEqual(failed, []string{"i-missing-instanceid"}) {
+		t.Errorf("expected i-missing-instanceid to fail the verification, got %v and %v", failed, err)
+	}
+	if !reflect.DeepEqual(instances, []string{"i-fake-instanceid", "i-missing-instanceid"}) {
+		t.Errorf("expected the instances left as they were, got %v", instances)
+	}
+}
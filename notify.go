@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+type notificationKind string
+
+const (
+	notifyStart     notificationKind = "start"
+	notifyComponent notificationKind = "component"
+	notifyProgress  notificationKind = "progress"
+	notifyFailure   notificationKind = "failure"
+	notifyFinish    notificationKind = "finish"
+	notifyApproval  notificationKind = "approval"
+
+	// Number of notifications buffered per backend before new ones get dropped
+	notificationQueueSize = 100
+	// Timeout for every http call made by a notifier
+	notificationHTTPTimeout = 10 * time.Second
+)
+
+var allNotificationKinds = []notificationKind{
+	notifyStart,
+	notifyComponent,
+	notifyProgress,
+	notifyFailure,
+	notifyFinish,
+	notifyApproval,
+}
+
+// Progress is only sent to the backends asking for it, as it is fairly chatty
+var defaultNotificationKinds = []notificationKind{
+	notifyStart,
+	notifyComponent,
+	notifyFailure,
+	notifyFinish,
+	notifyApproval,
+}
+
+type notification struct {
+	kind      notificationKind
+	title     string
+	text      string
+	component string
+	// Id of the gate waiting for a decision, for approval requests
+	approval string
+	progress []componentProgress
+}
+
+type notifier interface {
+	name() string
+	notify(notification) error
+}
+
+type notifierBackend struct {
+	notifier notifier
+	events   map[notificationKind]bool
+	queue    chan notification
+}
+
+// Fans notifications out to every configured backend. Each backend has its own queue
+// and worker so that a slow or failing backend never holds up the roll or the others.
+type notificationDispatcher struct {
+	backends []*notifierBackend
+	wg       sync.WaitGroup
+	mu       sync.Mutex
+	// Set once closed, the notifications sent after that are dropped
+	closed bool
+}
+
+func newNotificationDispatcher() *notificationDispatcher {
+	return &notificationDispatcher{}
+}
+
+func (d *notificationDispatcher) add(n notifier, events []notificationKind) {
+	backend := &notifierBackend{
+		notifier: n,
+		events:   make(map[notificationKind]bool),
+		queue:    make(chan notification, notificationQueueSize),
+	}
+	for _, e := range events {
+		backend.events[e] = true
+	}
+	d.backends = append(d.backends, backend)
+
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		for n := range backend.queue {
+			err := backend.notifier.notify(n)
+			if err != nil {
+				glog.Errorf("an error occurred sending the %s notification to %s.\nError %s", n.kind, backend.notifier.name(), err)
+			}
+		}
+	}()
+}
+
+func (d *notificationDispatcher) send(n notification) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		glog.Errorf("notifications are closed, dropping the %s notification", n.kind)
+		return
+	}
+	for _, backend := range d.backends {
+		if !backend.events[n.kind] {
+			continue
+		}
+		select {
+		case backend.queue <- n:
+		default:
+			glog.Errorf("notification queue for %s is full, dropping the %s notification", backend.notifier.name(), n.kind)
+		}
+	}
+}
+
+// Waits up to timeout for the queued notifications to be delivered. No notification
+// can be sent once the dispatcher is closed.
+func (d *notificationDispatcher) close(timeout time.Duration) {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return
+	}
+	d.closed = true
+	for _, backend := range d.backends {
+		close(backend.queue)
+	}
+	d.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		glog.Errorf("timed out after %v waiting for notifications to be delivered", timeout)
+	}
+}
+
+func parseNotificationKinds(events string, defaults []notificationKind) ([]notificationKind, error) {
+	if events == "" {
+		return defaults, nil
+	}
+
+	var kinds []notificationKind
+	for _, e := range strings.Split(events, ",") {
+		kind := notificationKind(strings.TrimSpace(e))
+		valid := false
+		for _, k := range allNotificationKinds {
+			if kind == k {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return nil, fmt.Errorf("unknown notification event %q, expected one of %v", kind, allNotificationKinds)
+		}
+		kinds = append(kinds, kind)
+	}
+	return kinds, nil
+}
+
+// Builds the dispatcher from the environment. Every backend whose required variables
+// are set gets added, each filtered on its own comma separated list of events.
+func configureNotifiers() (*notificationDispatcher, error) {
+	d := newNotificationDispatcher()
+
+	addBackend := func(n notifier, eventsVar string, defaults []notificationKind) error {
+		events, err := parseNotificationKinds(os.Getenv(eventsVar), defaults)
+		if err != nil {
+			return fmt.Errorf("unable to parse %s: %s", eventsVar, err)
+		}
+		glog.V(4).Infof("Sending %v notifications to %s", events, n.name())
+		d.add(n, events)
+		return nil
+	}
+
+	if url := os.Getenv("SLACK_WEBHOOK"); url != "" {
+		err := addBackend(newSlackWebhookNotifier(url), "SLACK_WEBHOOK_EVENTS", defaultNotificationKinds)
+		if err != nil {
+			return d, err
+		}
+	}
+
+	if token := os.Getenv("SLACK_API_TOKEN"); token != "" {
+		channel := os.Getenv("SLACK_CHANNEL")
+		if channel == "" {
+			return d, fmt.Errorf("set the SLACK_CHANNEL variable when using SLACK_API_TOKEN")
+		}
+		mode := os.Getenv("SLACK_THREAD_MODE")
+		if mode == "" {
+			mode = slackModeUpdate
+		}
+		if mode != slackModeUpdate && mode != slackModeThread {
+			return d, fmt.Errorf("unknown SLACK_THREAD_MODE %q, expected %s or %s", mode, slackModeUpdate, slackModeThread)
+		}
+		n := newSlackAPINotifier(token, channel, mode, os.Getenv("SLACK_ONCALL_GROUP"))
+		err := addBackend(n, "SLACK_API_EVENTS", allNotificationKinds)
+		if err != nil {
+			return d, err
+		}
+	}
+
+	if url := os.Getenv("TEAMS_WEBHOOK"); url != "" {
+		err := addBackend(newTeamsNotifier(url), "TEAMS_WEBHOOK_EVENTS", defaultNotificationKinds)
+		if err != nil {
+			return d, err
+		}
+	}
+
+	if url := os.Getenv("NOTIFY_WEBHOOK_URL"); url != "" {
+		body := defaultWebhookTemplate
+		if path := os.Getenv("NOTIFY_WEBHOOK_TEMPLATE"); path != "" {
+			b, err := ioutil.ReadFile(path)
+			if err != nil {
+				return d, fmt.Errorf("unable to read NOTIFY_WEBHOOK_TEMPLATE: %s", err)
+			}
+			body = string(b)
+		}
+		n, err := newWebhookNotifier(url, body)
+		if err != nil {
+			return d, err
+		}
+		err = addBackend(n, "NOTIFY_WEBHOOK_EVENTS", defaultNotificationKinds)
+		if err != nil {
+			return d, err
+		}
+	}
+
+	if host := os.Getenv("SMTP_HOST"); host != "" {
+		port := 25
+		if p := os.Getenv("SMTP_PORT"); p != "" {
+			var err error
+			port, err = strconv.Atoi(p)
+			if err != nil {
+				return d, fmt.Errorf("unable to parse SMTP_PORT: %s", err)
+			}
+		}
+		from := os.Getenv("SMTP_FROM")
+		to := os.Getenv("SMTP_TO")
+		if from == "" || to == "" {
+			return d, fmt.Errorf("set the SMTP_FROM and SMTP_TO variables when using SMTP_HOST")
+		}
+		n := newSMTPNotifier(host, port, os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD"), from, strings.Split(to, ","))
+		err := addBackend(n, "SMTP_EVENTS", defaultNotificationKinds)
+		if err != nil {
+			return d, err
+		}
+	}
+
+	if len(d.backends) == 0 {
+		glog.Warning("No notification backend configured, notifications will only be logged")
+	}
+	return d, nil
+}
+
+// Posts body as json to url and returns the response body. Any non 2xx
+// status is considered an error.
+func postJSON(url string, body interface{}, headers map[string]string) ([]byte, error) {
+	var b []byte
+	switch v := body.(type) {
+	case []byte:
+		b = v
+	default:
+		var err error
+		b, err = json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Add(k, v)
+	}
+
+	client := &http.Client{Timeout: notificationHTTPTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return respBody, fmt.Errorf("got status %s from %s: %s", resp.Status, req.URL.Host, respBody)
+	}
+	return respBody, nil
+}
+
+// Template helper so that values can be safely embedded in json bodies
+func templateJSON(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+var templateFuncs = template.FuncMap{
+	"json": templateJSON,
+}
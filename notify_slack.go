@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+const (
+	// Progress is shown by editing the start message in place
+	slackModeUpdate = "update"
+	// Progress is posted as replies in the thread of the start message
+	slackModeThread = "thread"
+
+	progressBarWidth = 20
+
+	// Action ids of the buttons on approval requests
+	slackApproveAction = "approve"
+	slackRejectAction  = "reject"
+)
+
+var slackAPIURL = "https://slack.com/api"
+
+type slackWebhookNotifier struct {
+	url string
+}
+
+// Posts through the slack web api, which unlike webhooks allows the start message
+// to be updated and replied to as the roll progresses.
+type slackAPINotifier struct {
+	token       string
+	channel     string
+	mode        string
+	oncallGroup string
+	// Set once the start message has been posted
+	channelID string
+	ts        string
+	startText string
+}
+
+type slackText struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+type slackButton struct {
+	Type     string     `json:"type"`
+	Text     *slackText `json:"text"`
+	ActionID string     `json:"action_id"`
+	Value    string     `json:"value"`
+	Style    string     `json:"style,omitempty"`
+}
+
+type slackBlock struct {
+	Type string     `json:"type"`
+	Text *slackText `json:"text,omitempty"`
+	// Either slackText or slackButton elements
+	Elements []interface{} `json:"elements,omitempty"`
+}
+
+type slackMessage struct {
+	Channel        string       `json:"channel,omitempty"`
+	Text           string       `json:"text"`
+	Blocks         []slackBlock `json:"blocks,omitempty"`
+	Ts             string       `json:"ts,omitempty"`
+	ThreadTs       string       `json:"thread_ts,omitempty"`
+	ReplyBroadcast bool         `json:"reply_broadcast,omitempty"`
+}
+
+type slackAPIResponse struct {
+	Ok      bool   `json:"ok"`
+	Error   string `json:"error"`
+	Channel string `json:"channel"`
+	Ts      string `json:"ts"`
+}
+
+func newSlackWebhookNotifier(url string) *slackWebhookNotifier {
+	return &slackWebhookNotifier{url: url}
+}
+
+func (n *slackWebhookNotifier) name() string {
+	return "slack webhook"
+}
+
+func (n *slackWebhookNotifier) notify(msg notification) error {
+	_, err := postJSON(n.url, slackMessage{Text: msg.text}, nil)
+	return err
+}
+
+func newSlackAPINotifier(token, channel, mode, oncallGroup string) *slackAPINotifier {
+	return &slackAPINotifier{
+		token:       token,
+		channel:     channel,
+		mode:        mode,
+		oncallGroup: oncallGroup,
+	}
+}
+
+func (n *slackAPINotifier) name() string {
+	return fmt.Sprintf("slack channel %s", n.channel)
+}
+
+func (n *slackAPINotifier) notify(msg notification) error {
+	if msg.kind == notifyStart {
+		return n.postStart(msg)
+	}
+	if msg.approval != "" {
+		return n.postApproval(msg)
+	}
+	if n.ts == "" {
+		// The start message never made it, there is nothing to update or reply to
+		_, err := n.call("chat.postMessage", slackMessage{Channel: n.channel, Text: msg.text})
+		return err
+	}
+
+	switch msg.kind {
+	case notifyProgress:
+		if n.mode == slackModeThread {
+			return n.reply(msg.text, false)
+		}
+		return n.update(msg)
+	case notifyFailure:
+		text := msg.text
+		if n.oncallGroup != "" {
+			text = fmt.Sprintf("<!subteam^%s> %s", n.oncallGroup, text)
+		}
+		err := n.reply(text, true)
+		if err != nil {
+			return err
+		}
+		return n.update(msg)
+	default:
+		err := n.reply(msg.text, msg.kind == notifyFinish)
+		if err != nil {
+			return err
+		}
+		return n.update(msg)
+	}
+}
+
+func (n *slackAPINotifier) postStart(msg notification) error {
+	n.startText = msg.text
+	resp, err := n.call("chat.postMessage", slackMessage{
+		Channel: n.channel,
+		Text:    msg.text,
+		Blocks:  n.blocks(msg),
+	})
+	if err != nil {
+		return err
+	}
+	n.channelID = resp.Channel
+	n.ts = resp.Ts
+	return nil
+}
+
+// Edits the start message with the latest progress of every component
+func (n *slackAPINotifier) update(msg notification) error {
+	_, err := n.call("chat.update", slackMessage{
+		Channel: n.channelID,
+		Ts:      n.ts,
+		Text:    n.startText,
+		Blocks:  n.blocks(msg),
+	})
+	return err
+}
+
+func (n *slackAPINotifier) reply(text string, broadcast bool) error {
+	_, err := n.call("chat.postMessage", slackMessage{
+		Channel:        n.channelID,
+		Text:           text,
+		ThreadTs:       n.ts,
+		ReplyBroadcast: broadcast,
+	})
+	return err
+}
+
+// Asks for approval with approve and reject buttons, in the thread of the start
+// message when there is one. The clicks are sent by slack to the roller http server.
+func (n *slackAPINotifier) postApproval(msg notification) error {
+	text := msg.text
+	if n.oncallGroup != "" {
+		text = fmt.Sprintf("<!subteam^%s> %s", n.oncallGroup, text)
+	}
+	message := slackMessage{
+		Channel: n.channel,
+		Text:    text,
+		Blocks: []slackBlock{
+			{
+				Type: "section",
+				Text: &slackText{Type: "mrkdwn", Text: text},
+			},
+			{
+				Type: "actions",
+				Elements: []interface{}{
+					slackButton{
+						Type:     "button",
+						Text:     &slackText{Type: "plain_text", Text: "Approve"},
+						ActionID: slackApproveAction,
+						Value:    msg.approval,
+						Style:    "primary",
+					},
+					slackButton{
+						Type:     "button",
+						Text:     &slackText{Type: "plain_text", Text: "Reject"},
+						ActionID: slackRejectAction,
+						Value:    msg.approval,
+						Style:    "danger",
+					},
+				},
+			},
+		},
+	}
+	if n.ts != "" {
+		message.Channel = n.channelID
+		message.ThreadTs = n.ts
+		message.ReplyBroadcast = true
+	}
+	_, err := n.call("chat.postMessage", message)
+	return err
+}
+
+func (n *slackAPINotifier) blocks(msg notification) []slackBlock {
+	blocks := []slackBlock{
+		{
+			Type: "header",
+			Text: &slackText{Type: "plain_text", Text: fmt.Sprintf("Rolling update of %s", kubernetesCluster)},
+		},
+		{
+			Type: "section",
+			Text: &slackText{Type: "mrkdwn", Text: n.startText},
+		},
+	}
+
+	if len(msg.progress) > 0 {
+		blocks = append(blocks, slackBlock{Type: "divider"})
+	}
+	for _, p := range msg.progress {
+		blocks = append(blocks, slackBlock{
+			Type: "section",
+			Text: &slackText{
+				Type: "mrkdwn",
+				Text: fmt.Sprintf("*%s* `%s`\n`%s` %d/%d replaced, %d replacements healthy",
+					p.name, p.phase, progressBar(p.replaced, p.total, progressBarWidth), p.replaced, p.total, p.healthy),
+			},
+		})
+	}
+
+	blocks = append(blocks, slackBlock{
+		Type: "context",
+		Elements: []interface{}{
+			slackText{Type: "mrkdwn", Text: fmt.Sprintf("Last update: %s", time.Now().Format(time.RFC822))},
+		},
+	})
+	return blocks
+}
+
+// Calls a slack web api method. The api answers with a 200 even on failures so the
+// ok field of the response has to be checked.
+func (n *slackAPINotifier) call(method string, body interface{}) (*slackAPIResponse, error) {
+	headers := map[string]string{
+		"Authorization": fmt.Sprintf("Bearer %s", n.token),
+	}
+	b, err := postJSON(fmt.Sprintf("%s/%s", slackAPIURL, method), body, headers)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &slackAPIResponse{}
+	err = json.Unmarshal(b, resp)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse the slack %s response: %s", method, err)
+	}
+	if !resp.Ok {
+		return resp, fmt.Errorf("slack %s failed: %s", method, resp.Error)
+	}
+	return resp, nil
+}
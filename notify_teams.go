@@ -0,0 +1,51 @@
+package main
+
+import (
+	"strings"
+)
+
+type teamsNotifier struct {
+	url string
+}
+
+// Legacy actionable message card, which is what the teams incoming webhooks accept
+type teamsMessageCard struct {
+	Type       string `json:"@type"`
+	Context    string `json:"@context"`
+	Summary    string `json:"summary"`
+	Title      string `json:"title"`
+	Text       string `json:"text"`
+	ThemeColor string `json:"themeColor"`
+}
+
+func newTeamsNotifier(url string) *teamsNotifier {
+	return &teamsNotifier{url: url}
+}
+
+func (n *teamsNotifier) name() string {
+	return "microsoft teams webhook"
+}
+
+func (n *teamsNotifier) notify(msg notification) error {
+	color := "0076D7"
+	switch msg.kind {
+	case notifyFailure:
+		color = "D70000"
+	case notifyComponent:
+		color = "2EB886"
+	case notifyApproval:
+		color = "FFA500"
+	}
+
+	card := teamsMessageCard{
+		Type:    "MessageCard",
+		Context: "https://schema.org/extensions",
+		Summary: msg.title,
+		Title:   msg.title,
+		// Teams renders the text as markdown, which needs blank lines to break lines
+		Text:       strings.Replace(msg.text, "\n", "\n\n", -1),
+		ThemeColor: color,
+	}
+	_, err := postJSON(n.url, card, nil)
+	return err
+}
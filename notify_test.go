@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeNotifier struct {
+	mu       sync.Mutex
+	received []notification
+}
+
+func (n *fakeNotifier) name() string {
+	return "fake"
+}
+
+func (n *fakeNotifier) notify(msg notification) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.received = append(n.received, msg)
+	return nil
+}
+
+// Starts a server recording the request bodies it receives and answering with response
+func newFakeNotificationServer(response string) (*httptest.Server, *[]string) {
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(b))
+		w.Write([]byte(response))
+	}))
+	return server, &bodies
+}
+
+func TestParseNotificationKinds(t *testing.T) {
+	kinds, err := parseNotificationKinds("", defaultNotificationKinds)
+	if err != nil || len(kinds) != len(defaultNotificationKinds) {
+		t.Errorf("expected the default notification kinds, got %v: %s", kinds, err)
+	}
+
+	kinds, err = parseNotificationKinds("start, failure", defaultNotificationKinds)
+	if err != nil {
+		t.Errorf("got error parsing notification kinds: %s", err)
+	}
+	if len(kinds) != 2 || kinds[0] != notifyStart || kinds[1] != notifyFailure {
+		t.Errorf("expected [start failure], got %v", kinds)
+	}
+
+	_, err = parseNotificationKinds("start,bogus", defaultNotificationKinds)
+	if err == nil {
+		t.Error("expected error but got nil")
+	}
+}
+
+func TestNotificationDispatcherFiltersEvents(t *testing.T) {
+	d := newNotificationDispatcher()
+	failures := &fakeNotifier{}
+	everything := &fakeNotifier{}
+	d.add(failures, []notificationKind{notifyFailure})
+	d.add(everything, allNotificationKinds)
+
+	d.send(notification{kind: notifyStart, text: "start"})
+	d.send(notification{kind: notifyFailure, text: "failure"})
+	d.send(notification{kind: notifyFinish, text: "finish"})
+	d.close(time.Second)
+
+	if len(failures.received) != 1 || failures.received[0].text != "failure" {
+		t.Errorf("expected only the failure notification, got %v", failures.received)
+	}
+	if len(everything.received) != 3 {
+		t.Errorf("expected 3 notifications, got %v", everything.received)
+	}
+}
+
+func TestNotificationDispatcherSendAfterClose(t *testing.T) {
+	d := newNotificationDispatcher()
+	n := &fakeNotifier{}
+	d.add(n, allNotificationKinds)
+	d.close(time.Second)
+
+	d.send(notification{kind: notifyProgress, text: "paused"})
+	d.close(time.Second)
+	if len(n.received) != 0 {
+		t.Errorf("expected the notification sent once closed to be dropped, got %v", n.received)
+	}
+}
+
+func TestSlackWebhookNotifier(t *testing.T) {
+	server, bodies := newFakeNotificationServer("ok")
+	defer server.Close()
+
+	err := newSlackWebhookNotifier(server.URL).notify(notification{kind: notifyStart, text: "hello"})
+	if err != nil {
+		t.Errorf("got error posting to slack: %s", err)
+	}
+	if len(*bodies) != 1 || (*bodies)[0] != `{"text":"hello"}` {
+		t.Errorf("unexpected slack payload %v", *bodies)
+	}
+}
+
+func TestSlackAPINotifierError(t *testing.T) {
+	server, _ := newFakeNotificationServer(`{"ok": false, "error": "channel_not_found"}`)
+	defer server.Close()
+	slackAPIURL = server.URL
+
+	err := newSlackAPINotifier("fake-token", "#fake", slackModeUpdate, "").notify(notification{kind: notifyStart, text: "hello"})
+	if err == nil || !strings.Contains(err.Error(), "channel_not_found") {
+		t.Errorf("expected channel_not_found error, got %v", err)
+	}
+}
+
+func TestTeamsNotifier(t *testing.T) {
+	server, bodies := newFakeNotificationServer("1")
+	defer server.Close()
+
+	err := newTeamsNotifier(server.URL).notify(notification{kind: notifyFailure, title: "failed", text: "a\nb"})
+	if err != nil {
+		t.Errorf("got error posting to teams: %s", err)
+	}
+
+	card := teamsMessageCard{}
+	json.Unmarshal([]byte((*bodies)[0]), &card)
+	if card.Type != "MessageCard" || card.Title != "failed" || card.Text != "a\n\nb" || card.ThemeColor != "D70000" {
+		t.Errorf("unexpected teams card %+v", card)
+	}
+}
+
+func TestWebhookNotifierTemplate(t *testing.T) {
+	server, bodies := newFakeNotificationServer("")
+	defer server.Close()
+
+	n, err := newWebhookNotifier(server.URL, `{"msg": {{json .Text}}, "kind": "{{.Event}}"}`)
+	if err != nil {
+		t.Fatalf("got error parsing the webhook template: %s", err)
+	}
+	err = n.notify(notification{kind: notifyFinish, text: `done "quoted"`})
+	if err != nil {
+		t.Errorf("got error posting to the webhook: %s", err)
+	}
+	if (*bodies)[0] != `{"msg": "done \"quoted\"", "kind": "finish"}` {
+		t.Errorf("unexpected webhook payload %s", (*bodies)[0])
+	}
+
+	_, err = newWebhookNotifier(server.URL, defaultWebhookTemplate)
+	if err != nil {
+		t.Errorf("got error parsing the default webhook template: %s", err)
+	}
+}
+
+func TestPostJSONStatusError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	_, err := postJSON(server.URL, map[string]string{}, nil)
+	if err == nil {
+		t.Error("expected error but got nil")
+	}
+}
+
+func TestSMTPNotifierMessage(t *testing.T) {
+	n := newSMTPNotifier("localhost", 25, "", "", "roller@example.com", []string{"a@example.com", "b@example.com"})
+	msg := string(n.message(notification{title: "subject", text: "line1\nline2"}))
+	if !strings.Contains(msg, "To: a@example.com, b@example.com\r\n") ||
+		!strings.Contains(msg, "Subject: subject\r\n") ||
+		!strings.HasSuffix(msg, "\r\nline1\r\nline2\r\n") {
+		t.Errorf("unexpected smtp message %q", msg)
+	}
+}
+
+type fakeSlackCall struct {
+	method  string
+	message slackMessage
+}
+
+func newFakeSlackAPI() (*httptest.Server, *[]fakeSlackCall) {
+	var calls []fakeSlackCall
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		msg := slackMessage{}
+		json.NewDecoder(r.Body).Decode(&msg)
+		calls = append(calls, fakeSlackCall{method: strings.TrimPrefix(r.URL.Path, "/"), message: msg})
+		w.Write([]byte(`{"ok": true, "channel": "C123", "ts": "1234.5678"}`))
+	}))
+	return server, &calls
+}
+
+func TestSlackAPINotifierUpdatesInPlace(t *testing.T) {
+	server, calls := newFakeSlackAPI()
+	defer server.Close()
+	slackAPIURL = server.URL
+
+	progress := []componentProgress{{name: "k8s-node", phase: phaseDrain, replaced: 42, total: 120}}
+	n := newSlackAPINotifier("fake-token", "#fake", slackModeUpdate, "S0ONCALL")
+	n.notify(notification{kind: notifyStart, text: "starting"})
+	n.notify(notification{kind: notifyProgress, text: "k8s-node: 42/120 replaced", progress: progress})
+	n.notify(notification{kind: notifyFailure, text: "k8s-node failed", progress: progress})
+
+	if len(*calls) != 4 {
+		t.Fatalf("expected 4 slack calls, got %d", len(*calls))
+	}
+	if (*calls)[0].method != "chat.postMessage" || len((*calls)[0].message.Blocks) == 0 {
+		t.Errorf("expected the start message to be posted with blocks, got %+v", (*calls)[0])
+	}
+
+	update := (*calls)[1]
+	if update.method != "chat.update" || update.message.Ts != "1234.5678" || update.message.Channel != "C123" {
+		t.Errorf("expected the start message to be updated, got %+v", update)
+	}
+	found := false
+	for _, block := range update.message.Blocks {
+		if block.Text != nil && strings.Contains(block.Text.Text, "42/120 replaced") {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected the progress counters in the updated message, got %+v", update.message.Blocks)
+	}
+
+	failure := (*calls)[2]
+	if failure.message.ThreadTs != "1234.5678" || !strings.HasPrefix(failure.message.Text, "<!subteam^S0ONCALL>") {
+		t.Errorf("expected a thread reply mentioning the oncall group, got %+v", failure.message)
+	}
+}
+
+func TestSlackAPINotifierThreadMode(t *testing.T) {
+	server, calls := newFakeSlackAPI()
+	defer server.Close()
+	slackAPIURL = server.URL
+
+	n := newSlackAPINotifier("fake-token", "#fake", slackModeThread, "")
+	n.notify(notification{kind: notifyStart, text: "starting"})
+	n.notify(notification{kind: notifyProgress, text: "etcd: 1/3 replaced"})
+
+	reply := (*calls)[1]
+	if reply.method != "chat.postMessage" || reply.message.ThreadTs != "1234.5678" {
+		t.Errorf("expected progress to be replied in thread, got %+v", reply)
+	}
+}
+
+func TestProgressBar(t *testing.T) {
+	if bar := progressBar(1, 4, 8); bar != "██░░░░░░" {
+		t.Errorf("unexpected progress bar %s", bar)
+	}
+	if bar := progressBar(0, 0, 4); bar != "████" {
+		t.Errorf("unexpected progress bar %s", bar)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"text/template"
+)
+
+// Default body of the generic webhook, every field is json encoded by the template
+const defaultWebhookTemplate = `{"event": {{json .Event}}, "cluster": {{json .Cluster}}, "component": {{json .Component}}, "ansibleVersion": {{json .AnsibleVersion}}, "title": {{json .Title}}, "text": {{json .Text}}}`
+
+type webhookNotifier struct {
+	url  string
+	body *template.Template
+}
+
+// Data made available to the generic webhook body template
+type webhookPayload struct {
+	Event          string
+	Cluster        string
+	Component      string
+	AnsibleVersion string
+	Title          string
+	Text           string
+}
+
+func newWebhookNotifier(url, body string) (*webhookNotifier, error) {
+	t, err := template.New("webhook").Funcs(templateFuncs).Parse(body)
+	if err != nil {
+		return nil, err
+	}
+	return &webhookNotifier{
+		url:  url,
+		body: t,
+	}, nil
+}
+
+func (n *webhookNotifier) name() string {
+	return "webhook"
+}
+
+func (n *webhookNotifier) notify(msg notification) error {
+	var body bytes.Buffer
+	err := n.body.Execute(&body, webhookPayload{
+		Event:          string(msg.kind),
+		Cluster:        kubernetesCluster,
+		Component:      msg.component,
+		AnsibleVersion: ansibleVersion,
+		Title:          msg.title,
+		Text:           msg.text,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = postJSON(n.url, body.Bytes(), nil)
+	return err
+}
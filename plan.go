@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// Status of the report of a plan, see planModel
+const planStatus = "planned"
+
+// Describes what a roll would do, without changing anything: the components in the
+// order they would be rolled, their instances and ASGs, and the dependency graph.
+func rollPlan(awsClient *awsClient, inventory []*ec2.Instance, graph *componentGraph) (string, error) {
+	stages, err := graph.stages()
+	if err != nil {
+		return "", err
+	}
+	targets, err := newPreflightTargets(awsClient, inventory, graph.components)
+	if err != nil {
+		return "", err
+	}
+	byComponent := make(map[string]preflightTarget)
+	for _, t := range targets {
+		byComponent[t.component] = t
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Plan for cluster %s to ansible version %s\n", kubernetesCluster, ansibleVersion)
+	for i, stage := range stages {
+		fmt.Fprintf(&b, "Stage %d:\n", i+1)
+		for _, component := range stage {
+			target := byComponent[component]
+			fmt.Fprintf(&b, "  %s: %d instances to replace in %s, %s", component, len(target.instances),
+				strings.Join(target.asgs, ", "), componentStrategy(component))
+			if canaryEnabled(component) {
+				fmt.Fprintf(&b, " with a canary")
+			}
+			if deps := graph.dependencies[component]; len(deps) > 0 {
+				fmt.Fprintf(&b, ", after %s", strings.Join(deps, ", "))
+			}
+			fmt.Fprintln(&b)
+		}
+	}
+	fmt.Fprintf(&b, "Graph:\n")
+	for _, line := range strings.Split(graph.render(), "\n") {
+		fmt.Fprintf(&b, "  %s\n", line)
+	}
+	fmt.Fprintf(&b, "Estimated duration: %v\n", estimateRollDuration(inventory, graph))
+	return b.String(), nil
+}
+
+// Report of what a roll would do, each component with the instances it would replace
+func planModel(awsClient *awsClient, inventory []*ec2.Instance, graph *componentGraph) (runModel, error) {
+	m := runModel{
+		Cluster:          kubernetesCluster,
+		AnsibleVersion:   ansibleVersion,
+		TargetComponents: graph.components,
+		Status:           planStatus,
+	}
+	targets, err := newPreflightTargets(awsClient, inventory, graph.components)
+	if err != nil {
+		return m, err
+	}
+	for _, t := range targets {
+		var instances []string
+		for _, i := range t.instances {
+			instances = append(instances, *i.InstanceId)
+		}
+		m.Components = append(m.Components, componentModel{
+			Name:      t.component,
+			Status:    planStatus,
+			Phase:     phasePending,
+			Total:     len(t.instances),
+			ASGs:      t.asgs,
+			Instances: instances,
+		})
+	}
+	return m, nil
+}
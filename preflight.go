@@ -0,0 +1,358 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/golang/glog"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Maximum number of offending resources listed in a failed check
+const preflightReportLimit = 10
+
+// A component about to be rolled, as seen by the pre-flight checks
+type preflightTarget struct {
+	component string
+	instances []*ec2.Instance
+	asgs      []string
+	// Whether the component launches all its replacements before terminating anything
+	surge bool
+}
+
+type preflightCheck struct {
+	name string
+	run  func() error
+}
+
+type preflightResult struct {
+	name    string
+	skipped bool
+	err     error
+}
+
+func newPreflightTargets(awsClient *awsClient, inventory []*ec2.Instance, components []string) ([]preflightTarget, error) {
+	var targets []preflightTarget
+	for _, component := range components {
+		spec := lookupComponentSpec(component)
+		instances := spec.selectInstances(inventory)
+		asgs, err := awsClient.ec2.getUniqueTagValues(asgTagName, instances)
+		if err != nil {
+			return targets, err
+		}
+		targets = append(targets, preflightTarget{
+			component: component,
+			instances: instances,
+			asgs:      asgs,
+			surge:     spec.surges(),
+		})
+	}
+	return targets, nil
+}
+
+func preflightChecks(awsClient *awsClient, kubernetesClient kubernetesClient, lock *rollLock, targets []preflightTarget) []preflightCheck {
+	return []preflightCheck{
+		{name: "nodes-ready", run: func() error { return checkNodesReady(kubernetesClient) }},
+		{name: "pending-pods", run: func() error { return checkPendingPods(kubernetesClient, preflightPendingThreshold) }},
+		{name: "aws-account", run: func() error { return checkAWSAccount(awsClient, awsAccount) }},
+		{name: "asg-capacity", run: func() error { return checkASGCapacity(awsClient, targets) }},
+		{name: "ec2-quotas", run: func() error { return checkEC2Quotas(awsClient, targets) }},
+		{name: "launch-template", run: func() error { return checkLaunchTemplates(awsClient, targets) }},
+		{name: "scaling-activities", run: func() error { return checkScalingActivities(awsClient, targets) }},
+		{name: "roll-tags", run: func() error { return checkRollTags(awsClient, targets) }},
+		{name: "roll-lock", run: func() error { return checkRollLock(lock) }},
+		{name: "pdb-evictions", run: func() error { return checkPDBEvictions(kubernetesClient) }},
+	}
+}
+
+// Runs every check, skipping the ones listed in skip, and returns an error when any of them failed
+func runPreflightChecks(checks []preflightCheck, skip []string) ([]preflightResult, error) {
+	var results []preflightResult
+	var failed []string
+
+	for _, check := range checks {
+		result := preflightResult{name: check.name}
+		for _, s := range skip {
+			if strings.TrimSpace(s) == check.name {
+				result.skipped = true
+			}
+		}
+		if !result.skipped {
+			glog.V(4).Infof("Running pre-flight check %s", check.name)
+			result.err = check.run()
+			if result.err != nil {
+				failed = append(failed, check.name)
+			}
+		}
+		results = append(results, result)
+	}
+
+	if len(failed) > 0 {
+		return results, fmt.Errorf("pre-flight checks failed: %s", strings.Join(failed, ", "))
+	}
+	return results, nil
+}
+
+func preflightReport(results []preflightResult) string {
+	report := "Pre-flight checks:\n"
+	for _, r := range results {
+		switch {
+		case r.skipped:
+			report += fmt.Sprintf("  [SKIP] %s\n", r.name)
+		case r.err != nil:
+			report += fmt.Sprintf("  [FAIL] %s: %s\n", r.name, r.err)
+		default:
+			report += fmt.Sprintf("  [PASS] %s\n", r.name)
+		}
+	}
+	return report
+}
+
+// Formats a list of offending resources, truncated to preflightReportLimit entries
+func limitList(items []string) string {
+	if len(items) > preflightReportLimit {
+		return fmt.Sprintf("%s and %d more", strings.Join(items[:preflightReportLimit], ", "), len(items)-preflightReportLimit)
+	}
+	return strings.Join(items, ", ")
+}
+
+func nodeReady(node corev1.Node) bool {
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == corev1.NodeReady {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+func checkNodesReady(client kubernetesClient) error {
+	nodes, err := client.getNodes(metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	var notReady []string
+	for _, node := range nodes.Items {
+		if !nodeReady(node) {
+			notReady = append(notReady, node.Name)
+		}
+	}
+	if len(notReady) > 0 {
+		return fmt.Errorf("%d nodes are not ready: %s", len(notReady), limitList(notReady))
+	}
+	return nil
+}
+
+func checkPendingPods(client kubernetesClient, threshold time.Duration) error {
+	pods, err := client.getPods(metav1.NamespaceAll, metav1.ListOptions{
+		FieldSelector: "status.phase=Pending",
+	})
+	if err != nil {
+		return err
+	}
+	var pending []string
+	for _, pod := range pods.Items {
+		if pod.Status.Phase == corev1.PodPending && time.Since(pod.CreationTimestamp.Time) > threshold {
+			pending = append(pending, fmt.Sprintf("%s/%s", pod.Namespace, pod.Name))
+		}
+	}
+	if len(pending) > 0 {
+		return fmt.Errorf("%d pods have been pending for more than %v: %s", len(pending), threshold, limitList(pending))
+	}
+	return nil
+}
+
+func checkASGCapacity(awsClient *awsClient, targets []preflightTarget) error {
+	var problems []string
+	for _, target := range targets {
+		for _, asg := range target.asgs {
+			desired, err := awsClient.autoscaling.getDesiredCount(asg)
+			if err != nil {
+				return err
+			}
+			inService, err := awsClient.autoscaling.getInServiceCount(asg)
+			if err != nil {
+				return err
+			}
+			if int64(inService) != desired {
+				problems = append(problems, fmt.Sprintf("ASG %s has %d instances in service for a desired count of %d", asg, inService, desired))
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// Ensures the running On-Demand vCPU quotas leave room for the instances launched by
+// the components which surge
+func checkEC2Quotas(awsClient *awsClient, targets []preflightTarget) error {
+	params := &ec2.DescribeInstancesInput{
+		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String("instance-state-name"),
+				Values: aws.StringSlice([]string{"pending", "running"}),
+			},
+		},
+	}
+	running, err := awsClient.ec2.describeInstances(params)
+	if err != nil {
+		return err
+	}
+
+	typeSet := make(map[string]struct{})
+	for _, instance := range running {
+		typeSet[aws.StringValue(instance.InstanceType)] = struct{}{}
+	}
+	var types []string
+	for t := range typeSet {
+		types = append(types, t)
+	}
+	vcpus, err := awsClient.ec2.getInstanceTypeVCPUs(types)
+	if err != nil {
+		return err
+	}
+
+	// Spot instances count against separate quotas
+	usage := make(map[string]int64)
+	for _, instance := range running {
+		if instance.InstanceLifecycle != nil {
+			continue
+		}
+		instanceType := aws.StringValue(instance.InstanceType)
+		usage[vcpuQuotaCode(instanceType)] += vcpus[instanceType]
+	}
+
+	surge := make(map[string]int64)
+	for _, target := range targets {
+		if !target.surge {
+			continue
+		}
+		for _, instance := range target.instances {
+			if instance.InstanceLifecycle != nil {
+				continue
+			}
+			instanceType := aws.StringValue(instance.InstanceType)
+			surge[vcpuQuotaCode(instanceType)] += vcpus[instanceType]
+		}
+	}
+
+	var problems []string
+	var codes []string
+	for code := range surge {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	for _, code := range codes {
+		quota, err := awsClient.quotas.getEC2Quota(code)
+		if err != nil {
+			return err
+		}
+		required := usage[code] + surge[code]
+		if float64(required) > quota {
+			problems = append(problems, fmt.Sprintf("quota %s allows %.0f vCPUs but %d are in use and the roll needs %d more", code, quota, usage[code], surge[code]))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func checkLaunchTemplates(awsClient *awsClient, targets []preflightTarget) error {
+	var problems []string
+	for _, target := range targets {
+		for _, asg := range target.asgs {
+			group, err := awsClient.autoscaling.getAutoscalingGroup(asg)
+			if err != nil {
+				return err
+			}
+
+			template := group.LaunchTemplate
+			if template == nil && group.MixedInstancesPolicy != nil && group.MixedInstancesPolicy.LaunchTemplate != nil {
+				template = group.MixedInstancesPolicy.LaunchTemplate.LaunchTemplateSpecification
+			}
+
+			var imageID string
+			switch {
+			case template != nil:
+				imageID, err = awsClient.ec2.getLaunchTemplateImage(aws.StringValue(template.LaunchTemplateId),
+					aws.StringValue(template.LaunchTemplateName), aws.StringValue(template.Version))
+			case group.LaunchConfigurationName != nil:
+				imageID, err = awsClient.autoscaling.getLaunchConfigurationImage(*group.LaunchConfigurationName)
+			default:
+				err = fmt.Errorf("no launch template or launch configuration")
+			}
+			if err == nil {
+				err = awsClient.ec2.validateImage(imageID)
+			}
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("ASG %s: %s", asg, err))
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func checkScalingActivities(awsClient *awsClient, targets []preflightTarget) error {
+	var problems []string
+	for _, target := range targets {
+		for _, asg := range target.asgs {
+			activities, err := awsClient.autoscaling.getInProgressActivities(asg)
+			if err != nil {
+				return err
+			}
+			if len(activities) > 0 {
+				problems = append(problems, fmt.Sprintf("ASG %s has scaling activities in progress: %s", asg, limitList(activities)))
+			}
+			refreshes, err := awsClient.autoscaling.getInProgressInstanceRefreshes(asg)
+			if err != nil {
+				return err
+			}
+			if len(refreshes) > 0 {
+				problems = append(problems, fmt.Sprintf("ASG %s has an instance refresh in progress: %s", asg, limitList(refreshes)))
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func checkRollLock(lock *rollLock) error {
+	holder, err := lock.heldBy()
+	if err != nil {
+		return err
+	}
+	if holder != "" {
+		return fmt.Errorf("another roll holds the lock: %s", holder)
+	}
+	return nil
+}
+
+// Draining a node blocks on any pod disruption budget which does not allow evictions
+func checkPDBEvictions(client kubernetesClient) error {
+	pdbs, err := client.getPodDisruptionBudgets(metav1.NamespaceAll)
+	if err != nil {
+		return err
+	}
+	var blocking []string
+	for _, pdb := range pdbs.Items {
+		if pdb.Status.ExpectedPods > 0 && pdb.Status.DisruptionsAllowed < 1 {
+			blocking = append(blocking, fmt.Sprintf("%s/%s", pdb.Namespace, pdb.Name))
+		}
+	}
+	if len(blocking) > 0 {
+		return fmt.Errorf("%d pod disruption budgets do not allow any eviction: %s", len(blocking), limitList(blocking))
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestNodeReady(t *testing.T) {
+	node := corev1.Node{}
+	if nodeReady(node) {
+		t.Errorf("expected a node without conditions not to be ready")
+	}
+
+	node.Status.Conditions = []corev1.NodeCondition{
+		{Type: corev1.NodeMemoryPressure, Status: corev1.ConditionFalse},
+		{Type: corev1.NodeReady, Status: corev1.ConditionTrue},
+	}
+	if !nodeReady(node) {
+		t.Errorf("expected the node to be ready")
+	}
+
+	node.Status.Conditions[1].Status = corev1.ConditionUnknown
+	if nodeReady(node) {
+		t.Errorf("expected a node with an unknown ready condition not to be ready")
+	}
+}
+
+func TestCheckPendingPods(t *testing.T) {
+	client := newFakeClient()
+	defer func() { fakePodList = &corev1.PodList{} }()
+
+	fakePodList = &corev1.PodList{
+		Items: []corev1.Pod{
+			{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:              "recent",
+					Namespace:         "default",
+					CreationTimestamp: metav1.NewTime(time.Now()),
+				},
+				Status: corev1.PodStatus{Phase: corev1.PodPending},
+			},
+		},
+	}
+	err := checkPendingPods(client, 5*time.Minute)
+	if err != nil {
+		t.Errorf("expected recently created pods to be ignored, got %s", err)
+	}
+
+	fakePodList.Items = append(fakePodList.Items, corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              "stuck",
+			Namespace:         "default",
+			CreationTimestamp: metav1.NewTime(time.Now().Add(-10 * time.Minute)),
+		},
+		Status: corev1.PodStatus{Phase: corev1.PodPending},
+	})
+	err = checkPendingPods(client, 5*time.Minute)
+	if err == nil || !strings.Contains(err.Error(), "default/stuck") {
+		t.Errorf("expected default/stuck to be reported, got %v", err)
+	}
+}
+
+func TestCheckPDBEvictions(t *testing.T) {
+	client := newFakeClient()
+	defer func() { fakePodDisruptionBudgetList = &policyv1beta1.PodDisruptionBudgetList{} }()
+
+	fakePodDisruptionBudgetList = &policyv1beta1.PodDisruptionBudgetList{
+		Items: []policyv1beta1.PodDisruptionBudget{
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: "healthy", Namespace: "default"},
+				Status:     policyv1beta1.PodDisruptionBudgetStatus{ExpectedPods: 3, DisruptionsAllowed: 1},
+			},
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: "unused", Namespace: "default"},
+				Status:     policyv1beta1.PodDisruptionBudgetStatus{ExpectedPods: 0, DisruptionsAllowed: 0},
+			},
+		},
+	}
+	err := checkPDBEvictions(client)
+	if err != nil {
+		t.Errorf("expected no blocking pod disruption budget, got %s", err)
+	}
+
+	fakePodDisruptionBudgetList.Items = append(fakePodDisruptionBudgetList.Items, policyv1beta1.PodDisruptionBudget{
+		ObjectMeta: metav1.ObjectMeta{Name: "blocking", Namespace: "kube-system"},
+		Status:     policyv1beta1.PodDisruptionBudgetStatus{ExpectedPods: 2, DisruptionsAllowed: 0},
+	})
+	err = checkPDBEvictions(client)
+	if err == nil || !strings.Contains(err.Error(), "kube-system/blocking") {
+		t.Errorf("expected kube-system/blocking to be reported, got %v", err)
+	}
+}
+
+func TestRunPreflightChecks(t *testing.T) {
+	ran := make(map[string]bool)
+	check := func(name string, err error) preflightCheck {
+		return preflightCheck{name: name, run: func() error {
+			ran[name] = true
+			return err
+		}}
+	}
+	checks := []preflightCheck{
+		check("passing", nil),
+		check("failing", fmt.Errorf("broken")),
+		check("skipped", fmt.Errorf("should not run")),
+	}
+
+	results, err := runPreflightChecks(checks, []string{" skipped"})
+	if err == nil || err.Error() != "pre-flight checks failed: failing" {
+		t.Errorf("expected only the failing check to be reported, got %v", err)
+	}
+	if ran["skipped"] {
+		t.Errorf("expected the skipped check not to run")
+	}
+
+	expected := "Pre-flight checks:\n  [PASS] passing\n  [FAIL] failing: broken\n  [SKIP] skipped\n"
+	if report := preflightReport(results); report != expected {
+		t.Errorf("expected report %q, got %q", expected, report)
+	}
+
+	_, err = runPreflightChecks(checks, []string{"failing", "skipped"})
+	if err != nil {
+		t.Errorf("expected no error when failing checks are skipped, got %s", err)
+	}
+}
+
+func TestLimitList(t *testing.T) {
+	var items []string
+	for i := 0; i < preflightReportLimit+3; i++ {
+		items = append(items, fmt.Sprintf("item-%d", i))
+	}
+	if l := limitList(items[:2]); l != "item-0, item-1" {
+		t.Errorf("unexpected list %q", l)
+	}
+	if l := limitList(items); !strings.HasSuffix(l, "item-9 and 3 more") {
+		t.Errorf("expected the list to be truncated, got %q", l)
+	}
+}
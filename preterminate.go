@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// How long a pre-termination command gets to finish unless its timeoutSeconds says otherwise
+	defaultPreTerminateTimeout = 10 * time.Minute
+	// How often the invocation of a pre-termination command is polled at first, and at most
+	preTerminatePollInterval    = 5 * time.Second
+	preTerminateMaxPollInterval = 30 * time.Second
+)
+
+// A Systems Manager document sent to the original instances of a component before
+// they get terminated, such as AWS-RunShellScript to flush logs or deregister the
+// instance from a service mesh
+type ssmCommandSpec struct {
+	Document       string              `json:"document"`
+	Parameters     map[string][]string `json:"parameters"`
+	TimeoutSeconds int                 `json:"timeoutSeconds"`
+	// abort (the default) stops the roll when the command fails, ignore terminates the
+	// instance anyway
+	OnFailure string `json:"onFailure"`
+}
+
+func (s *ssmCommandSpec) validate(component string) error {
+	if s.Document == "" {
+		return fmt.Errorf("the preTerminateCommand of component %s needs a document", component)
+	}
+	switch s.OnFailure {
+	case "", hookFailureAbort, hookFailureIgnore:
+	default:
+		return fmt.Errorf("the preTerminateCommand of component %s has an unknown onFailure %q", component, s.OnFailure)
+	}
+	return nil
+}
+
+func (s *ssmCommandSpec) timeout() time.Duration {
+	if s.TimeoutSeconds > 0 {
+		return time.Duration(s.TimeoutSeconds) * time.Second
+	}
+	return defaultPreTerminateTimeout
+}
+
+func (s *rollerState) recordCommand(c *componentType, result ssmCommandResult) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c.commands = append(c.commands, result)
+}
+
+// Runs the preTerminateCommand of the component on the instance, if it has one, and
+// records its outcome in the run report. A failing command aborts the roll and its
+// error is returned, unless it is set to be ignored.
+func runPreTerminateCommand(awsClient *awsClient, myComponent *componentType, instanceID string, interval time.Duration) error {
+	spec := myComponent.spec.PreTerminateCommand
+	if spec == nil {
+		return nil
+	}
+
+	glog.V(2).Infof("Running %s on %s instance %s before terminating it", spec.Document, myComponent.name, instanceID)
+	ctx, cancel := state.waitContext()
+	defer cancel()
+	w := waiter{
+		what:        fmt.Sprintf("%s to run on %s", spec.Document, instanceID),
+		timeout:     spec.timeout(),
+		interval:    interval,
+		backoff:     2,
+		maxInterval: preTerminateMaxPollInterval,
+	}
+	result, err := awsClient.ssm.runCommand(ctx, w, instanceID, spec.Document, spec.Parameters)
+	state.recordCommand(myComponent, result)
+	if err == nil {
+		glog.V(4).Infof("Command %s on %s output: %s", result.CommandID, instanceID, result.Output)
+		return nil
+	}
+
+	err = fmt.Errorf("the pre-termination command of %s failed: %s", myComponent.name, err)
+	if spec.OnFailure == hookFailureIgnore {
+		glog.Errorf("%s, terminating %s anyway", err, instanceID)
+		return nil
+	}
+	state.abort(err)
+	return err
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Phases a component goes through while it is being rolled
+const (
+	phasePending   = "pending"
+	phaseSurge     = "surge"
+	phaseCanary    = "canary"
+	phaseSoak      = "soak"
+	phaseVerify    = "verify"
+	phaseCordon    = "cordon"
+	phaseDrain     = "drain"
+	phaseTerminate = "terminate"
+	phaseDone      = "done"
+	phaseFailed    = "failed"
+	phaseSkipped   = "skipped"
+)
+
+// Point in time copy of a component progress, safe to hand over to the notifiers
+type componentProgress struct {
+	name     string
+	phase    string
+	replaced int
+	healthy  int
+	total    int
+}
+
+// Renders a text progress bar of the given width
+func progressBar(done, total, width int) string {
+	filled := width
+	if total > 0 {
+		filled = done * width / total
+	}
+	if filled > width {
+		filled = width
+	}
+	return strings.Repeat("█", filled) + strings.Repeat("░", width-filled)
+}
+
+func (s *rollerState) progressSnapshot() []componentProgress {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var progress []componentProgress
+	for _, c := range s.components {
+		progress = append(progress, componentProgress{
+			name:     c.name,
+			phase:    c.phase,
+			replaced: c.replaced,
+			healthy:  c.healthy,
+			total:    c.total,
+		})
+	}
+	return progress
+}
+
+// Moves a component to a new phase and lets the notifiers know about it
+func (s *rollerState) setPhase(c *componentType, phase string) {
+	s.mu.Lock()
+	changed := c.phase != phase
+	c.phase = phase
+	s.mu.Unlock()
+
+	if changed {
+		s.notifyProgress(c)
+	}
+}
+
+// Records old instances terminated and replacement instances verified for a component
+func (s *rollerState) addProgress(c *componentType, replaced, healthy int) {
+	s.mu.Lock()
+	c.replaced += replaced
+	c.healthy += healthy
+	s.mu.Unlock()
+
+	s.notifyProgress(c)
+}
+
+func (s *rollerState) notifyProgress(c *componentType) {
+	model := s.runModel(c.name)
+	if model.Component == nil {
+		return
+	}
+	s.notify(notifyProgress, fmt.Sprintf("Roll of %s on %s: %s", c.name, kubernetesCluster, model.Component.Phase),
+		s.templates.render(s.templates.progress, model), c.name)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/golang/glog"
+)
+
+// Tag of the instances whose scale-in protection the roll changed, so that it can be
+// put back by -cleanup
+const rollerTagScaleIn = "roller:scale-in-protection"
+
+// Values of the roller:scale-in-protection tag
+const (
+	scaleInProtectionAdded   = "added"
+	scaleInProtectionRemoved = "removed"
+)
+
+// Scale-in protection changed by the roll on the instances of an ASG
+type scaleInChange struct {
+	asg     string
+	added   []string
+	removed []string
+}
+
+// Protects every instance of the ASGs of the component from scale-in but the originals
+// about to be terminated, which lose their protection, so that the ASGs can only pick
+// the originals when scaling back in. Returns what changed, to be restored once the
+// terminations are done.
+func protectReplacements(awsClient *awsClient, c *componentType, originals []string) ([]scaleInChange, error) {
+	terminating := make(map[string]bool)
+	for _, id := range originals {
+		terminating[id] = true
+	}
+
+	var changes []scaleInChange
+	for _, asg := range c.asgs {
+		group, err := awsClient.autoscaling.getAutoscalingGroup(asg)
+		if err != nil {
+			return changes, err
+		}
+		change := scaleInChange{asg: asg}
+		for _, i := range group.Instances {
+			id := aws.StringValue(i.InstanceId)
+			protected := aws.BoolValue(i.ProtectedFromScaleIn)
+			switch {
+			case terminating[id] && protected:
+				change.removed = append(change.removed, id)
+			case !terminating[id] && !protected:
+				change.added = append(change.added, id)
+			}
+		}
+
+		glog.V(4).Infof("Protecting %v of ASG %s from scale-in, and not %v", change.added, asg, change.removed)
+		err = awsClient.autoscaling.setScaleInProtection(asg, change.added, true)
+		if err != nil {
+			return changes, fmt.Errorf("unable to protect the instances of ASG %s from scale-in: %s", asg, err)
+		}
+		tagRollInstances(awsClient, change.added, map[string]string{rollerTagScaleIn: scaleInProtectionAdded})
+		err = awsClient.autoscaling.setScaleInProtection(asg, change.removed, false)
+		if err != nil {
+			changes = append(changes, scaleInChange{asg: asg, added: change.added})
+			return changes, fmt.Errorf("unable to remove the scale-in protection of the original instances of ASG %s: %s", asg, err)
+		}
+		tagRollInstances(awsClient, change.removed, map[string]string{rollerTagScaleIn: scaleInProtectionRemoved})
+		changes = append(changes, change)
+	}
+	return changes, nil
+}
+
+// Puts the scale-in protection back the way the ASGs had it, on the instances still in them
+func restoreScaleInProtection(awsClient *awsClient, changes []scaleInChange) {
+	for _, change := range changes {
+		group, err := awsClient.autoscaling.getAutoscalingGroup(change.asg)
+		if err != nil {
+			glog.Errorf("an error occurred restoring the scale-in protection of ASG %s.\nError %s", change.asg, err)
+			continue
+		}
+		inGroup := make(map[string]bool)
+		for _, i := range group.Instances {
+			inGroup[aws.StringValue(i.InstanceId)] = true
+		}
+		for _, restore := range []struct {
+			instances []string
+			protected bool
+		}{{change.added, false}, {change.removed, true}} {
+			var instances []string
+			for _, id := range restore.instances {
+				if inGroup[id] {
+					instances = append(instances, id)
+				}
+			}
+			if len(instances) == 0 {
+				continue
+			}
+			err = awsClient.autoscaling.setScaleInProtection(change.asg, instances, restore.protected)
+			if err == nil {
+				err = awsClient.ec2.untagInstances(instances, []string{rollerTagScaleIn})
+			}
+			if err != nil {
+				glog.Errorf("an error occurred restoring the scale-in protection of %v in ASG %s.\nError %s", instances, change.asg, err)
+			}
+		}
+	}
+}
+
+// Whether the instance is a replacement which passed its health check, and must not
+// be terminated
+func (c *componentType) isReplacement(instanceID string) bool {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	for _, id := range c.replacements {
+		if id == instanceID {
+			return true
+		}
+	}
+	return false
+}
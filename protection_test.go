@@ -0,0 +1,90 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+)
+
+func fakeASGInstances(protection map[string]bool) *autoscaling.DescribeAutoScalingGroupsOutput {
+	group := &autoscaling.Group{AutoScalingGroupName: aws.String("nodes")}
+	for _, id := range []string{"i-1", "i-2", "i-3", "i-4"} {
+		if protected, ok := protection[id]; ok {
+			group.Instances = append(group.Instances, &autoscaling.Instance{InstanceId: aws.String(id), ProtectedFromScaleIn: aws.Bool(protected)})
+		}
+	}
+	return &autoscaling.DescribeAutoScalingGroupsOutput{AutoScalingGroups: []*autoscaling.Group{group}}
+}
+
+func TestProtectReplacements(t *testing.T) {
+	defer func(st *rollerState) { state = st }(state)
+	defer resetFakeTags()
+	defer func() { fakeSetInstanceProtectionInputs = nil }()
+	state = fakeRollerState()
+	state.runID = "20200102T030405Z"
+	awsClient := &awsClient{
+		ec2:         newAWSEc2Controller(newFakeAWSEc2Client()),
+		autoscaling: newAWSAutoscalingController(newFakeAWSAutoscalingClient()),
+	}
+	c := &componentType{name: "k8s-node", asgs: []string{"nodes"}}
+
+	// i-1 and i-2 are the originals, i-4 got launched protected by the ASG
+	fakeDescribeAutoScalingGroupsOutput = fakeASGInstances(map[string]bool{"i-1": true, "i-2": false, "i-3": false, "i-4": true})
+	changes, err := protectReplacements(awsClient, c, []string{"i-1", "i-2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || strings.Join(changes[0].added, ",") != "i-3" || strings.Join(changes[0].removed, ",") != "i-1" {
+		t.Fatalf("expected i-3 protected and i-1 unprotected, got %+v", changes)
+	}
+	if len(fakeSetInstanceProtectionInputs) != 2 || !aws.BoolValue(fakeSetInstanceProtectionInputs[0].ProtectedFromScaleIn) ||
+		aws.BoolValue(fakeSetInstanceProtectionInputs[1].ProtectedFromScaleIn) {
+		t.Errorf("expected the protection set then removed, got %v", fakeSetInstanceProtectionInputs)
+	}
+	if len(fakeCreateTagsInputs) != 2 || ec2Tags(fakeCreateTagsInputs[1].Tags)[rollerTagScaleIn] != scaleInProtectionRemoved {
+		t.Errorf("expected the changes tagged, got %v", fakeCreateTagsInputs)
+	}
+
+	// The originals are gone, only the protection added to i-3 gets removed
+	fakeSetInstanceProtectionInputs = nil
+	fakeDescribeAutoScalingGroupsOutput = fakeASGInstances(map[string]bool{"i-3": true, "i-4": true})
+	restoreScaleInProtection(awsClient, changes)
+	if len(fakeSetInstanceProtectionInputs) != 1 || aws.StringValue(fakeSetInstanceProtectionInputs[0].InstanceIds[0]) != "i-3" ||
+		aws.BoolValue(fakeSetInstanceProtectionInputs[0].ProtectedFromScaleIn) {
+		t.Errorf("expected the protection of i-3 removed, got %v", fakeSetInstanceProtectionInputs)
+	}
+}
+
+func TestTerminateInstancesSparesReplacements(t *testing.T) {
+	defer func(st *rollerState) { state = st }(state)
+	state = fakeRollerState()
+	awsClient := &awsClient{ec2: newAWSEc2Controller(newFakeAWSEc2Client())}
+	c := &componentType{name: "k8s-node", replacements: []string{"i-3"}}
+
+	err := terminateInstances(awsClient, []string{"i-3"}, c, 0)
+	if err == nil || !strings.Contains(err.Error(), "refusing to terminate i-3") {
+		t.Errorf("expected the replacement to be spared, got %v", err)
+	}
+}
+
+func TestReplacementsOutOfOrder(t *testing.T) {
+	defer func(st *rollerState) { state = st }(state)
+	state = fakeApprovalState(nil)
+	c := &componentType{name: "k8s-node", asgs: []string{"nodes"}, spec: componentSpec{PollIntervalSeconds: 1}}
+
+	instances := findAndVerifyOutOfOrder(t, c)
+	sort.Strings(instances)
+	replacements := append([]string(nil), c.replacements...)
+	sort.Strings(replacements)
+	if strings.Join(instances, ",") != "i-a,i-b,i-c" || strings.Join(replacements, ",") != "i-a,i-b,i-c" {
+		t.Errorf("expected the 3 instances recorded as replacements, got %v and %v", instances, replacements)
+	}
+	for _, id := range []string{"i-a", "i-b", "i-c"} {
+		if !c.isReplacement(id) {
+			t.Errorf("expected %s to be spared as a replacement", id)
+		}
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/golang/glog"
+)
+
+// Most batches of messages read from the launch events queue at once
+const launchQueueDrainLimit = 50
+
+// A launch of an instance by an ASG, from its scaling activities or a notification
+type launchEvent struct {
+	// Replacement batch of the component the launch belongs to
+	Batch      int
+	ASG        string
+	ActivityID string
+	// Empty until the instance is launched, and for failed launches
+	Instance string
+	Status   string
+	Message  string
+	Time     time.Time
+	// Launched in place of a spot instance EC2 reclaimed, rather than for the roll
+	Interruption bool
+}
+
+func (e launchEvent) failed() bool {
+	return e.Status == autoscaling.ScalingActivityStatusCodeFailed
+}
+
+// Where the launches of the ASGs come from
+type launchEventSource interface {
+	// Returns the launches of the ASG known so far
+	launchEvents(asg string) ([]launchEvent, error)
+}
+
+// Launches from the scaling activities of the ASGs
+type activityLaunchSource struct {
+	autoscaling *awsAutoscalingController
+}
+
+func (s activityLaunchSource) launchEvents(asg string) ([]launchEvent, error) {
+	return s.autoscaling.getLaunchActivities(asg)
+}
+
+// Launches from the EventBridge EC2 Instance Launch Successful and Unsuccessful events
+// of the ASGs, or their launch lifecycle notifications, delivered to an SQS queue
+// dedicated to the cluster
+type queueLaunchSource struct {
+	sqs      *awsSQSController
+	queueURL string
+	mu       sync.Mutex
+	// Launches received so far, by ASG and activity
+	events map[string]map[string]launchEvent
+}
+
+func newQueueLaunchSource(sqs *awsSQSController, queueURL string) *queueLaunchSource {
+	return &queueLaunchSource{
+		sqs:      sqs,
+		queueURL: queueURL,
+		events:   make(map[string]map[string]launchEvent),
+	}
+}
+
+func (s *queueLaunchSource) launchEvents(asg string) ([]launchEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.drain()
+	if err != nil {
+		return nil, err
+	}
+	var events []launchEvent
+	for _, e := range s.events[asg] {
+		events = append(events, e)
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].Time.After(events[j].Time) })
+	return events, nil
+}
+
+// Reads the messages waiting in the queue. They all get deleted, the queue only
+// holds the launch events of the cluster.
+func (s *queueLaunchSource) drain() error {
+	for i := 0; i < launchQueueDrainLimit; i++ {
+		messages, err := s.sqs.receiveMessages(s.queueURL)
+		if err != nil {
+			return fmt.Errorf("unable to read the launch events queue: %s", err)
+		}
+		if len(messages) == 0 {
+			return nil
+		}
+		for _, m := range messages {
+			event, ok := parseLaunchMessage(aws.StringValue(m.Body))
+			if ok {
+				if s.events[event.ASG] == nil {
+					s.events[event.ASG] = make(map[string]launchEvent)
+				}
+				s.events[event.ASG][event.ActivityID] = event
+			} else {
+				glog.V(4).Infof("Ignoring message %s of the launch events queue", aws.StringValue(m.MessageId))
+			}
+			err = s.sqs.deleteMessage(s.queueURL, m)
+			if err != nil {
+				glog.Errorf("an error occurred deleting message %s of the launch events queue.\nError %s", aws.StringValue(m.MessageId), err)
+			}
+		}
+	}
+	return nil
+}
+
+// Parses an EventBridge launch event or a launch lifecycle notification
+func parseLaunchMessage(body string) (launchEvent, bool) {
+	var msg struct {
+		DetailType string `json:"detail-type"`
+		Detail     struct {
+			AutoScalingGroupName string
+			ActivityID           string `json:"ActivityId"`
+			EC2InstanceID        string `json:"EC2InstanceId"`
+			StatusMessage        string
+			StartTime            string
+			Cause                string
+		} `json:"detail"`
+		LifecycleTransition  string
+		AutoScalingGroupName string
+		EC2InstanceID        string `json:"EC2InstanceId"`
+		RequestID            string `json:"RequestId"`
+		Time                 string
+	}
+	err := json.Unmarshal([]byte(body), &msg)
+	if err != nil {
+		return launchEvent{}, false
+	}
+
+	event := launchEvent{
+		ASG:        msg.Detail.AutoScalingGroupName,
+		ActivityID: msg.Detail.ActivityID,
+		Instance:   msg.Detail.EC2InstanceID,
+		Message:    msg.Detail.StatusMessage,
+		// Lifecycle notifications do not give the cause of the launch
+		Interruption: isSpotInterruption(msg.Detail.Cause),
+	}
+	event.Time, _ = time.Parse(time.RFC3339, msg.Detail.StartTime)
+	switch {
+	case msg.DetailType == "EC2 Instance Launch Successful":
+		event.Status = autoscaling.ScalingActivityStatusCodeSuccessful
+	case msg.DetailType == "EC2 Instance Launch Unsuccessful":
+		event.Status = autoscaling.ScalingActivityStatusCodeFailed
+		event.Instance = ""
+	case msg.LifecycleTransition == "autoscaling:EC2_INSTANCE_LAUNCHING":
+		event = launchEvent{
+			ASG:        msg.AutoScalingGroupName,
+			ActivityID: msg.RequestID,
+			Instance:   msg.EC2InstanceID,
+			Status:     autoscaling.ScalingActivityStatusCodeMidLifecycleAction,
+		}
+		event.Time, _ = time.Parse(time.RFC3339, msg.Time)
+	default:
+		return launchEvent{}, false
+	}
+	return event, event.ASG != "" && event.ActivityID != ""
+}
+
+// The launches the ASGs of a component make in response to one step of the roll, such
+// as raising their desired counts or terminating an instance
+type replacementBatch struct {
+	id        int
+	component *componentType
+	source    launchEventSource
+	// When the batch started, to fall back on the launch time of the instances
+	start time.Time
+	// Activities of the ASGs which were there before the batch started
+	known map[string]bool
+}
+
+// Starts a batch of replacements of the component, to be called right before the step
+// launching them. Without a launch source, or when the launches of its ASGs can not be
+// listed, the replacements are the instances launched after the batch started.
+func (s *rollerState) startReplacementBatch(c *componentType) *replacementBatch {
+	s.mu.Lock()
+	c.batches++
+	b := &replacementBatch{
+		id:        c.batches,
+		component: c,
+		source:    s.launchSource,
+		start:     time.Now(),
+		known:     make(map[string]bool),
+	}
+	s.mu.Unlock()
+
+	if b.source == nil {
+		return b
+	}
+	for _, asg := range c.asgs {
+		events, err := b.source.launchEvents(asg)
+		if err != nil {
+			glog.Errorf("an error occurred listing the launches of ASG %s, falling back on the launch time of the instances.\nError %s", asg, err)
+			b.source = nil
+			return b
+		}
+		for _, e := range events {
+			b.known[e.ActivityID] = true
+		}
+	}
+	return b
+}
+
+// Launches of the ASGs of the component since the batch started
+func (b *replacementBatch) launches() ([]launchEvent, error) {
+	var launches []launchEvent
+	for _, asg := range b.component.asgs {
+		events, err := b.source.launchEvents(asg)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range events {
+			if b.known[e.ActivityID] {
+				continue
+			}
+			e.Batch = b.id
+			launches = append(launches, e)
+		}
+	}
+	return launches, nil
+}
+
+// Leaves the failed launches of the ASG out of the batch, once a fallback gave it
+// another chance
+func (b *replacementBatch) skipFailures(asg string) error {
+	launches, err := b.launches()
+	if err != nil {
+		return err
+	}
+	for _, e := range launches {
+		if e.ASG == asg && e.failed() {
+			b.known[e.ActivityID] = true
+		}
+	}
+	return nil
+}
+
+// Waits for count instances launched by the batch, giving up as soon as one of the
+// launches fails
+func findBatchReplacements(ctx context.Context, w waiter, b *replacementBatch, count int) ([]string, error) {
+	c := b.component
+	var launches []launchEvent
+	err := w.wait(ctx, func() (bool, error) {
+		var err error
+		launches, err = b.launches()
+		if err != nil {
+			return false, fmt.Errorf("an error occurred looking for replacement %s instances: %s", c.name, err)
+		}
+		launched := 0
+		for _, e := range launches {
+			// The ASG also fills in for the spot instances EC2 reclaims, whatever happens to those launches
+			if e.Interruption {
+				continue
+			}
+			if e.failed() {
+				return false, &launchFailureError{component: c.name, launch: e}
+			}
+			if e.Instance != "" {
+				launched++
+			}
+		}
+		glog.Infof("Found %d/%d replacement %s instances of batch %d - %s\n", launched, count, c.name, b.id, timeStamp())
+		return launched >= count, nil
+	})
+	state.recordLaunches(c, launches)
+
+	var instances []string
+	for _, e := range launches {
+		if e.Instance != "" && !e.failed() && !e.Interruption {
+			instances = append(instances, e.Instance)
+		}
+	}
+	if errors.Is(err, errWaitTimeout) {
+		return instances, fmt.Errorf("Found %d/%d replacement %s instances. Giving up", len(instances), count, c.name)
+	}
+	return instances, err
+}
+
+// Keeps the launches of the component for the run report, the latest state of each
+func (s *rollerState) recordLaunches(c *componentType, launches []launchEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range launches {
+		found := false
+		for i := range c.launches {
+			if c.launches[i].ActivityID == e.ActivityID {
+				c.launches[i] = e
+				found = true
+				break
+			}
+		}
+		if !found {
+			c.launches = append(c.launches, e)
+		}
+	}
+}
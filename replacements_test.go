@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// Local stand-in for the launch events of the ASGs
+type localLaunchSource struct {
+	mu     sync.Mutex
+	events map[string][]launchEvent
+	err    error
+}
+
+func (s *localLaunchSource) launchEvents(asg string) ([]launchEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]launchEvent(nil), s.events[asg]...), s.err
+}
+
+func (s *localLaunchSource) launch(e launchEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events[e.ASG] = append([]launchEvent{e}, s.events[e.ASG]...)
+}
+
+type FakeAwsSQSClient struct {
+	messages []*sqs.Message
+	deleted  int
+}
+
+func (s *FakeAwsSQSClient) receiveMessage(input *sqs.ReceiveMessageInput) (*sqs.ReceiveMessageOutput, error) {
+	n := len(s.messages)
+	if n > 10 {
+		n = 10
+	}
+	out := &sqs.ReceiveMessageOutput{Messages: s.messages[:n]}
+	s.messages = s.messages[n:]
+	return out, nil
+}
+
+func (s *FakeAwsSQSClient) deleteMessage(input *sqs.DeleteMessageInput) (*sqs.DeleteMessageOutput, error) {
+	s.deleted++
+	return &sqs.DeleteMessageOutput{}, nil
+}
+
+func TestGetLaunchActivities(t *testing.T) {
+	defer func() { fakeDescribeScalingActivitiesOutput = &autoscaling.DescribeScalingActivitiesOutput{} }()
+	fakeDescribeScalingActivitiesOutput = &autoscaling.DescribeScalingActivitiesOutput{
+		Activities: []*autoscaling.Activity{
+			{ActivityId: aws.String("a3"), Description: aws.String("Launching a new EC2 instance.  Status Reason: Could not launch On-Demand Instances. InsufficientInstanceCapacity"), StatusCode: aws.String("Failed"), StatusMessage: aws.String("InsufficientInstanceCapacity")},
+			{ActivityId: aws.String("a2"), Description: aws.String("Terminating EC2 instance: i-0123456789abcdef0"), StatusCode: aws.String("Successful")},
+			{ActivityId: aws.String("a1"), Description: aws.String("Launching a new EC2 instance: i-0fedcba9876543210"), StatusCode: aws.String("Successful")},
+		},
+	}
+	launches, err := newAWSAutoscalingController(newFakeAWSAutoscalingClient()).getLaunchActivities("nodes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(launches) != 2 {
+		t.Fatalf("expected the 2 launch activities, got %+v", launches)
+	}
+	if !launches[0].failed() || launches[0].Instance != "" || launches[0].Message != "InsufficientInstanceCapacity" {
+		t.Errorf("expected the failed launch without an instance, got %+v", launches[0])
+	}
+	if launches[1].Instance != "i-0fedcba9876543210" || launches[1].ASG != "nodes" {
+		t.Errorf("expected the launched instance, got %+v", launches[1])
+	}
+}
+
+func TestParseLaunchMessage(t *testing.T) {
+	tests := map[string]launchEvent{
+		`{"detail-type": "EC2 Instance Launch Successful", "detail": {"AutoScalingGroupName": "nodes", "ActivityId": "a1", "EC2InstanceId": "i-1", "StartTime": "2020-01-02T03:04:05.678Z"}}`: {
+			ASG: "nodes", ActivityID: "a1", Instance: "i-1", Status: "Successful", Time: time.Date(2020, 1, 2, 3, 4, 5, 678000000, time.UTC),
+		},
+		`{"detail-type": "EC2 Instance Launch Unsuccessful", "detail": {"AutoScalingGroupName": "nodes", "ActivityId": "a2", "EC2InstanceId": "", "StatusMessage": "The image id does not exist"}}`: {
+			ASG: "nodes", ActivityID: "a2", Status: "Failed", Message: "The image id does not exist",
+		},
+		`{"detail-type": "EC2 Instance Launch Successful", "detail": {"AutoScalingGroupName": "nodes", "ActivityId": "a4", "EC2InstanceId": "i-4", "Cause": "At 2020-01-02T03:04:05Z an instance was launched in response to an EC2 instance rebalance recommendation."}}`: {
+			ASG: "nodes", ActivityID: "a4", Instance: "i-4", Status: "Successful", Interruption: true,
+		},
+		`{"LifecycleTransition": "autoscaling:EC2_INSTANCE_LAUNCHING", "AutoScalingGroupName": "nodes", "RequestId": "a3", "EC2InstanceId": "i-3"}`: {
+			ASG: "nodes", ActivityID: "a3", Instance: "i-3", Status: "MidLifecycleAction",
+		},
+	}
+	for body, expected := range tests {
+		event, ok := parseLaunchMessage(body)
+		if !ok || event != expected {
+			t.Errorf("expected %+v for %s, got %+v", expected, body, event)
+		}
+	}
+
+	for _, body := range []string{`{"Event": "autoscaling:TEST_NOTIFICATION"}`, `{"detail-type": "EC2 Instance Terminate Successful"}`, `not json`} {
+		if _, ok := parseLaunchMessage(body); ok {
+			t.Errorf("expected %s to be ignored", body)
+		}
+	}
+}
+
+func TestQueueLaunchSource(t *testing.T) {
+	client := &FakeAwsSQSClient{}
+	for i := 0; i < 12; i++ {
+		body := fmt.Sprintf(`{"detail-type": "EC2 Instance Launch Successful", "detail": {"AutoScalingGroupName": "nodes", "ActivityId": "a%d", "EC2InstanceId": "i-%d"}}`, i, i)
+		client.messages = append(client.messages, &sqs.Message{Body: aws.String(body)})
+	}
+	client.messages = append(client.messages, &sqs.Message{Body: aws.String(`{"Event": "autoscaling:TEST_NOTIFICATION"}`)})
+
+	source := newQueueLaunchSource(newAWSSQSController(client), "https://sqs.us-east-1.amazonaws.com/1/launches")
+	events, err := source.launchEvents("nodes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 12 || client.deleted != 13 {
+		t.Errorf("expected the 12 launches and every message deleted, got %d launches and %d deleted", len(events), client.deleted)
+	}
+	// Launches stay known once read off the queue
+	events, _ = source.launchEvents("nodes")
+	if len(events) != 12 {
+		t.Errorf("expected the launches to be kept, got %d", len(events))
+	}
+}
+
+func TestFindBatchReplacements(t *testing.T) {
+	s := fakeApprovalState(nil)
+	defer func(st *rollerState) { state = st }(state)
+	state = s
+
+	source := &localLaunchSource{events: map[string][]launchEvent{
+		"nodes": {{ASG: "nodes", ActivityID: "old", Instance: "i-old", Status: "Successful"}},
+	}}
+	s.launchSource = source
+	c := &componentType{name: "k8s-node", asgs: []string{"nodes"}}
+	w := waiter{what: "test", timeout: time.Second, interval: time.Millisecond}
+
+	batch := s.startReplacementBatch(c)
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		source.launch(launchEvent{ASG: "nodes", ActivityID: "new1", Instance: "i-new1", Status: "InProgress"})
+		source.launch(launchEvent{ASG: "nodes", ActivityID: "new2", Instance: "i-new2", Status: "Successful"})
+	}()
+	instances, err := findBatchReplacements(context.Background(), w, batch, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(instances) != 2 || strings.Contains(strings.Join(instances, ","), "i-old") {
+		t.Errorf("expected the 2 instances launched by the batch, got %v", instances)
+	}
+	if len(c.launches) != 2 || c.launches[0].Batch != 1 {
+		t.Errorf("expected the launches of batch 1 in the report, got %+v", c.launches)
+	}
+
+	// A failed launch is surfaced right away rather than once the wait times out
+	batch = s.startReplacementBatch(c)
+	source.launch(launchEvent{ASG: "nodes", ActivityID: "new3", Status: "Failed", Message: "InsufficientInstanceCapacity"})
+	w.timeout = time.Minute
+	start := time.Now()
+	_, err = findBatchReplacements(context.Background(), w, batch, 1)
+	if err == nil || !strings.Contains(err.Error(), "InsufficientInstanceCapacity") || time.Since(start) > 10*time.Second {
+		t.Errorf("expected the failed launch right away, got %v", err)
+	}
+	if batch.id != 2 || c.launches[2].Batch != 2 {
+		t.Errorf("expected the failed launch in batch 2, got %+v", c.launches)
+	}
+
+	// The launches filling in for reclaimed spot instances are not the roll's, even failed
+	batch = s.startReplacementBatch(c)
+	source.launch(launchEvent{ASG: "nodes", ActivityID: "spot1", Status: "Failed", Message: "InsufficientInstanceCapacity", Interruption: true})
+	source.launch(launchEvent{ASG: "nodes", ActivityID: "spot2", Instance: "i-spot2", Status: "Successful", Interruption: true})
+	source.launch(launchEvent{ASG: "nodes", ActivityID: "new4", Instance: "i-new4", Status: "Successful"})
+	instances, err = findBatchReplacements(context.Background(), w, batch, 1)
+	if err != nil || strings.Join(instances, ",") != "i-new4" {
+		t.Errorf("expected only the launch of the roll, got %v and %v", instances, err)
+	}
+
+	// Without the launches, the batch falls back on the launch time of the instances
+	source.err = fmt.Errorf("throttled")
+	batch = s.startReplacementBatch(c)
+	if batch.source != nil {
+		t.Errorf("expected the batch to fall back on the launch time")
+	}
+}
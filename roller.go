@@ -1,16 +1,14 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
-	"io/ioutil"
-	"net/http"
 	"os"
+	"os/signal"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	corev1 "k8s.io/api/core/v1"
@@ -23,27 +21,29 @@ import (
 )
 
 var (
-	cluster                  = os.Getenv("CLUSTER")
-	awsAccount               = os.Getenv("AWS_ACCOUNT")
-	awsProfile               = os.Getenv("AWS_PROFILE")
-	awsRegion                = os.Getenv("AWS_REGION")
-	slackToken               = os.Getenv("SLACK_WEBHOOK")
-	rollerComponents         = os.Getenv("ROLLER_COMPONENTS")
-	rollerLogLevel           = os.Getenv("ROLLER_LOG_LEVEL")
-	ansibleVersion           = os.Getenv("ANSIBLE_VERSION")
-	kubernetesServer         = os.Getenv("KUBERNETES_SERVER")
-	kubernetesToken          = os.Getenv("KUBERNETES_TOKEN")
-	terminationWaitPeriodStr = os.Getenv("TERMINATION_WAIT_PERIOD_SECONDS")
-	desiredCountStepStr      = os.Getenv("TERMINATION_BATCH_NODES_SIZE")
-	desiredCountStep         = 5
-	state                    *rollerState
-	kubernetesCluster        string
-	targetComponents         []string
-	defaultComponents        = []string{
-		"k8s-node",
-		"k8s-master",
-		"etcd",
-	}
+	cluster                           = os.Getenv("CLUSTER")
+	awsAccount                        = os.Getenv("AWS_ACCOUNT")
+	awsProfile                        = os.Getenv("AWS_PROFILE")
+	awsRegion                         = os.Getenv("AWS_REGION")
+	rollerComponents                  = os.Getenv("ROLLER_COMPONENTS")
+	rollerComponentOrder              = os.Getenv("ROLLER_COMPONENT_ORDER")
+	rollerConfigPath                  = os.Getenv("ROLLER_CONFIG")
+	planOnly                          = flag.Bool("plan", false, "Print the components which would be rolled and in which order, then exit")
+	fleetPath                         = flag.String("fleet", "", "Roll the clusters listed in this fleet file in waves")
+	fleetReportFile                   = os.Getenv("FLEET_REPORT_FILE")
+	cleanupOnly                       = flag.Bool("cleanup", false, "Put back the instances and ASGs left tagged by an interrupted roll, then exit")
+	daemonPath                        = flag.String("daemon", "", "Keep rolling the clusters listed in this daemon file during their maintenance windows")
+	rollerReportFile                  = os.Getenv("ROLLER_REPORT_FILE")
+	rollerLogLevel                    = os.Getenv("ROLLER_LOG_LEVEL")
+	ansibleVersion                    = os.Getenv("ANSIBLE_VERSION")
+	kubernetesServer                  = os.Getenv("KUBERNETES_SERVER")
+	kubernetesToken                   = os.Getenv("KUBERNETES_TOKEN")
+	terminationWaitPeriodStr          = os.Getenv("TERMINATION_WAIT_PERIOD_SECONDS")
+	desiredCountStepStr               = os.Getenv("TERMINATION_BATCH_NODES_SIZE")
+	desiredCountStep                  = 5
+	state                             *rollerState
+	kubernetesCluster                 string
+	targetComponents                  []string
 	clusterAutoscalerServiceName      = "cluster-autoscaler"
 	clusterAutoscalerServiceNamespace = "kube-system"
 	clusterTerminatorServiceName      = "terminator"
@@ -52,31 +52,102 @@ var (
 	terminationWaitPeriod             = time.Duration(5 * time.Second)
 	apiKey                            = os.Getenv("DATADOG_API_KEY")
 	appKey                            = os.Getenv("DATADOG_APP_KEY")
+	ddDowntimeScope                   = os.Getenv("DATADOG_DOWNTIME_SCOPE")
+	preflightSkipChecks               = os.Getenv("PREFLIGHT_SKIP_CHECKS")
+	preflightPendingThresholdStr      = os.Getenv("PREFLIGHT_PENDING_POD_THRESHOLD_SECONDS")
+	preflightPendingThreshold         = time.Duration(5 * time.Minute)
+	httpAddr                          = os.Getenv("ROLLER_HTTP_ADDR")
+	canaryComponentsStr               = os.Getenv("CANARY_COMPONENTS")
+	canarySoakStr                     = os.Getenv("CANARY_SOAK_SECONDS")
+	canaryCordonNodesStr              = os.Getenv("CANARY_CORDON_NODES")
+	canaryComponents                  []string
+	canarySoak                        = time.Duration(10 * time.Minute)
+	canaryCordonNodes                 = 0
+	httpToken                         = os.Getenv("ROLLER_HTTP_TOKEN")
+	launchEventsQueueURL              = os.Getenv("LAUNCH_EVENTS_QUEUE_URL")
+	awsRetryBudgetsStr                = os.Getenv("AWS_RETRY_BUDGETS")
+	awsAssumeRoleARN                  = os.Getenv("AWS_ASSUME_ROLE_ARN")
+	awsAssumeRoleExternalID           = os.Getenv("AWS_ASSUME_ROLE_EXTERNAL_ID")
+	awsAssumeRoleSessionName          = os.Getenv("AWS_ASSUME_ROLE_SESSION_NAME")
+	awsAssumeRoleTagSession           = os.Getenv("AWS_ASSUME_ROLE_TAG_SESSION") == "true"
+	awsAssumeRoleDurationStr          = os.Getenv("AWS_ASSUME_ROLE_DURATION_SECONDS")
+	awsAssumeRoleDuration             time.Duration
+	awsMFASerial                      = os.Getenv("AWS_MFA_SERIAL")
+	awsMFAToken                       = os.Getenv("AWS_MFA_TOKEN")
+	awsWebIdentityTokenFile           = os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE")
+)
+
+// Replacement strategies of the components
+const (
+	// Terminates each instance before verifying its replacement, see replaceInstancesTerminateAndVerify
+	strategyTerminateAndVerify = "terminate-and-verify"
+	// Surges the replacements before terminating anything, see replaceInstancesVerifyAndTerminate
+	strategyVerifyAndTerminate = "verify-and-terminate"
+	// Moves the instances to a copy of each ASG, see replaceInstancesBlueGreen
+	strategyBlueGreen = "blue-green"
 )
 
 const (
 	remainingThreshold = 10
+	// How long to wait for pending notifications to go out before exiting
+	notificationCloseTimeout = time.Minute
 )
 
 type componentType struct {
 	name      string
+	spec      componentSpec
 	start     time.Time
 	finish    time.Time
 	status    bool
 	instances []*ec2.Instance
 	asgs      []string
 	err       error
+	replaced  int
+	healthy   int
+	total     int
+	failures  int
+	// Spot instances EC2 reclaimed during the roll
+	reclaimed int
+	phase     string
+	// Desired count the roller last set on each ASG of the component
+	desired map[string]int
+	// Outcome of the pre-termination commands run on its instances
+	commands []ssmCommandResult
+	// Number of replacement batches started, and the launches of their instances
+	batches  int
+	launches []launchEvent
+	// Launch fallbacks applied to its ASGs
+	fallbacks []appliedFallback
+	// Replacement instances which passed the health check
+	replacements []string
 }
 
 type rollerState struct {
-	components        []*componentType
-	startTime         time.Time
+	mu         sync.Mutex
+	components []*componentType
+	startTime  time.Time
+	// Tagged on the instances and ASGs the roll acts on
+	runID             string
 	inventory         []*ec2.Instance
-	SlackText         string `json:"text"`
+	notifications     *notificationDispatcher
+	templates         *messageTemplates
+	operator          string
 	clusterAutoscaler clusterAutoscalerState
 	clusterTerminator clusterTerminatorState
 	downtimeID        int
+	downtimeEnd       time.Time
 	dd                *ddClientConfig
+	// Set when an abort condition fired, no instance gets terminated past this point
+	abortErr  error
+	abortCh   chan struct{}
+	approvals *approvals
+	// Set while the roll is paused, closed when it resumes
+	resumeCh chan struct{}
+	pausedBy string
+	events   []instanceEvent
+	// Where the launches of the replacement instances are found, their launch time is
+	// used instead when unset
+	launchSource launchEventSource
 }
 
 type clusterAutoscalerState struct {
@@ -95,73 +166,138 @@ func timeStamp() string {
 	return time.Now().Format(time.RFC822)
 }
 
-func (s *rollerState) SlackPost() error {
-	client := &http.Client{}
-	b, err := json.Marshal(s)
-	if err != nil {
-		return err
-	}
+func (s *rollerState) notify(kind notificationKind, title, text, component string) {
+	glog.V(4).Infof("Sending %s notification: %s", kind, text)
+	s.notifications.send(notification{
+		kind:      kind,
+		title:     title,
+		text:      text,
+		component: component,
+		progress:  s.progressSnapshot(),
+	})
+}
 
-	req, err := http.NewRequest(
-		"POST",
-		slackToken,
-		bytes.NewBuffer(b))
+func (s *rollerState) Summary() (string, string) {
+	model := s.runModel("")
+	title := fmt.Sprintf("Rolling update of %s finished with status %s", kubernetesCluster, model.Status)
+	return title, s.templates.render(s.templates.summary, model)
+}
 
-	if err != nil {
-		return err
+func (c *componentType) hasInstance(instanceID string) bool {
+	for _, i := range c.instances {
+		if *i.InstanceId == instanceID {
+			return true
+		}
 	}
+	return false
+}
 
-	req.Header.Add("Content-Type", "application/json")
+// Whether some target components have not started rolling yet
+func (s *rollerState) componentsWaiting() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	resp, err := client.Do(req)
-	if err != nil {
-		return err
+	started := make(map[string]bool)
+	for _, c := range s.components {
+		started[c.name] = c.phase != phasePending
 	}
-	defer resp.Body.Close()
-
-	_, err = ioutil.ReadAll(resp.Body)
-	return err
+	for _, name := range targetComponents {
+		if !started[name] {
+			return true
+		}
+	}
+	return false
 }
 
-func (s *rollerState) Summary() error {
-	var summary string
-	status := "success"
+func (s *rollerState) getComponent(name string) *componentType {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
 	for _, c := range s.components {
-		if !c.status {
-			status = "failure"
-			break
+		if c.name == name {
+			return c
 		}
 	}
+	return nil
+}
 
-	if s.clusterAutoscaler.status == "failure" {
-		status = "failure"
+// Records the outcome of a component roll once its replacement function returned, a
+// success unless it or resuming the ASG processes failed
+func (s *rollerState) finishComponent(name string, err error) {
+	c := s.getComponent(name)
+	if c == nil {
+		return
 	}
+	s.mu.Lock()
+	if c.finish.IsZero() {
+		c.finish = time.Now()
+	}
+	if err != nil && c.err == nil {
+		c.err = err
+	}
+	c.status = c.err == nil
+	if c.status {
+		c.phase = phaseDone
+	} else {
+		c.phase = phaseFailed
+	}
+	m := c.model()
+	s.mu.Unlock()
+	s.ddComponentEvent(m)
 
-	duration := time.Since(s.startTime)
-	summary = fmt.Sprintf("Finished a rolling update on cluster %s with the components %+v as the target components.\nOverall status: %s\nOverall duration: %v\n", kubernetesCluster, targetComponents, status, duration-(duration%time.Minute))
-
-	for _, c := range s.components {
-		var status string
-		duration := c.finish.Sub(c.start)
-		if c.status {
-			status = "success"
-		} else {
-			status = "failure"
-		}
+	if m.Status == statusSuccess {
+		s.notify(notifyComponent, fmt.Sprintf("Roll of %s completed on %s", m.Name, kubernetesCluster),
+			fmt.Sprintf("Component %s completed on cluster %s, replaced %d instances", m.Name, kubernetesCluster, m.Replaced), m.Name)
+	} else {
+		s.notify(notifyFailure, fmt.Sprintf("Roll of %s failed on %s", m.Name, kubernetesCluster),
+			fmt.Sprintf("Component %s failed on cluster %s: %s", m.Name, kubernetesCluster, m.Error), m.Name)
+	}
+}
 
-		cs := fmt.Sprintf("Component %s status: %s - duration: %v\n", c.name, status, duration-(duration%time.Minute))
-		if c.err != nil {
-			cs = cs + fmt.Sprintf("Component %s error: %s\n", c.name, c.err)
-		}
+func componentStrategy(component string) string {
+	return lookupComponentSpec(component).Strategy
+}
 
-		summary = summary + cs
+// Rolls a component with its replacement strategy and records the outcome
+func rollComponent(awsClient *awsClient, component string) error {
+	var err error
+	switch componentStrategy(component) {
+	case strategyVerifyAndTerminate:
+		err = replaceInstancesVerifyAndTerminate(awsClient, component, ansibleVersion)
+	case strategyBlueGreen:
+		err = replaceInstancesBlueGreen(awsClient, component, ansibleVersion)
+	default:
+		err = replaceInstancesTerminateAndVerify(awsClient, component, ansibleVersion)
 	}
+	if err != nil {
+		glog.Error(err)
+	}
+	state.finishComponent(component, err)
+	c := state.getComponent(component)
+	payload := newHookPayload(hookPostComponent, c, nil)
+	payload.Status = statusString(err == nil)
+	payload.Error = errorString(err)
+	hookErr := runHooks(payload)
+	if err != nil {
+		return err
+	}
+	if hookErr != nil {
+		return hookErr
+	}
+	return approveComponent(component)
+}
 
-	summary = summary + fmt.Sprintf("Cluster autoscaler enabled: %t, status: %s", s.clusterAutoscaler.enabled, s.clusterAutoscaler.status)
-
-	s.SlackText = summary
-	err := s.SlackPost()
+// Pauses once a component rolled successfully when the component gate is set, so
+// that the components waiting on it only start once approved
+func approveComponent(component string) error {
+	if !state.componentsWaiting() {
+		return nil
+	}
+	err := state.awaitApproval(gateComponent, component, fmt.Sprintf("%s-done", component),
+		fmt.Sprintf("Component %s has been rolled.", component))
+	if err != nil {
+		glog.Error(err)
+	}
 	return err
 }
 
@@ -235,24 +371,25 @@ func enableClusterTerminator(*rollerState) {
 func addComponentToState(awsClient *awsClient, component string, state *rollerState) (*componentType, error) {
 	myComponent := &componentType{
 		name:  component,
+		spec:  lookupComponentSpec(component),
 		start: time.Now(),
+		phase: phasePending,
 	}
 
-	// Get list of instances by filter on tag ServiceComponent == component
-	//	params.Filters = append(params.Filters, newEC2Filter("tag:ServiceComponent", "k8s-master"))
-	instances, err := awsClient.ec2.instancesMatchingTagValue("ServiceComponent", component, state.inventory)
-	if err != nil {
-		return myComponent, err
-	}
+	// Get list of instances matching the tags and ASGs of the component
+	instances := myComponent.spec.selectInstances(state.inventory)
 	myComponent.instances = instances
+	myComponent.total = len(instances)
 
-	asgs, err := awsClient.ec2.getUniqueTagValues("aws:autoscaling:groupName", instances)
+	asgs, err := awsClient.ec2.getUniqueTagValues(asgTagName, instances)
 	if err != nil {
 		return myComponent, err
 	}
 	myComponent.asgs = asgs
 
+	state.mu.Lock()
 	state.components = append(state.components, myComponent)
+	state.mu.Unlock()
 	return myComponent, nil
 }
 
@@ -292,6 +429,7 @@ func replaceInstancesPrepare(awsClient *awsClient, component string, scalingProc
 	}
 	glog.V(4).Infof("Component %s has starting instance Ids %v\n", component, instanceList)
 
+	tagRollASGs(awsClient, myComponent)
 	for _, asg := range myComponent.asgs {
 		glog.V(4).Infof("Suspending autoscaling processes for %s\n", asg)
 		_, err := awsClient.autoscaling.manageASGProcesses(asg, scalingProcesses, "suspend")
@@ -308,13 +446,26 @@ func resumeASGProcesses(awsClient *awsClient, scalingProcesses []*string, compon
 		glog.V(4).Infof("Resuming autoscaling processes for %s\n", asg)
 		_, err := awsClient.autoscaling.manageASGProcesses(asg, scalingProcesses, "resume")
 		if err != nil {
-			glog.Errorf("an error occurred while resuming processes on %s\n Error: %s", asg, err)
-			component.status = false
+			err = fmt.Errorf("an error occurred while resuming processes on %s\n Error: %s", asg, err)
+			glog.Errorf("%s", err)
+			state.mu.Lock()
+			if component.err == nil {
+				component.err = err
+			}
+			state.mu.Unlock()
 		}
 	}
 }
 
 func cordonKubernetesNodes(kubernetesClient kubernetesClient, instanceList []string) error {
+	return setKubernetesNodesUnschedulable(kubernetesClient, instanceList, true)
+}
+
+func uncordonKubernetesNodes(kubernetesClient kubernetesClient, instanceList []string) error {
+	return setKubernetesNodesUnschedulable(kubernetesClient, instanceList, false)
+}
+
+func setKubernetesNodesUnschedulable(kubernetesClient kubernetesClient, instanceList []string, unschedulable bool) error {
 	nodesController := kubernetesNodes{}
 	labels := make(map[string]string)
 	var nodeListToCordon []corev1.Node
@@ -331,20 +482,24 @@ func cordonKubernetesNodes(kubernetesClient kubernetesClient, instanceList []str
 
 	nodesFail := make(map[string]error)
 	for _, node := range nodeListToCordon {
-		glog.V(4).Infof("Cordoning kubernetes node: %s\n", node.Name)
-		node.Spec.Unschedulable = true
+		glog.V(4).Infof("Setting kubernetes node %s unschedulable to %t\n", node.Name, unschedulable)
+		node.Spec.Unschedulable = unschedulable
 		node := &node
 		updatedNode, err := nodesController.updateNode(kubernetesClient, node)
 		if err != nil {
 			nodesFail[node.Name] = err
+			continue
 		}
-		if !updatedNode.Spec.Unschedulable {
+		if updatedNode.Spec.Unschedulable != unschedulable {
 			nodesFail[node.Name] = fmt.Errorf("failed for unknown reason")
 		}
 	}
 
 	if len(nodesFail) > 0 {
-		return fmt.Errorf("failed to cordon nodes: %s", nodesFail)
+		if unschedulable {
+			return fmt.Errorf("failed to cordon nodes: %s", nodesFail)
+		}
+		return fmt.Errorf("failed to uncordon nodes: %s", nodesFail)
 	}
 	return nil
 }
@@ -383,11 +538,9 @@ func drainKubernetesNodes(kubernetesClient kubernetesClient, instanceList []stri
 // Terminates and checks one or more instances at a time, in a "rolling" fashion. Differs from
 // replaceInstancesVerifyAndTerminate() in that it terminates the instances before verifying replacements.
 // Useful for small ASGs or when there is an upper limit to the number of instances you can have in the an ASG.
-func replaceInstancesTerminateAndVerify(awsClient *awsClient, component, ansibleVersion string, wg *sync.WaitGroup) error {
+func replaceInstancesTerminateAndVerify(awsClient *awsClient, component, ansibleVersion string) error {
 	glog.V(4).Infof("Starting process to terminate and replace instances for %s", component)
 
-	defer wg.Done()
-
 	// The number of instances to terminate and replace at a time
 	newInstanceRollingCount := 1
 
@@ -406,23 +559,78 @@ func replaceInstancesTerminateAndVerify(awsClient *awsClient, component, ansible
 	defer resumeASGProcesses(awsClient, scalingProcesses, myComponent)
 
 	glog.V(4).Infof("Starting instance termination verify loop for component %s", myComponent.name)
-	for _, n := range myComponent.instances {
-		terminateTime := time.Now()
+	for i, n := range myComponent.instances {
+		err = state.checkAbort(myComponent)
+		if err != nil {
+			return err
+		}
+		// The ASG already filled in for a spot instance EC2 reclaimed, there is nothing to replace
+		reclaimed, reclaimErr := reclaimedInstances(awsClient, []string{*n.InstanceId})
+		if reclaimErr != nil {
+			glog.Errorf("an error occurred checking whether %s was reclaimed.\nError %s", *n.InstanceId, reclaimErr)
+		}
+		if len(reclaimed) > 0 {
+			state.recordReclaimed(myComponent, reclaimed)
+			continue
+		}
+		if myComponent.spec.Kubernetes == kubernetesRoleDrain {
+			tagInstanceState(awsClient, []string{*n.InstanceId}, instanceStateDraining)
+			err = cordonAndDrain(myComponent, []string{*n.InstanceId})
+			if err != nil {
+				return err
+			}
+		}
+		if ddDowntimeScope == "host" {
+			startHostDownTime(myComponent, *n.InstanceId)
+		}
+		err = runHooks(newHookPayload(hookPreTerminate, myComponent, n))
+		if err != nil {
+			return err
+		}
+		err = runPreTerminateCommand(awsClient, myComponent, *n.InstanceId, preTerminatePollInterval)
+		if err != nil {
+			return err
+		}
+		state.setPhase(myComponent, phaseTerminate)
+		tagInstanceState(awsClient, []string{*n.InstanceId}, instanceStatePendingTermination)
+		replacements := state.startReplacementBatch(myComponent)
 		r, err := awsClient.ec2.terminateInstance(*n.InstanceId)
 		if err != nil {
 			err = fmt.Errorf("an error occurred while terminating %s instance %s\n Error: %s\n Response: %s", myComponent.name, *n.InstanceId, err, r)
 			glog.V(4).Infof("%s", err)
 			return err
 		}
+		state.recordInstanceEvent(myComponent, *n.InstanceId, eventTerminated)
 
-		_, err = findAndVerifyReplacementInstances(awsClient, myComponent, ansibleVersion, newInstanceRollingCount, terminateTime)
+		state.setPhase(myComponent, phaseVerify)
+		newInstances, err := findAndVerifyReplacementInstances(awsClient, myComponent, ansibleVersion, newInstanceRollingCount, replacements)
 		if err != nil {
 			return err
 		}
+		tagRollInstances(awsClient, newInstances, map[string]string{rollerTagReplaces: *n.InstanceId})
+		state.addProgress(myComponent, 1, newInstanceRollingCount)
+
+		// The original instance is gone at this point, a failing canary can only abort the roll
+		if i == 0 && canaryEnabled(myComponent.name) {
+			kubernetesClient := newClient(kubernetesServer, kubernetesToken)
+			for _, canary := range newInstances {
+				err = soakCanary(kubernetesClient, myComponent, canary, myComponent.spec.Kubernetes != kubernetesRoleNone, canarySoak, canaryCheckInterval)
+				if err != nil {
+					state.abort(err)
+					return err
+				}
+			}
+		}
+
+		if i < len(myComponent.instances)-1 {
+			err = state.approveBatch(myComponent, i+1)
+			if err != nil {
+				return err
+			}
+		}
 	}
 
-	myComponent.status = true
-	myComponent.finish = time.Now()
+	untagRoll(awsClient, myComponent)
 
 	glog.V(4).Infof("Completed normal instance termination verify loop for component %s", myComponent.name)
 	return nil
@@ -431,11 +639,9 @@ func replaceInstancesTerminateAndVerify(awsClient *awsClient, component, ansible
 // Spins up new replacement instances, verifies them, and then terminates the old instances. Differs from
 // replaceInstancesTerminateAndVerify() in that it verifies replacements before terminating the old instances.
 // Useful for large ASGs when there is no upper limit to the number of instances you can have in the ASG.
-func replaceInstancesVerifyAndTerminate(awsClient *awsClient, component string, ansibleVersion string, wg *sync.WaitGroup) error {
+func replaceInstancesVerifyAndTerminate(awsClient *awsClient, component string, ansibleVersion string) error {
 	glog.V(4).Infof("Starting process to start new instances and terminate existing for %s", component)
 
-	defer wg.Done()
-
 	scalingProcesses := []*string{
 		aws.String("AZRebalance"),
 		aws.String("Terminate"),
@@ -474,12 +680,36 @@ func replaceInstancesVerifyAndTerminate(awsClient *awsClient, component string,
 		}
 	}
 
+	// Keep the On-Demand and Spot mix of the replacements the same as the originals
+	bases, err := surgeOnDemandBase(awsClient, myComponent)
+	defer restoreOnDemandBase(awsClient, bases)
+	if err != nil {
+		return err
+	}
+
 	desiredCountTarget := desiredCount * 2
 	temporaryDesiredCount := desiredCount
 	var findNewCount int
+	batch := 0
+
+	kubernetesClient := newClient(kubernetesServer, kubernetesToken)
+
+	// Replace a single instance and let it soak before surging the rest of the batches
+	if canaryEnabled(myComponent.name) && len(myComponent.asgs) > 0 {
+		_, err = runCanary(awsClient, kubernetesClient, myComponent, myComponent.asgs[0], desiredCount, instanceList)
+		if err != nil {
+			return err
+		}
+		temporaryDesiredCount++
+	}
 
 	for remaining := desiredCountTarget - temporaryDesiredCount; remaining != 0; {
 
+		err = state.checkAbort(myComponent)
+		if err != nil {
+			return err
+		}
+
 		// Ensure that someone named Derek didn't enable the autoscaler while we are rolling the cluster
 		disableClusterAutoscaler(state)
 
@@ -496,10 +726,11 @@ func replaceInstancesVerifyAndTerminate(awsClient *awsClient, component string,
 
 		glog.V(4).Infof("desiredCount is %d, desiredCountTarget is %d and temporaryDesiredCount is %d", desiredCount, desiredCountTarget, temporaryDesiredCount)
 
-		creationTime := time.Now()
+		state.setPhase(myComponent, phaseSurge)
+		replacements := state.startReplacementBatch(myComponent)
 		for _, asg := range myComponent.asgs {
 			glog.V(4).Infof("Setting desired count for ASG %s to %d", asg, temporaryDesiredCount)
-			_, err = awsClient.autoscaling.setDesiredCount(asg, int64(temporaryDesiredCount))
+			err = setDesiredCount(awsClient, myComponent, asg, temporaryDesiredCount)
 			if err != nil {
 				err = fmt.Errorf("got error when trying to set the desired count for ASG %s: %s. ", asg, err)
 				glog.V(4).Infof("%s", err)
@@ -508,32 +739,45 @@ func replaceInstancesVerifyAndTerminate(awsClient *awsClient, component string,
 		}
 
 		// Verify the new ec2 instances are created and that they are valid
-		newInstances, err := findAndVerifyReplacementInstances(awsClient, myComponent, ansibleVersion, findNewCount, creationTime)
+		state.setPhase(myComponent, phaseVerify)
+		newInstances, err := findAndVerifyReplacementInstances(awsClient, myComponent, ansibleVersion, findNewCount, replacements)
 		glog.V(4).Infof("newInstances are %v", newInstances)
 		if err != nil {
 			return err
 		}
+		state.addProgress(myComponent, 0, len(newInstances))
+
+		batch++
+		if temporaryDesiredCount != desiredCountTarget {
+			err = state.approveBatch(myComponent, batch)
+			if err != nil {
+				return err
+			}
+		}
 	}
 
-	// Mark all the old kubernetes nodes as unschedulable. This is necessary because during the following
-	// termination step, we do not want pods to be rescheduled on the old nodes
-	glog.V(4).Infof("Starting kubernetes cordon process for %s", myComponent.name)
-	kubernetesClient := newClient(kubernetesServer, kubernetesToken)
-	err = cordonKubernetesNodes(kubernetesClient, instanceList)
+	err = state.checkAbort(myComponent)
 	if err != nil {
-		err = fmt.Errorf("an error occurred attempting to cordon kubernetes nodes %s\n Error: %s", instanceList, err)
-		glog.V(4).Infof("%s", err)
+		return err
 	}
-	// Drain all previous nodes, this moves the workload onto the new nodes first, so we come up before we start killing nodes.
-	glog.V(4).Infof("Starting kubernetes drain process for %s", myComponent.name)
-	err = drainKubernetesNodes(kubernetesClient, instanceList)
+	state.mu.Lock()
+	replacementIDs := append([]string(nil), myComponent.replacements...)
+	state.mu.Unlock()
+	tagReplacedInstances(awsClient, instanceList, replacementIDs)
+
+	// Keep the ASGs from picking a replacement when their desired counts get set back
+	protection, err := protectReplacements(awsClient, myComponent, instanceList)
+	defer restoreScaleInProtection(awsClient, protection)
 	if err != nil {
-		err = fmt.Errorf("an error occurred attempting to cordon kubernetes nodes %s\n Error: %s", instanceList, err)
-		glog.V(4).Infof("%s", err)
+		return err
+	}
+	if myComponent.spec.Kubernetes == kubernetesRoleDrain {
+		tagInstanceState(awsClient, instanceList, instanceStateDraining)
+		err = cordonAndDrain(myComponent, instanceList)
+		if err != nil {
+			return err
+		}
 	}
-	// Wait for 60 seconds just to let the drain finish and things to calm down
-	glog.V(4).Infof("Pausing 1 minute for the drain to calm down")
-	time.Sleep(60 * time.Second)
 
 	// Suspend the launch process so the ASG doesn't backfill the instances we're about to terminate
 	scalingProcesses = []*string{
@@ -553,42 +797,49 @@ func replaceInstancesVerifyAndTerminate(awsClient *awsClient, component string,
 	resumeASGProcesses(awsClient, scalingProcesses, myComponent)
 
 	// Terminate the original instances one at a time and sleep for sleepSeconds in between
+	state.setPhase(myComponent, phaseTerminate)
 	err = terminateInstances(awsClient, instanceList, myComponent, terminationWaitPeriod)
 	if err != nil {
 		return err
 	}
 
+	ctx, cancel := state.waitContext()
+	defer cancel()
 	for _, asg := range myComponent.asgs {
-		asgOk := false
-		for loop := 0; loop < 30; loop++ {
-			instanceCount, err := awsClient.autoscaling.getInstanceCount(asg)
+		w := componentWaiter(myComponent, fmt.Sprintf("the old instances to leave ASG %s", asg))
+		err = w.wait(ctx, func() (bool, error) {
+			group, err := awsClient.autoscaling.getAutoscalingGroup(asg)
 			if err != nil {
-				err = fmt.Errorf("an error occurred attempting to validate number of instances in ASG %s\n Error: %s", asg, err)
-				glog.V(4).Infof("%s", err)
-				return err
+				return false, fmt.Errorf("an error occurred attempting to validate number of instances in ASG %s\n Error: %s", asg, err)
 			}
-			if instanceCount != desiredCount {
-				glog.V(4).Infof("Waiting for all nodes to terminate. Previous desired count for ASG %s must match the number"+
-					"of instances in the ASG", asg)
-				time.Sleep(30 * time.Second)
-				continue
+			// Counting the instances would not do, the ASG may have filled in for reclaimed spot instances
+			var left []string
+			for _, i := range group.Instances {
+				if myComponent.hasInstance(aws.StringValue(i.InstanceId)) {
+					left = append(left, aws.StringValue(i.InstanceId))
+				}
 			}
-			glog.V(4).Infof("All old nodes in ASG %s have terminated", asg)
-			asgOk = true
-			break
-		}
-		if !asgOk {
+			if len(left) > 0 {
+				glog.V(4).Infof("Waiting for all nodes to terminate. Old instances %v are still in ASG %s", left, asg)
+				return false, nil
+			}
+			return true, nil
+		})
+		if errors.Is(err, errWaitTimeout) {
 			err = fmt.Errorf("an error occurred attempting to validate number of instances in ASG %s\n "+
 				"Error: Timed out waiting for instances to be removed from ASG", asg)
+		}
+		if err != nil {
 			glog.V(4).Infof("%s", err)
 			return err
 		}
+		glog.V(4).Infof("All old nodes in ASG %s have terminated", asg)
 	}
 
 	// Set desired count back to what it was originally
 	for _, asg := range myComponent.asgs {
 		glog.V(4).Infof("Setting desired count for ASG %s to %d", asg, desiredCount)
-		_, err = awsClient.autoscaling.setDesiredCount(asg, int64(desiredCount))
+		err = setDesiredCount(awsClient, myComponent, asg, desiredCount)
 		if err != nil {
 			err = fmt.Errorf("got error when trying to set the desired count for ASG %s: %s. ", asg, err)
 			glog.V(4).Infof("%s", err)
@@ -596,29 +847,138 @@ func replaceInstancesVerifyAndTerminate(awsClient *awsClient, component string,
 		}
 	}
 
-	myComponent.status = true
-	myComponent.finish = time.Now()
+	untagRoll(awsClient, myComponent)
 
 	glog.V(4).Infof("Completed normal instance verify and termination loop for component %s", myComponent.name)
 	return nil
 }
 
+// Mark the old kubernetes nodes as unschedulable, so that pods do not get rescheduled on them, and drain
+// them. This moves the workload onto the new nodes first, so we come up before we start killing nodes.
+// Cordon and drain failures are only logged, as they are when rolling by hand.
+func cordonAndDrain(myComponent *componentType, instanceList []string) error {
+	kubernetesClient := newClient(kubernetesServer, kubernetesToken)
+
+	glog.V(4).Infof("Starting kubernetes cordon process for %s", myComponent.name)
+	state.setPhase(myComponent, phaseCordon)
+	err := cordonKubernetesNodes(kubernetesClient, instanceList)
+	if err != nil {
+		err = fmt.Errorf("an error occurred attempting to cordon kubernetes nodes %s\n Error: %s", instanceList, err)
+		glog.V(4).Infof("%s", err)
+	} else {
+		for _, instanceID := range instanceList {
+			state.recordInstanceEvent(myComponent, instanceID, eventCordoned)
+		}
+	}
+
+	glog.V(4).Infof("Starting kubernetes drain process for %s", myComponent.name)
+	state.setPhase(myComponent, phaseDrain)
+	err = drainKubernetesNodes(kubernetesClient, instanceList)
+	if err != nil {
+		err = fmt.Errorf("an error occurred attempting to drain kubernetes nodes %s\n Error: %s", instanceList, err)
+		glog.V(4).Infof("%s", err)
+	} else {
+		for _, instanceID := range instanceList {
+			state.recordInstanceEvent(myComponent, instanceID, eventDrained)
+		}
+	}
+
+	// Wait for 60 seconds just to let the drain finish and things to calm down
+	glog.V(4).Infof("Pausing 1 minute for the drain to calm down")
+	time.Sleep(60 * time.Second)
+	return state.checkAbort(myComponent)
+}
+
+// Sets the desired count of an ASG of the component and records it for the status
+func setDesiredCount(awsClient *awsClient, myComponent *componentType, asg string, desiredCount int) error {
+	_, err := awsClient.autoscaling.setDesiredCount(asg, int64(desiredCount))
+	if err != nil {
+		return err
+	}
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if myComponent.desired == nil {
+		myComponent.desired = make(map[string]int)
+	}
+	myComponent.desired[asg] = desiredCount
+	return nil
+}
+
 func terminateInstances(awsClient *awsClient, instanceList []string, myComponent *componentType, sleepSeconds time.Duration) error {
 	glog.V(2).Infof("Starting instance termination for %s nodes", myComponent.name)
-	for _, instanceID := range instanceList {
+	// Spot instances EC2 reclaimed are gone already, and so are their pre-termination commands
+	reclaimed, err := reclaimedInstances(awsClient, instanceList)
+	if err != nil {
+		glog.Errorf("an error occurred looking for reclaimed spot instances among %v.\nError %s", instanceList, err)
+	}
+	state.recordReclaimed(myComponent, reclaimed)
+	for _, instanceID := range withoutStrings(instanceList, reclaimed) {
+		err := state.checkAbort(myComponent)
+		if err != nil {
+			return err
+		}
+		if myComponent.isReplacement(instanceID) {
+			return fmt.Errorf("refusing to terminate %s, it is a healthy replacement %s instance", instanceID, myComponent.name)
+		}
+		err = runHooks(newHookPayload(hookPreTerminate, myComponent, findInstance(state.inventory, instanceID)))
+		if err != nil {
+			return err
+		}
+		// Failed replacements never got to run anything worth shutting down gracefully
+		if myComponent.hasInstance(instanceID) {
+			err = runPreTerminateCommand(awsClient, myComponent, instanceID, preTerminatePollInterval)
+			if err != nil {
+				return err
+			}
+		}
+		if ddDowntimeScope == "host" {
+			startHostDownTime(myComponent, instanceID)
+		}
+		tagInstanceState(awsClient, []string{instanceID}, instanceStatePendingTermination)
 		response, err := awsClient.ec2.terminateInstance(instanceID)
 		if err != nil {
 			err = fmt.Errorf("an error occurred while terminating %s instance %s\n Error: %s\n Response: %s", myComponent.name, instanceID, err, response)
 			glog.V(4).Infof("%s", err)
 			return err
 		}
+		state.recordInstanceEvent(myComponent, instanceID, eventTerminated)
+		// Failed replacements also get terminated here, only the original instances count as replaced
+		if myComponent.hasInstance(instanceID) {
+			state.addProgress(myComponent, 1, 0)
+		}
 		glog.V(2).Infof("Waiting %s for %s to terminate", sleepSeconds, instanceID)
 		time.Sleep(sleepSeconds)
 	}
 	return nil
 }
 
-func findAndVerifyReplacementInstances(awsClient *awsClient, myComponent *componentType, ansibleVersion string, desiredCount int, creationTime time.Time) ([]string, error) {
+// Mutes the datadog monitors of a single host that is about to be terminated
+func startHostDownTime(myComponent *componentType, instanceID string) {
+	host := ddHostName(instanceID, myComponent.instances)
+	glog.V(4).Infof("Setting datadog downtime for host %s", host)
+	_, err := state.dd.startHostDownTime(host, hostDowntimeDuration)
+	if err != nil {
+		glog.Errorf("an error occurred setting datadog downtime for host %s.\nError %s", host, err)
+	}
+}
+
+// Waits for the replacement instances to pass the health check of the component and
+// returns the ones which did not
+func verifyReplacementInstances(awsClient *awsClient, myComponent *componentType, instances []string) ([]string, error) {
+	ctx, cancel := state.waitContext()
+	defer cancel()
+	w := componentWaiter(myComponent, "replacement instances to be healthy")
+	switch myComponent.spec.HealthCheck {
+	case healthCheckNode:
+		return verifyReplacementNodes(ctx, w, newClient(kubernetesServer, kubernetesToken), myComponent, instances)
+	case healthCheckNone:
+		return nil, nil
+	default:
+		return awsClient.ec2.verifyReplacementInstances(ctx, w, myComponent, instances)
+	}
+}
+
+func findAndVerifyReplacementInstances(awsClient *awsClient, myComponent *componentType, ansibleVersion string, desiredCount int, replacements *replacementBatch) ([]string, error) {
 	if _, ok := provisionAttemptCounter[myComponent.name]; ok {
 		provisionAttemptCounter[myComponent.name]++
 	} else {
@@ -626,15 +986,54 @@ func findAndVerifyReplacementInstances(awsClient *awsClient, myComponent *compon
 	}
 
 	// Wait for all new nodes to come up before continuing
-	newInstances, err := awsClient.ec2.findReplacementInstances(myComponent, ansibleVersion, desiredCount, creationTime)
+	ctx, cancel := state.waitContext()
+	defer cancel()
+	w := componentWaiter(myComponent, "replacement instances")
+	var newInstances []string
+	var err error
+	if replacements.source != nil && len(myComponent.asgs) > 0 {
+		for {
+			newInstances, err = findBatchReplacements(ctx, w, replacements, desiredCount)
+			var failure *launchFailureError
+			if !errors.As(err, &failure) || !applyLaunchFallback(awsClient, myComponent, failure.launch) {
+				break
+			}
+			// The ASG keeps retrying the launches, now with the fallback
+			if skipErr := replacements.skipFailures(failure.launch.ASG); skipErr != nil {
+				break
+			}
+		}
+	} else {
+		newInstances, err = awsClient.ec2.findReplacementInstances(ctx, w, myComponent, ansibleVersion, desiredCount, replacements.start)
+	}
 	if err != nil {
 		err = fmt.Errorf("an error occurred finding the replacement instances for component %s\n Error: %s", myComponent.name, err)
 		glog.V(4).Infof("%s", err)
 		return newInstances, err
 	}
+	for _, instanceID := range newInstances {
+		state.recordInstanceEvent(myComponent, instanceID, eventLaunched)
+	}
+	tagInstanceState(awsClient, newInstances, instanceStateReplacement)
 
-	instances, err := awsClient.ec2.verifyReplacementInstances(myComponent, newInstances)
+	instances, err := verifyReplacementInstances(awsClient, myComponent, newInstances)
+	if err != nil && len(instances) > 0 {
+		// Spot replacements EC2 reclaimed while being verified did not fail, their ASGs fill in for them
+		reclaimed, reclaimErr := reclaimedInstances(awsClient, instances)
+		if reclaimErr != nil {
+			glog.Errorf("an error occurred looking for reclaimed spot instances among %v.\nError %s", instances, reclaimErr)
+		}
+		if len(reclaimed) > 0 {
+			state.recordReclaimed(myComponent, reclaimed)
+			instances = withoutStrings(instances, reclaimed)
+			newInstances = withoutStrings(newInstances, reclaimed)
+			if len(instances) == 0 {
+				err = nil
+			}
+		}
+	}
 	if err != nil {
+		myComponent.failures += len(instances)
 		if len(instances) > 0 {
 			startingInstanceCount := len(newInstances)
 			// If failure rate is at or under 25%, we will terminate and retry the failed instances. The exception
@@ -665,9 +1064,9 @@ func findAndVerifyReplacementInstances(awsClient *awsClient, myComponent *compon
 					return instances, err
 				}
 				glog.Infof("Failed to find valid replacement %s instances. Trying again", myComponent.name)
-				now := time.Now()
+				retry := state.startReplacementBatch(myComponent)
 				terminateInstances(awsClient, instances, myComponent, time.Duration(30*time.Second))
-				findAndVerifyReplacementInstances(awsClient, myComponent, ansibleVersion, len(instances), now)
+				findAndVerifyReplacementInstances(awsClient, myComponent, ansibleVersion, len(instances), retry)
 			}
 			glog.Errorf("%s", err)
 			return instances, err
@@ -678,6 +1077,28 @@ func findAndVerifyReplacementInstances(awsClient *awsClient, myComponent *compon
 		glog.V(4).Infof("%s", err)
 		return newInstances, err
 	}
+	for _, instanceID := range newInstances {
+		state.recordInstanceEvent(myComponent, instanceID, eventHealthy)
+	}
+	state.mu.Lock()
+	myComponent.replacements = append(myComponent.replacements, newInstances...)
+	state.mu.Unlock()
+
+	// The hooks get the addresses of the new instances, which are not in the inventory
+	if hasHooks(hookPostHealthy) && len(newInstances) > 0 {
+		described, err := awsClient.ec2.describeInstances(&ec2.DescribeInstancesInput{
+			Filters: []*ec2.Filter{{Name: aws.String("instance-id"), Values: aws.StringSlice(newInstances)}},
+		})
+		if err != nil {
+			glog.Errorf("an error occurred describing the replacement instances for the hooks.\nError %s", err)
+		}
+		for _, instanceID := range newInstances {
+			err = runHooks(newHookPayload(hookPostHealthy, myComponent, findInstance(described, instanceID)))
+			if err != nil {
+				return newInstances, err
+			}
+		}
+	}
 	return newInstances, nil
 }
 
@@ -685,8 +1106,6 @@ func main() {
 	flag.Parse()
 	flag.Lookup("logtostderr").Value.Set("true")
 
-	_ = os.Setenv("AWS_SDK_LOAD_CONFIG", "true")
-
 	if rollerLogLevel != "" {
 		flag.Lookup("v").Value.Set(rollerLogLevel)
 	} else {
@@ -695,6 +1114,45 @@ func main() {
 
 	glog.Info("Log level set to: ", flag.Lookup("v").Value)
 
+	// Commands driving a roller already running
+	if flag.NArg() > 0 {
+		err := runStatusCommand(flag.Args(), os.Stdout)
+		if err != nil {
+			glog.Fatalf("%s", err)
+		}
+		return
+	}
+
+	if *daemonPath != "" {
+		stop := make(chan struct{})
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		go func() {
+			<-signals
+			close(stop)
+		}()
+		runDaemon(*daemonPath, stop)
+		return
+	}
+
+	if *fleetPath != "" {
+		if !rollFleet(*fleetPath, *planOnly) {
+			glog.Flush()
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Keep the recent logs for the dashboard, before anything logs concurrently
+	var logs *logTail
+	if httpAddr != "" {
+		var err error
+		logs, err = captureLogs()
+		if err != nil {
+			glog.Errorf("Unable to capture the logs for the dashboard: %s", err)
+		}
+	}
+
 	kubernetesCluster = fmt.Sprintf("%s-%s-%s", awsAccount, awsRegion, cluster)
 
 	switch {
@@ -706,8 +1164,6 @@ func main() {
 		glog.Fatal("Set one of the variables AWS_ACCOUNT or AWS_PROFILE")
 	case ansibleVersion == "":
 		glog.Fatal("Set the ANSIBLE_VERSION variable to the desired ansible git sha")
-	case slackToken == "":
-		glog.Fatal("Set the SLACK_WEBHOOK variable to desired webhook")
 	case kubernetesServer == "":
 		glog.Fatal("Set the KUBERNETES_SERVER variable to desired kubernetes server")
 	case kubernetesToken == "":
@@ -734,12 +1190,93 @@ func main() {
 		}
 	}
 
-	// Are we going to roll all of etcd, k8s-master and k8s-node or just
-	// a subset.
+	if preflightPendingThresholdStr != "" {
+		threshold, err := strconv.ParseInt(preflightPendingThresholdStr, 10, 64)
+		if err != nil {
+			glog.Fatalf("Unable to parse PREFLIGHT_PENDING_POD_THRESHOLD_SECONDS: %s", err)
+		}
+		preflightPendingThreshold = (time.Duration(threshold) * time.Second)
+	}
+
+	if canaryComponentsStr != "" {
+		canaryComponents = strings.Split(canaryComponentsStr, ",")
+	}
+
+	if canarySoakStr != "" {
+		soak, err := strconv.ParseInt(canarySoakStr, 10, 64)
+		if err != nil {
+			glog.Fatalf("Unable to parse CANARY_SOAK_SECONDS: %s", err)
+		}
+		canarySoak = (time.Duration(soak) * time.Second)
+	}
+
+	if canaryCordonNodesStr != "" {
+		var err error
+		canaryCordonNodes, err = strconv.Atoi(canaryCordonNodesStr)
+		if err != nil {
+			glog.Fatalf("Unable to parse CANARY_CORDON_NODES: %s", err)
+		}
+	}
+
+	if awsRetryBudgetsStr != "" {
+		budgets, err := parseAWSRetryBudgets(awsRetryBudgetsStr)
+		if err != nil {
+			glog.Fatalf("Unable to parse AWS_RETRY_BUDGETS: %s", err)
+		}
+		rollerRetryer = newAWSRetryer(budgets)
+	}
+
+	if awsAssumeRoleDurationStr != "" {
+		duration, err := strconv.ParseInt(awsAssumeRoleDurationStr, 10, 64)
+		if err != nil {
+			glog.Fatalf("Unable to parse AWS_ASSUME_ROLE_DURATION_SECONDS: %s", err)
+		}
+		awsAssumeRoleDuration = (time.Duration(duration) * time.Second)
+	}
+
+	notifications, err := configureNotifiers()
+	if err != nil {
+		glog.Fatalf("Unable to configure notifications: %s", err)
+	}
+
+	templates, err := loadMessageTemplates()
+	if err != nil {
+		glog.Fatalf("Unable to load the message templates: %s", err)
+	}
+
+	approvals, err := configureApprovals(httpAddr)
+	if err != nil {
+		glog.Fatalf("Unable to configure the approval gates: %s", err)
+	}
+
+	knownComponents, err := loadComponentSpecs(rollerConfigPath)
+	if err != nil {
+		glog.Fatalf("Unable to load ROLLER_CONFIG: %s", err)
+	}
+	rollerHooks, err = loadHooks(rollerConfigPath)
+	if err != nil {
+		glog.Fatalf("Unable to load the hooks of ROLLER_CONFIG: %s", err)
+	}
+
+	// Are we going to roll all of etcd, k8s-master, k8s-node and the configured
+	// components or just a subset.
 	if rollerComponents != "" {
 		targetComponents = strings.Split(rollerComponents, ",")
 	} else {
-		targetComponents = defaultComponents
+		targetComponents = knownComponents
+	}
+
+	order := rollerComponentOrder
+	if order == "" {
+		order = defaultComponentOrder
+	}
+	dependencies, err := parseComponentOrder(order)
+	if err != nil {
+		glog.Fatalf("Unable to parse ROLLER_COMPONENT_ORDER: %s", err)
+	}
+	graph, err := newComponentGraph(targetComponents, specDependencies(dependencies))
+	if err != nil {
+		glog.Fatalf("Unable to order the components: %s", err)
 	}
 
 	awsClient := newAwsClient()
@@ -754,20 +1291,131 @@ func main() {
 		glog.Fatalf("An error occurred getting the EC2 inventory: %s.\n", err)
 	}
 
+	if *planOnly {
+		plan, err := rollPlan(awsClient, inv, graph)
+		if err != nil {
+			glog.Fatalf("An error occurred planning the roll: %s.\n", err)
+		}
+		fmt.Print(plan)
+		if rollerReportFile != "" {
+			model, err := planModel(awsClient, inv, graph)
+			if err == nil {
+				err = writeReport(rollerReportFile, model)
+			}
+			if err != nil {
+				glog.Fatalf("An error occurred writing the plan report: %s.\n", err)
+			}
+		}
+		return
+	}
+
+	if *cleanupOnly {
+		err = cleanupRoll(awsClient, newClient(kubernetesServer, kubernetesToken))
+		if err != nil {
+			glog.Fatalf("An error occurred cleaning up after the interrupted roll: %s.\n", err)
+		}
+		return
+	}
+
+	startTime := time.Now()
 	state = &rollerState{
-		startTime: time.Now(),
-		inventory: inv,
+		startTime:     startTime,
+		runID:         newRunID(startTime),
+		inventory:     inv,
+		notifications: notifications,
+		templates:     templates,
+		operator:      operatorIdentity(),
 		clusterAutoscaler: clusterAutoscalerState{
 			enabled: false,
 			status:  "success",
 		},
-		dd: newDataDogClient(apiKey, appKey),
+		dd:        newDataDogClient(apiKey, appKey),
+		approvals: approvals,
+	}
+	if launchEventsQueueURL != "" {
+		state.launchSource = newQueueLaunchSource(awsClient.sqs, launchEventsQueueURL)
+	} else {
+		state.launchSource = activityLaunchSource{autoscaling: awsClient.autoscaling}
 	}
 
-	// Set downtime in datadog for the cluster
-	state.downtimeID, err = state.dd.startDownTime([]string{fmt.Sprintf("kubernetescluster:%s", kubernetesCluster)})
+	var server *rollerServer
+	if httpAddr != "" {
+		server = newRollerServer(httpAddr, httpToken)
+		state.registerStatus(server)
+		newDashboard(state, awsClient, logs).register(server)
+		if approvals != nil {
+			approvals.register(server)
+		}
+		err = server.start()
+		if err != nil {
+			glog.Fatalf("Unable to start the http server: %s", err)
+		}
+	}
+	if approvals != nil && approvals.tty {
+		go approvals.readTTY(os.Stdin, state.operator)
+	}
+
+	// The server is stopped first so that no request sends a notification once closed
+	shutdown := func() {
+		if server != nil {
+			server.stop()
+		}
+		state.notifications.close(notificationCloseTimeout)
+	}
+
+	// Make sure the cluster is in a state where it is safe to roll before touching anything
+	kubernetesClient := newClient(kubernetesServer, kubernetesToken)
+	lock := newRollLock(kubernetesClient, state.operator)
+	watchdog, err := configureWatchdog(kubernetesClient, state.dd)
 	if err != nil {
-		glog.Errorf("an error occurred setting datadog downtime.\nError %s", err)
+		glog.Fatalf("Unable to configure the abort conditions: %s", err)
+	}
+	targets, err := newPreflightTargets(awsClient, inv, targetComponents)
+	if err != nil {
+		glog.Fatalf("An error occurred preparing the pre-flight checks: %s.\n", err)
+	}
+	var skipChecks []string
+	if preflightSkipChecks != "" {
+		skipChecks = strings.Split(preflightSkipChecks, ",")
+	}
+	results, err := runPreflightChecks(preflightChecks(awsClient, kubernetesClient, lock, targets), skipChecks)
+	report := preflightReport(results)
+	glog.Info(report)
+	if err != nil {
+		state.notify(notifyFailure, fmt.Sprintf("Rolling update of %s aborted by pre-flight checks", kubernetesCluster),
+			fmt.Sprintf("Rolling update of %s was not started.\n%s", kubernetesCluster, report), "")
+		shutdown()
+		glog.Fatalf("Not rolling the cluster: %s", err)
+	}
+
+	err = lock.acquire()
+	if err != nil {
+		glog.Fatalf("Not rolling the cluster: %s", err)
+	}
+
+	err = state.awaitApproval(gatePreflight, "", "preflight", fmt.Sprintf("Pre-flight checks passed on %s.\n%s", kubernetesCluster, report))
+	if err != nil {
+		lockErr := lock.release()
+		if lockErr != nil {
+			glog.Errorf("An error occurred releasing the roll lock.\nError %s", lockErr)
+		}
+		shutdown()
+		glog.Fatalf("Not rolling the cluster: %s", err)
+	}
+
+	// Set downtime in datadog for the whole cluster, sized from the estimated roll duration, unless
+	// downtimes are scoped to the individual hosts as they get terminated
+	stopDownTimeWatch := make(chan struct{})
+	if ddDowntimeScope != "host" {
+		estimate := estimateRollDuration(inv, graph)
+		glog.V(4).Infof("Estimated roll duration is %v", estimate)
+		state.downtimeID, err = state.dd.startDownTime([]string{fmt.Sprintf("kubernetescluster:%s", kubernetesCluster)}, estimate)
+		if err != nil {
+			glog.Errorf("an error occurred setting datadog downtime.\nError %s", err)
+		} else {
+			state.downtimeEnd = time.Now().Add(estimate)
+			go state.watchDownTime(stopDownTimeWatch)
+		}
 	}
 
 	// Only manage the cluster autoscaler if rolling the k8s-node component.
@@ -779,53 +1427,31 @@ func main() {
 		}
 	}
 
-	state.SlackText = fmt.Sprintf("Starting a rolling update on cluster %s with the components %+v as the target components.\nAnsible version is set to %s\nManagement of cluster autoscaler is set to %t", kubernetesCluster, targetComponents, ansibleVersion, state.clusterAutoscaler.enabled)
+	startTitle := fmt.Sprintf("Rolling update started on %s", kubernetesCluster)
+	startText := state.templates.render(state.templates.start, state.runModel(""))
+	state.notify(notifyStart, startTitle, startText, "")
 
-	err = state.SlackPost()
-	glog.V(4).Infof("Slack Post: %s", state.SlackText)
+	err = state.dd.postEvent(startTitle, startText, "info", ddTags(""))
 	if err != nil {
-		glog.Errorf("an error occurred posting to slack.\nError %s", err)
+		glog.Errorf("an error occurred posting the datadog event.\nError %s", err)
 	}
 
-	var wg sync.WaitGroup
-	var masterWg sync.WaitGroup
+	// Keep an eye on the cluster while it rolls, halting the terminations if anything goes wrong
+	stopWatchdog := make(chan struct{})
+	go state.watch(watchdog, stopWatchdog)
 
-	// Roll through the master instances
-	for _, component := range targetComponents {
-		if component == "k8s-master" {
-			masterWg.Add(1)
-			go func(component string) {
-				err := replaceInstancesTerminateAndVerify(awsClient, component, ansibleVersion, &masterWg)
-				if err != nil {
-					glog.Error(err)
-				}
-			}(component)
-		}
-	}
+	// Roll the components as soon as their prerequisites are done. A failing pre-roll hook
+	// aborts the roll, the components then stop before replacing anything.
+	runHooks(newHookPayload(hookPreRoll, nil, nil))
+	graph.run(func(component string) error {
+		return rollComponent(awsClient, component)
+	})
+	close(stopWatchdog)
 
-	// Roll through the node or etcd instances
-	for _, component := range targetComponents {
-		if component != "k8s-master" {
-			wg.Add(1)
-			go func(component string) {
-				var err error
-				// Batch replace k8s-worker nodes and replace one at a time for etcd components
-				if component == "k8s-node" {
-					glog.V(2).Info("Waiting for any masters to complete before continuing with nodes")
-					masterWg.Wait()
-					err = replaceInstancesVerifyAndTerminate(awsClient, component, ansibleVersion, &wg)
-				} else {
-					err = replaceInstancesTerminateAndVerify(awsClient, component, ansibleVersion, &wg)
-				}
-				if err != nil {
-					glog.Error(err)
-				}
-			}(component)
-		}
-	}
-
-	wg.Wait()
-	masterWg.Wait()
+	payload := newHookPayload(hookPostRoll, nil, nil)
+	payload.Status = state.runModel("").Status
+	payload.Error = errorString(state.abortError())
+	runHooks(payload)
 
 	if state.clusterAutoscaler.enabled {
 		enableClusterAutoscaler(state)
@@ -833,14 +1459,31 @@ func main() {
 	}
 
 	// End datadog downtime
-	err = state.dd.endDownTime(state.downtimeID)
+	close(stopDownTimeWatch)
+	if ddDowntimeScope != "host" {
+		err = state.dd.endDownTime(state.downtimeID)
+		if err != nil {
+			glog.Errorf("An error occurred unsetting the datadog downtime.\nError %s", err)
+		}
+	}
+
+	err = state.ddSubmitMetrics()
 	if err != nil {
-		glog.Errorf("An error occurred unsetting the datadog downtime.\nError %s", err)
+		glog.Errorf("An error occurred submitting the datadog metrics.\nError %s", err)
 	}
 
-	err = state.Summary()
+	err = lock.release()
 	if err != nil {
-		glog.Errorf("an error occurred psting to slack.\nError %s", err)
+		glog.Errorf("An error occurred releasing the roll lock.\nError %s", err)
+	}
+
+	summaryTitle, summary := state.Summary()
+	state.notify(notifyFinish, summaryTitle, summary, "")
+	if rollerReportFile != "" {
+		err = writeReport(rollerReportFile, state.runModel(""))
+		if err != nil {
+			glog.Errorf("An error occurred writing the roll report.\nError %s", err)
+		}
 	}
-	glog.V(4).Infof("Slack Post: %s", state.SlackText)
+	shutdown()
 }
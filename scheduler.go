@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Masters are rolled before the nodes unless ROLLER_COMPONENT_ORDER says otherwise
+const defaultComponentOrder = "k8s-master>k8s-node"
+
+// The target components and the components each of them waits on
+type componentGraph struct {
+	components   []string
+	dependencies map[string][]string
+}
+
+// Parses comma separated chains of components, each rolled after the one on its left,
+// like etcd>k8s-master>k8s-node,k8s-node>ingress-node
+func parseComponentOrder(order string) (map[string][]string, error) {
+	dependencies := make(map[string][]string)
+	for _, chain := range strings.Split(order, ",") {
+		if strings.TrimSpace(chain) == "" {
+			continue
+		}
+		links := strings.Split(chain, ">")
+		if len(links) < 2 {
+			return nil, fmt.Errorf("invalid component order %q, expected components separated by >", chain)
+		}
+		for i := 1; i < len(links); i++ {
+			prerequisite := strings.TrimSpace(links[i-1])
+			component := strings.TrimSpace(links[i])
+			if prerequisite == "" || component == "" {
+				return nil, fmt.Errorf("invalid component order %q, empty component name", chain)
+			}
+			dependencies[component] = append(dependencies[component], prerequisite)
+		}
+	}
+	return dependencies, nil
+}
+
+// Builds the graph of the target components. Components which are not being rolled
+// are replaced by their own prerequisites, so that the order still holds across them.
+func newComponentGraph(components []string, dependencies map[string][]string) (*componentGraph, error) {
+	targeted := make(map[string]bool)
+	for _, c := range components {
+		targeted[c] = true
+	}
+
+	g := &componentGraph{
+		components:   components,
+		dependencies: make(map[string][]string),
+	}
+	for _, c := range components {
+		seen := make(map[string]bool)
+		var walk func(string)
+		walk = func(component string) {
+			for _, d := range dependencies[component] {
+				if seen[d] {
+					continue
+				}
+				seen[d] = true
+				if targeted[d] {
+					g.dependencies[c] = append(g.dependencies[c], d)
+				} else {
+					walk(d)
+				}
+			}
+		}
+		walk(c)
+	}
+
+	_, err := g.stages()
+	if err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// Groups the components in stages, every component only depending on components of
+// the previous stages
+func (g *componentGraph) stages() ([][]string, error) {
+	stage := make(map[string]int)
+	var stages [][]string
+
+	for len(stage) < len(g.components) {
+		var current []string
+		for _, c := range g.components {
+			if _, ok := stage[c]; ok {
+				continue
+			}
+			ready := true
+			for _, d := range g.dependencies[c] {
+				if s, ok := stage[d]; !ok || s == len(stages) {
+					ready = false
+					break
+				}
+			}
+			if ready {
+				current = append(current, c)
+			}
+		}
+
+		if len(current) == 0 {
+			var cycle []string
+			for _, c := range g.components {
+				if _, ok := stage[c]; !ok {
+					cycle = append(cycle, c)
+				}
+			}
+			return nil, fmt.Errorf("component order has a cycle between %s", strings.Join(cycle, ", "))
+		}
+		for _, c := range current {
+			stage[c] = len(stages)
+		}
+		stages = append(stages, current)
+	}
+	return stages, nil
+}
+
+// Lists the edges of the graph, one prerequisite -> component per line
+func (g *componentGraph) render() string {
+	var lines []string
+	for _, c := range g.components {
+		if len(g.dependencies[c]) == 0 {
+			lines = append(lines, c)
+		}
+		for _, d := range g.dependencies[c] {
+			lines = append(lines, fmt.Sprintf("%s -> %s", d, c))
+		}
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
+
+// Rolls every component with run as soon as all of its prerequisites succeeded,
+// independent components running in parallel. Components with a failed prerequisite
+// are skipped. Returns the error of every component.
+func (g *componentGraph) run(run func(component string) error) map[string]error {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	errs := make(map[string]error)
+	done := make(map[string]chan struct{})
+	for _, c := range g.components {
+		done[c] = make(chan struct{})
+	}
+
+	for _, c := range g.components {
+		wg.Add(1)
+		go func(component string) {
+			defer wg.Done()
+			defer close(done[component])
+
+			var err error
+			for _, d := range g.dependencies[component] {
+				glog.V(2).Infof("Waiting for %s to complete before rolling %s", d, component)
+				<-done[d]
+				mu.Lock()
+				failed := errs[d]
+				mu.Unlock()
+				if failed != nil {
+					err = fmt.Errorf("skipped %s as its prerequisite %s failed", component, d)
+					break
+				}
+			}
+			if err != nil {
+				glog.Error(err)
+				state.skipComponent(component, err)
+			} else {
+				err = run(component)
+			}
+
+			mu.Lock()
+			errs[component] = err
+			mu.Unlock()
+		}(c)
+	}
+
+	wg.Wait()
+	return errs
+}
+
+// Records a component which was never rolled because one of its prerequisites failed
+func (s *rollerState) skipComponent(name string, err error) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.components = append(s.components, &componentType{
+		name:   name,
+		start:  now,
+		finish: now,
+		phase:  phaseSkipped,
+		err:    err,
+	})
+}
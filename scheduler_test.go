@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestParseComponentOrder(t *testing.T) {
+	dependencies, err := parseComponentOrder("etcd>k8s-master>k8s-node, k8s-node>ingress-node,gpu-node>ingress-node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string][]string{
+		"k8s-master":   {"etcd"},
+		"k8s-node":     {"k8s-master"},
+		"ingress-node": {"k8s-node", "gpu-node"},
+	}
+	if !reflect.DeepEqual(dependencies, expected) {
+		t.Errorf("expected %v, got %v", expected, dependencies)
+	}
+
+	for _, order := range []string{"etcd", "etcd>>k8s-node"} {
+		if _, err := parseComponentOrder(order); err == nil {
+			t.Errorf("expected %q to be invalid", order)
+		}
+	}
+}
+
+func TestComponentGraphStages(t *testing.T) {
+	dependencies, _ := parseComponentOrder("etcd>k8s-master>k8s-node,k8s-node>ingress-node")
+
+	// Components which are not rolled are replaced by their prerequisites
+	g, err := newComponentGraph([]string{"k8s-node", "ingress-node", "etcd"}, dependencies)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stages, _ := g.stages()
+	expected := [][]string{{"etcd"}, {"k8s-node"}, {"ingress-node"}}
+	if !reflect.DeepEqual(stages, expected) {
+		t.Errorf("expected stages %v, got %v", expected, stages)
+	}
+	if g.render() != "etcd\netcd -> k8s-node\nk8s-node -> ingress-node" {
+		t.Errorf("unexpected graph %q", g.render())
+	}
+
+	// The order holds across any number of components which are not rolled
+	dependencies, _ = parseComponentOrder("etcd>k8s-master>k8s-node,bastion>k8s-node")
+	g, err = newComponentGraph([]string{"k8s-node", "etcd"}, dependencies)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stages, _ = g.stages()
+	expected = [][]string{{"etcd"}, {"k8s-node"}}
+	if !reflect.DeepEqual(stages, expected) {
+		t.Errorf("expected k8s-node to wait on etcd through k8s-master, got %v", stages)
+	}
+
+	dependencies, _ = parseComponentOrder("etcd>k8s-master>etcd")
+	_, err = newComponentGraph([]string{"etcd", "k8s-master", "k8s-node"}, dependencies)
+	if err == nil || !strings.Contains(err.Error(), "cycle between etcd, k8s-master") {
+		t.Errorf("expected a cycle to be detected, got %v", err)
+	}
+}
+
+func TestComponentGraphRun(t *testing.T) {
+	state = fakeRollerState()
+	state.components = nil
+	defer func() { state = nil }()
+
+	dependencies, _ := parseComponentOrder("etcd>k8s-master>k8s-node,etcd>ingress-node")
+	g, _ := newComponentGraph([]string{"k8s-node", "k8s-master", "etcd", "ingress-node", "bastion"}, dependencies)
+
+	var mu sync.Mutex
+	var ran []string
+	errs := g.run(func(component string) error {
+		mu.Lock()
+		ran = append(ran, component)
+		mu.Unlock()
+		if component == "k8s-master" {
+			return fmt.Errorf("fake failure")
+		}
+		return nil
+	})
+
+	position := make(map[string]int)
+	for i, c := range ran {
+		position[c] = i
+	}
+	if _, ok := position["k8s-node"]; ok {
+		t.Errorf("expected k8s-node not to run after k8s-master failed, ran %v", ran)
+	}
+	if position["etcd"] > position["k8s-master"] || position["etcd"] > position["ingress-node"] {
+		t.Errorf("expected etcd to run before its dependents, ran %v", ran)
+	}
+	if _, ok := position["bastion"]; !ok {
+		t.Errorf("expected independent components to run, ran %v", ran)
+	}
+
+	if errs["etcd"] != nil || errs["k8s-master"] == nil || errs["k8s-node"] == nil {
+		t.Errorf("unexpected errors %v", errs)
+	}
+	if len(state.components) != 1 || state.components[0].name != "k8s-node" || state.components[0].phase != phaseSkipped {
+		t.Errorf("expected k8s-node to be recorded as skipped, got %+v", state.components)
+	}
+}
+
+func TestRollPlan(t *testing.T) {
+	awsClient := &awsClient{
+		ec2:         newAWSEc2Controller(newFakeAWSEc2Client()),
+		autoscaling: newAWSAutoscalingController(newFakeAWSAutoscalingClient()),
+	}
+	var inventory []*ec2.Instance
+	inventory = append(inventory, fakeComponentInventory("k8s-master", 3)...)
+	inventory = append(inventory, fakeComponentInventory("k8s-node", 10)...)
+
+	dependencies, _ := parseComponentOrder(defaultComponentOrder)
+	g, _ := newComponentGraph([]string{"k8s-node", "k8s-master"}, dependencies)
+	plan, err := rollPlan(awsClient, inventory, g)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{
+		"Stage 1:\n  k8s-master: 3 instances to replace in , terminate-and-verify\n",
+		"Stage 2:\n  k8s-node: 10 instances to replace in , verify-and-terminate, after k8s-master\n",
+		"Graph:\n  k8s-master\n  k8s-master -> k8s-node\n",
+	} {
+		if !strings.Contains(plan, expected) {
+			t.Errorf("expected %q in the plan:\n%s", expected, plan)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// How long in flight requests get to complete when the server shuts down
+const httpShutdownTimeout = 5 * time.Second
+
+// Local http server the roller can be driven through, listening on ROLLER_HTTP_ADDR
+type rollerServer struct {
+	addr   string
+	token  string
+	mux    *http.ServeMux
+	server *http.Server
+}
+
+func newRollerServer(addr, token string) *rollerServer {
+	mux := http.NewServeMux()
+	return &rollerServer{
+		addr:   addr,
+		token:  token,
+		mux:    mux,
+		server: &http.Server{Addr: addr, Handler: mux},
+	}
+}
+
+// Registers a handler which requires the ROLLER_HTTP_TOKEN bearer token when one is set
+func (s *rollerServer) handle(pattern string, handler http.HandlerFunc) {
+	s.mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+		if s.token != "" {
+			expected := fmt.Sprintf("Bearer %s", s.token)
+			if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(expected)) != 1 {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		handler(w, r)
+	})
+}
+
+// Registers a handler which changes the course of the roll. Anyone reaching the port
+// could drive the roll without a token, so these refuse every request until
+// ROLLER_HTTP_TOKEN is set.
+func (s *rollerServer) handleControl(pattern string, handler http.HandlerFunc) {
+	s.handle(pattern, func(w http.ResponseWriter, r *http.Request) {
+		if s.token == "" {
+			http.Error(w, "set ROLLER_HTTP_TOKEN to control the roll", http.StatusForbidden)
+			return
+		}
+		handler(w, r)
+	})
+}
+
+// Who sent a control request, as recorded in the approvals and notifications. The
+// token is shared so it can't tell operators apart, and the name a caller claims
+// isn't trusted.
+func httpCaller(r *http.Request) string {
+	return fmt.Sprintf("the http api from %s", r.RemoteAddr)
+}
+
+// Registers a handler which does its own authentication
+func (s *rollerServer) handleUnauthenticated(pattern string, handler http.HandlerFunc) {
+	s.mux.HandleFunc(pattern, handler)
+}
+
+// Binds the address before returning so that a port already in use is reported
+// right away, then serves in the background
+func (s *rollerServer) start() error {
+	listener, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	glog.Infof("Listening on %s", listener.Addr())
+	go func() {
+		err := s.server.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			glog.Errorf("an error occurred serving http.\nError %s", err)
+		}
+	}()
+	return nil
+}
+
+func (s *rollerServer) stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), httpShutdownTimeout)
+	defer cancel()
+	err := s.server.Shutdown(ctx)
+	if err != nil {
+		glog.Errorf("an error occurred shutting down the http server.\nError %s", err)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		glog.Errorf("an error occurred writing the http response.\nError %s", err)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/golang/glog"
+)
+
+// Tag of the ASGs whose On-Demand base capacity the roll raised, with the one they had
+const rollerTagOnDemandBase = "roller:on-demand-base-capacity"
+
+// State reason of the spot instances EC2 reclaimed
+const spotReclaimedStateReason = "Server.SpotInstanceTermination"
+
+// Causes of the launches the ASGs make in place of the spot instances EC2 reclaims, or
+// is about to when capacity rebalancing is on
+var spotInterruptionCauses = []string{
+	"rebalance recommendation",
+	"spot instance interruption",
+}
+
+func isSpotInterruption(cause string) bool {
+	cause = strings.ToLower(cause)
+	for _, c := range spotInterruptionCauses {
+		if strings.Contains(cause, c) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether EC2 reclaimed the spot instance
+func instanceReclaimed(instance *ec2.Instance) bool {
+	return aws.StringValue(instance.InstanceLifecycle) == ec2.InstanceLifecycleTypeSpot &&
+		instance.StateReason != nil && aws.StringValue(instance.StateReason.Code) == spotReclaimedStateReason
+}
+
+// Returns the instances among instanceIDs which EC2 reclaimed
+func reclaimedInstances(awsClient *awsClient, instanceIDs []string) ([]string, error) {
+	var reclaimed []string
+	if len(instanceIDs) == 0 {
+		return reclaimed, nil
+	}
+	instances, err := awsClient.ec2.describeInstances(&ec2.DescribeInstancesInput{
+		Filters: []*ec2.Filter{{Name: aws.String("instance-id"), Values: aws.StringSlice(instanceIDs)}},
+	})
+	if err != nil {
+		return reclaimed, err
+	}
+	wanted := make(map[string]bool)
+	for _, id := range instanceIDs {
+		wanted[id] = true
+	}
+	for _, i := range instances {
+		if wanted[aws.StringValue(i.InstanceId)] && instanceReclaimed(i) {
+			reclaimed = append(reclaimed, aws.StringValue(i.InstanceId))
+		}
+	}
+	return reclaimed, nil
+}
+
+// Records the instances EC2 reclaimed, which are neither replaced by the roll nor failed
+func (s *rollerState) recordReclaimed(c *componentType, instanceIDs []string) {
+	if len(instanceIDs) == 0 {
+		return
+	}
+	glog.Infof("Spot instances %v of %s were reclaimed by EC2", instanceIDs, c.name)
+	for _, id := range instanceIDs {
+		s.recordInstanceEvent(c, id, eventReclaimed)
+	}
+	s.mu.Lock()
+	c.reclaimed += len(instanceIDs)
+	s.mu.Unlock()
+}
+
+// On-Demand base capacity of the mixed instances policy of the ASG, when it has one
+func onDemandBase(group *autoscaling.Group) (int64, bool) {
+	if group.MixedInstancesPolicy == nil || group.MixedInstancesPolicy.InstancesDistribution == nil {
+		return 0, false
+	}
+	return aws.Int64Value(group.MixedInstancesPolicy.InstancesDistribution.OnDemandBaseCapacity), true
+}
+
+// Doubles the On-Demand base capacity of the ASGs of the component with a mixed instances
+// policy, as their desired counts double while surging. Otherwise the base is already
+// met by the originals and the replacements only get the percentage above it, leaving
+// the ASGs short of On-Demand instances once the originals are gone. Returns the bases
+// the ASGs had, to be restored once the roll is done.
+func surgeOnDemandBase(awsClient *awsClient, c *componentType) (map[string]int64, error) {
+	bases := make(map[string]int64)
+	for _, asg := range c.asgs {
+		group, err := awsClient.autoscaling.getAutoscalingGroup(asg)
+		if err != nil {
+			return bases, err
+		}
+		base, ok := onDemandBase(group)
+		if !ok || base == 0 {
+			continue
+		}
+		if state.runID != "" {
+			err = awsClient.autoscaling.tagASG(asg, map[string]string{rollerTagOnDemandBase: strconv.FormatInt(base, 10)})
+			if err != nil {
+				glog.Errorf("an error occurred tagging ASG %s with its On-Demand base capacity.\nError %s", asg, err)
+			}
+		}
+		glog.V(4).Infof("Raising the On-Demand base capacity of ASG %s from %d to %d", asg, base, 2*base)
+		err = awsClient.autoscaling.setOnDemandBaseCapacity(group, 2*base)
+		if err != nil {
+			return bases, fmt.Errorf("unable to raise the On-Demand base capacity of ASG %s: %s", asg, err)
+		}
+		bases[asg] = base
+	}
+	return bases, nil
+}
+
+// Puts back the On-Demand base capacity of the ASGs
+func restoreOnDemandBase(awsClient *awsClient, bases map[string]int64) {
+	for asg, base := range bases {
+		err := restoreASGOnDemandBase(awsClient, asg, base)
+		if err != nil {
+			glog.Errorf("%s", err)
+		}
+	}
+}
+
+func restoreASGOnDemandBase(awsClient *awsClient, asg string, base int64) error {
+	group, err := awsClient.autoscaling.getAutoscalingGroup(asg)
+	if err == nil {
+		err = awsClient.autoscaling.setOnDemandBaseCapacity(group, base)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to set the On-Demand base capacity of ASG %s back to %d: %s", asg, base, err)
+	}
+	err = awsClient.autoscaling.untagASG(asg, []string{rollerTagOnDemandBase})
+	if err != nil {
+		return fmt.Errorf("unable to remove the %s tag of ASG %s: %s", rollerTagOnDemandBase, asg, err)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestReclaimedInstances(t *testing.T) {
+	defer resetFakeTags()
+	instance := func(id, lifecycle, reason string) *ec2.Instance {
+		i := &ec2.Instance{InstanceId: aws.String(id), StateReason: &ec2.StateReason{Code: aws.String(reason)}}
+		if lifecycle != "" {
+			i.InstanceLifecycle = aws.String(lifecycle)
+		}
+		return i
+	}
+	fakeDescribeInstancesOutput = &ec2.DescribeInstancesOutput{Reservations: []*ec2.Reservation{{Instances: []*ec2.Instance{
+		instance("i-1", "spot", spotReclaimedStateReason),
+		instance("i-2", "spot", "Client.UserInitiatedShutdown"),
+		instance("i-3", "", spotReclaimedStateReason),
+		instance("i-4", "spot", spotReclaimedStateReason),
+	}}}}
+	awsClient := &awsClient{ec2: newAWSEc2Controller(newFakeAWSEc2Client())}
+
+	reclaimed, err := reclaimedInstances(awsClient, []string{"i-1", "i-2", "i-3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(reclaimed, ",") != "i-1" {
+		t.Errorf("expected only the spot instance EC2 reclaimed, got %v", reclaimed)
+	}
+}
+
+func TestSurgeOnDemandBase(t *testing.T) {
+	defer func(st *rollerState) { state = st }(state)
+	defer resetFakeTags()
+	defer func() { fakeUpdateAutoScalingGroupInput = nil }()
+	state = fakeRollerState()
+	state.runID = "20200102T030405Z"
+	fakeDescribeAutoScalingGroupsOutput = &autoscaling.DescribeAutoScalingGroupsOutput{
+		AutoScalingGroups: []*autoscaling.Group{{
+			AutoScalingGroupName: aws.String("nodes"),
+			MixedInstancesPolicy: &autoscaling.MixedInstancesPolicy{
+				InstancesDistribution: &autoscaling.InstancesDistribution{
+					OnDemandBaseCapacity:                aws.Int64(2),
+					OnDemandPercentageAboveBaseCapacity: aws.Int64(25),
+				},
+				LaunchTemplate: &autoscaling.LaunchTemplate{LaunchTemplateSpecification: &autoscaling.LaunchTemplateSpecification{LaunchTemplateId: aws.String("lt-1")}},
+			},
+		}},
+	}
+	awsClient := &awsClient{autoscaling: newAWSAutoscalingController(newFakeAWSAutoscalingClient())}
+	c := &componentType{name: "k8s-node", asgs: []string{"nodes"}}
+
+	bases, err := surgeOnDemandBase(awsClient, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	distribution := fakeUpdateAutoScalingGroupInput.MixedInstancesPolicy.InstancesDistribution
+	if bases["nodes"] != 2 || aws.Int64Value(distribution.OnDemandBaseCapacity) != 4 || aws.Int64Value(distribution.OnDemandPercentageAboveBaseCapacity) != 25 {
+		t.Errorf("expected the base doubled and the percentage kept, got %v", distribution)
+	}
+	if tags := fakeCreateOrUpdateTagsInputs[0].Tags; aws.StringValue(tags[0].Key) != rollerTagOnDemandBase || aws.StringValue(tags[0].Value) != "2" {
+		t.Errorf("expected the original base tagged, got %v", tags)
+	}
+
+	restoreOnDemandBase(awsClient, bases)
+	distribution = fakeUpdateAutoScalingGroupInput.MixedInstancesPolicy.InstancesDistribution
+	if aws.Int64Value(distribution.OnDemandBaseCapacity) != 2 || len(fakeDeleteASGTagsInputs) != 1 {
+		t.Errorf("expected the base set back and untagged, got %v and %v", distribution, fakeDeleteASGTagsInputs)
+	}
+
+	// ASGs without a base to keep are left alone
+	fakeUpdateAutoScalingGroupInput = nil
+	fakeDescribeAutoScalingGroupsOutput.AutoScalingGroups[0].MixedInstancesPolicy = nil
+	bases, err = surgeOnDemandBase(awsClient, c)
+	if err != nil || len(bases) != 0 || fakeUpdateAutoScalingGroupInput != nil {
+		t.Errorf("expected nothing to change, got %v, %v and %v", bases, err, fakeUpdateAutoScalingGroupInput)
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// How long the status commands wait on the roller
+const statusClientTimeout = 30 * time.Second
+
+// Live state of the roll, as served on /status
+type statusModel struct {
+	runModel
+	Paused   bool
+	PausedBy string
+}
+
+func (s *rollerState) statusModel() statusModel {
+	m := statusModel{runModel: s.runModel("")}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m.Paused = s.resumeCh != nil
+	m.PausedBy = s.pausedBy
+	return m
+}
+
+// Holds the components at their next step until resumed. Returns false if the roll
+// was already paused.
+func (s *rollerState) pause(by string) bool {
+	s.mu.Lock()
+	if s.resumeCh != nil {
+		s.mu.Unlock()
+		return false
+	}
+	s.resumeCh = make(chan struct{})
+	s.pausedBy = by
+	s.mu.Unlock()
+
+	glog.Infof("Roll paused by %s", by)
+	s.notify(notifyProgress, fmt.Sprintf("Rolling update of %s paused", kubernetesCluster),
+		fmt.Sprintf("Rolling update of %s paused by %s, the components stop at their next step until it is resumed.", kubernetesCluster, by), "")
+	return true
+}
+
+// Returns false if the roll was not paused
+func (s *rollerState) resume(by string) bool {
+	s.mu.Lock()
+	if s.resumeCh == nil {
+		s.mu.Unlock()
+		return false
+	}
+	close(s.resumeCh)
+	s.resumeCh = nil
+	s.pausedBy = ""
+	s.mu.Unlock()
+
+	glog.Infof("Roll resumed by %s", by)
+	s.notify(notifyProgress, fmt.Sprintf("Rolling update of %s resumed", kubernetesCluster),
+		fmt.Sprintf("Rolling update of %s resumed by %s.", kubernetesCluster, by), "")
+	return true
+}
+
+// Blocks while the roll is paused, unless it gets aborted
+func (s *rollerState) waitIfPaused(c *componentType) {
+	s.mu.Lock()
+	resume := s.resumeCh
+	s.mu.Unlock()
+	if resume == nil {
+		return
+	}
+
+	glog.Infof("Roll is paused, holding %s", c.name)
+	select {
+	case <-resume:
+	case <-s.abortChannel():
+	}
+}
+
+func (s *rollerState) registerStatus(server *rollerServer) {
+	server.handle("/status", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, s.statusModel())
+	})
+	server.handleControl("/pause", controlHandler(func(by, reason string) error {
+		if !s.pause(by) {
+			return fmt.Errorf("the roll is already paused")
+		}
+		return nil
+	}))
+	server.handleControl("/resume", controlHandler(func(by, reason string) error {
+		if !s.resume(by) {
+			return fmt.Errorf("the roll is not paused")
+		}
+		return nil
+	}))
+	server.handleControl("/abort", controlHandler(func(by, reason string) error {
+		if reason == "" {
+			reason = "no reason given"
+		}
+		s.abort(fmt.Errorf("aborted by %s: %s", by, reason))
+		return nil
+	}))
+}
+
+func controlHandler(action func(by, reason string) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		err := action(httpCaller(r), r.URL.Query().Get("reason"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]bool{"ok": true})
+	}
+}
+
+func (m statusModel) render() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Cluster %s to ansible version %s, started by %s %v ago: %s\n",
+		m.Cluster, m.AnsibleVersion, m.Operator, m.Duration.Round(time.Second), m.Status)
+	if m.Paused {
+		fmt.Fprintf(&b, "Paused by %s\n", m.PausedBy)
+	}
+	if m.AbortReason != "" {
+		fmt.Fprintf(&b, "Aborted: %s\n", m.AbortReason)
+	}
+	for _, c := range m.Components {
+		fmt.Fprintf(&b, "  %s: %s, %d/%d replaced, %d remaining, %d failures", c.Name, c.Phase, c.Replaced, c.Total, c.Remaining, c.Failures)
+		if c.Reclaimed > 0 {
+			fmt.Fprintf(&b, ", %d reclaimed", c.Reclaimed)
+		}
+		var asgs []string
+		for asg := range c.DesiredCounts {
+			asgs = append(asgs, asg)
+		}
+		sort.Strings(asgs)
+		for _, asg := range asgs {
+			fmt.Fprintf(&b, ", %s desired %d", asg, c.DesiredCounts[asg])
+		}
+		if c.Error != "" {
+			fmt.Fprintf(&b, " (%s)", c.Error)
+		}
+		fmt.Fprintln(&b)
+	}
+	return b.String()
+}
+
+// Base url of the http server of a running roller listening on addr
+func statusURL(addr string) string {
+	if strings.HasPrefix(addr, ":") {
+		addr = "localhost" + addr
+	}
+	return fmt.Sprintf("http://%s", addr)
+}
+
+// Runs one of the status, pause, resume or abort commands against the roller
+// listening on ROLLER_HTTP_ADDR, writing its outcome to out
+func runStatusCommand(args []string, out io.Writer) error {
+	if httpAddr == "" {
+		return fmt.Errorf("set ROLLER_HTTP_ADDR to the address the roller listens on")
+	}
+	base := statusURL(httpAddr)
+	query := url.Values{}
+
+	var req *http.Request
+	var err error
+	switch args[0] {
+	case "status":
+		req, err = http.NewRequest(http.MethodGet, base+"/status", nil)
+	case "pause", "resume", "abort":
+		if len(args) > 1 {
+			query.Set("reason", strings.Join(args[1:], " "))
+		}
+		req, err = http.NewRequest(http.MethodPost, fmt.Sprintf("%s/%s?%s", base, args[0], query.Encode()), nil)
+	default:
+		return fmt.Errorf("unknown command %q, expected status, pause, resume or abort", args[0])
+	}
+	if err != nil {
+		return err
+	}
+	if httpToken != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", httpToken))
+	}
+
+	client := &http.Client{Timeout: statusClientTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	if args[0] != "status" {
+		fmt.Fprintf(out, "Sent %s to the roller\n", args[0])
+		return nil
+	}
+	m := statusModel{}
+	err = json.Unmarshal(body, &m)
+	if err != nil {
+		return fmt.Errorf("unable to parse the status: %s", err)
+	}
+	fmt.Fprint(out, m.render())
+	return nil
+}
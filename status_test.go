@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPauseResume(t *testing.T) {
+	s := fakeApprovalState(nil)
+	component := s.components[1]
+
+	if !s.pause("alice") || s.pause("bob") {
+		t.Errorf("expected only the first pause to go through")
+	}
+	if m := s.statusModel(); !m.Paused || m.PausedBy != "alice" {
+		t.Errorf("expected the status to show the roll paused by alice, got %+v", m)
+	}
+
+	done := make(chan error)
+	go func() { done <- s.checkAbort(component) }()
+	select {
+	case <-done:
+		t.Fatalf("expected the component to be held while the roll is paused")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	if !s.resume("alice") || s.resume("alice") {
+		t.Errorf("expected only the first resume to go through")
+	}
+	if err := <-done; err != nil {
+		t.Errorf("expected the component to go on once resumed, got %s", err)
+	}
+
+	// An abort releases the components held by a pause
+	s.pause("alice")
+	go func() { done <- s.checkAbort(component) }()
+	s.abort(fmt.Errorf("fake abort"))
+	if err := <-done; err == nil || !strings.Contains(err.Error(), "aborted") {
+		t.Errorf("expected the component to stop on abort, got %v", err)
+	}
+}
+
+func TestStatusCommand(t *testing.T) {
+	s := fakeApprovalState(nil)
+	s.components[1].desired = map[string]int{"k8s-node-asg": 130}
+	server := newRollerServer("", "fake-token")
+	s.registerStatus(server)
+	ts := httptest.NewServer(server.mux)
+	defer ts.Close()
+
+	defer func(addr, token string) { httpAddr, httpToken = addr, token }(httpAddr, httpToken)
+	httpAddr = strings.TrimPrefix(ts.URL, "http://")
+	httpToken = "fake-token"
+
+	var out bytes.Buffer
+	err := runStatusCommand([]string{"status"}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"k8s-node: drain, 42/120 replaced, 78 remaining", "k8s-node-asg desired 130", "(fake error)"} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("expected %q in the status:\n%s", expected, out.String())
+		}
+	}
+
+	if err = runStatusCommand([]string{"pause"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if err = runStatusCommand([]string{"pause"}, &out); err == nil || !strings.Contains(err.Error(), "already paused") {
+		t.Errorf("expected a second pause to be refused, got %v", err)
+	}
+	out.Reset()
+	runStatusCommand([]string{"status"}, &out)
+	if !strings.Contains(out.String(), "Paused by ") {
+		t.Errorf("expected the status to show the pause:\n%s", out.String())
+	}
+	if err = runStatusCommand([]string{"resume"}, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = runStatusCommand([]string{"abort", "too", "many", "pending", "pods"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.abortError(); err == nil || !strings.HasSuffix(err.Error(), ": too many pending pods") {
+		t.Errorf("expected the roll to be aborted with the reason, got %v", err)
+	}
+
+	httpToken = "wrong-token"
+	if err = runStatusCommand([]string{"status"}, &out); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("expected the wrong token to be refused, got %v", err)
+	}
+	if err = runStatusCommand([]string{"restart"}, &out); err == nil {
+		t.Errorf("expected an unknown command to fail")
+	}
+}
+
+func TestControlWithoutToken(t *testing.T) {
+	s := fakeApprovalState(nil)
+	server := newRollerServer("", "")
+	s.registerStatus(server)
+	ts := httptest.NewServer(server.mux)
+	defer ts.Close()
+
+	defer func(addr, token string) { httpAddr, httpToken = addr, token }(httpAddr, httpToken)
+	httpAddr = strings.TrimPrefix(ts.URL, "http://")
+	httpToken = ""
+
+	var out bytes.Buffer
+	if err := runStatusCommand([]string{"status"}, &out); err != nil {
+		t.Errorf("expected the status to be served without a token, got %s", err)
+	}
+	for _, command := range []string{"pause", "resume", "abort"} {
+		if err := runStatusCommand([]string{command}, &out); err == nil || !strings.Contains(err.Error(), "403") {
+			t.Errorf("expected %s to be refused without a token, got %v", command, err)
+		}
+	}
+	if s.statusModel().Paused || s.abortError() != nil {
+		t.Errorf("expected the roll not to be controlled without a token")
+	}
+}
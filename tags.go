@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/golang/glog"
+)
+
+// Tags the roller leaves on the instances and ASGs it acts on, so that a roll can be
+// followed from the EC2 console and cleaned up after it got interrupted
+const (
+	rollerTagRunID = "roller:run-id"
+	// Where the instance is at in the roll, one of the instanceState values
+	rollerTagState = "roller:state"
+	// Replacement launched in place of an original instance, and the other way around
+	rollerTagReplacedBy = "roller:replaced-by"
+	rollerTagReplaces   = "roller:replaces"
+	// Desired capacity of the ASG before the roll
+	rollerTagDesiredCapacity = "roller:desired-capacity"
+)
+
+// Values of the roller:state tag
+const (
+	instanceStateDraining           = "draining"
+	instanceStatePendingTermination = "pending-termination"
+	instanceStateReplacement        = "replacement"
+)
+
+// Identifies the roll in the tags, unique for a cluster as only one roll holds its lock
+func newRunID(t time.Time) string {
+	return t.UTC().Format("20060102T150405Z")
+}
+
+// Tags the instances with the run ID and the given tags. The tags only help following
+// the roll, failing to set them is logged and the roll goes on.
+func tagRollInstances(awsClient *awsClient, instances []string, tags map[string]string) {
+	if state.runID == "" || len(instances) == 0 {
+		return
+	}
+	all := map[string]string{rollerTagRunID: state.runID}
+	for k, v := range tags {
+		all[k] = v
+	}
+	err := awsClient.ec2.tagInstances(instances, all)
+	if err != nil {
+		glog.Errorf("an error occurred tagging instances %v with %s.\nError %s", instances, keysString(tags), err)
+	}
+}
+
+func tagInstanceState(awsClient *awsClient, instances []string, instanceState string) {
+	tagRollInstances(awsClient, instances, map[string]string{rollerTagState: instanceState})
+}
+
+// Pairs each original instance with a replacement, in the order they were launched
+func tagReplacedInstances(awsClient *awsClient, originals, replacements []string) {
+	for i, original := range originals {
+		if i >= len(replacements) {
+			return
+		}
+		tagRollInstances(awsClient, []string{original}, map[string]string{rollerTagReplacedBy: replacements[i]})
+		tagRollInstances(awsClient, []string{replacements[i]}, map[string]string{rollerTagReplaces: original})
+	}
+}
+
+// Tags the ASGs of the component with the run ID and their desired capacity before the
+// roll changes it
+func tagRollASGs(awsClient *awsClient, c *componentType) {
+	if state.runID == "" {
+		return
+	}
+	for _, asg := range c.asgs {
+		desired, err := awsClient.autoscaling.getDesiredCount(asg)
+		if err == nil {
+			err = awsClient.autoscaling.tagASG(asg, map[string]string{
+				rollerTagRunID:           state.runID,
+				rollerTagDesiredCapacity: strconv.FormatInt(desired, 10),
+			})
+		}
+		if err != nil {
+			glog.Errorf("an error occurred tagging ASG %s with the roll.\nError %s", asg, err)
+		}
+	}
+}
+
+// Removes the tags of a roll which went through from the ASGs of the component and its
+// replacements. The replacements keep the run ID which launched them.
+func untagRoll(awsClient *awsClient, c *componentType) {
+	if state.runID == "" {
+		return
+	}
+	for _, asg := range c.asgs {
+		err := awsClient.autoscaling.untagASG(asg, []string{rollerTagRunID, rollerTagDesiredCapacity})
+		if err != nil {
+			glog.Errorf("an error occurred removing the roll tags of ASG %s.\nError %s", asg, err)
+		}
+	}
+	state.mu.Lock()
+	replacements := append([]string(nil), c.replacements...)
+	state.mu.Unlock()
+	if len(replacements) > 0 {
+		err := awsClient.ec2.untagInstances(replacements, []string{rollerTagState})
+		if err != nil {
+			glog.Errorf("an error occurred removing the roll tags of instances %v.\nError %s", replacements, err)
+		}
+	}
+}
+
+// Value of a tag of the ASG
+func asgTag(group *autoscaling.Group, key string) (string, bool) {
+	for _, tag := range group.Tags {
+		if aws.StringValue(tag.Key) == key {
+			return aws.StringValue(tag.Value), true
+		}
+	}
+	return "", false
+}
+
+// Fails when targeted ASGs still carry the tags of another roll, which got interrupted
+// before it could put them back the way they were
+func checkRollTags(awsClient *awsClient, targets []preflightTarget) error {
+	var leftovers []string
+	for _, target := range targets {
+		for _, asg := range target.asgs {
+			group, err := awsClient.autoscaling.getAutoscalingGroup(asg)
+			if err != nil {
+				return err
+			}
+			if runID, ok := asgTag(group, rollerTagRunID); ok {
+				leftovers = append(leftovers, fmt.Sprintf("%s (run %s)", asg, runID))
+			}
+		}
+	}
+	if len(leftovers) > 0 {
+		return fmt.Errorf("ASGs left over by an interrupted roll, run the roller with -cleanup first: %s", limitList(leftovers))
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func resetFakeTags() {
+	fakeCreateTagsInputs = nil
+	fakeDeleteTagsInputs = nil
+	fakeCreateOrUpdateTagsInputs = nil
+	fakeDeleteASGTagsInputs = nil
+	fakeSetDesiredCapacityInputs = nil
+	fakeSetInstanceProtectionInputs = nil
+	fakeDescribeInstancesOutput = nil
+	fakeDescribeAutoScalingGroupsOutput = &autoscaling.DescribeAutoScalingGroupsOutput{}
+}
+
+func ec2Tags(tags []*ec2.Tag) map[string]string {
+	m := make(map[string]string)
+	for _, tag := range tags {
+		m[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+	return m
+}
+
+func TestTagRollInstances(t *testing.T) {
+	defer func(st *rollerState) { state = st }(state)
+	defer resetFakeTags()
+	state = fakeRollerState()
+	awsClient := &awsClient{ec2: newAWSEc2Controller(newFakeAWSEc2Client())}
+
+	// Nothing gets tagged outside of a roll
+	tagInstanceState(awsClient, []string{"i-1"}, instanceStateDraining)
+	if len(fakeCreateTagsInputs) != 0 {
+		t.Fatalf("expected no tags without a run ID, got %v", fakeCreateTagsInputs)
+	}
+
+	state.runID = newRunID(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC))
+	tagInstanceState(awsClient, []string{"i-1", "i-2"}, instanceStateDraining)
+	tags := ec2Tags(fakeCreateTagsInputs[0].Tags)
+	if len(fakeCreateTagsInputs[0].Resources) != 2 || tags[rollerTagRunID] != "20200102T030405Z" || tags[rollerTagState] != instanceStateDraining {
+		t.Errorf("expected both instances tagged with the run ID and their state, got %+v", fakeCreateTagsInputs[0])
+	}
+
+	fakeCreateTagsInputs = nil
+	tagReplacedInstances(awsClient, []string{"i-1", "i-2", "i-3"}, []string{"i-4", "i-5"})
+	if len(fakeCreateTagsInputs) != 4 {
+		t.Fatalf("expected the 2 pairs tagged, got %d calls", len(fakeCreateTagsInputs))
+	}
+	if aws.StringValue(fakeCreateTagsInputs[2].Resources[0]) != "i-2" || ec2Tags(fakeCreateTagsInputs[2].Tags)[rollerTagReplacedBy] != "i-5" ||
+		ec2Tags(fakeCreateTagsInputs[3].Tags)[rollerTagReplaces] != "i-2" {
+		t.Errorf("expected i-2 to be replaced by i-5, got %v and %v", fakeCreateTagsInputs[2], fakeCreateTagsInputs[3])
+	}
+}
+
+func TestRollASGTags(t *testing.T) {
+	defer func(st *rollerState) { state = st }(state)
+	defer resetFakeTags()
+	state = fakeRollerState()
+	state.runID = "20200102T030405Z"
+	fakeDescribeAutoScalingGroupsOutput = &autoscaling.DescribeAutoScalingGroupsOutput{
+		AutoScalingGroups: []*autoscaling.Group{{AutoScalingGroupName: aws.String("nodes"), DesiredCapacity: aws.Int64(3)}},
+	}
+	awsClient := &awsClient{
+		ec2:         newAWSEc2Controller(newFakeAWSEc2Client()),
+		autoscaling: newAWSAutoscalingController(newFakeAWSAutoscalingClient()),
+	}
+	c := &componentType{name: "k8s-node", asgs: []string{"nodes"}, replacements: []string{"i-4"}}
+
+	tagRollASGs(awsClient, c)
+	tags := fakeCreateOrUpdateTagsInputs[0].Tags
+	if len(tags) != 2 || aws.StringValue(tags[0].Key) != rollerTagDesiredCapacity || aws.StringValue(tags[0].Value) != "3" || aws.BoolValue(tags[0].PropagateAtLaunch) {
+		t.Errorf("expected the desired capacity tagged without propagating it, got %v", tags)
+	}
+
+	untagRoll(awsClient, c)
+	if len(fakeDeleteASGTagsInputs) != 1 || len(fakeDeleteTagsInputs) != 1 || aws.StringValue(fakeDeleteTagsInputs[0].Resources[0]) != "i-4" {
+		t.Errorf("expected the tags of the ASG and the state of the replacements removed, got %v and %v", fakeDeleteASGTagsInputs, fakeDeleteTagsInputs)
+	}
+}
+
+func TestCheckRollTags(t *testing.T) {
+	defer resetFakeTags()
+	awsClient := &awsClient{autoscaling: newAWSAutoscalingController(newFakeAWSAutoscalingClient())}
+	targets := []preflightTarget{{component: "k8s-node", asgs: []string{"nodes"}}}
+
+	fakeDescribeAutoScalingGroupsOutput = &autoscaling.DescribeAutoScalingGroupsOutput{
+		AutoScalingGroups: []*autoscaling.Group{{AutoScalingGroupName: aws.String("nodes")}},
+	}
+	if err := checkRollTags(awsClient, targets); err != nil {
+		t.Errorf("expected an untagged ASG to pass, got %s", err)
+	}
+
+	fakeDescribeAutoScalingGroupsOutput.AutoScalingGroups[0].Tags = []*autoscaling.TagDescription{
+		{Key: aws.String(rollerTagRunID), Value: aws.String("20200102T030405Z")},
+	}
+	err := checkRollTags(awsClient, targets)
+	if err == nil || !strings.Contains(err.Error(), "nodes (run 20200102T030405Z)") {
+		t.Errorf("expected the leftover ASG, got %v", err)
+	}
+}
+
+func TestCleanupRoll(t *testing.T) {
+	defer resetFakeTags()
+	instance := func(id string, tags map[string]string) *ec2.Instance {
+		i := &ec2.Instance{InstanceId: aws.String(id), Tags: []*ec2.Tag{{Key: aws.String(asgTagName), Value: aws.String("nodes")}}}
+		for k, v := range tags {
+			i.Tags = append(i.Tags, &ec2.Tag{Key: aws.String(k), Value: aws.String(v)})
+		}
+		return i
+	}
+	fakeDescribeInstancesOutput = &ec2.DescribeInstancesOutput{Reservations: []*ec2.Reservation{{Instances: []*ec2.Instance{
+		instance("i-fake-instanceid", map[string]string{rollerTagRunID: "run", rollerTagState: instanceStateDraining}),
+		instance("i-2", map[string]string{rollerTagRunID: "run", rollerTagState: instanceStateReplacement}),
+		instance("i-3", map[string]string{rollerTagRunID: "run", rollerTagScaleIn: scaleInProtectionAdded}),
+		{InstanceId: aws.String("i-4"), Tags: []*ec2.Tag{{Key: aws.String(rollerTagScaleIn), Value: aws.String(scaleInProtectionAdded)}}},
+	}}}}
+	fakeDescribeAutoScalingGroupsOutput = &autoscaling.DescribeAutoScalingGroupsOutput{
+		AutoScalingGroups: []*autoscaling.Group{{
+			AutoScalingGroupName: aws.String("nodes"),
+			DesiredCapacity:      aws.Int64(6),
+			Tags: []*autoscaling.TagDescription{
+				{Key: aws.String(rollerTagRunID), Value: aws.String("run")},
+				{Key: aws.String(rollerTagDesiredCapacity), Value: aws.String("3")},
+			},
+		}, {
+			// The copy of a blue-green roll scaled to zero, without any instance left
+			AutoScalingGroupName: aws.String("nodes-20210304T050607Z"),
+			DesiredCapacity:      aws.Int64(0),
+			Tags: []*autoscaling.TagDescription{
+				{Key: aws.String(rollerTagRunID), Value: aws.String("run")},
+				{Key: aws.String(rollerTagReplacesASG), Value: aws.String("nodes")},
+			},
+		}},
+	}
+	awsClient := &awsClient{
+		ec2:         newAWSEc2Controller(newFakeAWSEc2Client()),
+		autoscaling: newAWSAutoscalingController(newFakeAWSAutoscalingClient()),
+	}
+
+	err := cleanupRoll(awsClient, newFakeClient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fakeSetInstanceProtectionInputs) != 1 || aws.StringValue(fakeSetInstanceProtectionInputs[0].InstanceIds[0]) != "i-3" ||
+		aws.BoolValue(fakeSetInstanceProtectionInputs[0].ProtectedFromScaleIn) {
+		t.Errorf("expected the protection added to i-3 removed, got %v", fakeSetInstanceProtectionInputs)
+	}
+	if len(fakeDeleteTagsInputs) != 2 || len(fakeDeleteTagsInputs[0].Resources) != 2 {
+		t.Errorf("expected the roll tags removed from the 2 instances with a state, got %v", fakeDeleteTagsInputs)
+	}
+	if len(fakeSetDesiredCapacityInputs) != 1 || aws.Int64Value(fakeSetDesiredCapacityInputs[0].DesiredCapacity) != 3 {
+		t.Errorf("expected the desired capacity set back to 3, got %v", fakeSetDesiredCapacityInputs)
+	}
+	if len(fakeDeleteASGTagsInputs) != 2 || aws.StringValue(fakeDeleteASGTagsInputs[1].Tags[0].ResourceId) != "nodes-20210304T050607Z" {
+		t.Errorf("expected the roll tags removed from both ASGs, got %v", fakeDeleteASGTagsInputs)
+	}
+	if len(fakeLeases) != 0 {
+		t.Errorf("expected the roll lock released, got %v", fakeLeases)
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const defaultStartTemplate = `Starting a rolling update on cluster {{.Cluster}} with the components {{.TargetComponents}} as the target components.
+Ansible version is set to {{.AnsibleVersion}}
+Management of cluster autoscaler is set to {{.ClusterAutoscaler.Enabled}}`
+
+const defaultProgressTemplate = `{{with .Component}}{{.Name}}: {{.Replaced}}/{{.Total}} replaced ({{.Phase}}){{end}}`
+
+const defaultSummaryTemplate = `Finished a rolling update on cluster {{.Cluster}} with the components {{.TargetComponents}} as the target components.
+Overall status: {{.Status}}
+Overall duration: {{round .Duration}}
+{{range .Components}}Component {{.Name}} status: {{.Status}} - duration: {{round .Duration}}
+{{if .Error}}Component {{.Name}} error: {{.Error}}
+{{end}}{{end}}{{if .AbortReason}}Roll aborted: {{.AbortReason}}
+{{end}}Cluster autoscaler enabled: {{.ClusterAutoscaler.Enabled}}, status: {{.ClusterAutoscaler.Status}}`
+
+// Everything known about the run, as exposed to the message templates
+type runModel struct {
+	Cluster string
+	// Tagged on the instances and ASGs the roll acts on
+	RunID            string
+	AnsibleVersion   string
+	Operator         string
+	TargetComponents []string
+	Status           string
+	// Why the roll was aborted, if it was
+	AbortReason       string
+	StartTime         time.Time
+	Duration          time.Duration
+	Components        []componentModel
+	ClusterAutoscaler deploymentModel
+	ClusterTerminator deploymentModel
+	// The component the message is about, only set for progress messages
+	Component *componentModel
+	// Free form values from ROLLER_TEMPLATE_VARS, like runbook or dashboard links
+	Vars map[string]string
+	// Retries of the AWS calls, by operation
+	AWSRetries map[string]awsOperationStats
+}
+
+type componentModel struct {
+	Name      string
+	Status    string
+	Phase     string
+	Start     time.Time
+	Finish    time.Time
+	Duration  time.Duration
+	Replaced  int
+	Healthy   int
+	Total     int
+	Remaining int
+	Failures  int
+	Reclaimed int
+	ASGs      []string
+	Instances []string
+	// Desired count the roller last set on each ASG
+	DesiredCounts map[string]int
+	// Pre-termination commands run on the instances
+	Commands []ssmCommandResult
+	// Launches of the replacement instances by the ASGs
+	Launches []launchEvent
+	// Launch fallbacks applied to the ASGs
+	Fallbacks []appliedFallback
+	Error     string
+}
+
+type deploymentModel struct {
+	Enabled bool
+	Status  string
+	Error   string
+}
+
+type messageTemplates struct {
+	start    *template.Template
+	progress *template.Template
+	summary  *template.Template
+	vars     map[string]string
+}
+
+var messageTemplateFuncs = template.FuncMap{
+	"json":  templateJSON,
+	"join":  strings.Join,
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+	// Rounds a duration down to the minute
+	"round": func(d time.Duration) time.Duration {
+		return d - (d % time.Minute)
+	},
+}
+
+// Parses the message template at path, or the built-in default when path is empty
+func parseMessageTemplate(name, path, defaultTemplate string) (*template.Template, error) {
+	text := defaultTemplate
+	if path != "" {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read the %s template: %s", name, err)
+		}
+		text = string(b)
+	}
+
+	t, err := template.New(name).Funcs(messageTemplateFuncs).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse the %s template: %s", name, err)
+	}
+	return t, nil
+}
+
+// Loads the start, progress and summary templates, replacing the built-in defaults
+// with the files pointed at by ROLLER_START_TEMPLATE, ROLLER_PROGRESS_TEMPLATE and
+// ROLLER_SUMMARY_TEMPLATE when set.
+func loadMessageTemplates() (*messageTemplates, error) {
+	var err error
+	t := &messageTemplates{
+		vars: parseKeyValues(os.Getenv("ROLLER_TEMPLATE_VARS")),
+	}
+
+	t.start, err = parseMessageTemplate("start", os.Getenv("ROLLER_START_TEMPLATE"), defaultStartTemplate)
+	if err != nil {
+		return nil, err
+	}
+	t.progress, err = parseMessageTemplate("progress", os.Getenv("ROLLER_PROGRESS_TEMPLATE"), defaultProgressTemplate)
+	if err != nil {
+		return nil, err
+	}
+	t.summary, err = parseMessageTemplate("summary", os.Getenv("ROLLER_SUMMARY_TEMPLATE"), defaultSummaryTemplate)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *messageTemplates) render(tmpl *template.Template, model runModel) string {
+	model.Vars = t.vars
+	var b bytes.Buffer
+	err := tmpl.Execute(&b, model)
+	if err != nil {
+		glog.Errorf("an error occurred rendering the %s message template.\nError %s", tmpl.Name(), err)
+		return fmt.Sprintf("%s (unable to render the %s message: %s)", kubernetesCluster, tmpl.Name(), err)
+	}
+	return strings.TrimSpace(b.String())
+}
+
+// Parses a comma separated list of key=value pairs
+func parseKeyValues(s string) map[string]string {
+	values := make(map[string]string)
+	for _, kv := range strings.Split(s, ",") {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		values[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return values
+}
+
+// Who is running the roller, from ROLLER_OPERATOR or the local user
+func operatorIdentity() string {
+	if operator := os.Getenv("ROLLER_OPERATOR"); operator != "" {
+		return operator
+	}
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
+
+// Status of a component or of the run
+const (
+	statusPending = "pending"
+	statusRunning = "running"
+	statusSuccess = "success"
+	statusFailure = "failure"
+)
+
+func statusString(ok bool) string {
+	if ok {
+		return statusSuccess
+	}
+	return statusFailure
+}
+
+// Status of the component from its start and finish times, only a failure once it
+// finished with an error
+func (c *componentType) statusValue() string {
+	switch {
+	case !c.finish.IsZero():
+		return statusString(c.status)
+	case c.start.IsZero():
+		return statusPending
+	default:
+		return statusRunning
+	}
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// Status of the run, running until every target component finished
+func (s *rollerState) overallStatus() string {
+	if s.abortErr != nil || s.clusterAutoscaler.status == statusFailure {
+		return statusFailure
+	}
+	finished := make(map[string]bool)
+	running := false
+	for _, c := range s.components {
+		switch c.statusValue() {
+		case statusFailure:
+			return statusFailure
+		case statusSuccess:
+			finished[c.name] = true
+		default:
+			running = true
+		}
+	}
+	for _, name := range targetComponents {
+		if !finished[name] {
+			running = true
+		}
+	}
+	if running {
+		return statusRunning
+	}
+	return statusSuccess
+}
+
+func (c *componentType) model() componentModel {
+	finish := c.finish
+	if finish.IsZero() {
+		finish = time.Now()
+	}
+
+	var instances []string
+	for _, i := range c.instances {
+		instances = append(instances, *i.InstanceId)
+	}
+	desired := make(map[string]int)
+	for asg, count := range c.desired {
+		desired[asg] = count
+	}
+	remaining := c.total - c.replaced
+	if remaining < 0 {
+		remaining = 0
+	}
+
+	return componentModel{
+		Name:          c.name,
+		Status:        c.statusValue(),
+		Phase:         c.phase,
+		Start:         c.start,
+		Finish:        c.finish,
+		Duration:      finish.Sub(c.start),
+		Replaced:      c.replaced,
+		Healthy:       c.healthy,
+		Total:         c.total,
+		Remaining:     remaining,
+		Failures:      c.failures,
+		Reclaimed:     c.reclaimed,
+		ASGs:          c.asgs,
+		Instances:     instances,
+		DesiredCounts: desired,
+		Commands:      append([]ssmCommandResult(nil), c.commands...),
+		Launches:      append([]launchEvent(nil), c.launches...),
+		Fallbacks:     append([]appliedFallback(nil), c.fallbacks...),
+		Error:         errorString(c.err),
+	}
+}
+
+// Builds the template model of the run, with the named component as the subject
+// of the message if set
+func (s *rollerState) runModel(component string) runModel {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m := runModel{
+		Cluster:          kubernetesCluster,
+		RunID:            s.runID,
+		AnsibleVersion:   ansibleVersion,
+		Operator:         s.operator,
+		TargetComponents: targetComponents,
+		Status:           s.overallStatus(),
+		AbortReason:      errorString(s.abortErr),
+		StartTime:        s.startTime,
+		Duration:         time.Since(s.startTime),
+		ClusterAutoscaler: deploymentModel{
+			Enabled: s.clusterAutoscaler.enabled,
+			Status:  s.clusterAutoscaler.status,
+			Error:   errorString(s.clusterAutoscaler.err),
+		},
+		ClusterTerminator: deploymentModel{
+			Enabled: s.clusterTerminator.enabled,
+			Status:  s.clusterTerminator.status,
+			Error:   errorString(s.clusterTerminator.err),
+		},
+		AWSRetries: rollerRetryer.operations(),
+	}
+
+	for _, c := range s.components {
+		cm := c.model()
+		m.Components = append(m.Components, cm)
+		if c.name == component {
+			m.Component = &cm
+		}
+	}
+	return m
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func fakeRollerState() *rollerState {
+	start := time.Now().Add(-30 * time.Minute)
+	return &rollerState{
+		startTime: start,
+		operator:  "fake-operator",
+		components: []*componentType{
+			{
+				name:     "etcd",
+				start:    start,
+				finish:   start.Add(10 * time.Minute),
+				status:   true,
+				phase:    phaseDone,
+				replaced: 3,
+				total:    3,
+			},
+			{
+				name:     "k8s-node",
+				start:    start,
+				finish:   start.Add(20 * time.Minute),
+				phase:    phaseDrain,
+				replaced: 42,
+				total:    120,
+				err:      errors.New("fake error"),
+			},
+		},
+		clusterAutoscaler: clusterAutoscalerState{
+			enabled: true,
+			status:  "success",
+		},
+	}
+}
+
+func TestDefaultSummaryTemplate(t *testing.T) {
+	kubernetesCluster = "fake-cluster"
+	targetComponents = []string{"etcd", "k8s-node"}
+	s := fakeRollerState()
+	templates, err := loadMessageTemplates()
+	if err != nil {
+		t.Fatalf("got error loading the default templates: %s", err)
+	}
+	s.templates = templates
+
+	title, summary := s.Summary()
+	if !strings.Contains(title, "failure") {
+		t.Errorf("expected a failure title, got %s", title)
+	}
+	expected := "Finished a rolling update on cluster fake-cluster with the components [etcd k8s-node] as the target components.\n" +
+		"Overall status: failure\n" +
+		"Overall duration: 30m0s\n" +
+		"Component etcd status: success - duration: 10m0s\n" +
+		"Component k8s-node status: failure - duration: 20m0s\n" +
+		"Component k8s-node error: fake error\n" +
+		"Cluster autoscaler enabled: true, status: success"
+	if summary != expected {
+		t.Errorf("expected summary:\n%s\ngot:\n%s", expected, summary)
+	}
+}
+
+func TestRunStatus(t *testing.T) {
+	defer func() { targetComponents = nil }()
+	targetComponents = []string{"etcd", "k8s-node", "k8s-master"}
+	s := fakeRollerState()
+	node := s.components[1]
+	node.finish = time.Time{}
+	node.err = nil
+
+	if status := node.statusValue(); status != statusRunning {
+		t.Errorf("expected a component still rolling to be running, got %s", status)
+	}
+	if status := (&componentType{}).statusValue(); status != statusPending {
+		t.Errorf("expected a component not started to be pending, got %s", status)
+	}
+	if m := s.runModel(""); m.Status != statusRunning || m.Components[1].Status != statusRunning {
+		t.Errorf("expected the run to be running, got %s and %s", m.Status, m.Components[1].Status)
+	}
+
+	// k8s-master has not started yet
+	node.finish = time.Now()
+	node.status = true
+	if status := s.overallStatus(); status != statusRunning {
+		t.Errorf("expected the run to be running until every target finished, got %s", status)
+	}
+	targetComponents = []string{"etcd", "k8s-node"}
+	if status := s.overallStatus(); status != statusSuccess {
+		t.Errorf("expected the run to succeed, got %s", status)
+	}
+	node.status = false
+	if status := s.overallStatus(); status != statusFailure {
+		t.Errorf("expected the run to fail with a failed component, got %s", status)
+	}
+}
+
+func TestDefaultProgressTemplate(t *testing.T) {
+	s := fakeRollerState()
+	templates, _ := loadMessageTemplates()
+	text := templates.render(templates.progress, s.runModel("k8s-node"))
+	if text != "k8s-node: 42/120 replaced (drain)" {
+		t.Errorf("unexpected progress message %s", text)
+	}
+}
+
+func TestUserSuppliedTemplate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "roller-templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "summary.tmpl")
+	ioutil.WriteFile(path, []byte(`{{.Operator}} rolled {{len .Components}} components, runbook: {{.Vars.runbook}}`), 0644)
+	os.Setenv("ROLLER_SUMMARY_TEMPLATE", path)
+	os.Setenv("ROLLER_TEMPLATE_VARS", "runbook=https://example.com/runbook, dashboard=https://example.com/dash")
+	defer os.Unsetenv("ROLLER_SUMMARY_TEMPLATE")
+	defer os.Unsetenv("ROLLER_TEMPLATE_VARS")
+
+	s := fakeRollerState()
+	templates, err := loadMessageTemplates()
+	if err != nil {
+		t.Fatalf("got error loading the templates: %s", err)
+	}
+	s.templates = templates
+
+	_, summary := s.Summary()
+	if summary != "fake-operator rolled 2 components, runbook: https://example.com/runbook" {
+		t.Errorf("unexpected summary %s", summary)
+	}
+}
+
+func TestMissingTemplateFile(t *testing.T) {
+	os.Setenv("ROLLER_START_TEMPLATE", "/nonexistent/start.tmpl")
+	defer os.Unsetenv("ROLLER_START_TEMPLATE")
+
+	_, err := loadMessageTemplates()
+	if err == nil {
+		t.Error("expected error but got nil")
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"sort"
 	"strings"
 )
 
@@ -21,3 +22,28 @@ func keysString(m map[string]string) string {
 	}
 	return strings.Join(keys, ",")
 }
+
+// Keys of the map, sorted
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// The strings of list which are not in remove, in order
+func withoutStrings(list, remove []string) []string {
+	removed := make(map[string]bool)
+	for _, s := range remove {
+		removed[s] = true
+	}
+	var results []string
+	for _, s := range list {
+		if !removed[s] {
+			results = append(results, s)
+		}
+	}
+	return results
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// How long a component waits for its instances unless its waitTimeoutSeconds says otherwise
+	defaultWaitTimeout = 15 * time.Minute
+	// How often a component checks on its instances unless its pollIntervalSeconds says otherwise
+	defaultPollInterval = 30 * time.Second
+)
+
+// Returned by waiter.wait when the condition was not met before the timeout
+var errWaitTimeout = errors.New("timed out")
+
+// Polls a condition until it is met, an error occurs, the timeout expires or the
+// context is done
+type waiter struct {
+	// What is waited for, in the logs and errors
+	what     string
+	timeout  time.Duration
+	interval time.Duration
+	// Factor the interval grows by after each poll, up to maxInterval. The interval
+	// stays the same when it is 1 or less.
+	backoff     float64
+	maxInterval time.Duration
+	// Called after each poll which did not meet the condition
+	progress func(elapsed time.Duration)
+}
+
+// Waiter of a component, polling every pollIntervalSeconds for up to waitTimeoutSeconds
+func componentWaiter(c *componentType, what string) waiter {
+	w := waiter{
+		what:     fmt.Sprintf("%s %s", c.name, what),
+		timeout:  defaultWaitTimeout,
+		interval: defaultPollInterval,
+	}
+	if c.spec.WaitTimeoutSeconds > 0 {
+		w.timeout = time.Duration(c.spec.WaitTimeoutSeconds) * time.Second
+	}
+	if c.spec.PollIntervalSeconds > 0 {
+		w.interval = time.Duration(c.spec.PollIntervalSeconds) * time.Second
+	}
+	return w
+}
+
+// Returns nil once condition returns true, the error of condition if it fails,
+// errWaitTimeout once the timeout expires or the error of ctx once it is done, both
+// wrapped
+func (w waiter) wait(ctx context.Context, condition func() (bool, error)) error {
+	start := time.Now()
+	deadline := start.Add(w.timeout)
+	interval := w.interval
+
+	for {
+		done, err := condition()
+		if err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return fmt.Errorf("%s %w after %v", w.what, errWaitTimeout, w.timeout)
+		}
+		if w.progress != nil {
+			w.progress(time.Since(start))
+		} else {
+			glog.V(2).Infof("Still waiting for %s after %v", w.what, time.Since(start).Round(time.Second))
+		}
+
+		sleep := interval
+		if sleep > remaining {
+			sleep = remaining
+		}
+		timer := time.NewTimer(sleep)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("stopped waiting for %s: %w", w.what, ctx.Err())
+		case <-timer.C:
+		}
+
+		if w.backoff > 1 {
+			interval = time.Duration(float64(interval) * w.backoff)
+			if w.maxInterval > 0 && interval > w.maxInterval {
+				interval = w.maxInterval
+			}
+		}
+	}
+}
+
+// Context of the waits of the roll, done once the roll is aborted
+func (s *rollerState) waitContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	abort := s.abortChannel()
+	go func() {
+		select {
+		case <-abort:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
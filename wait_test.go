@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestWaiter(t *testing.T) {
+	polls := 0
+	w := waiter{what: "test", timeout: time.Second, interval: time.Millisecond}
+	err := w.wait(context.Background(), func() (bool, error) {
+		polls++
+		return polls == 3, nil
+	})
+	if err != nil || polls != 3 {
+		t.Errorf("expected the wait to succeed on the 3rd poll, got %v after %d", err, polls)
+	}
+
+	err = w.wait(context.Background(), func() (bool, error) {
+		return false, fmt.Errorf("no such ASG")
+	})
+	if err == nil || err.Error() != "no such ASG" {
+		t.Errorf("expected the error of the condition, got %v", err)
+	}
+
+	w.timeout = 10 * time.Millisecond
+	err = w.wait(context.Background(), func() (bool, error) { return false, nil })
+	if !errors.Is(err, errWaitTimeout) {
+		t.Errorf("expected the wait to time out, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	w.timeout = time.Minute
+	err = w.wait(ctx, func() (bool, error) { return false, nil })
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the wait to stop with its context, got %v", err)
+	}
+}
+
+func TestWaiterBackoff(t *testing.T) {
+	var elapsed []time.Duration
+	w := waiter{
+		what:        "test",
+		timeout:     time.Second,
+		interval:    5 * time.Millisecond,
+		backoff:     2,
+		maxInterval: 20 * time.Millisecond,
+		progress:    func(e time.Duration) { elapsed = append(elapsed, e) },
+	}
+	w.wait(context.Background(), func() (bool, error) { return len(elapsed) == 5, nil })
+	if len(elapsed) != 5 {
+		t.Fatalf("expected 5 progress calls, got %d", len(elapsed))
+	}
+	// Waits of 5, 10, 20 and 20 milliseconds
+	if elapsed[4] < 55*time.Millisecond || elapsed[4] > 500*time.Millisecond {
+		t.Errorf("expected the interval to double up to its max, got %v", elapsed)
+	}
+}
+
+func TestComponentWaiter(t *testing.T) {
+	c := &componentType{name: "k8s-node"}
+	w := componentWaiter(c, "replacement instances")
+	if w.timeout != defaultWaitTimeout || w.interval != defaultPollInterval || w.what != "k8s-node replacement instances" {
+		t.Errorf("expected the default waiter, got %+v", w)
+	}
+
+	c.spec.WaitTimeoutSeconds = 3600
+	c.spec.PollIntervalSeconds = 60
+	w = componentWaiter(c, "replacement instances")
+	if w.timeout != time.Hour || w.interval != time.Minute {
+		t.Errorf("expected the waiter of the component spec, got %+v", w)
+	}
+}
+
+func TestWaitContext(t *testing.T) {
+	s := fakeApprovalState(nil)
+	ctx, cancel := s.waitContext()
+	defer cancel()
+	s.abort(fmt.Errorf("too many pending pods"))
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Errorf("expected the context to be done once the roll is aborted")
+	}
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	defaultWatchdogInterval = 30 * time.Second
+	// Number of recent kubernetes api calls the error rate is computed over
+	apiErrorWindow = 20
+	// How far back metric queries look for their latest data point
+	metricQueryWindow = 5 * time.Minute
+	// Timeout for the prometheus queries
+	prometheusQueryTimeout = 10 * time.Second
+)
+
+// A condition evaluated throughout the roll, which aborts it once it has been firing
+// for longer than its grace period.
+type abortCondition struct {
+	name  string
+	grace time.Duration
+	// Whether the condition calls the kubernetes api, its errors then count towards the api error rate
+	api bool
+	// Returns a description of the problem when the condition fires
+	evaluate func() (string, error)
+}
+
+type watchdog struct {
+	conditions []abortCondition
+	interval   time.Duration
+	// When each condition started firing
+	firingSince map[string]time.Time
+	// Outcome of the last apiErrorWindow kubernetes api calls, true on success
+	apiCalls []bool
+}
+
+type prometheusResponse struct {
+	Status string `json:"status"`
+	Error  string `json:"error"`
+	Data   struct {
+		Result []struct {
+			Value []interface{} `json:"value"`
+		} `json:"result"`
+	} `json:"data"`
+}
+
+func newWatchdog(interval time.Duration) *watchdog {
+	return &watchdog{
+		interval:    interval,
+		firingSince: make(map[string]time.Time),
+	}
+}
+
+func (w *watchdog) add(c abortCondition) {
+	glog.V(4).Infof("Watching abort condition %s", c.name)
+	w.conditions = append(w.conditions, c)
+}
+
+func (w *watchdog) recordAPICall(ok bool) {
+	w.apiCalls = append(w.apiCalls, ok)
+	if len(w.apiCalls) > apiErrorWindow {
+		w.apiCalls = w.apiCalls[len(w.apiCalls)-apiErrorWindow:]
+	}
+}
+
+// Fraction of the recent kubernetes api calls which failed, and false until the window is full
+func (w *watchdog) apiErrorRate() (float64, bool) {
+	if len(w.apiCalls) < apiErrorWindow {
+		return 0, false
+	}
+	failed := 0
+	for _, ok := range w.apiCalls {
+		if !ok {
+			failed++
+		}
+	}
+	return float64(failed) / float64(len(w.apiCalls)), true
+}
+
+// Evaluates every condition and returns an error describing the first one which has
+// been firing for longer than its grace period
+func (w *watchdog) evaluate(now time.Time) error {
+	for _, c := range w.conditions {
+		problem, err := c.evaluate()
+		if c.api {
+			w.recordAPICall(err == nil)
+		}
+		if err != nil {
+			glog.Errorf("an error occurred evaluating the %s abort condition.\nError %s", c.name, err)
+			continue
+		}
+
+		if problem == "" {
+			if _, ok := w.firingSince[c.name]; ok {
+				glog.Infof("Abort condition %s cleared", c.name)
+				delete(w.firingSince, c.name)
+			}
+			continue
+		}
+
+		since, ok := w.firingSince[c.name]
+		if !ok {
+			since = now
+			w.firingSince[c.name] = now
+			glog.Warningf("Abort condition %s is firing: %s", c.name, problem)
+		}
+		if now.Sub(since) >= c.grace {
+			return fmt.Errorf("abort condition %s fired: %s", c.name, problem)
+		}
+	}
+	return nil
+}
+
+// Evaluates the conditions every interval until stop is closed, aborting the roll as
+// soon as one of them fires
+func (s *rollerState) watch(w *watchdog, stop <-chan struct{}) {
+	if len(w.conditions) == 0 {
+		return
+	}
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			err := w.evaluate(now)
+			if err != nil {
+				s.abort(err)
+				return
+			}
+		}
+	}
+}
+
+// Stops any further termination. The components bail out at their next step and go
+// through their usual cleanup.
+func (s *rollerState) abort(err error) {
+	s.mu.Lock()
+	first := s.abortErr == nil
+	if first {
+		s.abortErr = err
+		if s.abortCh != nil {
+			close(s.abortCh)
+		}
+	}
+	s.mu.Unlock()
+
+	if first {
+		glog.Errorf("Aborting the roll: %s", err)
+		s.notify(notifyFailure, fmt.Sprintf("Rolling update of %s aborted", kubernetesCluster),
+			fmt.Sprintf("Rolling update of %s aborted, no further instance will be terminated: %s", kubernetesCluster, err), "")
+	}
+}
+
+func (s *rollerState) abortError() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.abortErr
+}
+
+// Returns a channel closed once the roll is aborted
+func (s *rollerState) abortChannel() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.abortCh == nil {
+		s.abortCh = make(chan struct{})
+		if s.abortErr != nil {
+			close(s.abortCh)
+		}
+	}
+	return s.abortCh
+}
+
+// Returns an error once the roll has been aborted, to be checked before every disruptive step.
+// Holds the component there while the roll is paused.
+func (s *rollerState) checkAbort(c *componentType) error {
+	s.waitIfPaused(c)
+	err := s.abortError()
+	if err != nil {
+		return fmt.Errorf("stopped rolling %s, the roll was aborted: %s", c.name, err)
+	}
+	return nil
+}
+
+func pendingPodsCondition(client kubernetesClient, max int) func() (string, error) {
+	return func() (string, error) {
+		pods, err := client.getPods(metav1.NamespaceAll, metav1.ListOptions{
+			FieldSelector: "status.phase=Pending",
+		})
+		if err != nil {
+			return "", err
+		}
+		if len(pods.Items) > max {
+			return fmt.Sprintf("%d pods are pending, the maximum is %d", len(pods.Items), max), nil
+		}
+		return "", nil
+	}
+}
+
+func pdbViolationsCondition(client kubernetesClient) func() (string, error) {
+	return func() (string, error) {
+		pdbs, err := client.getPodDisruptionBudgets(metav1.NamespaceAll)
+		if err != nil {
+			return "", err
+		}
+		var violated []string
+		for _, pdb := range pdbs.Items {
+			if pdb.Status.ExpectedPods > 0 && pdb.Status.CurrentHealthy < pdb.Status.DesiredHealthy {
+				violated = append(violated, fmt.Sprintf("%s/%s (%d/%d healthy)", pdb.Namespace, pdb.Name,
+					pdb.Status.CurrentHealthy, pdb.Status.DesiredHealthy))
+			}
+		}
+		if len(violated) > 0 {
+			return fmt.Sprintf("%d pod disruption budgets are below their minimum: %s", len(violated), limitList(violated)), nil
+		}
+		return "", nil
+	}
+}
+
+func countNotReadyNodes(client kubernetesClient) (int, error) {
+	nodes, err := client.getNodes(metav1.ListOptions{})
+	if err != nil {
+		return 0, err
+	}
+	notReady := 0
+	for _, node := range nodes.Items {
+		if !nodeReady(node) {
+			notReady++
+		}
+	}
+	return notReady, nil
+}
+
+// Fires when more than increase nodes became NotReady compared to the start of the roll
+func notReadyNodesCondition(client kubernetesClient, baseline, increase int) func() (string, error) {
+	return func() (string, error) {
+		notReady, err := countNotReadyNodes(client)
+		if err != nil {
+			return "", err
+		}
+		if notReady-baseline > increase {
+			return fmt.Sprintf("%d nodes are not ready, up from %d at the start of the roll", notReady, baseline), nil
+		}
+		return "", nil
+	}
+}
+
+// Probes the api server on every evaluation, so the rate does not depend on the other
+// conditions being enabled
+func apiErrorRateCondition(w *watchdog, client kubernetesClient, max float64) func() (string, error) {
+	return func() (string, error) {
+		_, err := client.getNodes(metav1.ListOptions{Limit: 1})
+		w.recordAPICall(err == nil)
+		rate, ok := w.apiErrorRate()
+		if ok && rate > max {
+			return fmt.Sprintf("%.0f%% of the last %d kubernetes api calls failed", rate*100, apiErrorWindow), nil
+		}
+		return "", nil
+	}
+}
+
+func datadogQueryCondition(dd *ddClientConfig, query string, threshold float64) func() (string, error) {
+	return func() (string, error) {
+		value, ok, err := dd.queryMetric(query, metricQueryWindow)
+		if err != nil || !ok {
+			return "", err
+		}
+		if value > threshold {
+			return fmt.Sprintf("datadog query %s is at %g, above %g", query, value, threshold), nil
+		}
+		return "", nil
+	}
+}
+
+// Returns the highest value of an instant prometheus query, and false when it returned nothing
+func queryPrometheus(server, query string) (float64, bool, error) {
+	client := &http.Client{Timeout: prometheusQueryTimeout}
+	resp, err := client.Get(fmt.Sprintf("%s/api/v1/query?query=%s", strings.TrimRight(server, "/"), url.QueryEscape(query)))
+	if err != nil {
+		return 0, false, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, false, err
+	}
+	result := &prometheusResponse{}
+	err = json.Unmarshal(body, result)
+	if err != nil {
+		return 0, false, fmt.Errorf("unable to parse the prometheus response: %s", err)
+	}
+	if result.Status != "success" {
+		return 0, false, fmt.Errorf("prometheus query failed: %s", result.Error)
+	}
+
+	found := false
+	var max float64
+	for _, r := range result.Data.Result {
+		if len(r.Value) != 2 {
+			continue
+		}
+		s, ok := r.Value[1].(string)
+		if !ok {
+			continue
+		}
+		value, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return 0, false, fmt.Errorf("unable to parse the prometheus value %q: %s", s, err)
+		}
+		if !found || value > max {
+			max = value
+			found = true
+		}
+	}
+	return max, found, nil
+}
+
+func prometheusQueryCondition(server, query string, threshold float64) func() (string, error) {
+	return func() (string, error) {
+		value, ok, err := queryPrometheus(server, query)
+		if err != nil || !ok {
+			return "", err
+		}
+		if value > threshold {
+			return fmt.Sprintf("prometheus query %s is at %g, above %g", query, value, threshold), nil
+		}
+		return "", nil
+	}
+}
+
+func parseSeconds(name string, defaultValue time.Duration) (time.Duration, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return defaultValue, nil
+	}
+	seconds, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unable to parse %s: %s", name, err)
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// Builds the watchdog from the environment. Every condition whose variables are set
+// gets evaluated, none by default.
+func configureWatchdog(client kubernetesClient, dd *ddClientConfig) (*watchdog, error) {
+	interval, err := parseSeconds("ABORT_CHECK_INTERVAL_SECONDS", defaultWatchdogInterval)
+	if err != nil {
+		return nil, err
+	}
+	grace, err := parseSeconds("ABORT_GRACE_SECONDS", 0)
+	if err != nil {
+		return nil, err
+	}
+	w := newWatchdog(interval)
+
+	if v := os.Getenv("ABORT_PENDING_PODS"); v != "" {
+		max, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse ABORT_PENDING_PODS: %s", err)
+		}
+		pendingGrace, err := parseSeconds("ABORT_PENDING_PODS_SECONDS", 5*time.Minute)
+		if err != nil {
+			return nil, err
+		}
+		w.add(abortCondition{name: "pending-pods", grace: pendingGrace, api: true, evaluate: pendingPodsCondition(client, max)})
+	}
+
+	if os.Getenv("ABORT_PDB_VIOLATIONS") == "true" {
+		w.add(abortCondition{name: "pdb-violations", grace: grace, api: true, evaluate: pdbViolationsCondition(client)})
+	}
+
+	if v := os.Getenv("ABORT_NOT_READY_NODES"); v != "" {
+		increase, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse ABORT_NOT_READY_NODES: %s", err)
+		}
+		baseline, err := countNotReadyNodes(client)
+		if err != nil {
+			return nil, fmt.Errorf("unable to count the nodes not ready: %s", err)
+		}
+		w.add(abortCondition{name: "not-ready-nodes", grace: grace, api: true, evaluate: notReadyNodesCondition(client, baseline, increase)})
+	}
+
+	if v := os.Getenv("ABORT_API_ERROR_RATE"); v != "" {
+		max, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse ABORT_API_ERROR_RATE: %s", err)
+		}
+		w.add(abortCondition{name: "api-error-rate", grace: grace, evaluate: apiErrorRateCondition(w, client, max)})
+	}
+
+	if query := os.Getenv("ABORT_DATADOG_QUERY"); query != "" {
+		threshold, err := strconv.ParseFloat(os.Getenv("ABORT_DATADOG_THRESHOLD"), 64)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse ABORT_DATADOG_THRESHOLD: %s", err)
+		}
+		w.add(abortCondition{name: "datadog-query", grace: grace, evaluate: datadogQueryCondition(dd, query, threshold)})
+	}
+
+	if server := os.Getenv("ABORT_PROMETHEUS_URL"); server != "" {
+		query := os.Getenv("ABORT_PROMETHEUS_QUERY")
+		if query == "" {
+			return nil, fmt.Errorf("set the ABORT_PROMETHEUS_QUERY variable when using ABORT_PROMETHEUS_URL")
+		}
+		threshold, err := strconv.ParseFloat(os.Getenv("ABORT_PROMETHEUS_THRESHOLD"), 64)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse ABORT_PROMETHEUS_THRESHOLD: %s", err)
+		}
+		w.add(abortCondition{name: "prometheus-query", grace: grace, evaluate: prometheusQueryCondition(server, query, threshold)})
+	}
+
+	return w, nil
+}
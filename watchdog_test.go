@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestWatchdogGracePeriod(t *testing.T) {
+	firing := true
+	w := newWatchdog(time.Second)
+	w.add(abortCondition{
+		name:  "fake",
+		grace: 5 * time.Minute,
+		evaluate: func() (string, error) {
+			if firing {
+				return "fake problem", nil
+			}
+			return "", nil
+		},
+	})
+
+	start := time.Now()
+	if err := w.evaluate(start); err != nil {
+		t.Errorf("expected the condition not to fire within its grace period, got %s", err)
+	}
+	if err := w.evaluate(start.Add(4 * time.Minute)); err != nil {
+		t.Errorf("expected the condition not to fire within its grace period, got %s", err)
+	}
+
+	// Clearing the condition resets its grace period
+	firing = false
+	if err := w.evaluate(start.Add(5 * time.Minute)); err != nil {
+		t.Errorf("expected a cleared condition not to fire, got %s", err)
+	}
+	firing = true
+	if err := w.evaluate(start.Add(6 * time.Minute)); err != nil {
+		t.Errorf("expected the condition not to fire within its new grace period, got %s", err)
+	}
+
+	err := w.evaluate(start.Add(11 * time.Minute))
+	if err == nil || err.Error() != "abort condition fake fired: fake problem" {
+		t.Errorf("expected the condition to fire, got %v", err)
+	}
+}
+
+func TestWatchdogAPIErrorRate(t *testing.T) {
+	defer func() { fakeGetNodesError = nil }()
+	failing := false
+	w := newWatchdog(time.Second)
+	w.add(abortCondition{
+		name: "api",
+		api:  true,
+		evaluate: func() (string, error) {
+			if failing {
+				return "", fmt.Errorf("fake api error")
+			}
+			return "", nil
+		},
+	})
+	w.add(abortCondition{name: "api-error-rate", evaluate: apiErrorRateCondition(w, newFakeClient(), 0.5)})
+
+	now := time.Now()
+	for i := 0; i < apiErrorWindow; i++ {
+		if err := w.evaluate(now); err != nil {
+			t.Fatalf("expected no error while the api is healthy, got %s", err)
+		}
+	}
+
+	// The probes of the api-error-rate condition succeed
+	failing = true
+	for i := 0; i < apiErrorWindow; i++ {
+		if err := w.evaluate(now); err != nil {
+			t.Fatalf("expected no error at a 50%% error rate, got %s", err)
+		}
+	}
+	fakeGetNodesError = fmt.Errorf("fake api error")
+	err := w.evaluate(now)
+	if err == nil || !strings.Contains(err.Error(), "api-error-rate") {
+		t.Errorf("expected the api error rate to fire, got %v", err)
+	}
+}
+
+func TestWatchdogAPIErrorRateAlone(t *testing.T) {
+	os.Setenv("ABORT_API_ERROR_RATE", "0.5")
+	defer os.Unsetenv("ABORT_API_ERROR_RATE")
+	defer func() { fakeGetNodesError = nil }()
+	w, err := configureWatchdog(newFakeClient(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(w.conditions) != 1 {
+		t.Fatalf("expected the api-error-rate condition alone, got %d conditions", len(w.conditions))
+	}
+
+	fakeGetNodesError = fmt.Errorf("fake api error")
+	now := time.Now()
+	for i := 0; i < apiErrorWindow-1; i++ {
+		if err := w.evaluate(now); err != nil {
+			t.Fatalf("expected no error until %d api calls were made, got %s", apiErrorWindow, err)
+		}
+	}
+	err = w.evaluate(now)
+	if err == nil || !strings.Contains(err.Error(), "api-error-rate") {
+		t.Errorf("expected the api error rate to fire on its own, got %v", err)
+	}
+}
+
+func TestPDBViolationsCondition(t *testing.T) {
+	client := newFakeClient()
+	defer func() { fakePodDisruptionBudgetList = &policyv1beta1.PodDisruptionBudgetList{} }()
+
+	fakePodDisruptionBudgetList = &policyv1beta1.PodDisruptionBudgetList{
+		Items: []policyv1beta1.PodDisruptionBudget{
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "default"},
+				Status:     policyv1beta1.PodDisruptionBudgetStatus{ExpectedPods: 3, CurrentHealthy: 2, DesiredHealthy: 2},
+			},
+		},
+	}
+	problem, err := pdbViolationsCondition(client)()
+	if err != nil || problem != "" {
+		t.Errorf("expected no violation, got %q (%v)", problem, err)
+	}
+
+	fakePodDisruptionBudgetList.Items[0].Status.CurrentHealthy = 1
+	problem, err = pdbViolationsCondition(client)()
+	if err != nil || !strings.Contains(problem, "default/api (1/2 healthy)") {
+		t.Errorf("expected default/api to be reported, got %q (%v)", problem, err)
+	}
+}
+
+func TestPrometheusQueryCondition(t *testing.T) {
+	var query string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query().Get("query")
+		fmt.Fprint(w, `{"status":"success","data":{"resultType":"vector","result":[
+			{"metric":{"code":"500"},"value":[1600000000,"0.02"]},
+			{"metric":{"code":"503"},"value":[1600000000,"0.2"]}]}}`)
+	}))
+	defer server.Close()
+
+	value, ok, err := queryPrometheus(server.URL, "rate(errors[5m])")
+	if err != nil || !ok || value != 0.2 {
+		t.Errorf("expected the highest value 0.2, got %v %v (%v)", value, ok, err)
+	}
+	if query != "rate(errors[5m])" {
+		t.Errorf("expected the query to be sent, got %q", query)
+	}
+
+	problem, err := prometheusQueryCondition(server.URL, "rate(errors[5m])", 0.5)()
+	if err != nil || problem != "" {
+		t.Errorf("expected the query to be under the threshold, got %q (%v)", problem, err)
+	}
+	problem, err = prometheusQueryCondition(server.URL, "rate(errors[5m])", 0.1)()
+	if err != nil || problem == "" {
+		t.Errorf("expected the query to be over the threshold, got %q (%v)", problem, err)
+	}
+}
+
+func TestAbort(t *testing.T) {
+	s := fakeRollerState()
+	s.notifications = newNotificationDispatcher()
+	component := s.components[0]
+
+	if err := s.checkAbort(component); err != nil {
+		t.Errorf("expected no error before the roll is aborted, got %s", err)
+	}
+
+	s.abort(fmt.Errorf("first"))
+	s.abort(fmt.Errorf("second"))
+	err := s.checkAbort(component)
+	if err == nil || !strings.Contains(err.Error(), "first") {
+		t.Errorf("expected the first abort reason, got %v", err)
+	}
+
+	model := s.runModel("")
+	if model.Status != "failure" || model.AbortReason != "first" {
+		t.Errorf("expected an aborted run to be failed, got %s (%s)", model.Status, model.AbortReason)
+	}
+}